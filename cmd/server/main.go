@@ -5,6 +5,7 @@ import (
 	"gobi/internal/handlers"
 	"gobi/internal/middleware"
 	"gobi/pkg/database"
+	"gobi/pkg/storage"
 	"gobi/pkg/utils"
 	"time"
 
@@ -30,6 +31,21 @@ func main() {
 		utils.Logger.Fatalf("Failed to initialize database: %v", err)
 	}
 
+	// Move users and resources created before organizations existed into the default organization
+	if err := utils.EnsureDefaultOrganization(); err != nil {
+		utils.Logger.Fatalf("Failed to initialize organizations: %v", err)
+	}
+
+	// Chain audit events written before the audit log was hash chained
+	if err := utils.SealAuditLog(); err != nil {
+		utils.Logger.Fatalf("Failed to seal audit log: %v", err)
+	}
+
+	// Initialize blob storage for report and template files
+	if err := storage.Init(&cfg); err != nil {
+		utils.Logger.Fatalf("Failed to initialize storage: %v", err)
+	}
+
 	// Initialize query cache (default 5 min, cleanup 10 min)
 	utils.InitQueryCache(5*time.Minute, 10*time.Minute)
 
@@ -77,11 +93,23 @@ func main() {
 	// Public routes
 	r.POST("/api/auth/login", handlers.Login)
 	r.POST("/api/auth/register", handlers.Register)
+	r.POST("/api/auth/refresh", handlers.RefreshToken)
+	r.GET("/api/auth/oidc/login", handlers.OIDCLogin)
+	r.GET("/api/auth/oidc/callback", handlers.OIDCCallback)
+	r.POST("/api/auth/mfa/verify", handlers.VerifyMFA)
 
 	// Protected routes
 	authorized := r.Group("/api")
 	authorized.Use(middleware.AuthMiddleware(&cfg))
 	{
+		// Auth routes
+		authorized.POST("/auth/logout", handlers.Logout)
+		authorized.GET("/auth/mfa", handlers.GetMFAStatus)
+		authorized.POST("/auth/mfa/enroll", handlers.EnrollMFA)
+		authorized.POST("/auth/mfa/confirm", handlers.ConfirmMFA)
+		authorized.POST("/auth/mfa/disable", handlers.DisableMFA)
+		authorized.POST("/auth/mfa/recovery-codes", handlers.RegenerateRecoveryCodes)
+
 		// Query routes
 		authorized.POST("/queries", handlers.CreateQuery)
 		authorized.GET("/queries", handlers.ListQueries)
@@ -89,6 +117,10 @@ func main() {
 		authorized.PUT("/queries/:id", handlers.UpdateQuery)
 		authorized.DELETE("/queries/:id", handlers.DeleteQuery)
 		authorized.POST("/queries/:id/execute", handlers.ExecuteQuery)
+		authorized.GET("/queries/:id/versions", handlers.ListQueryVersions)
+		authorized.GET("/queries/:id/versions/diff", handlers.DiffQueryVersions)
+		authorized.GET("/queries/:id/versions/:version", handlers.GetQueryVersion)
+		authorized.POST("/queries/:id/versions/:version/restore", handlers.RestoreQueryVersion)
 
 		// Data source routes
 		authorized.POST("/datasources", handlers.CreateDataSource)
@@ -101,14 +133,20 @@ func main() {
 		authorized.POST("/charts", handlers.CreateChart)
 		authorized.GET("/charts", handlers.ListCharts)
 		authorized.GET("/charts/:id", handlers.GetChart)
+		authorized.GET("/charts/:id/data", handlers.GetChartData)
 		authorized.PUT("/charts/:id", handlers.UpdateChart)
 		authorized.DELETE("/charts/:id", handlers.DeleteChart)
+		authorized.GET("/charts/:id/versions", handlers.ListChartVersions)
+		authorized.GET("/charts/:id/versions/diff", handlers.DiffChartVersions)
+		authorized.GET("/charts/:id/versions/:version", handlers.GetChartVersion)
+		authorized.POST("/charts/:id/versions/:version/rollback", handlers.RollbackChartVersion)
 
 		// Excel template routes
 		authorized.POST("/templates", handlers.CreateTemplate)
 		authorized.GET("/templates", handlers.ListTemplates)
 		authorized.GET("/templates/:id", handlers.GetTemplate)
 		authorized.GET("/templates/:id/download", handlers.DownloadTemplate)
+		authorized.POST("/templates/:id/preview", handlers.PreviewTemplate)
 		authorized.PUT("/templates/:id", handlers.UpdateTemplate)
 		authorized.DELETE("/templates/:id", handlers.DeleteTemplate)
 
@@ -124,19 +162,100 @@ func main() {
 		authorized.PUT("/users/:id", handlers.UpdateUser)
 		// User reset password
 		authorized.POST("/users/:id/reset-password", handlers.ResetUserPassword)
+		authorized.POST("/users/:id/mfa/reset", handlers.ResetUserMFA)
+		authorized.POST("/users/:id/unlock", handlers.UnlockUser)
+		authorized.GET("/users/:id/attributes", handlers.GetUserAttributes)
+		authorized.PUT("/users/:id/attributes", handlers.SetUserAttributes)
+		authorized.GET("/lockouts", handlers.ListLoginLockouts)
+		authorized.DELETE("/lockouts/:id", handlers.DeleteLoginLockout)
 		// User delete
 		authorized.DELETE("/users/:id", handlers.DeleteUser)
 
+		// Audit log
+		authorized.GET("/audit", handlers.ListAuditEvents)
+		authorized.GET("/audit/export", handlers.ExportAuditEvents)
+		authorized.GET("/audit/verify", handlers.VerifyAuditLog)
+
+		// API key routes
+		authorized.POST("/api-keys", handlers.CreateAPIKey)
+		authorized.GET("/api-keys", handlers.ListAPIKeys)
+		authorized.DELETE("/api-keys/:id", handlers.RevokeAPIKey)
+
+		// Service account routes (admin only)
+		authorized.POST("/service-accounts", handlers.CreateServiceAccount)
+		authorized.GET("/service-accounts", handlers.ListServiceAccounts)
+		authorized.DELETE("/service-accounts/:id", handlers.DeleteServiceAccount)
+		authorized.POST("/service-accounts/:id/api-keys", handlers.CreateServiceAccountKey)
+		authorized.GET("/service-accounts/:id/api-keys", handlers.ListServiceAccountKeys)
+
 		// Report schedule routes
 		authorized.POST("/reports/schedules", handlers.CreateReportSchedule)
 		authorized.GET("/reports/schedules", handlers.ListReportSchedules)
 		authorized.GET("/reports/schedules/:id", handlers.GetReportSchedule)
 		authorized.PUT("/reports/schedules/:id", handlers.UpdateReportSchedule)
 		authorized.DELETE("/reports/schedules/:id", handlers.DeleteReportSchedule)
+		authorized.POST("/reports/schedules/:id/run", handlers.RunReportSchedule)
+		authorized.GET("/reports/schedules/:id/runs", handlers.ListReportRuns)
 
 		// Report routes
 		authorized.GET("/reports", handlers.ListReports)
 		authorized.GET("/reports/:id/download", handlers.DownloadReport)
+		authorized.GET("/reports/:id/deliveries", handlers.ListReportDeliveries)
+		authorized.GET("/reports/:id/compare/:otherId", handlers.CompareReports)
+
+		// Webhook destination routes
+		authorized.POST("/webhooks", handlers.CreateWebhook)
+		authorized.GET("/webhooks", handlers.ListWebhooks)
+		authorized.GET("/webhooks/:id", handlers.GetWebhook)
+		authorized.PUT("/webhooks/:id", handlers.UpdateWebhook)
+		authorized.DELETE("/webhooks/:id", handlers.DeleteWebhook)
+		authorized.POST("/webhooks/:id/test", handlers.TestWebhook)
+		authorized.GET("/webhooks/:id/deliveries", handlers.ListWebhookDeliveries)
+
+		// Alert routes
+		authorized.POST("/alerts", handlers.CreateAlert)
+		authorized.GET("/alerts", handlers.ListAlerts)
+		authorized.GET("/alerts/:id", handlers.GetAlert)
+		authorized.PUT("/alerts/:id", handlers.UpdateAlert)
+		authorized.DELETE("/alerts/:id", handlers.DeleteAlert)
+		authorized.POST("/alerts/:id/evaluate", handlers.EvaluateAlert)
+		authorized.GET("/alerts/:id/evaluations", handlers.ListAlertEvaluations)
+		authorized.GET("/alerts/:id/deliveries", handlers.ListAlertDeliveries)
+
+		// Role, group and grant routes
+		authorized.GET("/roles", handlers.ListRoles)
+		authorized.POST("/roles", handlers.CreateRole)
+		authorized.PUT("/roles/:name", handlers.UpdateRole)
+		authorized.DELETE("/roles/:name", handlers.DeleteRole)
+		authorized.GET("/groups", handlers.ListGroups)
+		authorized.POST("/groups", handlers.CreateGroup)
+		authorized.DELETE("/groups/:id", handlers.DeleteGroup)
+		authorized.POST("/groups/:id/members", handlers.AddGroupMember)
+		authorized.DELETE("/groups/:id/members/:userId", handlers.RemoveGroupMember)
+		authorized.GET("/grants", handlers.ListGrants)
+		authorized.POST("/grants", handlers.CreateGrant)
+		authorized.DELETE("/grants/:id", handlers.DeleteGrant)
+
+		// Row-level security policies
+		authorized.GET("/row-policies", handlers.ListRowPolicies)
+		authorized.POST("/row-policies", handlers.CreateRowPolicy)
+		authorized.DELETE("/row-policies/:id", handlers.DeleteRowPolicy)
+
+		// Organization and team routes
+		authorized.GET("/orgs", handlers.ListOrganizations)
+		authorized.POST("/orgs", handlers.CreateOrganization)
+		authorized.GET("/orgs/:id", handlers.GetOrganization)
+		authorized.PUT("/orgs/:id", handlers.UpdateOrganization)
+		authorized.DELETE("/orgs/:id", handlers.DeleteOrganization)
+		authorized.GET("/orgs/:id/members", handlers.ListOrganizationMembers)
+		authorized.POST("/orgs/:id/members", handlers.AddOrganizationMember)
+		authorized.PUT("/orgs/:id/members/:userId", handlers.UpdateOrganizationMember)
+		authorized.DELETE("/orgs/:id/members/:userId", handlers.RemoveOrganizationMember)
+		authorized.GET("/orgs/:id/teams", handlers.ListTeams)
+		authorized.POST("/orgs/:id/teams", handlers.CreateTeam)
+		authorized.DELETE("/orgs/:id/teams/:teamId", handlers.DeleteTeam)
+		authorized.POST("/orgs/:id/teams/:teamId/members", handlers.AddTeamMember)
+		authorized.DELETE("/orgs/:id/teams/:teamId/members/:userId", handlers.RemoveTeamMember)
 	}
 
 	// Initialize report generator
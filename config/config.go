@@ -9,16 +9,120 @@ import (
 
 type Config struct {
 	Server struct {
-		Port string
+		Port      string
+		PublicURL string // externally reachable base URL, used for links in report deliveries
 	}
 	JWT struct {
-		Secret          string
-		ExpirationHours int
+		Secret             string
+		ExpirationHours    int // lifetime of a refresh token; each refresh starts a new one
+		AccessTokenMinutes int // lifetime of an access token
 	}
 	Database struct {
 		Type string
 		DSN  string
 	}
+	Report struct {
+		PDFFont string // path to a UTF-8 TrueType font, needed for non-Latin text in PDF reports
+	}
+	SMTP struct {
+		Host          string
+		Port          int
+		Username      string
+		Password      string
+		From          string
+		TLS           bool // implicit TLS (usually port 465); otherwise STARTTLS is used when the server offers it
+		MaxAttempts   int  // delivery attempts per recipient
+		RetryInterval int  // seconds to wait after the first failed attempt, doubled after each further failure
+	}
+	Scheduler struct {
+		Workers      int // reports generated concurrently by this instance
+		LeaseSeconds int // how long a claimed schedule stays locked without a heartbeat
+		MisfireGrace int // seconds a run may be late before the schedule's misfire policy applies
+	}
+	Webhook struct {
+		MaxAttempts   int // delivery attempts per event
+		RetryInterval int // seconds to wait after the first failed attempt, doubled after each further failure
+		Timeout       int // request timeout in seconds
+	}
+	Storage struct {
+		Backend  string // where report and template content is kept: database, local or s3
+		LocalDir string // root directory of the local backend
+		S3       struct {
+			Endpoint  string // base URL of the S3-compatible service, e.g. https://s3.eu-west-1.amazonaws.com
+			Region    string
+			Bucket    string
+			AccessKey string
+			SecretKey string
+			Prefix    string // prepended to every object key
+			PathStyle bool   // address the bucket in the path instead of the host name, as MinIO expects
+		}
+	}
+	OIDC struct {
+		Enabled       bool
+		Issuer        string // base URL of the identity provider, whose discovery document is read on first use
+		ClientID      string
+		ClientSecret  string
+		RedirectURL   string   // callback URL registered at the provider, e.g. https://gobi.example.com/api/auth/oidc/callback
+		Scopes        []string // requested in addition to openid
+		UsernameClaim string   // ID token claim used as username for new users, preferred_username by default
+		GroupsClaim   string   // ID token claim listing the user's IdP groups, groups by default
+		LocalLogin    bool     // keep password login available next to single sign-on
+		PostLoginURL  string   // frontend page the callback redirects to with the tokens in the fragment; empty returns JSON
+		GroupMapping
+	}
+	LDAP struct {
+		Enabled            bool
+		URL                string // ldap://host:389 or ldaps://host:636
+		StartTLS           bool   // upgrade ldap:// connections with StartTLS before binding
+		InsecureSkipVerify bool   // accept any server certificate, for testing only
+		BindDN             string // service account used to search users; empty binds anonymously
+		BindPassword       string
+		BaseDN             string
+		UserFilter         string // search filter with %s for the escaped username
+		UsernameAttribute  string
+		EmailAttribute     string
+		GroupAttribute     string // attribute listing the DNs of the user's groups, memberOf on AD
+		SyncInterval       int    // minutes between directory syncs of known users, 0 disables syncing
+		GroupMapping
+	}
+	PasswordPolicy struct {
+		MinLength     int
+		RequireUpper  bool
+		RequireLower  bool
+		RequireDigit  bool
+		RequireSymbol bool
+		CheckBreached bool // reject passwords of the bundled list of common breached passwords
+		HistorySize   int  // number of recent passwords that cannot be reused, 0 allows reuse
+	}
+	Lockout struct {
+		MaxAttempts     int // failed logins of a username in a row before it is locked, 0 disables lockout
+		LockMinutes     int // duration of the first lockout, doubled after each further one
+		MaxLockMinutes  int
+		IPMaxAttempts   int // failed logins from one client IP within IPWindowMinutes before it is locked
+		IPWindowMinutes int
+	}
+}
+
+// GroupMapping turns the groups of an external directory or identity provider into a role and team
+// memberships
+type GroupMapping struct {
+	DefaultRole  string // role of users matching no role mapping
+	RoleMappings []GroupRoleMapping
+	TeamMappings []GroupTeamMapping
+}
+
+// GroupRoleMapping gives members of a group a role. The first mapping matching one of the user's groups
+// decides the role.
+type GroupRoleMapping struct {
+	Group string
+	Role  string
+}
+
+// GroupTeamMapping makes members of a group members of a team, created if missing
+type GroupTeamMapping struct {
+	Group        string
+	Organization string // organization name
+	Team         string
 }
 
 var AppConfig Config
@@ -43,10 +147,84 @@ func LoadConfig() {
 	viper.AutomaticEnv()
 
 	AppConfig.Server.Port = viper.GetString("server.port")
+	AppConfig.Server.PublicURL = viper.GetString("server.public_url")
 	AppConfig.JWT.Secret = viper.GetString("jwt.secret")
 	AppConfig.JWT.ExpirationHours = viper.GetInt("jwt.expiration_hours")
+	AppConfig.JWT.AccessTokenMinutes = viper.GetInt("jwt.access_token_minutes")
 	AppConfig.Database.Type = viper.GetString("database.type")
 	AppConfig.Database.DSN = viper.GetString("database.dsn")
+	AppConfig.Report.PDFFont = viper.GetString("report.pdf_font")
+	AppConfig.SMTP.Host = viper.GetString("smtp.host")
+	AppConfig.SMTP.Port = viper.GetInt("smtp.port")
+	AppConfig.SMTP.Username = viper.GetString("smtp.username")
+	AppConfig.SMTP.Password = viper.GetString("smtp.password")
+	AppConfig.SMTP.From = viper.GetString("smtp.from")
+	AppConfig.SMTP.TLS = viper.GetBool("smtp.tls")
+	AppConfig.SMTP.MaxAttempts = viper.GetInt("smtp.max_attempts")
+	AppConfig.SMTP.RetryInterval = viper.GetInt("smtp.retry_interval")
+	AppConfig.Scheduler.Workers = viper.GetInt("scheduler.workers")
+	AppConfig.Scheduler.LeaseSeconds = viper.GetInt("scheduler.lease_seconds")
+	AppConfig.Scheduler.MisfireGrace = viper.GetInt("scheduler.misfire_grace")
+	AppConfig.Webhook.MaxAttempts = viper.GetInt("webhook.max_attempts")
+	AppConfig.Webhook.RetryInterval = viper.GetInt("webhook.retry_interval")
+	AppConfig.Webhook.Timeout = viper.GetInt("webhook.timeout")
+	AppConfig.Storage.Backend = viper.GetString("storage.backend")
+	AppConfig.Storage.LocalDir = viper.GetString("storage.local_dir")
+	AppConfig.Storage.S3.Endpoint = viper.GetString("storage.s3.endpoint")
+	AppConfig.Storage.S3.Region = viper.GetString("storage.s3.region")
+	AppConfig.Storage.S3.Bucket = viper.GetString("storage.s3.bucket")
+	AppConfig.Storage.S3.AccessKey = viper.GetString("storage.s3.access_key")
+	AppConfig.Storage.S3.SecretKey = viper.GetString("storage.s3.secret_key")
+	AppConfig.Storage.S3.Prefix = viper.GetString("storage.s3.prefix")
+	AppConfig.Storage.S3.PathStyle = viper.GetBool("storage.s3.path_style")
+	viper.SetDefault("oidc.local_login", true)
+	AppConfig.OIDC.Enabled = viper.GetBool("oidc.enabled")
+	AppConfig.OIDC.Issuer = viper.GetString("oidc.issuer")
+	AppConfig.OIDC.ClientID = viper.GetString("oidc.client_id")
+	AppConfig.OIDC.ClientSecret = viper.GetString("oidc.client_secret")
+	AppConfig.OIDC.RedirectURL = viper.GetString("oidc.redirect_url")
+	AppConfig.OIDC.Scopes = viper.GetStringSlice("oidc.scopes")
+	AppConfig.OIDC.UsernameClaim = viper.GetString("oidc.username_claim")
+	AppConfig.OIDC.GroupsClaim = viper.GetString("oidc.groups_claim")
+	AppConfig.OIDC.DefaultRole = viper.GetString("oidc.default_role")
+	_ = viper.UnmarshalKey("oidc.role_mappings", &AppConfig.OIDC.RoleMappings)
+	_ = viper.UnmarshalKey("oidc.team_mappings", &AppConfig.OIDC.TeamMappings)
+	AppConfig.OIDC.LocalLogin = viper.GetBool("oidc.local_login")
+	AppConfig.OIDC.PostLoginURL = viper.GetString("oidc.post_login_url")
+	AppConfig.LDAP.Enabled = viper.GetBool("ldap.enabled")
+	AppConfig.LDAP.URL = viper.GetString("ldap.url")
+	AppConfig.LDAP.StartTLS = viper.GetBool("ldap.start_tls")
+	AppConfig.LDAP.InsecureSkipVerify = viper.GetBool("ldap.insecure_skip_verify")
+	AppConfig.LDAP.BindDN = viper.GetString("ldap.bind_dn")
+	AppConfig.LDAP.BindPassword = viper.GetString("ldap.bind_password")
+	AppConfig.LDAP.BaseDN = viper.GetString("ldap.base_dn")
+	AppConfig.LDAP.UserFilter = viper.GetString("ldap.user_filter")
+	AppConfig.LDAP.UsernameAttribute = viper.GetString("ldap.username_attribute")
+	AppConfig.LDAP.EmailAttribute = viper.GetString("ldap.email_attribute")
+	AppConfig.LDAP.GroupAttribute = viper.GetString("ldap.group_attribute")
+	AppConfig.LDAP.SyncInterval = viper.GetInt("ldap.sync_interval")
+	AppConfig.LDAP.DefaultRole = viper.GetString("ldap.default_role")
+	_ = viper.UnmarshalKey("ldap.role_mappings", &AppConfig.LDAP.RoleMappings)
+	_ = viper.UnmarshalKey("ldap.team_mappings", &AppConfig.LDAP.TeamMappings)
+	viper.SetDefault("password_policy.min_length", 8)
+	viper.SetDefault("password_policy.check_breached", true)
+	AppConfig.PasswordPolicy.MinLength = viper.GetInt("password_policy.min_length")
+	AppConfig.PasswordPolicy.RequireUpper = viper.GetBool("password_policy.require_upper")
+	AppConfig.PasswordPolicy.RequireLower = viper.GetBool("password_policy.require_lower")
+	AppConfig.PasswordPolicy.RequireDigit = viper.GetBool("password_policy.require_digit")
+	AppConfig.PasswordPolicy.RequireSymbol = viper.GetBool("password_policy.require_symbol")
+	AppConfig.PasswordPolicy.CheckBreached = viper.GetBool("password_policy.check_breached")
+	AppConfig.PasswordPolicy.HistorySize = viper.GetInt("password_policy.history_size")
+	viper.SetDefault("lockout.max_attempts", 5)
+	viper.SetDefault("lockout.lock_minutes", 1)
+	viper.SetDefault("lockout.max_lock_minutes", 60)
+	viper.SetDefault("lockout.ip_max_attempts", 20)
+	viper.SetDefault("lockout.ip_window_minutes", 15)
+	AppConfig.Lockout.MaxAttempts = viper.GetInt("lockout.max_attempts")
+	AppConfig.Lockout.LockMinutes = viper.GetInt("lockout.lock_minutes")
+	AppConfig.Lockout.MaxLockMinutes = viper.GetInt("lockout.max_lock_minutes")
+	AppConfig.Lockout.IPMaxAttempts = viper.GetInt("lockout.ip_max_attempts")
+	AppConfig.Lockout.IPWindowMinutes = viper.GetInt("lockout.ip_window_minutes")
 
 	fmt.Printf("Loaded config for env: %s, port: %s, db type: %s\n", env, AppConfig.Server.Port, AppConfig.Database.Type)
 }
@@ -0,0 +1,349 @@
+package handlers
+
+import (
+	"encoding/json"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/errors"
+	"gobi/pkg/utils"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// alertRequest carries the editable fields of an alert; nil fields are left unchanged on update
+type alertRequest struct {
+	Name           *string                       `json:"name"`
+	Description    *string                       `json:"description"`
+	QueryID        *uint                         `json:"query_id"`
+	CronPattern    *string                       `json:"cron_pattern"`
+	Timezone       *string                       `json:"timezone"`
+	Params         map[string]utils.ParamBinding `json:"params"`
+	Conditions     []utils.AlertCondition        `json:"conditions"`
+	Match          *string                       `json:"match" binding:"omitempty,oneof=any all"`
+	Recipients     []string                      `json:"recipients" binding:"omitempty,dive,email"`
+	WebhookIDs     []uint                        `json:"webhook_ids"`
+	NotifyResolved *bool                         `json:"notify_resolved"`
+	RepeatInterval *int                          `json:"repeat_interval" binding:"omitempty,min=0"`
+	Active         *bool                         `json:"active"`
+}
+
+// apply validates the request and copies it onto alert, returning whether the next run must be recalculated
+func (req *alertRequest) apply(c *gin.Context, alert *models.Alert) (bool, *errors.CustomError) {
+	reschedule := false
+	if req.Name != nil {
+		if *req.Name == "" {
+			return false, errors.NewBadRequestError("Alert name is required", nil)
+		}
+		alert.Name = *req.Name
+	}
+	if req.Description != nil {
+		alert.Description = *req.Description
+	}
+	if req.QueryID != nil {
+		var query models.Query
+		if err := database.DB.First(&query, *req.QueryID).Error; err != nil {
+			return false, errors.NewBadRequestError("Query not found", nil)
+		}
+		if !subject(c).Can(utils.QueryResource(query), utils.AccessExecute) {
+			return false, errors.ErrForbidden
+		}
+		alert.QueryID = query.ID
+	}
+	if req.CronPattern != nil {
+		if err := utils.ValidateCronPattern(*req.CronPattern); err != nil {
+			return false, errors.NewBadRequestError("Invalid cron pattern", err)
+		}
+		alert.CronPattern = *req.CronPattern
+		reschedule = true
+	}
+	if req.Timezone != nil {
+		if err := validateTimezone(*req.Timezone); err != nil {
+			return false, err
+		}
+		alert.Timezone = *req.Timezone
+		reschedule = true
+	}
+	if req.Params != nil {
+		if err := utils.ValidateParamBindings(req.Params); err != nil {
+			return false, errors.NewBadRequestError("Invalid alert parameters", err)
+		}
+		params, _ := json.Marshal(req.Params)
+		alert.Params = string(params)
+	}
+	if req.Conditions != nil {
+		if err := utils.ValidateAlertConditions(req.Conditions); err != nil {
+			return false, errors.NewBadRequestError("Invalid alert conditions", err)
+		}
+		conditions, _ := json.Marshal(req.Conditions)
+		alert.Conditions = string(conditions)
+	}
+	if req.Match != nil {
+		alert.Match = *req.Match
+	}
+	if req.Recipients != nil {
+		recipients, _ := json.Marshal(req.Recipients)
+		alert.Recipients = string(recipients)
+	}
+	if req.WebhookIDs != nil {
+		if err := checkWebhookAccess(c, req.WebhookIDs); err != nil {
+			return false, err
+		}
+		webhookIDs, _ := json.Marshal(req.WebhookIDs)
+		alert.Webhooks = string(webhookIDs)
+	}
+	if req.NotifyResolved != nil {
+		alert.NotifyResolved = *req.NotifyResolved
+	}
+	if req.RepeatInterval != nil {
+		alert.RepeatInterval = *req.RepeatInterval
+	}
+	if req.Active != nil {
+		reschedule = reschedule || (*req.Active && !alert.Active)
+		alert.Active = *req.Active
+	}
+	return reschedule, nil
+}
+
+// loadAlert fetches the alert of the request, checking that the current user has level access
+func loadAlert(c *gin.Context, level string) (models.Alert, bool) {
+	var alert models.Alert
+	if err := database.DB.First(&alert, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return alert, false
+	}
+	if !authorize(c, utils.AlertResource(alert), level) {
+		return alert, false
+	}
+	return alert, true
+}
+
+// CreateAlert creates an alert on the result of a saved query
+func CreateAlert(c *gin.Context) {
+	var req alertRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("Invalid alert data", err))
+		return
+	}
+	if req.Name == nil || req.QueryID == nil || req.CronPattern == nil || req.Conditions == nil {
+		c.Error(errors.NewBadRequestError("name, query_id, cron_pattern and conditions are required", nil))
+		return
+	}
+
+	if !requireCreate(c, utils.ResourceAlert) {
+		return
+	}
+
+	userID := c.GetUint("userID")
+	alert := models.Alert{
+		UserID:         userID,
+		OrganizationID: c.GetUint("orgID"),
+		Match:          utils.MatchAny,
+		NotifyResolved: true,
+		Active:         true,
+	}
+	if _, err := req.apply(c, &alert); err != nil {
+		c.Error(err)
+		return
+	}
+	alert.NextRun = utils.NextRunTime(alert.CronPattern, alert.Timezone, time.Now())
+
+	if err := database.DB.Create(&alert).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action": "create_alert",
+			"userID": userID,
+			"error":  err.Error(),
+		}).Error("Failed to create alert")
+		c.Error(errors.WrapError(err, "Could not create alert"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":  "create_alert",
+		"userID":  userID,
+		"alertID": alert.ID,
+		"nextRun": alert.NextRun,
+	}).Info("Alert created successfully")
+
+	c.JSON(http.StatusCreated, alert)
+}
+
+// ListAlerts lists the alerts the user can view. ?state=firing filters by state.
+func ListAlerts(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var alerts []models.Alert
+	query := database.DB.Model(&models.Alert{}).Scopes(subject(c).Visible(utils.ResourceAlert, "id", false))
+	if state := c.Query("state"); state != "" {
+		query = query.Where("state = ?", state)
+	}
+
+	if err := query.Order("id").Find(&alerts).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action": "list_alerts",
+			"userID": userID,
+			"error":  err.Error(),
+		}).Error("Failed to list alerts")
+		c.Error(errors.WrapError(err, "Could not fetch alerts"))
+		return
+	}
+
+	c.JSON(http.StatusOK, alerts)
+}
+
+// GetAlert gets a specific alert
+func GetAlert(c *gin.Context) {
+	alert, ok := loadAlert(c, utils.AccessView)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, alert)
+}
+
+// UpdateAlert updates an alert
+func UpdateAlert(c *gin.Context) {
+	alert, ok := loadAlert(c, utils.AccessEdit)
+	if !ok {
+		return
+	}
+
+	var req alertRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("Invalid alert data", err))
+		return
+	}
+	reschedule, cerr := req.apply(c, &alert)
+	if cerr != nil {
+		c.Error(cerr)
+		return
+	}
+	if reschedule {
+		alert.NextRun = utils.NextRunTime(alert.CronPattern, alert.Timezone, time.Now())
+	}
+
+	// State and lease columns belong to the scheduler, which may be evaluating the alert right now
+	if err := database.DB.Omit("locked_by", "locked_until", "state", "state_changed_at", "last_evaluated_at",
+		"last_notified_at", "last_error").Save(&alert).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":  "update_alert",
+			"alertID": alert.ID,
+			"error":   err.Error(),
+		}).Error("Failed to update alert")
+		c.Error(errors.WrapError(err, "Could not update alert"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":  "update_alert",
+		"userID":  c.GetUint("userID"),
+		"alertID": alert.ID,
+		"nextRun": alert.NextRun,
+	}).Info("Alert updated successfully")
+
+	c.JSON(http.StatusOK, alert)
+}
+
+// DeleteAlert deletes an alert
+func DeleteAlert(c *gin.Context) {
+	alert, ok := loadAlert(c, utils.AccessOwn)
+	if !ok {
+		return
+	}
+
+	if err := database.DB.Delete(&alert).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":  "delete_alert",
+			"alertID": alert.ID,
+			"error":   err.Error(),
+		}).Error("Failed to delete alert")
+		c.Error(errors.WrapError(err, "Could not delete alert"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":  "delete_alert",
+		"userID":  c.GetUint("userID"),
+		"alertID": alert.ID,
+	}).Info("Alert deleted successfully")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Alert deleted successfully"})
+}
+
+// EvaluateAlert evaluates an alert now and returns the evaluation. State changes are notified as usual.
+func EvaluateAlert(c *gin.Context) {
+	alert, ok := loadAlert(c, utils.AccessExecute)
+	if !ok {
+		return
+	}
+
+	eval, err := utils.EvaluateAlertNow(&alert)
+	if err == utils.ErrAlertBusy {
+		c.Error(errors.NewConflictError("Alert is already being evaluated", err))
+		return
+	}
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":  "evaluate_alert",
+			"alertID": alert.ID,
+			"error":   err.Error(),
+		}).Error("Failed to evaluate alert")
+		c.Error(errors.WrapError(err, "Could not evaluate alert"))
+		return
+	}
+
+	c.JSON(http.StatusOK, eval)
+}
+
+// ListAlertEvaluations lists the evaluations of an alert, newest first. ?limit defaults to 50.
+func ListAlertEvaluations(c *gin.Context) {
+	alert, ok := loadAlert(c, utils.AccessView)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		c.Error(errors.NewBadRequestError("limit must be between 1 and 1000", err))
+		return
+	}
+
+	var evals []models.AlertEvaluation
+	if err := database.DB.Where("alert_id = ?", alert.ID).Order("id DESC").Limit(limit).Find(&evals).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":  "list_alert_evaluations",
+			"alertID": alert.ID,
+			"error":   err.Error(),
+		}).Error("Failed to list alert evaluations")
+		c.Error(errors.WrapError(err, "Could not fetch alert evaluations"))
+		return
+	}
+
+	c.JSON(http.StatusOK, evals)
+}
+
+// ListAlertDeliveries lists the email and webhook notifications sent for an alert
+func ListAlertDeliveries(c *gin.Context) {
+	alert, ok := loadAlert(c, utils.AccessView)
+	if !ok {
+		return
+	}
+
+	var emails []models.ReportDelivery
+	var webhooks []models.WebhookDelivery
+	err := database.DB.Where("alert_id = ?", alert.ID).Order("id DESC").Limit(200).Find(&emails).Error
+	if err == nil {
+		err = database.DB.Where("alert_id = ?", alert.ID).Order("id DESC").Limit(200).Find(&webhooks).Error
+	}
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":  "list_alert_deliveries",
+			"alertID": alert.ID,
+			"error":   err.Error(),
+		}).Error("Failed to list alert deliveries")
+		c.Error(errors.WrapError(err, "Could not fetch alert deliveries"))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"email": emails, "webhooks": webhooks})
+}
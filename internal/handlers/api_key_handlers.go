@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/errors"
+	"gobi/pkg/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type apiKeyRequest struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"` // omitted for a key that does not expire
+}
+
+// createAPIKey creates a key for owner from the request body and returns its secret once
+func createAPIKey(c *gin.Context, owner models.User) {
+	var req apiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("Invalid API key request", err))
+		return
+	}
+	if err := utils.ValidateAPIKeyScopes(req.Scopes); err != nil {
+		c.Error(errors.NewBadRequestError("Invalid API key scopes", err))
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.Error(errors.NewBadRequestError("expires_at must be in the future", nil))
+		return
+	}
+
+	scopes, _ := json.Marshal(req.Scopes)
+	key := models.APIKey{
+		UserID:    owner.ID,
+		Name:      req.Name,
+		Scopes:    string(scopes),
+		CreatedBy: c.GetUint("userID"),
+		ExpiresAt: req.ExpiresAt,
+	}
+	secret, err := utils.GenerateAPIKey(database.DB, &key)
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":  "create_api_key",
+			"ownerID": owner.ID,
+			"error":   err.Error(),
+		}).Error("Failed to create API key")
+		c.Error(errors.WrapError(err, "Could not create API key"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":   "create_api_key",
+		"userID":   c.GetUint("userID"),
+		"ownerID":  owner.ID,
+		"apiKeyID": key.ID,
+		"prefix":   key.Prefix,
+		"scopes":   req.Scopes,
+	}).Info("API key created successfully")
+	utils.RecordAudit(auditEvent(c, "apikey.create", "apikey", key.ID), map[string]interface{}{
+		"owner_id": owner.ID, "prefix": key.Prefix, "scopes": req.Scopes, "expires_at": req.ExpiresAt,
+	})
+
+	// The secret cannot be recovered later, only the prefix is stored in clear
+	c.JSON(http.StatusCreated, gin.H{"key": secret, "api_key": key})
+}
+
+// listAPIKeys lists the keys of a user, including revoked and expired ones
+func listAPIKeys(c *gin.Context, ownerID uint) {
+	var keys []models.APIKey
+	if err := database.DB.Where("user_id = ?", ownerID).Order("created_at DESC").Find(&keys).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":  "list_api_keys",
+			"ownerID": ownerID,
+			"error":   err.Error(),
+		}).Error("Failed to list API keys")
+		c.Error(errors.WrapError(err, "Could not fetch API keys"))
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// CreateAPIKey creates a personal API key of the current user
+func CreateAPIKey(c *gin.Context) {
+	var user models.User
+	if err := database.DB.First(&user, c.GetUint("userID")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	createAPIKey(c, user)
+}
+
+// ListAPIKeys lists the API keys of the current user; user managers can pass ?user_id to list another
+// user's
+func ListAPIKeys(c *gin.Context) {
+	ownerID := c.GetUint("userID")
+	if id := c.Query("user_id"); id != "" {
+		if !requirePermission(c, utils.PermManageUsers) {
+			return
+		}
+		var user models.User
+		if err := database.DB.First(&user, id).Error; err != nil {
+			c.Error(errors.ErrNotFound)
+			return
+		}
+		ownerID = user.ID
+	}
+	listAPIKeys(c, ownerID)
+}
+
+// RevokeAPIKey revokes an API key of the current user, or any key for user managers. Revoked keys are kept so
+// that their use remains traceable.
+func RevokeAPIKey(c *gin.Context) {
+	var key models.APIKey
+	if err := database.DB.First(&key, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	userID := c.GetUint("userID")
+	if key.UserID != userID && !subject(c).HasPermission(utils.PermManageUsers) {
+		auditDenied(c, "apikey", key.ID, map[string]interface{}{"permission": utils.PermManageUsers})
+		c.Error(errors.ErrForbidden)
+		return
+	}
+
+	if key.RevokedAt == nil {
+		now := time.Now()
+		key.RevokedAt = &now
+		if err := database.DB.Model(&key).Update("revoked_at", &now).Error; err != nil {
+			utils.Logger.WithFields(map[string]interface{}{
+				"action":   "revoke_api_key",
+				"apiKeyID": key.ID,
+				"error":    err.Error(),
+			}).Error("Failed to revoke API key")
+			c.Error(errors.WrapError(err, "Could not revoke API key"))
+			return
+		}
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":   "revoke_api_key",
+		"userID":   userID,
+		"ownerID":  key.UserID,
+		"apiKeyID": key.ID,
+	}).Info("API key revoked successfully")
+	utils.RecordAudit(auditEvent(c, "apikey.revoke", "apikey", key.ID), map[string]interface{}{
+		"owner_id": key.UserID, "prefix": key.Prefix,
+	})
+
+	c.JSON(http.StatusOK, key)
+}
+
+// loadServiceAccount fetches the service account of the request; service accounts are managed by users
+// holding the users.manage permission
+func loadServiceAccount(c *gin.Context) (models.User, bool) {
+	var user models.User
+	if !requirePermission(c, utils.PermManageUsers) {
+		return user, false
+	}
+	if err := database.DB.Where("is_service_account = ?", true).First(&user, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return user, false
+	}
+	return user, true
+}
+
+// CreateServiceAccount creates a user for automation. It has no password and authenticates only with
+// API keys created for it by a user manager.
+func CreateServiceAccount(c *gin.Context) {
+	if !requirePermission(c, utils.PermManageUsers) {
+		return
+	}
+	var req struct {
+		Username string `json:"username" binding:"required"`
+		Email    string `json:"email" binding:"omitempty,email"`
+		Role     string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("Invalid service account request", err))
+		return
+	}
+	if req.Role == "" {
+		req.Role = "user"
+	}
+	if !utils.RoleExists(req.Role) {
+		c.Error(errors.NewBadRequestError(fmt.Sprintf("Unknown role %q", req.Role), nil))
+		return
+	}
+	if req.Email == "" {
+		// Email is unique, so each account gets its own placeholder
+		req.Email = req.Username + "@service-account.invalid"
+	}
+
+	var count int64
+	database.DB.Model(&models.User{}).Where("username = ? OR email = ?", req.Username, req.Email).Count(&count)
+	if count > 0 {
+		c.Error(errors.ErrUserExists)
+		return
+	}
+
+	// The account joins the organization it is created in
+	account := models.User{Username: req.Username, Email: req.Email, Role: req.Role, IsServiceAccount: true}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&account).Error; err != nil {
+			return err
+		}
+		if orgID := c.GetUint("orgID"); orgID != 0 {
+			return utils.AddOrganizationMember(tx, orgID, account.ID, utils.OrgRoleMember)
+		}
+		return nil
+	})
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":   "create_service_account",
+			"username": req.Username,
+			"error":    err.Error(),
+		}).Error("Failed to create service account")
+		c.Error(errors.WrapError(err, "Could not create service account"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":    "create_service_account",
+		"userID":    c.GetUint("userID"),
+		"accountID": account.ID,
+		"username":  account.Username,
+		"role":      account.Role,
+	}).Info("Service account created successfully")
+	event := auditEvent(c, "service_account.create", "user", account.ID)
+	event.Changes = utils.AuditChanges(nil, userAuditFields(account))
+	utils.RecordAudit(event, nil)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":                 account.ID,
+		"username":           account.Username,
+		"email":              account.Email,
+		"role":               account.Role,
+		"is_service_account": true,
+		"created_at":         account.CreatedAt,
+	})
+}
+
+// ListServiceAccounts lists the service accounts
+func ListServiceAccounts(c *gin.Context) {
+	if !requirePermission(c, utils.PermManageUsers) {
+		return
+	}
+	var accounts []models.User
+	if err := database.DB.Where("is_service_account = ?", true).Order("username").Find(&accounts).Error; err != nil {
+		c.Error(errors.WrapError(err, "Could not fetch service accounts"))
+		return
+	}
+
+	type serviceAccount struct {
+		ID        uint      `json:"id"`
+		Username  string    `json:"username"`
+		Email     string    `json:"email"`
+		Role      string    `json:"role"`
+		CreatedAt time.Time `json:"created_at"`
+		APIKeys   int64     `json:"api_keys"` // keys that are neither revoked nor expired
+	}
+	result := make([]serviceAccount, 0, len(accounts))
+	now := time.Now()
+	for _, a := range accounts {
+		var keys int64
+		database.DB.Model(&models.APIKey{}).
+			Where("user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", a.ID, now).
+			Count(&keys)
+		result = append(result, serviceAccount{ID: a.ID, Username: a.Username, Email: a.Email, Role: a.Role,
+			CreatedAt: a.CreatedAt, APIKeys: keys})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// DeleteServiceAccount deletes a service account and revokes its API keys
+func DeleteServiceAccount(c *gin.Context) {
+	account, ok := loadServiceAccount(c)
+	if !ok {
+		return
+	}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.APIKey{}).Where("user_id = ? AND revoked_at IS NULL", account.ID).
+			Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		for _, membership := range []interface{}{&models.GroupMember{}, &models.OrganizationMember{}, &models.TeamMember{}} {
+			if err := tx.Unscoped().Where("user_id = ?", account.ID).Delete(membership).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&account).Error
+	})
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":    "delete_service_account",
+			"accountID": account.ID,
+			"error":     err.Error(),
+		}).Error("Failed to delete service account")
+		c.Error(errors.WrapError(err, "Could not delete service account"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":    "delete_service_account",
+		"userID":    c.GetUint("userID"),
+		"accountID": account.ID,
+	}).Info("Service account deleted successfully")
+	event := auditEvent(c, "service_account.delete", "user", account.ID)
+	event.Changes = utils.AuditChanges(userAuditFields(account), nil)
+	utils.RecordAudit(event, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Service account deleted successfully"})
+}
+
+// CreateServiceAccountKey creates an API key for a service account
+func CreateServiceAccountKey(c *gin.Context) {
+	account, ok := loadServiceAccount(c)
+	if !ok {
+		return
+	}
+	createAPIKey(c, account)
+}
+
+// ListServiceAccountKeys lists the API keys of a service account
+func ListServiceAccountKeys(c *gin.Context) {
+	account, ok := loadServiceAccount(c)
+	if !ok {
+		return
+	}
+	listAPIKeys(c, account.ID)
+}
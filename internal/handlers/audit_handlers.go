@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/errors"
+	"gobi/pkg/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// auditEvent starts an audit event of the current request, acted by the current user
+func auditEvent(c *gin.Context, action, resourceType string, resourceID uint) models.AuditEvent {
+	return models.AuditEvent{
+		ActorID:        c.GetUint("userID"),
+		Action:         action,
+		ResourceType:   resourceType,
+		ResourceID:     resourceID,
+		OrganizationID: c.GetUint("orgID"),
+		Outcome:        utils.AuditSuccess,
+		IP:             c.ClientIP(),
+		UserAgent:      c.Request.UserAgent(),
+	}
+}
+
+// auditScope restricts audit queries to what the current user may read: every event with audit.read,
+// otherwise the events of the current organization for its admins
+func auditScope(c *gin.Context) (func(*gorm.DB) *gorm.DB, bool) {
+	if subject(c).HasPermission(utils.PermReadAudit) {
+		return func(db *gorm.DB) *gorm.DB { return db }, true
+	}
+	if orgID := c.GetUint("orgID"); orgID != 0 && c.GetString("orgRole") == utils.OrgRoleAdmin {
+		return func(db *gorm.DB) *gorm.DB { return db.Where("organization_id = ?", orgID) }, true
+	}
+	c.Error(errors.ErrForbidden)
+	return nil, false
+}
+
+// auditFilters applies the filters of the query string: actor_id, action (a trailing * matches a
+// prefix, e.g. auth.*), resource_type, resource_id, outcome, ip, organization_id and the RFC 3339
+// timestamps from and to
+func auditFilters(c *gin.Context) (func(*gorm.DB) *gorm.DB, error) {
+	var conds []func(*gorm.DB) *gorm.DB
+	for _, field := range []string{"actor_id", "resource_id", "organization_id"} {
+		if v := c.Query(field); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number", field)
+			}
+			column := field
+			conds = append(conds, func(db *gorm.DB) *gorm.DB { return db.Where(column+" = ?", id) })
+		}
+	}
+	for _, field := range []string{"resource_type", "outcome", "ip"} {
+		if v := c.Query(field); v != "" {
+			column := field
+			conds = append(conds, func(db *gorm.DB) *gorm.DB { return db.Where(column+" = ?", v) })
+		}
+	}
+	if action := c.Query("action"); action != "" {
+		if prefix, ok := strings.CutSuffix(action, "*"); ok {
+			conds = append(conds, func(db *gorm.DB) *gorm.DB { return db.Where("action LIKE ?", prefix+"%") })
+		} else {
+			conds = append(conds, func(db *gorm.DB) *gorm.DB { return db.Where("action = ?", action) })
+		}
+	}
+	for field, op := range map[string]string{"from": ">=", "to": "<"} {
+		if v := c.Query(field); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 timestamp", field)
+			}
+			cond := "created_at " + op + " ?"
+			conds = append(conds, func(db *gorm.DB) *gorm.DB { return db.Where(cond, t.UTC()) })
+		}
+	}
+	return func(db *gorm.DB) *gorm.DB {
+		for _, cond := range conds {
+			db = cond(db)
+		}
+		return db
+	}, nil
+}
+
+// ListAuditEvents lists audit events newest first. ?limit defaults to 100; ?before_id pages to older
+// events.
+func ListAuditEvents(c *gin.Context) {
+	scope, ok := auditScope(c)
+	if !ok {
+		return
+	}
+	filters, err := auditFilters(c)
+	if err != nil {
+		c.Error(errors.NewBadRequestError(err.Error(), nil))
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		c.Error(errors.NewBadRequestError("limit must be between 1 and 1000", err))
+		return
+	}
+	query := database.DB.Model(&models.AuditEvent{}).Scopes(scope, filters)
+	if before := c.Query("before_id"); before != "" {
+		query = query.Where("id < ?", before)
+	}
+
+	var events []models.AuditEvent
+	if err := query.Order("id DESC").Limit(limit).Find(&events).Error; err != nil {
+		c.Error(errors.WrapError(err, "Could not fetch audit events"))
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+var auditCSVHeader = []string{
+	"id", "created_at", "actor_id", "actor_name", "action", "resource_type", "resource_id", "organization_id",
+	"outcome", "ip", "user_agent", "changes", "details", "prev_hash", "hash",
+}
+
+// ExportAuditEvents downloads the audit events matching the filters of ListAuditEvents, oldest first,
+// as CSV or, with ?format=json, as JSON lines. Exports keep the hashes, so that the chain can be checked
+// outside of Gobi.
+func ExportAuditEvents(c *gin.Context) {
+	scope, ok := auditScope(c)
+	if !ok {
+		return
+	}
+	filters, err := auditFilters(c)
+	if err != nil {
+		c.Error(errors.NewBadRequestError(err.Error(), nil))
+		return
+	}
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "json" {
+		c.Error(errors.NewBadRequestError("format must be csv or json", nil))
+		return
+	}
+
+	utils.RecordAudit(auditEvent(c, "audit.export", "", 0), map[string]interface{}{
+		"format": format, "filters": c.Request.URL.RawQuery,
+	})
+
+	fileName := fmt.Sprintf("audit-%s.%s", time.Now().Format("20060102-150405"), format)
+	c.Header("Content-Disposition", "attachment; filename="+fileName)
+	var write func(models.AuditEvent) error
+	var flush func()
+	if format == "json" {
+		c.Header("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(c.Writer)
+		write = func(e models.AuditEvent) error { return enc.Encode(e) }
+		flush = func() {}
+	} else {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		w := csv.NewWriter(c.Writer)
+		w.Write(auditCSVHeader)
+		write = func(e models.AuditEvent) error {
+			prev := ""
+			if e.PrevHash != nil {
+				prev = *e.PrevHash
+			}
+			return w.Write([]string{
+				strconv.FormatUint(uint64(e.ID), 10), e.CreatedAt.UTC().Format(time.RFC3339Nano),
+				strconv.FormatUint(uint64(e.ActorID), 10), e.ActorName, e.Action, e.ResourceType,
+				strconv.FormatUint(uint64(e.ResourceID), 10), strconv.FormatUint(uint64(e.OrganizationID), 10),
+				e.Outcome, e.IP, e.UserAgent, e.Changes, e.Details, prev, e.Hash,
+			})
+		}
+		flush = w.Flush
+	}
+	c.Status(http.StatusOK)
+
+	// Events are streamed in batches, the response has started so failures can only be logged
+	var events []models.AuditEvent
+	err = database.DB.Model(&models.AuditEvent{}).Scopes(scope, filters).Order("id").
+		FindInBatches(&events, 500, func(tx *gorm.DB, batch int) error {
+			for _, e := range events {
+				if err := write(e); err != nil {
+					return err
+				}
+			}
+			flush()
+			return nil
+		}).Error
+	flush()
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action": "export_audit",
+			"userID": c.GetUint("userID"),
+			"error":  err.Error(),
+		}).Error("Audit export failed")
+	}
+}
+
+// VerifyAuditLog checks the hash chain of the whole audit log and reports the first broken event
+func VerifyAuditLog(c *gin.Context) {
+	if !requirePermission(c, utils.PermReadAudit) {
+		return
+	}
+	result, err := utils.VerifyAuditLog()
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not verify audit log"))
+		return
+	}
+	if !result.Valid {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":   "verify_audit",
+			"brokenAt": result.BrokenAt,
+			"reason":   result.Reason,
+		}).Error("Audit log chain is broken")
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/errors"
+	"gobi/pkg/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// loadVersionedChart fetches the chart of a version request, checking that the user has level access.
+// Deleted charts are included, since their history is kept and rolling back restores them.
+func loadVersionedChart(c *gin.Context, level string) (models.Chart, bool) {
+	var chart models.Chart
+	if err := database.DB.Unscoped().First(&chart, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return chart, false
+	}
+	if !authorize(c, utils.ChartResource(chart), level) {
+		return chart, false
+	}
+	return chart, true
+}
+
+// loadChartVersion fetches a version of chart by its number
+func loadChartVersion(chart models.Chart, number string) (models.ChartVersion, *errors.CustomError) {
+	var version models.ChartVersion
+	n, err := strconv.Atoi(number)
+	if err != nil || n <= 0 {
+		return version, errors.NewBadRequestError(fmt.Sprintf("Invalid version %q", number), err)
+	}
+	if err := database.DB.Where("chart_id = ? AND version = ?", chart.ID, n).First(&version).Error; err != nil {
+		return version, errors.ErrNotFound
+	}
+	return version, nil
+}
+
+// ListChartVersions lists the versions of a chart, newest first
+func ListChartVersions(c *gin.Context) {
+	chart, ok := loadVersionedChart(c, utils.AccessView)
+	if !ok {
+		return
+	}
+
+	var versions []models.ChartVersion
+	if err := database.DB.Where("chart_id = ?", chart.ID).Order("version DESC").Find(&versions).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":  "list_chart_versions",
+			"chartID": chart.ID,
+			"error":   err.Error(),
+		}).Error("Failed to list chart versions")
+		c.Error(errors.WrapError(err, "Could not fetch chart versions"))
+		return
+	}
+
+	c.JSON(http.StatusOK, versions)
+}
+
+// GetChartVersion gets one version of a chart
+func GetChartVersion(c *gin.Context) {
+	chart, ok := loadVersionedChart(c, utils.AccessView)
+	if !ok {
+		return
+	}
+	version, err := loadChartVersion(chart, c.Param("version"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, version)
+}
+
+// DiffChartVersions compares two versions of a chart given as ?from=N&to=M, see DiffQueryVersions
+func DiffChartVersions(c *gin.Context) {
+	chart, ok := loadVersionedChart(c, utils.AccessView)
+	if !ok {
+		return
+	}
+
+	to, err := loadChartVersion(chart, c.DefaultQuery("to", strconv.Itoa(chart.Version)))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	from, err := loadChartVersion(chart, c.DefaultQuery("from", strconv.Itoa(to.Version-1)))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, utils.DiffChartVersions(from, to))
+}
+
+// RollbackChartVersion makes the chart match an earlier version, restoring it if it was deleted. The
+// rollback is recorded as a new version.
+func RollbackChartVersion(c *gin.Context) {
+	chart, ok := loadVersionedChart(c, utils.AccessEdit)
+	if !ok {
+		return
+	}
+	version, cerr := loadChartVersion(chart, c.Param("version"))
+	if cerr != nil {
+		c.Error(cerr)
+		return
+	}
+
+	userID := c.GetUint("userID")
+	restored := chart.DeletedAt.Valid
+	var rolledBack models.ChartVersion
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		chart.Name = version.Name
+		chart.Type = version.Type
+		chart.QueryID = version.QueryID
+		chart.Config = version.Config
+		chart.Description = version.Description
+		chart.DeletedAt = gorm.DeletedAt{}
+		if err := tx.Unscoped().Save(&chart).Error; err != nil {
+			return err
+		}
+		var err error
+		rolledBack, err = utils.RecordChartVersion(tx, &chart, userID, fmt.Sprintf("Rolled back to version %d", version.Version))
+		return err
+	})
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":  "rollback_chart_version",
+			"chartID": chart.ID,
+			"version": version.Version,
+			"error":   err.Error(),
+		}).Error("Failed to roll back chart version")
+		c.Error(errors.WrapError(err, "Could not roll back chart version"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":     "rollback_chart_version",
+		"userID":     userID,
+		"chartID":    chart.ID,
+		"version":    version.Version,
+		"newVersion": rolledBack.Version,
+		"restored":   restored,
+	}).Info("Chart version rolled back successfully")
+
+	c.JSON(http.StatusOK, chart)
+}
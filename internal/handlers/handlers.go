@@ -10,9 +10,14 @@ import (
 	"net/http"
 	"time"
 
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"mime/multipart"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -21,6 +26,14 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	// maxTemplateSize limits uploaded Excel templates
+	maxTemplateSize = 10 << 20
+	// defaultPreviewRows and maxPreviewRows bound the live rows written per anchor in template previews
+	defaultPreviewRows = 20
+	maxPreviewRows     = 1000
+)
+
 // Auth handlers
 func Login(c *gin.Context) {
 	var login struct {
@@ -42,40 +55,53 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	if cfg := config.AppConfig; cfg.OIDC.Enabled && !cfg.OIDC.LocalLogin && !cfg.LDAP.Enabled {
+		c.Error(errors.NewError(http.StatusForbidden, "Password login is disabled, use single sign-on", nil))
+		return
+	}
+
+	if loginLocked(c, models.User{}, login.Username, "password") {
+		return
+	}
+
+	// Directory users, and usernames unknown here, are checked against LDAP when it is enabled
 	var user models.User
-	if err := database.DB.Where("username = ?", login.Username).First(&user).Error; err != nil {
-		utils.Logger.WithFields(map[string]interface{}{
-			"action":   "login",
-			"username": login.Username,
-			"error":    "user not found",
-		}).Warn("Login failed: user not found")
-		c.Error(errors.ErrInvalidCredentials)
+	err := database.DB.Where("username = ?", login.Username).First(&user).Error
+	var ok bool
+	method := "password"
+	if config.AppConfig.LDAP.Enabled && (err != nil || user.AuthProvider == utils.AuthProviderLDAP) {
+		method = utils.AuthProviderLDAP
+		user, ok = authenticateDirectoryUser(c, login.Username, login.Password)
+	} else {
+		ok = authenticateLocalUser(c, user, err, login.Username, login.Password)
+	}
+	if !ok {
+		if last := c.Errors.Last(); last != nil {
+			if last.Err == errors.ErrInvalidCredentials {
+				utils.RecordLoginFailure(login.Username, c.ClientIP())
+			}
+			auditLogin(c, user, login.Username, method, utils.AuditFailure, last.Error())
+		}
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(login.Password)); err != nil {
-		utils.Logger.WithFields(map[string]interface{}{
-			"action":   "login",
-			"username": login.Username,
-			"error":    "invalid password",
-		}).Warn("Login failed: invalid password")
-		c.Error(errors.ErrInvalidCredentials)
+	// Users with two-factor authentication get their tokens from VerifyMFA, which also resets their
+	// failed logins once the second factor was accepted
+	mfaToken, ok := startMFAChallenge(c, user)
+	if !ok {
 		return
 	}
+	if mfaToken != "" {
+		c.JSON(http.StatusOK, mfaChallengeResponse(mfaToken))
+		return
+	}
+	utils.RecordLoginSuccess(login.Username)
 
 	// 更新最后登录时间
 	user.LastLogin = time.Now()
 	database.DB.Save(&user)
 
-	// cfg := config.DefaultConfig
-	cfg := config.AppConfig
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"role":    user.Role,
-		"exp":     time.Now().Add(time.Duration(cfg.JWT.ExpirationHours) * time.Hour).Unix(),
-	})
-
-	tokenString, err := token.SignedString([]byte(cfg.JWT.Secret))
+	pair, err := utils.IssueTokenPair(user, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		utils.Logger.WithFields(map[string]interface{}{
 			"action":   "login",
@@ -92,30 +118,280 @@ func Login(c *gin.Context) {
 		"role":     user.Role,
 		"username": user.Username,
 	}).Info("User login success")
+	auditLogin(c, user, user.Username, method, utils.AuditSuccess, "")
 
-	c.JSON(http.StatusOK, gin.H{"token": tokenString})
+	c.JSON(http.StatusOK, tokenResponse(pair))
 }
 
-// 从 Authorization 头解析 JWT 并获取 role
-func getRoleFromToken(c *gin.Context) string {
+// loginLocked refuses a login step of a username, or of its client IP, that is locked after too many
+// failed logins
+func loginLocked(c *gin.Context, user models.User, username, method string) bool {
+	until := utils.LoginLockedUntil(username, c.ClientIP())
+	if until.IsZero() {
+		return false
+	}
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":      "login",
+		"username":    username,
+		"ip":          c.ClientIP(),
+		"lockedUntil": until,
+	}).Warn("Login refused: locked after repeated failures")
+	c.Header("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+	c.Error(errors.NewError(http.StatusTooManyRequests, "Too many failed login attempts, try again later", nil))
+	auditLogin(c, user, username, method, utils.AuditDenied, "locked")
+	return true
+}
+
+// auditLogin records a login attempt of a username, by a known user unless user.ID is 0. Logins waiting
+// for the second factor are recorded once it was checked.
+func auditLogin(c *gin.Context, user models.User, username, method, outcome, reason string) {
+	event := auditEvent(c, "auth.login", "user", user.ID)
+	event.ActorID = user.ID
+	event.ActorName = username
+	event.Outcome = outcome
+	details := map[string]interface{}{"method": method}
+	if reason != "" {
+		details["reason"] = reason
+	}
+	utils.RecordAudit(event, details)
+}
+
+// authenticateLocalUser checks the password of a user looked up by Login, where err is the error of the
+// lookup
+func authenticateLocalUser(c *gin.Context, user models.User, err error, username, password string) bool {
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":   "login",
+			"username": username,
+			"error":    "user not found",
+		}).Warn("Login failed: user not found")
+		c.Error(errors.ErrInvalidCredentials)
+		return false
+	}
+
+	if user.IsServiceAccount {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":   "login",
+			"username": username,
+			"error":    "service account",
+		}).Warn("Login failed: service accounts cannot log in")
+		c.Error(errors.ErrInvalidCredentials)
+		return false
+	}
+
+	if user.Disabled {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":   "login",
+			"username": username,
+			"error":    "user disabled",
+		}).Warn("Login failed: user is disabled")
+		c.Error(errors.ErrInvalidCredentials)
+		return false
+	}
+
+	if user.AuthProvider != "" {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":   "login",
+			"username": username,
+			"error":    "external user",
+		}).Warn("Login failed: user signs in through the identity provider")
+		c.Error(errors.ErrInvalidCredentials)
+		return false
+	}
+
+	if cfg := config.AppConfig.OIDC; cfg.Enabled && !cfg.LocalLogin {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":   "login",
+			"username": username,
+			"error":    "local login disabled",
+		}).Warn("Login failed: password login is disabled for local users")
+		c.Error(errors.ErrInvalidCredentials)
+		return false
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":   "login",
+			"username": username,
+			"error":    "invalid password",
+		}).Warn("Login failed: invalid password")
+		c.Error(errors.ErrInvalidCredentials)
+		return false
+	}
+	return true
+}
+
+// authenticateDirectoryUser checks a password against LDAP and provisions or updates the directory user
+func authenticateDirectoryUser(c *gin.Context, username, password string) (models.User, bool) {
+	identity, err := utils.AuthenticateLDAP(username, password)
+	if err != nil {
+		if errors.Is(err, utils.ErrLDAPInvalidCredentials) {
+			utils.Logger.WithFields(map[string]interface{}{
+				"action":   "login",
+				"username": username,
+				"error":    "invalid directory credentials",
+			}).Warn("Login failed: directory rejected credentials")
+			c.Error(errors.ErrInvalidCredentials)
+		} else {
+			utils.Logger.WithFields(map[string]interface{}{
+				"action":   "login",
+				"username": username,
+				"error":    err.Error(),
+			}).Error("Login failed: directory error")
+			c.Error(errors.NewError(http.StatusBadGateway, "Directory is unavailable", err))
+		}
+		return models.User{}, false
+	}
+
+	user, err := utils.ProvisionExternalUser(identity, config.AppConfig.LDAP.GroupMapping)
+	if err != nil {
+		if errors.Is(err, utils.ErrExternalAccountExists) {
+			c.Error(errors.NewConflictError("A local account with this username or email already exists", nil))
+		} else {
+			c.Error(errors.WrapError(err, "Could not provision user"))
+		}
+		return user, false
+	}
+	return user, true
+}
+
+// tokenResponse returns a token pair, keeping the token field of earlier versions for existing clients
+func tokenResponse(pair utils.TokenPair) gin.H {
+	return gin.H{
+		"token":              pair.AccessToken,
+		"access_token":       pair.AccessToken,
+		"token_type":         pair.TokenType,
+		"expires_in":         pair.ExpiresIn,
+		"refresh_token":      pair.RefreshToken,
+		"refresh_expires_at": pair.RefreshExpiresAt,
+	}
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token. The refresh token can be
+// used only once; a reused token revokes its whole session.
+func RefreshToken(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("refresh_token is required", err))
+		return
+	}
+
+	pair, err := utils.RotateRefreshToken(req.RefreshToken, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		if err == utils.ErrRefreshTokenInvalid || err == utils.ErrRefreshTokenReused {
+			utils.Logger.WithFields(map[string]interface{}{
+				"action": "refresh_token",
+				"ip":     c.ClientIP(),
+				"error":  err.Error(),
+			}).Warn("Token refresh rejected")
+			c.Error(errors.NewError(http.StatusUnauthorized, err.Error(), nil))
+			return
+		}
+		utils.Logger.WithFields(map[string]interface{}{
+			"action": "refresh_token",
+			"error":  err.Error(),
+		}).Error("Token refresh failed")
+		c.Error(errors.WrapError(err, "Could not refresh token"))
+		return
+	}
+
+	c.JSON(http.StatusOK, tokenResponse(pair))
+}
+
+// revokeUserSessions revokes all tokens of a user after a change to their account, reporting an error
+// to the client when that fails
+func revokeUserSessions(c *gin.Context, userID uint, reason string) bool {
+	if err := utils.RevokeUserTokens(userID, reason); err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":   "revoke_user_tokens",
+			"targetID": userID,
+			"reason":   reason,
+			"error":    err.Error(),
+		}).Error("Failed to revoke user tokens")
+		c.Error(errors.WrapError(err, "Could not revoke user sessions"))
+		return false
+	}
+	return true
+}
+
+// Logout revokes the access token of the request and the session it belongs to. With ?all=true every
+// session of the user is signed out.
+func Logout(c *gin.Context) {
+	userID := c.GetUint("userID")
+	sessionID := c.GetString("sessionID")
+	all := c.Query("all") == "true"
+
+	var err error
+	if all {
+		err = utils.RevokeUserTokens(userID, "logout from all sessions")
+	} else {
+		err = utils.RevokeAccessToken(c.GetString("tokenID"), userID, c.GetTime("tokenExpiresAt"), "logout")
+		if err == nil && sessionID != "" {
+			err = utils.RevokeSession(sessionID, "logout")
+		}
+	}
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action": "logout",
+			"userID": userID,
+			"error":  err.Error(),
+		}).Error("Logout failed")
+		c.Error(errors.WrapError(err, "Could not revoke token"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":    "logout",
+		"userID":    userID,
+		"sessionID": sessionID,
+		"all":       all,
+	}).Info("User logged out")
+	utils.RecordAudit(auditEvent(c, "auth.logout", "user", userID), map[string]interface{}{"all_sessions": all})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// 从 Authorization 头解析 JWT 并获取 claims，无效时返回 nil。Like AuthMiddleware, revoked tokens and
+// tokens of deleted or disabled users are refused, and the role is the one the user holds now.
+func tokenClaims(c *gin.Context) jwt.MapClaims {
 	authHeader := c.GetHeader("Authorization")
 	if authHeader == "" {
-		return ""
+		return nil
 	}
 	parts := strings.SplitN(authHeader, " ", 2)
 	if len(parts) != 2 || parts[0] != "Bearer" {
-		return ""
+		return nil
 	}
 	tokenStr := parts[1]
 	token, _ := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
 		return []byte(config.AppConfig.JWT.Secret), nil
 	})
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		if role, ok := claims["role"].(string); ok {
-			return role
-		}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil
+	}
+	tokenID, _ := claims["jti"].(string)
+	if tokenID == "" {
+		return nil
+	}
+	if revoked, err := utils.IsTokenRevoked(tokenID); err != nil || revoked {
+		return nil
 	}
-	return ""
+	userID, _ := claims["user_id"].(float64)
+	var user models.User
+	if err := database.DB.Select("id, role, disabled").First(&user, uint(userID)).Error; err != nil || user.Disabled {
+		return nil
+	}
+	claims["role"] = user.Role
+	return claims
+}
+
+// 从 Authorization 头解析 JWT 并获取 role
+func getRoleFromToken(c *gin.Context) string {
+	role, _ := tokenClaims(c)["role"].(string)
+	return role
 }
 
 func Register(c *gin.Context) {
@@ -124,6 +400,8 @@ func Register(c *gin.Context) {
 		Email    string `json:"email" binding:"required"`
 		Password string `json:"password" binding:"required"`
 		IsAdmin  bool   `json:"is_admin"`
+		Role     string `json:"role"`            // overrides is_admin when set
+		OrgID    uint   `json:"organization_id"` // organization the user joins, the default one when omitted
 	}
 
 	if err := c.ShouldBindJSON(&register); err != nil {
@@ -148,9 +426,11 @@ func Register(c *gin.Context) {
 	// 检查是否已有 admin 用户
 	var adminCount int64
 	database.DB.Model(&models.User{}).Where("role = ?", "admin").Count(&adminCount)
+	var registrar *utils.Subject // nil while bootstrapping the first admin
 	if adminCount > 0 {
-		role := getRoleFromToken(c)
-		if role != "admin" {
+		s := utils.NewSubject(0, getRoleFromToken(c))
+		registrar = &s
+		if !s.HasPermission(utils.PermManageUsers) {
 			utils.Logger.WithFields(map[string]interface{}{
 				"action":   "register",
 				"username": register.Username,
@@ -185,7 +465,12 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(register.Password), bcrypt.DefaultCost)
+	hashedPassword, err := utils.HashPassword(models.User{Username: register.Username}, register.Password)
+	var policyErr *utils.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		c.Error(errors.NewBadRequestError(policyErr.Error(), nil))
+		return
+	}
 	if err != nil {
 		utils.Logger.WithFields(map[string]interface{}{
 			"action":   "register",
@@ -201,15 +486,48 @@ func Register(c *gin.Context) {
 	if register.IsAdmin {
 		roleStr = "admin"
 	}
+	if register.Role != "" {
+		if !utils.RoleExists(register.Role) {
+			c.Error(errors.NewBadRequestError(fmt.Sprintf("Unknown role %q", register.Role), nil))
+			return
+		}
+		roleStr = register.Role
+	}
+	if registrar != nil {
+		// New users cannot get permissions the registering admin does not hold
+		if perm := registrar.UngrantablePermission(utils.RolePermissions(roleStr)); perm != "" {
+			c.Error(errors.NewError(http.StatusForbidden, fmt.Sprintf("Role %q needs permission %q, which you do not hold", roleStr, perm), nil))
+			return
+		}
+	}
+	if register.OrgID == 0 {
+		register.OrgID = utils.DefaultOrganizationID()
+	} else if err := database.DB.Select("id").First(&models.Organization{}, register.OrgID).Error; err != nil {
+		c.Error(errors.NewBadRequestError("Organization not found", err))
+		return
+	}
+	orgRole := utils.OrgRoleMember
+	if utils.NewSubject(0, roleStr).IsSuperuser() {
+		orgRole = utils.OrgRoleAdmin
+	}
 
 	user := models.User{
 		Username: register.Username,
 		Email:    register.Email,
-		Password: string(hashedPassword),
+		Password: hashedPassword,
 		Role:     roleStr,
 	}
 
-	if err := database.DB.Create(&user).Error; err != nil {
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		if register.OrgID == 0 {
+			return nil
+		}
+		return utils.AddOrganizationMember(tx, register.OrgID, user.ID, orgRole)
+	})
+	if err != nil {
 		utils.Logger.WithFields(map[string]interface{}{
 			"action":   "register",
 			"username": register.Username,
@@ -219,6 +537,16 @@ func Register(c *gin.Context) {
 		c.Error(errors.WrapError(err, "Could not create user"))
 		return
 	}
+	utils.RecordPasswordHistory(user.ID, hashedPassword)
+
+	// Register is a public route, the admin registering the user is known from the token only
+	event := auditEvent(c, "user.create", "user", user.ID)
+	if actorID, ok := tokenClaims(c)["user_id"].(float64); ok {
+		event.ActorID = uint(actorID)
+	}
+	event.OrganizationID = register.OrgID
+	event.Changes = utils.AuditChanges(nil, userAuditFields(user))
+	utils.RecordAudit(event, map[string]interface{}{"organization_role": orgRole})
 
 	utils.Logger.WithFields(map[string]interface{}{
 		"action":   "register",
@@ -258,17 +586,31 @@ func CreateQuery(c *gin.Context) {
 		return
 	}
 
-	userID, _ := c.Get("userID")
-	query := models.Query{
-		Name:         req.Name,
-		SQL:          req.SQL,
-		Description:  req.Description,
-		IsPublic:     req.IsPublic,
-		DataSourceID: req.DataSourceID,
-		UserID:       userID.(uint),
+	if !requireCreate(c, utils.ResourceQuery) ||
+		!authorizeReferenced(c, utils.ResourceDataSource, req.DataSourceID, utils.AccessExecute) ||
+		!requireUnfilteredDataSource(c, req.DataSourceID) {
+		return
 	}
 
-	if err := database.DB.Create(&query).Error; err != nil {
+	userID, _ := c.Get("userID")
+	query := models.Query{
+		Name:           req.Name,
+		SQL:            req.SQL,
+		Description:    req.Description,
+		IsPublic:       req.IsPublic,
+		DataSourceID:   req.DataSourceID,
+		UserID:         userID.(uint),
+		OrganizationID: c.GetUint("orgID"),
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&query).Error; err != nil {
+			return err
+		}
+		_, err := utils.RecordQueryVersion(tx, &query, query.UserID, "")
+		return err
+	})
+	if err != nil {
 		utils.Logger.WithFields(map[string]interface{}{
 			"action": "create_query",
 			"userID": userID,
@@ -295,16 +637,13 @@ func ListQueries(c *gin.Context) {
 	userID, _ := c.Get("userID")
 	role, _ := c.Get("role")
 
-	cacheKey := cacheKeyForListQueries(userID, role)
+	cacheKey := cacheKeyForListQueries(userID, role, c.GetUint("orgID"))
 	if cached, found := utils.GetQueryCache(cacheKey); found {
 		c.JSON(http.StatusOK, cached)
 		return
 	}
 
-	query := database.DB.Model(&models.Query{})
-	if role.(string) != "admin" {
-		query = query.Where("user_id = ? OR is_public = ?", userID, true)
-	}
+	query := database.DB.Model(&models.Query{}).Scopes(subject(c).Visible(utils.ResourceQuery, "id", true))
 
 	if err := query.Find(&queries).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch queries"})
@@ -319,7 +658,7 @@ func GetQuery(c *gin.Context) {
 	id := c.Param("id")
 	userID, _ := c.Get("userID")
 	role, _ := c.Get("role")
-	cacheKey := cacheKeyForGetQuery(id, userID, role)
+	cacheKey := cacheKeyForGetQuery(id, userID, role, c.GetUint("orgID"))
 	if cached, found := utils.GetQueryCache(cacheKey); found {
 		c.JSON(http.StatusOK, cached)
 		return
@@ -331,8 +670,7 @@ func GetQuery(c *gin.Context) {
 		return
 	}
 
-	if role.(string) != "admin" && query.UserID != userID.(uint) && !query.IsPublic {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.QueryResource(query), utils.AccessView) {
 		return
 	}
 
@@ -349,9 +687,7 @@ func UpdateQuery(c *gin.Context) {
 	}
 
 	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
-	if role.(string) != "admin" && query.UserID != userID.(uint) {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.QueryResource(query), utils.AccessEdit) {
 		return
 	}
 
@@ -359,7 +695,7 @@ func UpdateQuery(c *gin.Context) {
 		Name         string `json:"name"`
 		SQL          string `json:"sql"`
 		Description  string `json:"description"`
-		IsPublic     bool   `json:"is_public"`
+		IsPublic     *bool  `json:"is_public"` // omitted to keep the visibility
 		DataSourceID uint   `json:"data_source_id"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -374,22 +710,50 @@ func UpdateQuery(c *gin.Context) {
 		}
 		return
 	}
-
-	if req.Name != "" {
-		query.Name = req.Name
-	}
-	if req.SQL != "" {
-		query.SQL = req.SQL
+	// Changing the visibility shares the query, which needs own access
+	if req.IsPublic != nil && *req.IsPublic != query.IsPublic && !authorize(c, utils.QueryResource(query), utils.AccessOwn) {
+		return
 	}
-	if req.Description != "" {
-		query.Description = req.Description
+	if req.DataSourceID != 0 && req.DataSourceID != query.DataSourceID && !authorizeReferenced(c, utils.ResourceDataSource, req.DataSourceID, utils.AccessExecute) {
+		return
 	}
-	query.IsPublic = req.IsPublic
-	if req.DataSourceID != 0 {
-		query.DataSourceID = req.DataSourceID
+	if (req.SQL != "" && req.SQL != query.SQL) || (req.DataSourceID != 0 && req.DataSourceID != query.DataSourceID) {
+		target := query.DataSourceID
+		if req.DataSourceID != 0 {
+			target = req.DataSourceID
+		}
+		if !requireUnfilteredDataSource(c, target) {
+			return
+		}
 	}
 
-	if err := database.DB.Save(&query).Error; err != nil {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// Queries created before versioning get their previous state recorded first
+		if err := utils.EnsureQueryBaseline(tx, &query); err != nil {
+			return err
+		}
+		if req.Name != "" {
+			query.Name = req.Name
+		}
+		if req.SQL != "" {
+			query.SQL = req.SQL
+		}
+		if req.Description != "" {
+			query.Description = req.Description
+		}
+		if req.IsPublic != nil {
+			query.IsPublic = *req.IsPublic
+		}
+		if req.DataSourceID != 0 {
+			query.DataSourceID = req.DataSourceID
+		}
+		if err := tx.Save(&query).Error; err != nil {
+			return err
+		}
+		_, err := utils.RecordQueryVersion(tx, &query, userID.(uint), "")
+		return err
+	})
+	if err != nil {
 		c.Error(errors.WrapError(err, "Could not update query"))
 		return
 	}
@@ -407,10 +771,7 @@ func DeleteQuery(c *gin.Context) {
 		return
 	}
 
-	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
-	if role.(string) != "admin" && query.UserID != userID.(uint) {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.QueryResource(query), utils.AccessOwn) {
 		return
 	}
 
@@ -424,6 +785,22 @@ func DeleteQuery(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Query deleted successfully"})
 }
 
+// validChartTypes lists the supported chart types
+var validChartTypes = map[string]bool{
+	"bar":        true,
+	"line":       true,
+	"pie":        true,
+	"scatter":    true,
+	"radar":      true,
+	"heatmap":    true,
+	"gauge":      true,
+	"funnel":     true,
+	"3d-bar":     true,
+	"3d-scatter": true,
+	"3d-surface": true,
+	"3d-bubble":  true,
+}
+
 // Chart handlers
 func CreateChart(c *gin.Context) {
 	var req struct {
@@ -448,38 +825,35 @@ func CreateChart(c *gin.Context) {
 	}
 
 	// 验证图表类型
-	validChartTypes := map[string]bool{
-		"bar":        true,
-		"line":       true,
-		"pie":        true,
-		"scatter":    true,
-		"radar":      true,
-		"heatmap":    true,
-		"gauge":      true,
-		"funnel":     true,
-		"3d-bar":     true,
-		"3d-scatter": true,
-		"3d-surface": true,
-		"3d-bubble":  true,
-	}
-
 	if !validChartTypes[req.Type] {
 		c.Error(errors.NewBadRequestError("Invalid chart type", nil))
 		return
 	}
+	if !requireCreate(c, utils.ResourceChart) ||
+		!authorizeReferenced(c, utils.ResourceQuery, req.QueryID, utils.AccessView) {
+		return
+	}
 
 	userID, _ := c.Get("userID")
 	chart := models.Chart{
-		Name:        req.Name,
-		Type:        req.Type,
-		QueryID:     req.QueryID,
-		Config:      req.Config,
-		Data:        req.Data,
-		Description: req.Description,
-		UserID:      userID.(uint),
-	}
-
-	if err := database.DB.Create(&chart).Error; err != nil {
+		Name:           req.Name,
+		Type:           req.Type,
+		QueryID:        req.QueryID,
+		Config:         req.Config,
+		Data:           req.Data,
+		Description:    req.Description,
+		UserID:         userID.(uint),
+		OrganizationID: c.GetUint("orgID"),
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&chart).Error; err != nil {
+			return err
+		}
+		_, err := utils.RecordChartVersion(tx, &chart, chart.UserID, "")
+		return err
+	})
+	if err != nil {
 		c.Error(errors.WrapError(err, "Could not create chart"))
 		return
 	}
@@ -489,13 +863,8 @@ func CreateChart(c *gin.Context) {
 
 func ListCharts(c *gin.Context) {
 	var charts []models.Chart
-	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
-
-	query := database.DB.Preload("Query").Preload("User").Model(&models.Chart{})
-	if role.(string) != "admin" {
-		query = query.Where("user_id = ?", userID)
-	}
+	query := database.DB.Preload("Query").Preload("User").Model(&models.Chart{}).
+		Scopes(subject(c).Visible(utils.ResourceChart, "id", false))
 
 	if err := query.Find(&charts).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch charts"})
@@ -513,16 +882,44 @@ func GetChart(c *gin.Context) {
 		return
 	}
 
-	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
-	if role.(string) != "admin" && chart.UserID != userID.(uint) {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.ChartResource(chart), utils.AccessView) {
 		return
 	}
 
 	c.JSON(http.StatusOK, chart)
 }
 
+// GetChartData runs the query of a chart for the current user, binding {{name}} parameters from
+// params[name]=value query string arguments
+func GetChartData(c *gin.Context) {
+	var chart models.Chart
+	if err := database.DB.Preload("Query").First(&chart, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	if !authorize(c, utils.ChartResource(chart), utils.AccessView) {
+		return
+	}
+
+	started := time.Now()
+	columns, results, err := utils.RunSavedQueryWithParams(chart.Query, c.QueryMap("params"), subject(c))
+	event := auditEvent(c, "query.execute", utils.ResourceChart, chart.ID)
+	details := map[string]interface{}{
+		"query_id":    chart.QueryID,
+		"duration_ms": time.Since(started).Milliseconds(),
+	}
+	if err != nil {
+		event.Outcome = utils.AuditFailure
+		details["error"] = err.Error()
+		utils.RecordAudit(event, details)
+		c.Error(errors.NewError(http.StatusUnprocessableEntity, "Could not run chart query", err))
+		return
+	}
+	details["rows"] = len(results)
+	utils.RecordAudit(event, details)
+	c.JSON(http.StatusOK, gin.H{"columns": columns, "data": results})
+}
+
 func UpdateChart(c *gin.Context) {
 	id := c.Param("id")
 	var chart models.Chart
@@ -532,13 +929,19 @@ func UpdateChart(c *gin.Context) {
 	}
 
 	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
-	if role.(string) != "admin" && chart.UserID != userID.(uint) {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.ChartResource(chart), utils.AccessEdit) {
 		return
 	}
 
-	if err := c.ShouldBindJSON(&chart); err != nil {
+	var req struct {
+		Name        *string `json:"name"`
+		Type        *string `json:"type"`
+		QueryID     *uint   `json:"query_id"`
+		Config      *string `json:"config"`
+		Data        *string `json:"data"`
+		Description *string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
 		var syntaxErr *json.SyntaxError
 		var typeErr *json.UnmarshalTypeError
 		if errors.IsValidationError(err) {
@@ -550,8 +953,45 @@ func UpdateChart(c *gin.Context) {
 		}
 		return
 	}
+	if req.Type != nil && !validChartTypes[*req.Type] {
+		c.Error(errors.NewBadRequestError("Invalid chart type", nil))
+		return
+	}
+	if req.QueryID != nil && *req.QueryID != chart.QueryID &&
+		!authorizeReferenced(c, utils.ResourceQuery, *req.QueryID, utils.AccessView) {
+		return
+	}
 
-	if err := database.DB.Save(&chart).Error; err != nil {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// Charts created before versioning get their previous state recorded first
+		if err := utils.EnsureChartBaseline(tx, &chart); err != nil {
+			return err
+		}
+		if req.Name != nil {
+			chart.Name = *req.Name
+		}
+		if req.Type != nil {
+			chart.Type = *req.Type
+		}
+		if req.QueryID != nil {
+			chart.QueryID = *req.QueryID
+		}
+		if req.Config != nil {
+			chart.Config = *req.Config
+		}
+		if req.Data != nil {
+			chart.Data = *req.Data
+		}
+		if req.Description != nil {
+			chart.Description = *req.Description
+		}
+		if err := tx.Save(&chart).Error; err != nil {
+			return err
+		}
+		_, err := utils.RecordChartVersion(tx, &chart, userID.(uint), "")
+		return err
+	})
+	if err != nil {
 		c.Error(errors.WrapError(err, "Could not update chart"))
 		return
 	}
@@ -567,10 +1007,7 @@ func DeleteChart(c *gin.Context) {
 		return
 	}
 
-	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
-	if role.(string) != "admin" && chart.UserID != userID.(uint) {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.ChartResource(chart), utils.AccessOwn) {
 		return
 	}
 
@@ -598,36 +1035,43 @@ func CreateTemplate(c *gin.Context) {
 		}
 		return
 	}
-	openedFile, err := file.Open()
-	if err != nil {
+	content, placeholders, customErr := readTemplateUpload(file)
+	if customErr != nil {
 		utils.Logger.WithFields(map[string]interface{}{
-			"action": "create_template",
-			"userID": c.GetUint("userID"),
-			"error":  err.Error(),
-		}).Error("Create template: open file failed")
-		c.Error(errors.WrapError(err, "Could not open file"))
+			"action":   "create_template",
+			"userID":   c.GetUint("userID"),
+			"filename": file.Filename,
+			"error":    customErr.Error(),
+		}).Warn("Create template: invalid template file")
+		c.Error(customErr)
 		return
 	}
-	defer openedFile.Close()
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" {
+		name = file.Filename
+	}
 	desc := c.PostForm("description")
+	if !requireCreate(c, utils.ResourceTemplate) {
+		return
+	}
 	template := models.ExcelTemplate{
-		Name:        file.Filename,
-		UserID:      c.GetUint("userID"),
-		Template:    make([]byte, file.Size),
-		Description: desc,
+		Name:           name,
+		UserID:         c.GetUint("userID"),
+		OrganizationID: c.GetUint("orgID"),
+		Description:    desc,
+		Placeholders:   placeholders,
 	}
-	if file.Size > 0 {
-		if _, err := openedFile.Read(template.Template); err != nil && err.Error() != "EOF" {
-			utils.Logger.WithFields(map[string]interface{}{
-				"action": "create_template",
-				"userID": c.GetUint("userID"),
-				"error":  err.Error(),
-			}).Error("Create template: read file failed")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read file: " + err.Error()})
-			return
-		}
+	if _, err := utils.StoreTemplateContent(&template, content); err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action": "create_template",
+			"userID": c.GetUint("userID"),
+			"error":  err.Error(),
+		}).Error("Create template: storage error")
+		c.Error(errors.WrapError(err, "Could not store template file"))
+		return
 	}
 	if err := database.DB.Create(&template).Error; err != nil {
+		utils.RemoveStoredContent(template.StorageKey)
 		utils.Logger.WithFields(map[string]interface{}{
 			"action": "create_template",
 			"userID": c.GetUint("userID"),
@@ -645,15 +1089,59 @@ func CreateTemplate(c *gin.Context) {
 	c.JSON(http.StatusCreated, template)
 }
 
-func ListTemplates(c *gin.Context) {
-	var templates []models.ExcelTemplate
-	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
+// readTemplateUpload reads an uploaded template and validates its extension, size and contents,
+// returning the file bytes and the placeholders it declares as JSON
+func readTemplateUpload(file *multipart.FileHeader) ([]byte, string, *errors.CustomError) {
+	if strings.ToLower(filepath.Ext(file.Filename)) != ".xlsx" {
+		return nil, "", errors.NewBadRequestError("Template must be an .xlsx file", nil)
+	}
+	if file.Size == 0 {
+		return nil, "", errors.NewBadRequestError("Template file is empty", nil)
+	}
+	if file.Size > maxTemplateSize {
+		return nil, "", errors.NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Template exceeds the %d MB size limit", maxTemplateSize>>20), nil)
+	}
 
-	query := database.DB.Model(&models.ExcelTemplate{})
-	if role.(string) != "admin" {
-		query = query.Where("user_id = ?", userID)
+	openedFile, err := file.Open()
+	if err != nil {
+		return nil, "", errors.WrapError(err, "Could not open file")
+	}
+	defer openedFile.Close()
+	content, err := io.ReadAll(io.LimitReader(openedFile, maxTemplateSize+1))
+	if err != nil {
+		return nil, "", errors.WrapError(err, "Could not read file")
+	}
+	if len(content) > maxTemplateSize {
+		return nil, "", errors.NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Template exceeds the %d MB size limit", maxTemplateSize>>20), nil)
+	}
+
+	// XLSX files are zip archives
+	if !bytes.HasPrefix(content, []byte("PK\x03\x04")) {
+		return nil, "", errors.NewBadRequestError("Template is not a valid XLSX file", nil)
+	}
+	_, placeholders, err := utils.InspectTemplate(content)
+	if err != nil {
+		return nil, "", errors.NewBadRequestError("Template is not a valid XLSX file", err)
+	}
+	if placeholders == nil {
+		placeholders = []utils.TemplatePlaceholder{}
 	}
+	encoded, _ := json.Marshal(placeholders)
+	return content, string(encoded), nil
+}
+
+// templatePlaceholders decodes the stored placeholder list for API responses
+func templatePlaceholders(t models.ExcelTemplate) []utils.TemplatePlaceholder {
+	placeholders := []utils.TemplatePlaceholder{}
+	if t.Placeholders != "" {
+		_ = json.Unmarshal([]byte(t.Placeholders), &placeholders)
+	}
+	return placeholders
+}
+
+func ListTemplates(c *gin.Context) {
+	var templates []models.ExcelTemplate
+	query := database.DB.Model(&models.ExcelTemplate{}).Scopes(subject(c).Visible(utils.ResourceTemplate, "id", false))
 
 	if err := query.Find(&templates).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch templates"})
@@ -664,11 +1152,12 @@ func ListTemplates(c *gin.Context) {
 	result := make([]map[string]interface{}, 0, len(templates))
 	for _, t := range templates {
 		result = append(result, map[string]interface{}{
-			"id":          t.ID,
-			"name":        t.Name,
-			"user_id":     t.UserID,
-			"created_at":  t.CreatedAt,
-			"description": t.Description,
+			"id":           t.ID,
+			"name":         t.Name,
+			"user_id":      t.UserID,
+			"created_at":   t.CreatedAt,
+			"description":  t.Description,
+			"placeholders": templatePlaceholders(t),
 		})
 	}
 	c.JSON(http.StatusOK, result)
@@ -682,19 +1171,17 @@ func GetTemplate(c *gin.Context) {
 		return
 	}
 
-	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
-	if role.(string) != "admin" && template.UserID != userID.(uint) {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.TemplateResource(template), utils.AccessView) {
 		return
 	}
 
 	c.JSON(http.StatusOK, map[string]interface{}{
-		"id":          template.ID,
-		"name":        template.Name,
-		"user_id":     template.UserID,
-		"created_at":  template.CreatedAt,
-		"description": template.Description,
+		"id":           template.ID,
+		"name":         template.Name,
+		"user_id":      template.UserID,
+		"created_at":   template.CreatedAt,
+		"description":  template.Description,
+		"placeholders": templatePlaceholders(template),
 	})
 }
 
@@ -706,9 +1193,7 @@ func UpdateTemplate(c *gin.Context) {
 		return
 	}
 
-	userID, _ := c.Get("userID")
-	if template.UserID != userID.(uint) {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.TemplateResource(template), utils.AccessEdit) {
 		return
 	}
 
@@ -722,24 +1207,33 @@ func UpdateTemplate(c *gin.Context) {
 		return
 	}
 
-	openedFile, err := file.Open()
-	if err != nil {
-		c.Error(errors.WrapError(err, "Could not open file"))
+	content, placeholders, customErr := readTemplateUpload(file)
+	if customErr != nil {
+		c.Error(customErr)
 		return
 	}
-	defer openedFile.Close()
 
-	template.Name = file.Filename
-	template.Template = make([]byte, file.Size)
-	if _, err := openedFile.Read(template.Template); err != nil {
-		c.Error(errors.WrapError(err, "Could not read file"))
+	if name := strings.TrimSpace(c.PostForm("name")); name != "" {
+		template.Name = name
+	}
+	if desc, ok := c.GetPostForm("description"); ok {
+		template.Description = desc
+	}
+	template.Placeholders = placeholders
+	oldKey, err := utils.StoreTemplateContent(&template, content)
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not store template file"))
 		return
 	}
 
 	if err := database.DB.Save(&template).Error; err != nil {
+		utils.RemoveStoredContent(template.StorageKey)
 		c.Error(errors.WrapError(err, "Could not update template"))
 		return
 	}
+	if oldKey != "" {
+		utils.RemoveStoredContent(oldKey)
+	}
 
 	c.JSON(http.StatusOK, template)
 }
@@ -752,12 +1246,7 @@ func DeleteTemplate(c *gin.Context) {
 		return
 	}
 
-	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
-
-	// 权限检查：管理员可以删除所有模板，普通用户只能删除自己的模板
-	if role.(string) != "admin" && template.UserID != userID.(uint) {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.TemplateResource(template), utils.AccessOwn) {
 		return
 	}
 
@@ -778,22 +1267,131 @@ func DownloadTemplate(c *gin.Context) {
 		return
 	}
 
-	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
+	if !authorize(c, utils.TemplateResource(template), utils.AccessView) {
+		return
+	}
 
-	// 权限检查：管理员可以下载所有模板，普通用户只能下载自己的模板
-	if role.(string) != "admin" && template.UserID != userID.(uint) {
-		c.Error(errors.ErrForbidden)
+	content, err := utils.LoadTemplateContent(template)
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not read template file"))
 		return
 	}
 
 	// 设置响应头，告诉浏览器这是一个文件下载
 	c.Header("Content-Disposition", "attachment; filename="+template.Name)
 	c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
-	c.Header("Content-Length", fmt.Sprintf("%d", len(template.Template)))
+	c.Header("Content-Length", fmt.Sprintf("%d", len(content)))
 
 	// 写入文件内容
-	c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", template.Template)
+	c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", content)
+}
+
+// PreviewTemplate fills a template with sample or live query data and returns the workbook without creating a report
+func PreviewTemplate(c *gin.Context) {
+	id := c.Param("id")
+	var template models.ExcelTemplate
+	if err := database.DB.First(&template, id).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+
+	userID := c.GetUint("userID")
+	if !authorize(c, utils.TemplateResource(template), utils.AccessExecute) {
+		return
+	}
+
+	// Sample data is keyed by query ID; anchors without sample data run the live query
+	var req struct {
+		Params     map[string]string `json:"params"`
+		Limit      int               `json:"limit"`
+		SampleData map[string]struct {
+			Columns []string        `json:"columns"`
+			Rows    [][]interface{} `json:"rows"`
+		} `json:"sample_data"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.Error(errors.NewBadRequestError("Invalid preview request", err))
+			return
+		}
+	}
+	if req.Limit <= 0 || req.Limit > maxPreviewRows {
+		req.Limit = defaultPreviewRows
+	}
+	if req.Params == nil {
+		req.Params = map[string]string{}
+	}
+	if _, ok := req.Params["name"]; !ok {
+		req.Params["name"] = template.Name
+	}
+
+	runQuery := func(queryID uint) ([]string, []map[string]interface{}, error) {
+		if sample, ok := req.SampleData[strconv.FormatUint(uint64(queryID), 10)]; ok {
+			rows := make([]map[string]interface{}, 0, len(sample.Rows))
+			for _, values := range sample.Rows {
+				row := make(map[string]interface{}, len(sample.Columns))
+				for i, col := range sample.Columns {
+					if i < len(values) {
+						row[col] = values[i]
+					}
+				}
+				rows = append(rows, row)
+			}
+			return sample.Columns, rows, nil
+		}
+
+		var query models.Query
+		if err := database.DB.First(&query, queryID).Error; err != nil {
+			return nil, nil, fmt.Errorf("query %d not found", queryID)
+		}
+		if !subject(c).Can(utils.QueryResource(query), utils.AccessExecute) {
+			auditDenied(c, utils.ResourceQuery, query.ID, map[string]interface{}{"access": utils.AccessExecute, "template_id": template.ID})
+			return nil, nil, fmt.Errorf("access to query %d denied", queryID)
+		}
+		started := time.Now()
+		// Only the rows the preview shows are read from the data source
+		columns, results, err := utils.RunSavedQueryWithLimit(query, req.Params, subject(c), req.Limit)
+		// Live queries of a preview are audited like any other execution
+		event := auditEvent(c, "query.execute", utils.ResourceQuery, query.ID)
+		details := map[string]interface{}{
+			"data_source_id": query.DataSourceID,
+			"sql_hash":       utils.SQLHash(query.SQL),
+			"template_id":    template.ID,
+			"limit":          req.Limit,
+			"duration_ms":    time.Since(started).Milliseconds(),
+		}
+		if err != nil {
+			event.Outcome = utils.AuditFailure
+			details["error"] = err.Error()
+			utils.RecordAudit(event, details)
+			return nil, nil, err
+		}
+		details["rows"] = len(results)
+		utils.RecordAudit(event, details)
+		return columns, results, nil
+	}
+
+	file, err := utils.LoadTemplateContent(template)
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not read template file"))
+		return
+	}
+	content, err := utils.PreviewTemplate(file, time.Now(), req.Params, runQuery)
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":     "preview_template",
+			"userID":     userID,
+			"templateID": template.ID,
+			"error":      err.Error(),
+		}).Warn("Preview template failed")
+		c.Error(errors.NewError(http.StatusUnprocessableEntity, "Could not fill template", err))
+		return
+	}
+
+	fileName := strings.TrimSuffix(template.Name, filepath.Ext(template.Name)) + "_preview.xlsx"
+	c.Header("Content-Disposition", "attachment; filename="+fileName)
+	c.Header("Content-Length", fmt.Sprintf("%d", len(content)))
+	c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", content)
 }
 
 // DataSource handlers
@@ -816,8 +1414,12 @@ func CreateDataSource(c *gin.Context) {
 		}
 		return
 	}
+	if !requireCreate(c, utils.ResourceDataSource) {
+		return
+	}
 	userID, _ := c.Get("userID")
 	dataSource.UserID = userID.(uint)
+	dataSource.OrganizationID = c.GetUint("orgID")
 	// 加密密码
 	if dataSource.Password != "" {
 		encrypted, err := utils.EncryptAES(dataSource.Password)
@@ -842,6 +1444,9 @@ func CreateDataSource(c *gin.Context) {
 		return
 	}
 	utils.QueryCache.Flush()
+	event := auditEvent(c, "datasource.create", utils.ResourceDataSource, dataSource.ID)
+	event.Changes = utils.AuditChanges(nil, dataSourceAuditFields(dataSource))
+	utils.RecordAudit(event, nil)
 	utils.Logger.WithFields(map[string]interface{}{
 		"action":       "create_datasource",
 		"userID":       userID,
@@ -853,13 +1458,7 @@ func CreateDataSource(c *gin.Context) {
 
 func ListDataSources(c *gin.Context) {
 	var dataSources []models.DataSource
-	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
-
-	query := database.DB.Model(&models.DataSource{})
-	if role.(string) != "admin" {
-		query = query.Where("user_id = ? OR is_public = ?", userID, true)
-	}
+	query := database.DB.Model(&models.DataSource{}).Scopes(subject(c).Visible(utils.ResourceDataSource, "id", true))
 
 	if err := query.Find(&dataSources).Error; err != nil {
 		c.Error(errors.WrapError(err, "Could not fetch data sources"))
@@ -882,10 +1481,7 @@ func GetDataSource(c *gin.Context) {
 		return
 	}
 
-	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
-	if role.(string) != "admin" && dataSource.UserID != userID.(uint) && !dataSource.IsPublic {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.DataSourceResource(dataSource), utils.AccessView) {
 		return
 	}
 
@@ -903,10 +1499,7 @@ func UpdateDataSource(c *gin.Context) {
 		return
 	}
 
-	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
-	if role.(string) != "admin" && dataSource.UserID != userID.(uint) {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.DataSourceResource(dataSource), utils.AccessEdit) {
 		return
 	}
 
@@ -934,7 +1527,12 @@ func UpdateDataSource(c *gin.Context) {
 		}
 		return
 	}
+	// Changing the visibility shares the data source, which needs own access
+	if updateData.IsPublic != dataSource.IsPublic && !authorize(c, utils.DataSourceResource(dataSource), utils.AccessOwn) {
+		return
+	}
 
+	before := dataSourceAuditFields(dataSource)
 	// 更新字段
 	dataSource.Name = updateData.Name
 	dataSource.Type = updateData.Type
@@ -961,6 +1559,9 @@ func UpdateDataSource(c *gin.Context) {
 	}
 
 	utils.QueryCache.Flush()
+	event := auditEvent(c, "datasource.update", utils.ResourceDataSource, dataSource.ID)
+	event.Changes = utils.AuditChanges(before, dataSourceAuditFields(dataSource))
+	utils.RecordAudit(event, map[string]interface{}{"password_changed": updateData.Password != ""})
 
 	// 清除密码字段
 	dataSource.Password = ""
@@ -976,10 +1577,7 @@ func DeleteDataSource(c *gin.Context) {
 		return
 	}
 
-	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
-	if role.(string) != "admin" && dataSource.UserID != userID.(uint) {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.DataSourceResource(dataSource), utils.AccessOwn) {
 		return
 	}
 
@@ -1001,10 +1599,28 @@ func DeleteDataSource(c *gin.Context) {
 	}
 
 	utils.QueryCache.Flush()
+	event := auditEvent(c, "datasource.delete", utils.ResourceDataSource, dataSource.ID)
+	event.Changes = utils.AuditChanges(dataSourceAuditFields(dataSource), nil)
+	utils.RecordAudit(event, nil)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Data source deleted successfully"})
 }
 
+// dataSourceAuditFields returns the fields of a data source recorded in audit changes; the password is
+// left out
+func dataSourceAuditFields(ds models.DataSource) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        ds.Name,
+		"type":        ds.Type,
+		"host":        ds.Host,
+		"port":        ds.Port,
+		"database":    ds.Database,
+		"username":    ds.Username,
+		"description": ds.Description,
+		"is_public":   ds.IsPublic,
+	}
+}
+
 // 辅助函数：加密密码
 func encryptPassword(password string) (string, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -1014,14 +1630,14 @@ func encryptPassword(password string) (string, error) {
 	return string(hashedPassword), nil
 }
 
-func cacheKeyForListQueries(userID interface{}, role interface{}) string {
-	key := "list_queries:" + toString(userID) + ":" + toString(role)
+func cacheKeyForListQueries(userID interface{}, role interface{}, orgID interface{}) string {
+	key := "list_queries:" + toString(userID) + ":" + toString(role) + ":" + toString(orgID)
 	h := sha256.Sum256([]byte(key))
 	return hex.EncodeToString(h[:])
 }
 
-func cacheKeyForGetQuery(id string, userID interface{}, role interface{}) string {
-	key := "get_query:" + id + ":" + toString(userID) + ":" + toString(role)
+func cacheKeyForGetQuery(id string, userID interface{}, role interface{}, orgID interface{}) string {
+	key := "get_query:" + id + ":" + toString(userID) + ":" + toString(role) + ":" + toString(orgID)
 	h := sha256.Sum256([]byte(key))
 	return hex.EncodeToString(h[:])
 }
@@ -1041,9 +1657,7 @@ func toString(v interface{}) string {
 
 // 管理员手动清理缓存接口
 func ClearCache(c *gin.Context) {
-	role, _ := c.Get("role")
-	if role.(string) != "admin" {
-		c.Error(errors.ErrForbidden)
+	if !requirePermission(c, utils.PermClearCache) {
 		return
 	}
 	var req struct {
@@ -1084,28 +1698,31 @@ func DashboardStats(c *gin.Context) {
 	var totalUsers int64
 	var todayQueries int64
 
+	// 统计范围为当前组织
+	orgID := c.GetUint("orgID")
 	today := time.Now().Format("2006-01-02")
-	database.DB.Model(&models.Query{}).Count(&totalQueries)
-	database.DB.Model(&models.Chart{}).Count(&totalCharts)
-	database.DB.Model(&models.User{}).Count(&totalUsers)
-	database.DB.Model(&models.Query{}).Where("DATE(created_at) = ?", today).Count(&todayQueries)
+	database.DB.Model(&models.Query{}).Where("organization_id = ?", orgID).Count(&totalQueries)
+	database.DB.Model(&models.Chart{}).Where("organization_id = ?", orgID).Count(&totalCharts)
+	database.DB.Model(&models.OrganizationMember{}).Where("organization_id = ?", orgID).Count(&totalUsers)
+	database.DB.Model(&models.Query{}).Where("organization_id = ? AND DATE(created_at) = ?", orgID, today).Count(&todayQueries)
 
 	// 查询趋势（最近7天每天的查询数）
 	queryTrends := []map[string]interface{}{}
 	for i := 6; i >= 0; i-- {
 		date := time.Now().AddDate(0, 0, -i).Format("2006-01-02")
 		var count int64
-		database.DB.Model(&models.Query{}).Where("DATE(created_at) = ?", date).Count(&count)
+		database.DB.Model(&models.Query{}).Where("organization_id = ? AND DATE(created_at) = ?", orgID, date).Count(&count)
 		queryTrends = append(queryTrends, map[string]interface{}{"date": date, "count": count})
 	}
 
-	// 热门查询（执行次数最多的前5个查询）
+	// 热门查询（执行次数最多的前5个查询），仅包含当前用户可查看的查询
 	type HotQuery struct {
 		Name  string
 		Count int64
 	}
 	hotQueries := []HotQuery{}
-	database.DB.Table("queries").Select("name, exec_count as count").Order("exec_count desc").Limit(5).Scan(&hotQueries)
+	database.DB.Model(&models.Query{}).Scopes(subject(c).Visible(utils.ResourceQuery, "id", true)).
+		Select("name, exec_count as count").Order("exec_count desc").Limit(5).Scan(&hotQueries)
 
 	c.JSON(http.StatusOK, gin.H{
 		"totalQueries": totalQueries,
@@ -1119,11 +1736,10 @@ func DashboardStats(c *gin.Context) {
 
 // List users handler
 func ListUsers(c *gin.Context) {
-	role, _ := c.Get("role")
 	userID, _ := c.Get("userID")
 	var dbUsers []models.User
 
-	if role.(string) == "admin" {
+	if subject(c).HasPermission(utils.PermManageUsers) {
 		if err := database.DB.Find(&dbUsers).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch users"})
 			return
@@ -1136,28 +1752,31 @@ func ListUsers(c *gin.Context) {
 	}
 
 	var users []struct {
-		ID        uint      `json:"id"`
-		Username  string    `json:"username"`
-		Email     string    `json:"email"`
-		Role      string    `json:"role"`
-		CreatedAt time.Time `json:"created_at"`
-		LastLogin time.Time `json:"last_login"`
+		ID               uint      `json:"id"`
+		Username         string    `json:"username"`
+		Email            string    `json:"email"`
+		Role             string    `json:"role"`
+		CreatedAt        time.Time `json:"created_at"`
+		LastLogin        time.Time `json:"last_login"`
+		IsServiceAccount bool      `json:"is_service_account"`
 	}
 	for _, u := range dbUsers {
 		users = append(users, struct {
-			ID        uint      `json:"id"`
-			Username  string    `json:"username"`
-			Email     string    `json:"email"`
-			Role      string    `json:"role"`
-			CreatedAt time.Time `json:"created_at"`
-			LastLogin time.Time `json:"last_login"`
+			ID               uint      `json:"id"`
+			Username         string    `json:"username"`
+			Email            string    `json:"email"`
+			Role             string    `json:"role"`
+			CreatedAt        time.Time `json:"created_at"`
+			LastLogin        time.Time `json:"last_login"`
+			IsServiceAccount bool      `json:"is_service_account"`
 		}{
-			ID:        u.ID,
-			Username:  u.Username,
-			Email:     u.Email,
-			Role:      u.Role,
-			CreatedAt: u.CreatedAt,
-			LastLogin: u.LastLogin,
+			ID:               u.ID,
+			Username:         u.Username,
+			Email:            u.Email,
+			Role:             u.Role,
+			CreatedAt:        u.CreatedAt,
+			LastLogin:        u.LastLogin,
+			IsServiceAccount: u.IsServiceAccount,
 		})
 	}
 	c.JSON(http.StatusOK, users)
@@ -1168,13 +1787,16 @@ func UpdateUser(c *gin.Context) {
 	id := c.Param("id")
 	userID, _ := c.Get("userID")
 	role, _ := c.Get("role")
-	if role.(string) != "admin" && toString(userID) != id {
+	canManage := subject(c).HasPermission(utils.PermManageUsers)
+	if !canManage && toString(userID) != id {
 		utils.Logger.WithFields(map[string]interface{}{
 			"action":   "update_user",
 			"userID":   userID,
 			"targetID": id,
 			"role":     role,
 			"error":    "forbidden (only admin or self)"}).Warn("Update user: forbidden (only admin or self)")
+		targetID, _ := strconv.ParseUint(id, 10, 64)
+		auditDenied(c, "user", uint(targetID), map[string]interface{}{"permission": utils.PermManageUsers})
 		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
 		return
 	}
@@ -1183,6 +1805,10 @@ func UpdateUser(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
+	if perm := targetPermissionNotHeld(c, user); perm != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("User has permission %q, which you do not hold", perm)})
+		return
+	}
 	var req struct {
 		Username string `json:"username"`
 		Email    string `json:"email"`
@@ -1193,46 +1819,121 @@ func UpdateUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
+	before := userAuditFields(user)
 	if req.Username != "" {
 		user.Username = req.Username
 	}
 	if req.Email != "" {
 		user.Email = req.Email
 	}
+	// Tokens carry the role, so a role or password change signs the user out everywhere
+	revokeReason := ""
 	if req.Role != "" {
-		if role.(string) != "admin" {
+		if !canManage {
+			auditDenied(c, "user", user.ID, map[string]interface{}{"permission": utils.PermManageUsers, "role": req.Role})
 			c.JSON(http.StatusForbidden, gin.H{"error": "Only admin can change role"})
 			return
 		}
+		if !utils.RoleExists(req.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown role %q", req.Role)})
+			return
+		}
+		if req.Role != user.Role {
+			// Role changes cannot raise anyone above the caller: the caller's own role is fixed, and both
+			// the current and the new role may only hold permissions the caller holds
+			if user.ID == c.GetUint("userID") {
+				auditDenied(c, "user", user.ID, map[string]interface{}{"role": req.Role, "reason": "own role"})
+				c.JSON(http.StatusForbidden, gin.H{"error": "You cannot change your own role"})
+				return
+			}
+			perms := append(append([]string{}, utils.RolePermissions(user.Role)...), utils.RolePermissions(req.Role)...)
+			if perm := subject(c).UngrantablePermission(perms); perm != "" {
+				auditDenied(c, "user", user.ID, map[string]interface{}{"role": req.Role, "permission": perm, "reason": "not held"})
+				c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Role change needs permission %q, which you do not hold", perm)})
+				return
+			}
+			revokeReason = "role changed"
+		}
 		user.Role = req.Role
 	}
 	if req.Password != "" {
-		hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not hash password"})
+		hashed, ok := hashNewPassword(c, user, req.Password)
+		if !ok {
 			return
 		}
-		user.Password = string(hashed)
+		user.Password = hashed
+		revokeReason = "password changed"
 	}
 	if err := database.DB.Save(&user).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update user"})
 		return
 	}
+	if req.Password != "" {
+		utils.RecordPasswordHistory(user.ID, user.Password)
+	}
+	event := auditEvent(c, "user.update", "user", user.ID)
+	event.Changes = utils.AuditChanges(before, userAuditFields(user))
+	utils.RecordAudit(event, map[string]interface{}{"password_changed": req.Password != ""})
+	if revokeReason != "" && !revokeUserSessions(c, user.ID, revokeReason) {
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "User updated successfully"})
 }
 
+// userAuditFields returns the fields of a user recorded in audit changes; password hashes are left out
+func userAuditFields(user models.User) map[string]interface{} {
+	return map[string]interface{}{
+		"username": user.Username,
+		"email":    user.Email,
+		"role":     user.Role,
+	}
+}
+
+// targetPermissionNotHeld returns a permission that another user's role holds and the caller does not,
+// recording the denial. Managing such a user, by editing, resetting or deleting it, could be used to take
+// over its account, so user managers can only manage users they outrank, as when registering users.
+func targetPermissionNotHeld(c *gin.Context, target models.User) string {
+	if target.ID == c.GetUint("userID") {
+		return ""
+	}
+	perm := subject(c).UngrantablePermission(utils.RolePermissions(target.Role))
+	if perm != "" {
+		auditDenied(c, "user", target.ID, map[string]interface{}{"role": target.Role, "permission": perm, "reason": "not held"})
+	}
+	return perm
+}
+
+// hashNewPassword checks a new password of a user against the password policy and recent passwords and
+// hashes it, reporting 400 for a rejected password
+func hashNewPassword(c *gin.Context, user models.User, password string) (string, bool) {
+	hashed, err := utils.HashPassword(user, password)
+	var policyErr *utils.PasswordPolicyError
+	if errors.As(err, &policyErr) || errors.Is(err, utils.ErrPasswordReused) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not hash password"})
+		return "", false
+	}
+	return hashed, true
+}
+
 // Reset user password handler
 func ResetUserPassword(c *gin.Context) {
 	id := c.Param("id")
 	userID, _ := c.Get("userID")
 	role, _ := c.Get("role")
-	if role.(string) != "admin" && toString(userID) != id {
+	canManage := subject(c).HasPermission(utils.PermManageUsers)
+	if !canManage && toString(userID) != id {
 		utils.Logger.WithFields(map[string]interface{}{
 			"action":   "reset_password",
 			"userID":   userID,
 			"targetID": id,
 			"role":     role,
 			"error":    "forbidden (only admin or self)"}).Warn("Reset password: forbidden (only admin or self)")
+		targetID, _ := strconv.ParseUint(id, 10, 64)
+		auditDenied(c, "user", uint(targetID), map[string]interface{}{"permission": utils.PermManageUsers})
 		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
 		return
 	}
@@ -1241,6 +1942,10 @@ func ResetUserPassword(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
+	if perm := targetPermissionNotHeld(c, user); perm != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("User has permission %q, which you do not hold", perm)})
+		return
+	}
 	var req struct {
 		Password string `json:"password" binding:"required"`
 	}
@@ -1248,16 +1953,20 @@ func ResetUserPassword(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
 		return
 	}
-	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not hash password"})
+	hashed, ok := hashNewPassword(c, user, req.Password)
+	if !ok {
 		return
 	}
-	user.Password = string(hashed)
+	user.Password = hashed
 	if err := database.DB.Save(&user).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reset password"})
 		return
 	}
+	utils.RecordPasswordHistory(user.ID, hashed)
+	utils.RecordAudit(auditEvent(c, "user.password_reset", "user", user.ID), map[string]interface{}{"username": user.Username})
+	if !revokeUserSessions(c, user.ID, "password reset") {
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
 }
 
@@ -1269,11 +1978,7 @@ func ExecuteQuery(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Query not found"})
 		return
 	}
-	// 权限校验：仅本人或公开或管理员可执行
-	userID, _ := c.Get("userID")
-	role, _ := c.Get("role")
-	if role.(string) != "admin" && query.UserID != userID.(uint) && !query.IsPublic {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+	if !authorize(c, utils.QueryResource(query), utils.AccessExecute) {
 		return
 	}
 	// 连接数据源并执行 SQL
@@ -1286,12 +1991,50 @@ func ExecuteQuery(c *gin.Context) {
 		}
 		query.DataSource.Password = pwd
 	}
-	result, err := utils.ExecuteSQL(query.DataSource, query.SQL)
+	// {{name}} parameters are bound from params[name]=value query string arguments
+	sqlStr, args, err := utils.BindQueryParams(query.DataSource.Type, query.SQL, c.QueryMap("params"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Row policies of the query and its data source filter the rows by the user's attributes
+	filters, err := utils.RowFilters(subject(c), query)
+	if errors.Is(err, utils.ErrRowPolicyEditor) {
+		auditDenied(c, utils.ResourceQuery, query.ID, map[string]interface{}{"reason": "row policies"})
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not load row policies"})
+		return
+	}
+	params := len(args)
+	sqlStr, args = utils.WrapRowFilters(query.DataSource.Type, sqlStr, args, filters)
+	started := time.Now()
+	_, result, err := utils.ExecuteSQLWithColumns(query.DataSource, sqlStr, args...)
+	err = utils.RowFilterError(err, filters)
+	event := auditEvent(c, "query.execute", utils.ResourceQuery, query.ID)
+	details := map[string]interface{}{
+		"data_source_id": query.DataSourceID,
+		"sql_hash":       utils.SQLHash(query.SQL),
+		"params":         params,
+		"row_policies":   len(filters),
+		"duration_ms":    time.Since(started).Milliseconds(),
+	}
+	if err != nil {
+		event.Outcome = utils.AuditFailure
+		details["error"] = err.Error()
+		utils.RecordAudit(event, details)
 		fmt.Printf("Error: %s\n", err.Error())
+		if errors.Is(err, utils.ErrRowPolicyColumns) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	details["rows"] = len(result)
+	utils.RecordAudit(event, details)
 	// 执行次数+1
 	query.ExecCount++
 	database.DB.Save(&query)
@@ -1313,7 +2056,7 @@ func DeleteUser(c *gin.Context) {
 
 	userID, _ := c.Get("userID")
 	role, _ := c.Get("role")
-	if role.(string) != "admin" {
+	if !subject(c).HasPermission(utils.PermManageUsers) {
 		utils.Logger.WithFields(map[string]interface{}{
 			"action":   "delete_user",
 			"userID":   userID,
@@ -1321,11 +2064,29 @@ func DeleteUser(c *gin.Context) {
 			"role":     role,
 			"error":    "forbidden (only admin can delete)",
 		}).Warn("Delete user: forbidden (only admin)")
+		auditDenied(c, "user", user.ID, map[string]interface{}{"permission": utils.PermManageUsers})
 		c.Error(errors.ErrForbidden)
 		return
 	}
+	if perm := targetPermissionNotHeld(c, user); perm != "" {
+		c.Error(errors.NewError(http.StatusForbidden, fmt.Sprintf("User has permission %q, which you do not hold", perm), nil))
+		return
+	}
 
-	if err := database.DB.Delete(&user).Error; err != nil {
+	// Memberships, attributes and grants to the user go with it; resources it owns are kept
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		for _, membership := range []interface{}{&models.GroupMember{}, &models.OrganizationMember{}, &models.TeamMember{}, &models.UserAttribute{}} {
+			if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(membership).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Where("subject_type = ? AND subject_id = ?", utils.GrantSubjectUser, user.ID).
+			Delete(&models.ResourceGrant{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
 		utils.Logger.WithFields(map[string]interface{}{
 			"action":   "delete_user",
 			"userID":   userID,
@@ -1336,6 +2097,9 @@ func DeleteUser(c *gin.Context) {
 		c.Error(errors.WrapError(err, "Could not delete user"))
 		return
 	}
+	if !revokeUserSessions(c, user.ID, "user deleted") {
+		return
+	}
 
 	utils.Logger.WithFields(map[string]interface{}{
 		"action":   "delete_user",
@@ -1343,6 +2107,9 @@ func DeleteUser(c *gin.Context) {
 		"targetID": user.ID,
 		"role":     role,
 	}).Info("User deleted")
+	event := auditEvent(c, "user.delete", "user", user.ID)
+	event.Changes = utils.AuditChanges(userAuditFields(user), nil)
+	utils.RecordAudit(event, nil)
 
 	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
 }
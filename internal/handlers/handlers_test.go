@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"gobi/internal/models"
+	"gobi/pkg/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+func userRoutes(api *gin.RouterGroup) {
+	api.PUT("/users/:id", UpdateUser)
+	api.POST("/users/:id/reset-password", ResetUserPassword)
+	api.DELETE("/users/:id", DeleteUser)
+}
+
+// A role holding only users.manage must not take over accounts with permissions it lacks
+func TestUserManagerCannotManageAdmin(t *testing.T) {
+	r := newTestRouter(t, userRoutes)
+	createTestRole(t, "user-manager", "users.manage")
+	admin, _ := createTestUser(t, "admin", "admin")
+	_, token := createTestUser(t, "manager", "user-manager")
+	path := fmt.Sprintf("/api/users/%d", admin.ID)
+
+	for _, req := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodPost, path + "/reset-password", map[string]string{"password": "N3w-Passw0rd!"}},
+		{http.MethodPut, path, map[string]string{"email": "attacker@example.com"}},
+		{http.MethodPut, path, map[string]string{"password": "N3w-Passw0rd!"}},
+		{http.MethodDelete, path, nil},
+	} {
+		if w := doRequest(r, req.method, req.path, token, req.body); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s = %d %s", req.method, req.path, w.Code, w.Body.String())
+		}
+	}
+
+	var after models.User
+	if err := database.DB.First(&after, admin.ID).Error; err != nil {
+		t.Fatalf("admin was deleted: %v", err)
+	}
+	if after.Password != admin.Password || after.Email != admin.Email {
+		t.Fatal("admin account was changed")
+	}
+	if n := deniedEvents(t, "user", admin.ID); n != 4 {
+		t.Fatalf("%d denied events recorded, want 4", n)
+	}
+}
+
+func TestUserManagerManagesLesserUsers(t *testing.T) {
+	r := newTestRouter(t, userRoutes)
+	createTestRole(t, "user-manager", "users.manage")
+	createTestRole(t, "guest")
+	guest, _ := createTestUser(t, "guest", "guest")
+	manager, token := createTestUser(t, "manager", "user-manager")
+
+	if w := doRequest(r, http.MethodPost, fmt.Sprintf("/api/users/%d/reset-password", guest.ID), token,
+		map[string]string{"password": "N3w-Passw0rd!"}); w.Code != http.StatusOK {
+		t.Fatalf("reset password = %d %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(r, http.MethodPut, fmt.Sprintf("/api/users/%d", manager.ID), token,
+		map[string]string{"email": "manager@example.org"}); w.Code != http.StatusOK {
+		t.Fatalf("update self = %d %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(r, http.MethodDelete, fmt.Sprintf("/api/users/%d", guest.ID), token, nil); w.Code != http.StatusOK {
+		t.Fatalf("delete = %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/errors"
+	"gobi/pkg/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func loginThrottleResponse(t models.LoginThrottle) gin.H {
+	kind, value, _ := strings.Cut(t.Target, ":")
+	return gin.H{
+		"id":           t.ID,
+		"type":         kind, // user or ip
+		"value":        value,
+		"failures":     t.Failures,
+		"lockouts":     t.Lockouts,
+		"locked":       t.LockedUntil != nil && t.LockedUntil.After(time.Now()),
+		"locked_until": t.LockedUntil,
+		"last_failure": t.LastFailure,
+	}
+}
+
+// ListLoginLockouts lists usernames and client IPs with failed logins, locked ones first
+func ListLoginLockouts(c *gin.Context) {
+	if !requirePermission(c, utils.PermManageUsers) {
+		return
+	}
+	query := database.DB.Model(&models.LoginThrottle{})
+	if c.Query("locked") == "true" {
+		query = query.Where("locked_until > ?", time.Now())
+	}
+	var throttles []models.LoginThrottle
+	if err := query.Order("locked_until DESC, last_failure DESC").Find(&throttles).Error; err != nil {
+		c.Error(errors.WrapError(err, "Could not fetch lockouts"))
+		return
+	}
+	result := make([]gin.H, 0, len(throttles))
+	for _, t := range throttles {
+		result = append(result, loginThrottleResponse(t))
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// DeleteLoginLockout unlocks a username or client IP and resets its failed logins
+func DeleteLoginLockout(c *gin.Context) {
+	if !requirePermission(c, utils.PermManageUsers) {
+		return
+	}
+	var throttle models.LoginThrottle
+	if err := database.DB.First(&throttle, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	unlockLogin(c, throttle.Target, 0)
+}
+
+// UnlockUser unlocks the login of a user locked after failed logins
+func UnlockUser(c *gin.Context) {
+	if !requirePermission(c, utils.PermManageUsers) {
+		return
+	}
+	var user models.User
+	if err := database.DB.First(&user, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	unlockLogin(c, utils.LoginThrottleKey(utils.LoginThrottleUser, user.Username), user.ID)
+}
+
+func unlockLogin(c *gin.Context, target string, userID uint) {
+	if err := utils.UnlockLogin(target); err != nil {
+		c.Error(errors.WrapError(err, "Could not unlock login"))
+		return
+	}
+
+	event := auditEvent(c, "login.unlock", "login", 0)
+	if userID != 0 {
+		event.ResourceType, event.ResourceID = "user", userID
+	}
+	utils.RecordAudit(event, map[string]interface{}{"target": target})
+	utils.Logger.WithFields(map[string]interface{}{
+		"action": "unlock_login",
+		"userID": c.GetUint("userID"),
+		"target": target,
+	}).Info("Login unlocked by admin")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Login unlocked successfully"})
+}
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/errors"
+	"gobi/pkg/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type mfaCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// startMFAChallenge begins the second login step for users with two-factor authentication, returning
+// the challenge token, or "" when the user can be issued tokens right away
+func startMFAChallenge(c *gin.Context, user models.User) (string, bool) {
+	if !utils.MFAEnabled(user.ID) {
+		return "", true
+	}
+	token, err := utils.CreateMFAChallenge(user.ID)
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not start two-factor challenge"))
+		return "", false
+	}
+	utils.Logger.WithFields(map[string]interface{}{
+		"action": "login",
+		"userID": user.ID,
+	}).Info("Password accepted, waiting for second factor")
+	return token, true
+}
+
+func mfaChallengeResponse(token string) gin.H {
+	return gin.H{
+		"mfa_required": true,
+		"mfa_token":    token,
+		"expires_in":   int(utils.MFAChallengeLifetime.Seconds()),
+	}
+}
+
+// VerifyMFA completes a login with the code of the user's authenticator app or a recovery code
+func VerifyMFA(c *gin.Context) {
+	var req struct {
+		MFAToken string `json:"mfa_token" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("mfa_token and code are required", err))
+		return
+	}
+	// Wrong codes count as failed logins, so the lock of the user and client IP applies here as well
+	user, err := utils.MFAChallengeUser(req.MFAToken)
+	if err == nil && loginLocked(c, user, user.Username, "mfa") {
+		return
+	}
+	verified, err := utils.CompleteMFAChallenge(req.MFAToken, req.Code)
+	if err != nil {
+		if errors.Is(err, utils.ErrMFAInvalidCode) && user.ID != 0 {
+			utils.RecordLoginFailure(user.Username, c.ClientIP())
+		}
+		utils.Logger.WithFields(map[string]interface{}{
+			"action": "mfa_verify",
+			"userID": user.ID,
+			"error":  err.Error(),
+		}).Warn("Second factor rejected")
+		auditLogin(c, user, user.Username, "mfa", utils.AuditFailure, err.Error())
+		if errors.Is(err, utils.ErrMFAChallengeInvalid) {
+			c.Error(errors.NewError(http.StatusUnauthorized, "Two-factor challenge is invalid or expired, please sign in again", nil))
+		} else if errors.Is(err, utils.ErrMFAInvalidCode) || errors.Is(err, utils.ErrMFANotEnrolled) {
+			c.Error(errors.NewError(http.StatusUnauthorized, "Invalid two-factor code", nil))
+		} else {
+			c.Error(errors.WrapError(err, "Could not verify two-factor code"))
+		}
+		return
+	}
+	user = verified
+	// The account may have been disabled since the password step
+	if user.Disabled {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":   "mfa_verify",
+			"userID":   user.ID,
+			"username": user.Username,
+			"error":    "user disabled",
+		}).Warn("Login failed: user is disabled")
+		auditLogin(c, user, user.Username, "mfa", utils.AuditFailure, "user disabled")
+		c.Error(errors.ErrInvalidCredentials)
+		return
+	}
+	utils.RecordLoginSuccess(user.Username)
+
+	user.LastLogin = time.Now()
+	database.DB.Model(&user).Update("last_login", user.LastLogin)
+	pair, err := utils.IssueTokenPair(user, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not generate token"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":   "login",
+		"userID":   user.ID,
+		"role":     user.Role,
+		"username": user.Username,
+	}).Info("User login success")
+	auditLogin(c, user, user.Username, "mfa", utils.AuditSuccess, "")
+
+	c.JSON(http.StatusOK, tokenResponse(pair))
+}
+
+// GetMFAStatus shows whether the current user has two-factor authentication and whether the current
+// organization requires it
+func GetMFAStatus(c *gin.Context) {
+	userID := c.GetUint("userID")
+	var mfa models.UserMFA
+	database.DB.Where("user_id = ?", userID).Limit(1).Find(&mfa)
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":                  mfa.Enabled,
+		"enabled_at":               mfa.EnabledAt,
+		"pending":                  mfa.ID != 0 && !mfa.Enabled,
+		"recovery_codes_remaining": utils.RecoveryCodesRemaining(userID),
+		"required":                 utils.OrganizationRequiresMFA(c.GetUint("orgID")),
+	})
+}
+
+// EnrollMFA creates a TOTP secret for the current user and returns it with its provisioning URI and QR
+// code. Two-factor authentication is enabled by confirming a code with ConfirmMFA.
+func EnrollMFA(c *gin.Context) {
+	userID := c.GetUint("userID")
+	var user models.User
+	if err := database.DB.First(&user, userID).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	if user.IsServiceAccount {
+		c.Error(errors.NewBadRequestError("Service accounts cannot use two-factor authentication", nil))
+		return
+	}
+	secret, err := utils.BeginMFAEnrollment(userID)
+	if err != nil {
+		if errors.Is(err, utils.ErrMFAAlreadyEnabled) {
+			c.Error(errors.NewConflictError("Two-factor authentication is already enabled", nil))
+		} else {
+			c.Error(errors.WrapError(err, "Could not enroll two-factor authentication"))
+		}
+		return
+	}
+	uri := utils.MFAProvisioningURI(user.Username, secret)
+	qr, err := utils.MFAQRCode(uri)
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not render QR code"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": uri,
+		"qr_code":          qr,
+	})
+}
+
+// ConfirmMFA enables two-factor authentication with a first code from the authenticator app and returns
+// the recovery codes, which are shown only once
+func ConfirmMFA(c *gin.Context) {
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("code is required", err))
+		return
+	}
+	userID := c.GetUint("userID")
+	codes, err := utils.ConfirmMFAEnrollment(userID, req.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, utils.ErrMFANotEnrolled):
+			c.Error(errors.NewBadRequestError("Start enrollment first", nil))
+		case errors.Is(err, utils.ErrMFAAlreadyEnabled):
+			c.Error(errors.NewConflictError("Two-factor authentication is already enabled", nil))
+		case errors.Is(err, utils.ErrMFAInvalidCode):
+			c.Error(errors.NewBadRequestError("Invalid two-factor code", nil))
+		default:
+			c.Error(errors.WrapError(err, "Could not enable two-factor authentication"))
+		}
+		return
+	}
+
+	utils.RecordAudit(auditEvent(c, "mfa.enable", "user", userID), nil)
+	utils.Logger.WithFields(map[string]interface{}{
+		"action": "mfa_enable",
+		"userID": userID,
+	}).Info("Two-factor authentication enabled")
+
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "recovery_codes": codes})
+}
+
+// verifyCurrentUserMFA checks a code of the current user before a change to its second factor
+func verifyCurrentUserMFA(c *gin.Context) bool {
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("code is required", err))
+		return false
+	}
+	if err := utils.VerifyMFACode(c.GetUint("userID"), req.Code); err != nil {
+		if errors.Is(err, utils.ErrMFANotEnrolled) {
+			c.Error(errors.NewBadRequestError("Two-factor authentication is not enabled", nil))
+		} else if errors.Is(err, utils.ErrMFAInvalidCode) {
+			c.Error(errors.NewBadRequestError("Invalid two-factor code", nil))
+		} else {
+			c.Error(errors.WrapError(err, "Could not verify two-factor code"))
+		}
+		return false
+	}
+	return true
+}
+
+// DisableMFA turns off two-factor authentication for the current user, which needs a valid code.
+// Members of an organization requiring two-factor authentication cannot turn it off there.
+func DisableMFA(c *gin.Context) {
+	if utils.OrganizationRequiresMFA(c.GetUint("orgID")) {
+		c.Error(errors.NewError(http.StatusForbidden, "Two-factor authentication is required by this organization", nil))
+		return
+	}
+	if !verifyCurrentUserMFA(c) {
+		return
+	}
+	userID := c.GetUint("userID")
+	if err := utils.DisableMFA(userID); err != nil {
+		c.Error(errors.WrapError(err, "Could not disable two-factor authentication"))
+		return
+	}
+
+	utils.RecordAudit(auditEvent(c, "mfa.disable", "user", userID), nil)
+	utils.Logger.WithFields(map[string]interface{}{
+		"action": "mfa_disable",
+		"userID": userID,
+	}).Info("Two-factor authentication disabled")
+
+	c.JSON(http.StatusOK, gin.H{"enabled": false})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes, which needs a valid code
+func RegenerateRecoveryCodes(c *gin.Context) {
+	if !verifyCurrentUserMFA(c) {
+		return
+	}
+	codes, err := utils.RegenerateRecoveryCodes(c.GetUint("userID"))
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not generate recovery codes"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// ResetUserMFA removes the second factor of a user who lost it, so that the user can enroll again. The
+// reset signs the user out everywhere and is written to the audit log.
+func ResetUserMFA(c *gin.Context) {
+	if !requirePermission(c, utils.PermManageUsers) {
+		return
+	}
+	var user models.User
+	if err := database.DB.First(&user, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	if perm := targetPermissionNotHeld(c, user); perm != "" {
+		c.Error(errors.NewError(http.StatusForbidden, fmt.Sprintf("User has permission %q, which you do not hold", perm), nil))
+		return
+	}
+	hadMFA := utils.MFAEnabled(user.ID)
+	if err := utils.DisableMFA(user.ID); err != nil {
+		c.Error(errors.WrapError(err, "Could not reset two-factor authentication"))
+		return
+	}
+	if !revokeUserSessions(c, user.ID, "two-factor authentication reset") {
+		return
+	}
+
+	utils.RecordAudit(auditEvent(c, "mfa.reset", "user", user.ID),
+		map[string]interface{}{"username": user.Username, "had_mfa": hadMFA})
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":       "mfa_reset",
+		"userID":       c.GetUint("userID"),
+		"targetUserID": user.ID,
+	}).Warn("Two-factor authentication reset by admin")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication reset successfully"})
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// enableTestMFA enrolls a user in two-factor authentication and returns its recovery codes
+func enableTestMFA(t *testing.T, userID uint) []string {
+	t.Setenv("DATA_SOURCE_SECRET", "0123456789abcdef0123456789abcdef")
+	secret, err := utils.BeginMFAEnrollment(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var step [8]byte
+	binary.BigEndian.PutUint64(step[:], uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(step[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+
+	recovery, err := utils.ConfirmMFAEnrollment(userID, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recovery
+}
+
+func TestVerifyMFARejectsDisabledUser(t *testing.T) {
+	r := newTestRouter(t, func(api *gin.RouterGroup) {})
+	r.POST("/api/auth/mfa/verify", VerifyMFA)
+
+	active, _ := createTestUser(t, "active", "user")
+	disabled, _ := createTestUser(t, "disabled", "user")
+	sessions := func() int64 {
+		var count int64
+		database.DB.Model(&models.RefreshToken{}).Where("user_id = ?", disabled.ID).Count(&count)
+		return count
+	}
+	before := sessions()
+	for _, user := range []models.User{active, disabled} {
+		recovery := enableTestMFA(t, user.ID)
+		challenge, err := utils.CreateMFAChallenge(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Disabled between the password step and the second factor
+		if user.ID == disabled.ID {
+			database.DB.Model(&models.User{}).Where("id = ?", user.ID).Update("disabled", true)
+		}
+
+		w := doRequest(r, http.MethodPost, "/api/auth/mfa/verify", "", map[string]string{"mfa_token": challenge, "code": recovery[0]})
+		want := http.StatusOK
+		if user.ID == disabled.ID {
+			want = http.StatusUnauthorized
+		}
+		if w.Code != want {
+			t.Errorf("%s: verify = %d %s", user.Username, w.Code, w.Body.String())
+		}
+	}
+
+	if after := sessions(); after != before {
+		t.Fatalf("disabled user got %d new sessions", after-before)
+	}
+}
+
+func TestUserManagerCannotResetAdminMFA(t *testing.T) {
+	r := newTestRouter(t, func(api *gin.RouterGroup) {
+		api.POST("/users/:id/mfa/reset", ResetUserMFA)
+	})
+	createTestRole(t, "user-manager", "users.manage")
+	createTestRole(t, "guest")
+	admin, _ := createTestUser(t, "admin", "admin")
+	guest, _ := createTestUser(t, "guest", "guest")
+	_, token := createTestUser(t, "manager", "user-manager")
+	enableTestMFA(t, admin.ID)
+	enableTestMFA(t, guest.ID)
+
+	w := doRequest(r, http.MethodPost, fmt.Sprintf("/api/users/%d/mfa/reset", admin.ID), token, nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("reset admin = %d %s", w.Code, w.Body.String())
+	}
+	if !utils.MFAEnabled(admin.ID) {
+		t.Fatal("admin's second factor was removed")
+	}
+	if n := deniedEvents(t, "user", admin.ID); n != 1 {
+		t.Fatalf("%d denied events recorded, want 1", n)
+	}
+
+	if w := doRequest(r, http.MethodPost, fmt.Sprintf("/api/users/%d/mfa/reset", guest.ID), token, nil); w.Code != http.StatusOK {
+		t.Fatalf("reset guest = %d %s", w.Code, w.Body.String())
+	}
+	if utils.MFAEnabled(guest.ID) {
+		t.Fatal("guest's second factor was kept")
+	}
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"gobi/config"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/errors"
+	"gobi/pkg/utils"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// oidcStateCookie binds a login to the browser that started it, so that a callback URL with another
+// browser's state and code cannot sign a victim in to the attacker's account
+const (
+	oidcStateCookie     = "gobi_oidc_state"
+	oidcStateCookiePath = "/api/auth/oidc"
+)
+
+// setOIDCStateCookie stores the state of a login in the browser, or removes it when maxAge is negative
+func setOIDCStateCookie(c *gin.Context, state string, maxAge int) {
+	secure := c.Request.TLS != nil || strings.HasPrefix(config.AppConfig.OIDC.RedirectURL, "https://")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, maxAge, oidcStateCookiePath, "", secure, true)
+}
+
+// OIDCLogin starts single sign-on by redirecting the browser to the identity provider
+func OIDCLogin(c *gin.Context) {
+	if !config.AppConfig.OIDC.Enabled {
+		c.Error(errors.NewError(http.StatusNotFound, "Single sign-on is not enabled", nil))
+		return
+	}
+	authURL, state, err := utils.OIDCAuthURL()
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action": "oidc_login",
+			"error":  err.Error(),
+		}).Error("Could not start single sign-on")
+		c.Error(errors.NewError(http.StatusBadGateway, "Identity provider is unavailable", err))
+		return
+	}
+	setOIDCStateCookie(c, state, int(utils.OIDCStateLifetime.Seconds()))
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback completes single sign-on: the code returned by the identity provider is exchanged for an
+// ID token, the user is provisioned or updated from it, and a token pair is issued
+func OIDCCallback(c *gin.Context) {
+	if !config.AppConfig.OIDC.Enabled {
+		c.Error(errors.NewError(http.StatusNotFound, "Single sign-on is not enabled", nil))
+		return
+	}
+	if providerErr := c.Query("error"); providerErr != "" {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":      "oidc_callback",
+			"error":       providerErr,
+			"description": c.Query("error_description"),
+		}).Warn("Identity provider refused login")
+		c.Error(errors.NewError(http.StatusUnauthorized, "Login refused by identity provider: "+providerErr, nil))
+		auditLogin(c, models.User{}, "", "oidc", utils.AuditFailure, "provider error: "+providerErr)
+		return
+	}
+	state, code := c.Query("state"), c.Query("code")
+	if state == "" || code == "" {
+		c.Error(errors.NewBadRequestError("state and code are required", nil))
+		return
+	}
+	// The state must come back to the browser that started the login
+	cookie, _ := c.Cookie(oidcStateCookie)
+	setOIDCStateCookie(c, "", -1)
+	if subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action": "oidc_callback",
+			"error":  "state cookie mismatch",
+		}).Warn("Single sign-on failed: login was started in another browser")
+		auditLogin(c, models.User{}, "", "oidc", utils.AuditFailure, "state cookie mismatch")
+		c.Error(errors.NewBadRequestError("Login state is invalid or expired, please sign in again", nil))
+		return
+	}
+
+	identity, err := utils.CompleteOIDCLogin(state, code)
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action": "oidc_callback",
+			"error":  err.Error(),
+		}).Warn("Single sign-on failed")
+		auditLogin(c, models.User{}, "", "oidc", utils.AuditFailure, err.Error())
+		switch {
+		case errors.Is(err, utils.ErrOIDCStateInvalid):
+			c.Error(errors.NewBadRequestError("Login state is invalid or expired, please sign in again", nil))
+		case errors.Is(err, utils.ErrOIDCTokenRejected):
+			c.Error(errors.NewError(http.StatusUnauthorized, "Invalid ID token", nil))
+		default:
+			c.Error(errors.NewError(http.StatusBadGateway, "Identity provider is unavailable", err))
+		}
+		return
+	}
+
+	user, err := utils.ProvisionExternalUser(identity, config.AppConfig.OIDC.GroupMapping)
+	if err != nil {
+		if errors.Is(err, utils.ErrExternalAccountExists) {
+			utils.Logger.WithFields(map[string]interface{}{
+				"action":   "oidc_callback",
+				"username": identity.Username,
+				"email":    identity.Email,
+			}).Warn("Single sign-on failed: local account exists")
+			auditLogin(c, models.User{}, identity.Username, "oidc", utils.AuditFailure, err.Error())
+			c.Error(errors.NewConflictError("A local account with this username or email already exists", nil))
+			return
+		}
+		c.Error(errors.WrapError(err, "Could not provision user"))
+		return
+	}
+
+	mfaToken, ok := startMFAChallenge(c, user)
+	if !ok {
+		return
+	}
+	if mfaToken != "" {
+		if target := config.AppConfig.OIDC.PostLoginURL; target != "" {
+			fragment := url.Values{}
+			fragment.Set("mfa_token", mfaToken)
+			c.Redirect(http.StatusFound, target+"#"+fragment.Encode())
+			return
+		}
+		c.JSON(http.StatusOK, mfaChallengeResponse(mfaToken))
+		return
+	}
+
+	user.LastLogin = time.Now()
+	database.DB.Model(&user).Update("last_login", user.LastLogin)
+
+	pair, err := utils.IssueTokenPair(user, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not generate token"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":   "oidc_login",
+		"userID":   user.ID,
+		"role":     user.Role,
+		"username": user.Username,
+	}).Info("User login success")
+	auditLogin(c, user, user.Username, "oidc", utils.AuditSuccess, "")
+
+	if target := config.AppConfig.OIDC.PostLoginURL; target != "" {
+		// Tokens go in the fragment, which browsers do not send to servers or in Referer headers
+		fragment := url.Values{}
+		fragment.Set("access_token", pair.AccessToken)
+		fragment.Set("refresh_token", pair.RefreshToken)
+		fragment.Set("token_type", pair.TokenType)
+		fragment.Set("expires_in", strconv.Itoa(pair.ExpiresIn))
+		c.Redirect(http.StatusFound, target+"#"+fragment.Encode())
+		return
+	}
+	c.JSON(http.StatusOK, tokenResponse(pair))
+}
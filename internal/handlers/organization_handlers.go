@@ -0,0 +1,611 @@
+package handlers
+
+import (
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/errors"
+	"gobi/pkg/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// organizationRole returns the current user's role in an organization; users holding orgs.manage
+// administer every organization
+func organizationRole(c *gin.Context, orgID uint) string {
+	if subject(c).HasPermission(utils.PermManageOrgs) {
+		return utils.OrgRoleAdmin
+	}
+	return utils.OrgMemberRole(orgID, c.GetUint("userID"))
+}
+
+// loadOrganization fetches the organization of the request, which the current user must be a member of,
+// or an admin of when admin is set
+func loadOrganization(c *gin.Context, admin bool) (models.Organization, bool) {
+	var org models.Organization
+	if err := database.DB.First(&org, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return org, false
+	}
+	role := organizationRole(c, org.ID)
+	if role == "" || (admin && role != utils.OrgRoleAdmin) {
+		c.Error(errors.ErrForbidden)
+		return org, false
+	}
+	return org, true
+}
+
+func organizationResponse(org models.Organization, role string) gin.H {
+	var members, teams int64
+	database.DB.Model(&models.OrganizationMember{}).Where("organization_id = ?", org.ID).Count(&members)
+	database.DB.Model(&models.Team{}).Where("organization_id = ?", org.ID).Count(&teams)
+	return gin.H{
+		"id":          org.ID,
+		"name":        org.Name,
+		"description": org.Description,
+		"require_mfa": org.RequireMFA,
+		"role":        role, // role of the current user
+		"members":     members,
+		"teams":       teams,
+		"created_at":  org.CreatedAt,
+	}
+}
+
+// ListOrganizations lists the organizations the current user belongs to, or all of them for users
+// holding orgs.manage
+func ListOrganizations(c *gin.Context) {
+	var orgs []models.Organization
+	query := database.DB.Model(&models.Organization{})
+	if !subject(c).HasPermission(utils.PermManageOrgs) {
+		query = query.Where("id IN (?)", database.DB.Model(&models.OrganizationMember{}).
+			Select("organization_id").Where("user_id = ?", c.GetUint("userID")))
+	}
+	if err := query.Order("name").Find(&orgs).Error; err != nil {
+		c.Error(errors.WrapError(err, "Could not fetch organizations"))
+		return
+	}
+	result := make([]gin.H, 0, len(orgs))
+	for _, org := range orgs {
+		result = append(result, organizationResponse(org, organizationRole(c, org.ID)))
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// CreateOrganization creates an organization administered by its creator
+func CreateOrganization(c *gin.Context) {
+	if !requirePermission(c, utils.PermManageOrgs) {
+		return
+	}
+	var req struct {
+		Name        string `json:"name" binding:"required"`
+		Description string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("Invalid organization request", err))
+		return
+	}
+	var count int64
+	database.DB.Model(&models.Organization{}).Where("name = ?", req.Name).Count(&count)
+	if count > 0 {
+		c.Error(errors.NewConflictError(fmt.Sprintf("Organization %q already exists", req.Name), nil))
+		return
+	}
+
+	org := models.Organization{Name: req.Name, Description: req.Description}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&org).Error; err != nil {
+			return err
+		}
+		return utils.AddOrganizationMember(tx, org.ID, c.GetUint("userID"), utils.OrgRoleAdmin)
+	})
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not create organization"))
+		return
+	}
+
+	event := auditEvent(c, "organization.create", "organization", org.ID)
+	event.OrganizationID = org.ID
+	utils.RecordAudit(event, map[string]interface{}{"name": org.Name})
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":         "create_organization",
+		"userID":         c.GetUint("userID"),
+		"organizationID": org.ID,
+		"name":           org.Name,
+	}).Info("Organization created successfully")
+
+	c.JSON(http.StatusCreated, organizationResponse(org, utils.OrgRoleAdmin))
+}
+
+// GetOrganization gets an organization the current user belongs to
+func GetOrganization(c *gin.Context) {
+	org, ok := loadOrganization(c, false)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, organizationResponse(org, organizationRole(c, org.ID)))
+}
+
+// UpdateOrganization renames an organization, changes its description or whether it requires two-factor
+// authentication
+func UpdateOrganization(c *gin.Context) {
+	org, ok := loadOrganization(c, true)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		RequireMFA  *bool   `json:"require_mfa"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("Invalid organization request", err))
+		return
+	}
+	if req.Name != nil && *req.Name != org.Name {
+		if *req.Name == "" {
+			c.Error(errors.NewBadRequestError("Organization name is required", nil))
+			return
+		}
+		var count int64
+		database.DB.Model(&models.Organization{}).Where("name = ?", *req.Name).Count(&count)
+		if count > 0 {
+			c.Error(errors.NewConflictError(fmt.Sprintf("Organization %q already exists", *req.Name), nil))
+			return
+		}
+		org.Name = *req.Name
+	}
+	if req.Description != nil {
+		org.Description = *req.Description
+	}
+	mfaChanged := req.RequireMFA != nil && *req.RequireMFA != org.RequireMFA
+	if mfaChanged && *req.RequireMFA && !utils.MFAEnabled(c.GetUint("userID")) {
+		// Requiring two-factor authentication would lock the admin out of the organization
+		c.Error(errors.NewBadRequestError("Enable two-factor authentication on your account first", nil))
+		return
+	}
+	if req.RequireMFA != nil {
+		org.RequireMFA = *req.RequireMFA
+	}
+	if err := database.DB.Save(&org).Error; err != nil {
+		c.Error(errors.WrapError(err, "Could not update organization"))
+		return
+	}
+	if mfaChanged {
+		event := auditEvent(c, "organization.require_mfa", "organization", org.ID)
+		event.OrganizationID = org.ID
+		event.Changes = utils.AuditChanges(map[string]interface{}{"require_mfa": !org.RequireMFA},
+			map[string]interface{}{"require_mfa": org.RequireMFA})
+		utils.RecordAudit(event, nil)
+	}
+	c.JSON(http.StatusOK, organizationResponse(org, organizationRole(c, org.ID)))
+}
+
+// DeleteOrganization deletes an empty organization with its memberships and teams. Resources must be
+// deleted first, so that no tenant's data is orphaned.
+func DeleteOrganization(c *gin.Context) {
+	if !requirePermission(c, utils.PermManageOrgs) {
+		return
+	}
+	org, ok := loadOrganization(c, true)
+	if !ok {
+		return
+	}
+	hasResources, err := utils.OrganizationHasResources(org.ID)
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not check organization resources"))
+		return
+	}
+	if hasResources {
+		c.Error(errors.NewConflictError("Organization still has resources", nil))
+		return
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		teamIDs := tx.Model(&models.Team{}).Select("id").Where("organization_id = ?", org.ID)
+		if err := tx.Unscoped().Where("team_id IN (?)", teamIDs).Delete(&models.TeamMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("subject_type = ? AND subject_id IN (?)", utils.GrantSubjectTeam, teamIDs).
+			Delete(&models.ResourceGrant{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("organization_id = ?", org.ID).Delete(&models.Team{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("organization_id = ?", org.ID).Delete(&models.OrganizationMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&org).Error
+	})
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not delete organization"))
+		return
+	}
+
+	event := auditEvent(c, "organization.delete", "organization", org.ID)
+	event.OrganizationID = org.ID
+	utils.RecordAudit(event, map[string]interface{}{"name": org.Name})
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":         "delete_organization",
+		"userID":         c.GetUint("userID"),
+		"organizationID": org.ID,
+	}).Info("Organization deleted successfully")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Organization deleted successfully"})
+}
+
+// ListOrganizationMembers lists the members of an organization with their roles
+func ListOrganizationMembers(c *gin.Context) {
+	org, ok := loadOrganization(c, false)
+	if !ok {
+		return
+	}
+	type member struct {
+		UserID   uint   `json:"user_id"`
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Role     string `json:"role"`
+	}
+	members := []member{}
+	err := database.DB.Table("organization_members").
+		Select("organization_members.user_id, users.username, users.email, organization_members.role").
+		Joins("JOIN users ON users.id = organization_members.user_id AND users.deleted_at IS NULL").
+		Where("organization_members.organization_id = ? AND organization_members.deleted_at IS NULL", org.ID).
+		Order("users.username").Scan(&members).Error
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not fetch organization members"))
+		return
+	}
+	c.JSON(http.StatusOK, members)
+}
+
+type memberRoleRequest struct {
+	UserID uint   `json:"user_id"`
+	Role   string `json:"role" binding:"omitempty,oneof=admin member"`
+}
+
+// AddOrganizationMember adds a user to an organization, or changes the role of a member
+func AddOrganizationMember(c *gin.Context) {
+	org, ok := loadOrganization(c, true)
+	if !ok {
+		return
+	}
+	var req memberRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.UserID == 0 {
+		c.Error(errors.NewBadRequestError("user_id is required and role must be admin or member", err))
+		return
+	}
+	if req.Role == "" {
+		req.Role = utils.OrgRoleMember
+	}
+	var user models.User
+	if err := database.DB.First(&user, req.UserID).Error; err != nil {
+		c.Error(errors.NewBadRequestError(fmt.Sprintf("User %d not found", req.UserID), nil))
+		return
+	}
+	setOrganizationMemberRole(c, org, user.ID, req.Role)
+}
+
+// UpdateOrganizationMember changes the role of a member
+func UpdateOrganizationMember(c *gin.Context) {
+	org, ok := loadOrganization(c, true)
+	if !ok {
+		return
+	}
+	var req memberRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Role == "" {
+		c.Error(errors.NewBadRequestError("role must be admin or member", err))
+		return
+	}
+	var member models.OrganizationMember
+	if err := database.DB.Where("organization_id = ? AND user_id = ?", org.ID, c.Param("userId")).First(&member).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	setOrganizationMemberRole(c, org, member.UserID, req.Role)
+}
+
+// setOrganizationMemberRole saves a membership, keeping at least one admin in the organization
+func setOrganizationMemberRole(c *gin.Context, org models.Organization, userID uint, role string) {
+	previous := utils.OrgMemberRole(org.ID, userID)
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := utils.AddOrganizationMember(tx, org.ID, userID, role); err != nil {
+			return err
+		}
+		if utils.CountOrganizationAdmins(tx, org.ID) == 0 {
+			return errLastOrganizationAdmin
+		}
+		return nil
+	})
+	if err == errLastOrganizationAdmin {
+		c.Error(errors.NewConflictError("An organization needs at least one admin", nil))
+		return
+	}
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not save organization member"))
+		return
+	}
+	utils.QueryCache.Flush()
+
+	if previous != role {
+		action := "organization.member_add"
+		before := map[string]interface{}{}
+		if previous != "" {
+			action = "organization.member_role"
+			before["role"] = previous
+		}
+		event := auditEvent(c, action, "user", userID)
+		event.OrganizationID = org.ID
+		event.Changes = utils.AuditChanges(before, map[string]interface{}{"role": role})
+		utils.RecordAudit(event, nil)
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":         "set_organization_member",
+		"userID":         c.GetUint("userID"),
+		"organizationID": org.ID,
+		"memberID":       userID,
+		"role":           role,
+	}).Info("Organization member saved")
+
+	c.JSON(http.StatusOK, gin.H{"organization_id": org.ID, "user_id": userID, "role": role})
+}
+
+var errLastOrganizationAdmin = fmt.Errorf("organization needs at least one admin")
+
+// RemoveOrganizationMember removes a user from an organization and its teams. Members may remove
+// themselves to leave the organization.
+func RemoveOrganizationMember(c *gin.Context) {
+	var org models.Organization
+	if err := database.DB.First(&org, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	var member models.OrganizationMember
+	if err := database.DB.Where("organization_id = ? AND user_id = ?", org.ID, c.Param("userId")).First(&member).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	if member.UserID != c.GetUint("userID") && organizationRole(c, org.ID) != utils.OrgRoleAdmin {
+		c.Error(errors.ErrForbidden)
+		return
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		teamIDs := tx.Model(&models.Team{}).Select("id").Where("organization_id = ?", org.ID)
+		if err := tx.Unscoped().Where("user_id = ? AND team_id IN (?)", member.UserID, teamIDs).
+			Delete(&models.TeamMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(&member).Error; err != nil {
+			return err
+		}
+		if utils.CountOrganizationAdmins(tx, org.ID) == 0 {
+			return errLastOrganizationAdmin
+		}
+		return nil
+	})
+	if err == errLastOrganizationAdmin {
+		c.Error(errors.NewConflictError("An organization needs at least one admin", nil))
+		return
+	}
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not remove organization member"))
+		return
+	}
+	utils.QueryCache.Flush()
+
+	event := auditEvent(c, "organization.member_remove", "user", member.UserID)
+	event.OrganizationID = org.ID
+	event.Changes = utils.AuditChanges(map[string]interface{}{"role": member.Role}, nil)
+	utils.RecordAudit(event, nil)
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":         "remove_organization_member",
+		"userID":         c.GetUint("userID"),
+		"organizationID": org.ID,
+		"memberID":       member.UserID,
+	}).Info("Organization member removed")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Organization member removed successfully"})
+}
+
+func teamResponse(team models.Team) gin.H {
+	type member struct {
+		UserID uint   `json:"user_id"`
+		Role   string `json:"role"`
+	}
+	members := []member{}
+	database.DB.Model(&models.TeamMember{}).Select("user_id, role").Where("team_id = ?", team.ID).
+		Order("user_id").Scan(&members)
+	return gin.H{
+		"id":              team.ID,
+		"organization_id": team.OrganizationID,
+		"name":            team.Name,
+		"description":     team.Description,
+		"members":         members,
+		"created_at":      team.CreatedAt,
+	}
+}
+
+// ListTeams lists the teams of an organization with their members
+func ListTeams(c *gin.Context) {
+	org, ok := loadOrganization(c, false)
+	if !ok {
+		return
+	}
+	var teams []models.Team
+	if err := database.DB.Where("organization_id = ?", org.ID).Order("name").Find(&teams).Error; err != nil {
+		c.Error(errors.WrapError(err, "Could not fetch teams"))
+		return
+	}
+	result := make([]gin.H, 0, len(teams))
+	for _, team := range teams {
+		result = append(result, teamResponse(team))
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// CreateTeam creates a team in an organization
+func CreateTeam(c *gin.Context) {
+	org, ok := loadOrganization(c, true)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name        string `json:"name" binding:"required"`
+		Description string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("Invalid team request", err))
+		return
+	}
+	var count int64
+	database.DB.Model(&models.Team{}).Where("organization_id = ? AND name = ?", org.ID, req.Name).Count(&count)
+	if count > 0 {
+		c.Error(errors.NewConflictError(fmt.Sprintf("Team %q already exists", req.Name), nil))
+		return
+	}
+
+	team := models.Team{OrganizationID: org.ID, Name: req.Name, Description: req.Description}
+	if err := database.DB.Create(&team).Error; err != nil {
+		c.Error(errors.WrapError(err, "Could not create team"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":         "create_team",
+		"userID":         c.GetUint("userID"),
+		"organizationID": org.ID,
+		"teamID":         team.ID,
+		"name":           team.Name,
+	}).Info("Team created successfully")
+
+	c.JSON(http.StatusCreated, teamResponse(team))
+}
+
+// loadTeam fetches the team of the request for a change to it, which organization admins and the
+// team's maintainers may make
+func loadTeam(c *gin.Context) (models.Team, bool) {
+	var team models.Team
+	if err := database.DB.Where("organization_id = ?", c.Param("id")).First(&team, c.Param("teamId")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return team, false
+	}
+	if organizationRole(c, team.OrganizationID) == utils.OrgRoleAdmin {
+		return team, true
+	}
+	var maintainers int64
+	database.DB.Model(&models.TeamMember{}).Where("team_id = ? AND user_id = ? AND role = ?",
+		team.ID, c.GetUint("userID"), utils.TeamRoleMaintainer).Count(&maintainers)
+	if maintainers == 0 {
+		c.Error(errors.ErrForbidden)
+		return team, false
+	}
+	return team, true
+}
+
+// DeleteTeam deletes a team together with its memberships and the grants given to it
+func DeleteTeam(c *gin.Context) {
+	team, ok := loadTeam(c)
+	if !ok {
+		return
+	}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("team_id = ?", team.ID).Delete(&models.TeamMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("subject_type = ? AND subject_id = ?", utils.GrantSubjectTeam, team.ID).
+			Delete(&models.ResourceGrant{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&team).Error
+	})
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not delete team"))
+		return
+	}
+	utils.QueryCache.Flush()
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":         "delete_team",
+		"userID":         c.GetUint("userID"),
+		"organizationID": team.OrganizationID,
+		"teamID":         team.ID,
+	}).Info("Team deleted successfully")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Team deleted successfully"})
+}
+
+// AddTeamMember adds a member of the organization to a team, or changes the role of a team member
+func AddTeamMember(c *gin.Context) {
+	team, ok := loadTeam(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		UserID uint   `json:"user_id" binding:"required"`
+		Role   string `json:"role" binding:"omitempty,oneof=maintainer member"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("user_id is required and role must be maintainer or member", err))
+		return
+	}
+	if req.Role == "" {
+		req.Role = utils.TeamRoleMember
+	}
+	if utils.OrgMemberRole(team.OrganizationID, req.UserID) == "" {
+		c.Error(errors.NewBadRequestError(fmt.Sprintf("User %d is not a member of the organization", req.UserID), nil))
+		return
+	}
+
+	member := models.TeamMember{TeamID: team.ID, UserID: req.UserID}
+	database.DB.Where(&member).Limit(1).Find(&member)
+	member.Role = req.Role
+	if err := database.DB.Save(&member).Error; err != nil {
+		c.Error(errors.WrapError(err, "Could not add team member"))
+		return
+	}
+	utils.QueryCache.Flush()
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":   "add_team_member",
+		"userID":   c.GetUint("userID"),
+		"teamID":   team.ID,
+		"memberID": req.UserID,
+		"role":     req.Role,
+	}).Info("Team member added")
+
+	c.JSON(http.StatusOK, teamResponse(team))
+}
+
+// RemoveTeamMember removes a user from a team
+func RemoveTeamMember(c *gin.Context) {
+	team, ok := loadTeam(c)
+	if !ok {
+		return
+	}
+	res := database.DB.Unscoped().Where("team_id = ? AND user_id = ?", team.ID, c.Param("userId")).Delete(&models.TeamMember{})
+	if res.Error != nil {
+		c.Error(errors.WrapError(res.Error, "Could not remove team member"))
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	utils.QueryCache.Flush()
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":   "remove_team_member",
+		"userID":   c.GetUint("userID"),
+		"teamID":   team.ID,
+		"memberID": c.Param("userId"),
+	}).Info("Team member removed")
+
+	c.JSON(http.StatusOK, teamResponse(team))
+}
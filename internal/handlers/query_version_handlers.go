@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/errors"
+	"gobi/pkg/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// loadVersionedQuery fetches the query of a version request, checking that the user has level access:
+// view to read the history, edit to restore a version
+func loadVersionedQuery(c *gin.Context, level string) (models.Query, bool) {
+	var query models.Query
+	if err := database.DB.First(&query, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return query, false
+	}
+	if !authorize(c, utils.QueryResource(query), level) {
+		return query, false
+	}
+	return query, true
+}
+
+// loadQueryVersion fetches a version of query by its number
+func loadQueryVersion(query models.Query, number string) (models.QueryVersion, *errors.CustomError) {
+	var version models.QueryVersion
+	n, err := strconv.Atoi(number)
+	if err != nil || n <= 0 {
+		return version, errors.NewBadRequestError(fmt.Sprintf("Invalid version %q", number), err)
+	}
+	if err := database.DB.Where("query_id = ? AND version = ?", query.ID, n).First(&version).Error; err != nil {
+		return version, errors.ErrNotFound
+	}
+	return version, nil
+}
+
+// ListQueryVersions lists the versions of a query, newest first
+func ListQueryVersions(c *gin.Context) {
+	query, ok := loadVersionedQuery(c, utils.AccessView)
+	if !ok {
+		return
+	}
+
+	var versions []models.QueryVersion
+	if err := database.DB.Where("query_id = ?", query.ID).Order("version DESC").Find(&versions).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":  "list_query_versions",
+			"queryID": query.ID,
+			"error":   err.Error(),
+		}).Error("Failed to list query versions")
+		c.Error(errors.WrapError(err, "Could not fetch query versions"))
+		return
+	}
+
+	c.JSON(http.StatusOK, versions)
+}
+
+// GetQueryVersion gets one version of a query
+func GetQueryVersion(c *gin.Context) {
+	query, ok := loadVersionedQuery(c, utils.AccessView)
+	if !ok {
+		return
+	}
+	version, err := loadQueryVersion(query, c.Param("version"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, version)
+}
+
+// DiffQueryVersions compares two versions of a query given as ?from=N&to=M. to defaults to the current
+// version and from to the version before to.
+func DiffQueryVersions(c *gin.Context) {
+	query, ok := loadVersionedQuery(c, utils.AccessView)
+	if !ok {
+		return
+	}
+
+	toParam := c.DefaultQuery("to", strconv.Itoa(query.Version))
+	to, err := loadQueryVersion(query, toParam)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	fromParam := c.DefaultQuery("from", strconv.Itoa(to.Version-1))
+	from, err := loadQueryVersion(query, fromParam)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, utils.DiffQueryVersions(from, to))
+}
+
+// RestoreQueryVersion makes the query match an earlier version. History is never rewritten: the restore
+// is recorded as a new version.
+func RestoreQueryVersion(c *gin.Context) {
+	query, ok := loadVersionedQuery(c, utils.AccessEdit)
+	if !ok {
+		return
+	}
+	version, cerr := loadQueryVersion(query, c.Param("version"))
+	if cerr != nil {
+		c.Error(cerr)
+		return
+	}
+	var ds models.DataSource
+	if err := database.DB.Select("id").First(&ds, version.DataSourceID).Error; err != nil {
+		c.Error(errors.NewBadRequestError(fmt.Sprintf("Data source %d of version %d no longer exists", version.DataSourceID, version.Version), nil))
+		return
+	}
+	if (version.SQL != query.SQL || version.DataSourceID != query.DataSourceID) && !requireUnfilteredDataSource(c, version.DataSourceID) {
+		return
+	}
+
+	userID := c.GetUint("userID")
+	var restored models.QueryVersion
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		query.Name = version.Name
+		query.SQL = version.SQL
+		query.Description = version.Description
+		query.DataSourceID = version.DataSourceID
+		if err := tx.Save(&query).Error; err != nil {
+			return err
+		}
+		var err error
+		restored, err = utils.RecordQueryVersion(tx, &query, userID, fmt.Sprintf("Restored from version %d", version.Version))
+		return err
+	})
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":  "restore_query_version",
+			"queryID": query.ID,
+			"version": version.Version,
+			"error":   err.Error(),
+		}).Error("Failed to restore query version")
+		c.Error(errors.WrapError(err, "Could not restore query version"))
+		return
+	}
+
+	utils.QueryCache.Flush()
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":     "restore_query_version",
+		"userID":     userID,
+		"queryID":    query.ID,
+		"version":    version.Version,
+		"newVersion": restored.Version,
+	}).Info("Query version restored successfully")
+
+	c.JSON(http.StatusOK, query)
+}
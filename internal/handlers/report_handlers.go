@@ -2,11 +2,14 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"gobi/internal/models"
 	"gobi/pkg/database"
 	"gobi/pkg/errors"
 	"gobi/pkg/utils"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,12 +19,25 @@ import (
 // CreateReportSchedule creates a new report schedule
 func CreateReportSchedule(c *gin.Context) {
 	var req struct {
-		Name        string `json:"name" binding:"required"`
-		Type        string `json:"type" binding:"required,oneof=daily weekly monthly"`
-		QueryIDs    []uint `json:"query_ids"`
-		ChartIDs    []uint `json:"chart_ids"`
-		TemplateIDs []uint `json:"template_ids"`
-		CronPattern string `json:"cron_pattern" binding:"required"`
+		Name           string                        `json:"name" binding:"required"`
+		Type           string                        `json:"type" binding:"required,oneof=daily weekly monthly"`
+		QueryIDs       []uint                        `json:"query_ids"`
+		ChartIDs       []uint                        `json:"chart_ids"`
+		TemplateIDs    []uint                        `json:"template_ids"`
+		Params         map[string]utils.ParamBinding `json:"params"`
+		CronPattern    string                        `json:"cron_pattern" binding:"required"`
+		Format         string                        `json:"format" binding:"omitempty,oneof=xlsx pdf csv-zip html"`
+		Recipients     []string                      `json:"recipients" binding:"omitempty,dive,email"`
+		EmailSubject   string                        `json:"email_subject"`
+		EmailBody      string                        `json:"email_body"`
+		DeliveryMode   string                        `json:"delivery_mode" binding:"omitempty,oneof=attach link"`
+		WebhookIDs     []uint                        `json:"webhook_ids"`
+		MisfirePolicy  string                        `json:"misfire_policy" binding:"omitempty,oneof=skip run_once catch_up"`
+		MaxRetries     int                           `json:"max_retries" binding:"min=0,max=10"`
+		RetryDelay     int                           `json:"retry_delay" binding:"min=0,max=86400"`
+		Timezone       string                        `json:"timezone"`
+		RetentionCount int                           `json:"retention_count" binding:"min=0"`
+		RetentionDays  int                           `json:"retention_days" binding:"min=0"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -45,6 +61,26 @@ func CreateReportSchedule(c *gin.Context) {
 		c.Error(errors.NewBadRequestError("Invalid cron pattern", err))
 		return
 	}
+	if err := validateTimezone(req.Timezone); err != nil {
+		c.Error(err)
+		return
+	}
+	if err := validateEmailTemplates(req.EmailSubject, req.EmailBody); err != nil {
+		c.Error(err)
+		return
+	}
+	if err := utils.ValidateParamBindings(req.Params); err != nil {
+		c.Error(errors.NewBadRequestError("Invalid report parameters", err))
+		return
+	}
+	if err := checkWebhookAccess(c, req.WebhookIDs); err != nil {
+		c.Error(err)
+		return
+	}
+	if !requireCreate(c, utils.ResourceSchedule) ||
+		!checkScheduleContent(c, req.QueryIDs, req.ChartIDs, req.TemplateIDs) {
+		return
+	}
 
 	userID := c.GetUint("userID")
 
@@ -52,20 +88,43 @@ func CreateReportSchedule(c *gin.Context) {
 	queryIDs, _ := json.Marshal(req.QueryIDs)
 	chartIDs, _ := json.Marshal(req.ChartIDs)
 	templateIDs, _ := json.Marshal(req.TemplateIDs)
+	recipients, _ := json.Marshal(req.Recipients)
+	webhookIDs, _ := json.Marshal(req.WebhookIDs)
+	params, _ := json.Marshal(req.Params)
+	if req.DeliveryMode == "" {
+		req.DeliveryMode = utils.DeliveryAttach
+	}
+	if req.MisfirePolicy == "" {
+		req.MisfirePolicy = utils.MisfireRunOnce
+	}
 
-	// 使用cron表达式计算下次运行时间
-	nextRun := calculateNextRunFromCron(req.CronPattern)
+	// 使用cron表达式在报告时区中计算下次运行时间
+	nextRun := utils.NextRunTime(req.CronPattern, req.Timezone, time.Now())
 
 	schedule := models.ReportSchedule{
-		UserID:      userID,
-		Name:        req.Name,
-		Type:        req.Type,
-		Queries:     string(queryIDs),
-		Charts:      string(chartIDs),
-		Templates:   string(templateIDs),
-		CronPattern: req.CronPattern,
-		Active:      true,
-		NextRun:     nextRun,
+		UserID:         userID,
+		OrganizationID: c.GetUint("orgID"),
+		Name:           req.Name,
+		Type:           req.Type,
+		Queries:        string(queryIDs),
+		Charts:         string(chartIDs),
+		Templates:      string(templateIDs),
+		Params:         string(params),
+		CronPattern:    req.CronPattern,
+		Format:         utils.NormalizeReportFormat(req.Format),
+		Recipients:     string(recipients),
+		EmailSubject:   req.EmailSubject,
+		EmailBody:      req.EmailBody,
+		DeliveryMode:   req.DeliveryMode,
+		Webhooks:       string(webhookIDs),
+		MisfirePolicy:  req.MisfirePolicy,
+		MaxRetries:     req.MaxRetries,
+		RetryDelay:     req.RetryDelay,
+		Timezone:       req.Timezone,
+		RetentionCount: req.RetentionCount,
+		RetentionDays:  req.RetentionDays,
+		Active:         true,
+		NextRun:        nextRun,
 	}
 
 	if err := database.DB.Create(&schedule).Error; err != nil {
@@ -91,14 +150,9 @@ func CreateReportSchedule(c *gin.Context) {
 // ListReportSchedules lists all report schedules for the user
 func ListReportSchedules(c *gin.Context) {
 	userID := c.GetUint("userID")
-	role := c.GetString("role")
 
 	var schedules []models.ReportSchedule
-	query := database.DB.Model(&models.ReportSchedule{})
-
-	if role != "admin" {
-		query = query.Where("user_id = ?", userID)
-	}
+	query := database.DB.Model(&models.ReportSchedule{}).Scopes(subject(c).Visible(utils.ResourceSchedule, "id", false))
 
 	if err := query.Find(&schedules).Error; err != nil {
 		utils.Logger.WithFields(map[string]interface{}{
@@ -116,8 +170,6 @@ func ListReportSchedules(c *gin.Context) {
 // GetReportSchedule gets a specific report schedule
 func GetReportSchedule(c *gin.Context) {
 	id := c.Param("id")
-	userID := c.GetUint("userID")
-	role := c.GetString("role")
 
 	var schedule models.ReportSchedule
 	if err := database.DB.First(&schedule, id).Error; err != nil {
@@ -125,8 +177,7 @@ func GetReportSchedule(c *gin.Context) {
 		return
 	}
 
-	if role != "admin" && schedule.UserID != userID {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.ScheduleResource(schedule), utils.AccessView) {
 		return
 	}
 
@@ -137,7 +188,6 @@ func GetReportSchedule(c *gin.Context) {
 func UpdateReportSchedule(c *gin.Context) {
 	id := c.Param("id")
 	userID := c.GetUint("userID")
-	role := c.GetString("role")
 
 	var schedule models.ReportSchedule
 	if err := database.DB.First(&schedule, id).Error; err != nil {
@@ -145,25 +195,40 @@ func UpdateReportSchedule(c *gin.Context) {
 		return
 	}
 
-	if role != "admin" && schedule.UserID != userID {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.ScheduleResource(schedule), utils.AccessEdit) {
 		return
 	}
 
 	var req struct {
-		Name        string `json:"name"`
-		Type        string `json:"type" binding:"omitempty,oneof=daily weekly monthly"`
-		QueryIDs    []uint `json:"query_ids"`
-		ChartIDs    []uint `json:"chart_ids"`
-		TemplateIDs []uint `json:"template_ids"`
-		CronPattern string `json:"cron_pattern"`
-		Active      *bool  `json:"active"`
+		Name           string                        `json:"name"`
+		Type           string                        `json:"type" binding:"omitempty,oneof=daily weekly monthly"`
+		QueryIDs       []uint                        `json:"query_ids"`
+		ChartIDs       []uint                        `json:"chart_ids"`
+		TemplateIDs    []uint                        `json:"template_ids"`
+		Params         map[string]utils.ParamBinding `json:"params"`
+		CronPattern    string                        `json:"cron_pattern"`
+		Format         string                        `json:"format" binding:"omitempty,oneof=xlsx pdf csv-zip html"`
+		Recipients     []string                      `json:"recipients" binding:"omitempty,dive,email"`
+		EmailSubject   *string                       `json:"email_subject"`
+		EmailBody      *string                       `json:"email_body"`
+		DeliveryMode   string                        `json:"delivery_mode" binding:"omitempty,oneof=attach link"`
+		WebhookIDs     []uint                        `json:"webhook_ids"`
+		MisfirePolicy  string                        `json:"misfire_policy" binding:"omitempty,oneof=skip run_once catch_up"`
+		MaxRetries     *int                          `json:"max_retries" binding:"omitempty,min=0,max=10"`
+		RetryDelay     *int                          `json:"retry_delay" binding:"omitempty,min=0,max=86400"`
+		RetentionCount *int                          `json:"retention_count" binding:"omitempty,min=0"`
+		RetentionDays  *int                          `json:"retention_days" binding:"omitempty,min=0"`
+		Timezone       *string                       `json:"timezone"`
+		Active         *bool                         `json:"active"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.Error(errors.NewBadRequestError("Invalid report schedule data", err))
 		return
 	}
+	if !checkScheduleContent(c, req.QueryIDs, req.ChartIDs, req.TemplateIDs) {
+		return
+	}
 
 	if req.Name != "" {
 		schedule.Name = req.Name
@@ -183,6 +248,14 @@ func UpdateReportSchedule(c *gin.Context) {
 		templateIDs, _ := json.Marshal(req.TemplateIDs)
 		schedule.Templates = string(templateIDs)
 	}
+	if req.Params != nil {
+		if err := utils.ValidateParamBindings(req.Params); err != nil {
+			c.Error(errors.NewBadRequestError("Invalid report parameters", err))
+			return
+		}
+		params, _ := json.Marshal(req.Params)
+		schedule.Params = string(params)
+	}
 	if req.CronPattern != "" {
 		// 验证新的cron表达式
 		parser := cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow)
@@ -197,14 +270,71 @@ func UpdateReportSchedule(c *gin.Context) {
 			return
 		}
 		schedule.CronPattern = req.CronPattern
+	}
+	if req.Timezone != nil {
+		if err := validateTimezone(*req.Timezone); err != nil {
+			c.Error(err)
+			return
+		}
+		schedule.Timezone = *req.Timezone
+	}
+	if req.CronPattern != "" || req.Timezone != nil {
 		// 重新计算下次运行时间
-		schedule.NextRun = calculateNextRunFromCron(req.CronPattern)
+		schedule.NextRun = utils.NextRunTime(schedule.CronPattern, schedule.Timezone, time.Now())
+	}
+	if req.Format != "" {
+		schedule.Format = req.Format
+	}
+	if req.Recipients != nil {
+		recipients, _ := json.Marshal(req.Recipients)
+		schedule.Recipients = string(recipients)
+	}
+	if req.EmailSubject != nil {
+		if err := validateEmailTemplates(*req.EmailSubject, ""); err != nil {
+			c.Error(err)
+			return
+		}
+		schedule.EmailSubject = *req.EmailSubject
+	}
+	if req.EmailBody != nil {
+		if err := validateEmailTemplates("", *req.EmailBody); err != nil {
+			c.Error(err)
+			return
+		}
+		schedule.EmailBody = *req.EmailBody
+	}
+	if req.DeliveryMode != "" {
+		schedule.DeliveryMode = req.DeliveryMode
+	}
+	if req.MisfirePolicy != "" {
+		schedule.MisfirePolicy = req.MisfirePolicy
+	}
+	if req.MaxRetries != nil {
+		schedule.MaxRetries = *req.MaxRetries
+	}
+	if req.RetryDelay != nil {
+		schedule.RetryDelay = *req.RetryDelay
+	}
+	if req.RetentionCount != nil {
+		schedule.RetentionCount = *req.RetentionCount
+	}
+	if req.RetentionDays != nil {
+		schedule.RetentionDays = *req.RetentionDays
+	}
+	if req.WebhookIDs != nil {
+		if err := checkWebhookAccess(c, req.WebhookIDs); err != nil {
+			c.Error(err)
+			return
+		}
+		webhookIDs, _ := json.Marshal(req.WebhookIDs)
+		schedule.Webhooks = string(webhookIDs)
 	}
 	if req.Active != nil {
 		schedule.Active = *req.Active
 	}
 
-	if err := database.DB.Save(&schedule).Error; err != nil {
+	// The lease and last run columns belong to the scheduler, which may be running the report right now
+	if err := database.DB.Omit("locked_by", "locked_until", "last_run").Save(&schedule).Error; err != nil {
 		utils.Logger.WithFields(map[string]interface{}{
 			"action": "update_report_schedule",
 			"userID": userID,
@@ -228,7 +358,6 @@ func UpdateReportSchedule(c *gin.Context) {
 func DeleteReportSchedule(c *gin.Context) {
 	id := c.Param("id")
 	userID := c.GetUint("userID")
-	role := c.GetString("role")
 
 	var schedule models.ReportSchedule
 	if err := database.DB.First(&schedule, id).Error; err != nil {
@@ -236,8 +365,7 @@ func DeleteReportSchedule(c *gin.Context) {
 		return
 	}
 
-	if role != "admin" && schedule.UserID != userID {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.ScheduleResource(schedule), utils.AccessOwn) {
 		return
 	}
 
@@ -260,17 +388,113 @@ func DeleteReportSchedule(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Report schedule deleted successfully"})
 }
 
+// RunReportSchedule generates a schedule now, or reruns one of its reports when report_id is given.
+// Generation continues in the background; the response carries the pending report.
+func RunReportSchedule(c *gin.Context) {
+	id := c.Param("id")
+	userID := c.GetUint("userID")
+
+	var schedule models.ReportSchedule
+	if err := database.DB.First(&schedule, id).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+
+	if !authorize(c, utils.ScheduleResource(schedule), utils.AccessExecute) {
+		return
+	}
+
+	var req struct {
+		ReportID uint `json:"report_id"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.Error(errors.NewBadRequestError("Invalid run request", err))
+			return
+		}
+	}
+
+	var rerun *models.Report
+	if req.ReportID != 0 {
+		var report models.Report
+		if err := database.DB.Where("id = ? AND schedule_id = ?", req.ReportID, schedule.ID).First(&report).Error; err != nil {
+			c.Error(errors.NewBadRequestError("Report does not belong to this schedule", err))
+			return
+		}
+		if report.Status != utils.RunFailed && report.Status != utils.RunPartial {
+			c.Error(errors.NewBadRequestError("Only failed or partial reports can be rerun", nil))
+			return
+		}
+		rerun = &report
+	}
+
+	report, err := utils.RunScheduleNow(&schedule, rerun)
+	if err == utils.ErrScheduleBusy {
+		c.Error(errors.NewConflictError("Report schedule is already running", err))
+		return
+	}
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":     "run_report_schedule",
+			"scheduleID": schedule.ID,
+			"error":      err.Error(),
+		}).Error("Failed to start report run")
+		c.Error(errors.WrapError(err, "Could not start report run"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":     "run_report_schedule",
+		"userID":     userID,
+		"scheduleID": schedule.ID,
+		"reportID":   report.ID,
+	}).Info("Report run started")
+
+	c.JSON(http.StatusAccepted, report)
+}
+
+// ListReportRuns lists the runs of a schedule, newest first, with their steps
+func ListReportRuns(c *gin.Context) {
+	id := c.Param("id")
+
+	var schedule models.ReportSchedule
+	if err := database.DB.First(&schedule, id).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+
+	if !authorize(c, utils.ScheduleResource(schedule), utils.AccessView) {
+		return
+	}
+
+	query := database.DB.Where("schedule_id = ?", schedule.ID)
+	if reportID := c.Query("report_id"); reportID != "" {
+		query = query.Where("report_id = ?", reportID)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var runs []models.ReportRun
+	if err := query.Preload("Steps").Order("id DESC").Limit(100).Find(&runs).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":     "list_report_runs",
+			"scheduleID": schedule.ID,
+			"error":      err.Error(),
+		}).Error("Failed to list report runs")
+		c.Error(errors.WrapError(err, "Could not fetch report runs"))
+		return
+	}
+
+	c.JSON(http.StatusOK, runs)
+}
+
 // ListReports lists all reports for the user
 func ListReports(c *gin.Context) {
 	userID := c.GetUint("userID")
-	role := c.GetString("role")
 
 	var reports []models.Report
-	query := database.DB.Model(&models.Report{})
-
-	if role != "admin" {
-		query = query.Where("user_id = ?", userID)
-	}
+	query := database.DB.Model(&models.Report{}).Scopes(subject(c).Visible(utils.ResourceSchedule, "schedule_id", false))
 
 	if err := query.Find(&reports).Error; err != nil {
 		utils.Logger.WithFields(map[string]interface{}{
@@ -288,8 +512,6 @@ func ListReports(c *gin.Context) {
 // DownloadReport downloads a specific report
 func DownloadReport(c *gin.Context) {
 	id := c.Param("id")
-	userID := c.GetUint("userID")
-	role := c.GetString("role")
 
 	var report models.Report
 	if err := database.DB.First(&report, id).Error; err != nil {
@@ -297,25 +519,161 @@ func DownloadReport(c *gin.Context) {
 		return
 	}
 
-	if role != "admin" && report.UserID != userID {
-		c.Error(errors.ErrForbidden)
+	if !authorize(c, utils.ReportResource(report), utils.AccessView) {
 		return
 	}
 
-	fileName := report.Name
-	if report.Type == "daily" {
-		fileName += "_" + report.GeneratedAt.Format("2006-01-02")
-	} else if report.Type == "weekly" {
-		fileName += "_week_" + report.GeneratedAt.Format("2006-01-02")
-	} else if report.Type == "monthly" {
-		fileName += "_" + report.GeneratedAt.Format("2006-01")
+	content, err := utils.LoadReportContent(report)
+	if err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":   "download_report",
+			"reportID": report.ID,
+			"error":    err.Error(),
+		}).Error("Failed to read report content")
+		c.Error(errors.WrapError(err, "Could not read report content"))
+		return
 	}
-	fileName += ".xlsx"
+
+	fileName := utils.ReportFileName(report)
+	contentType, _ := utils.ReportFileType(report.Format)
+
+	utils.RecordAudit(auditEvent(c, "report.download", "report", report.ID), map[string]interface{}{
+		"schedule_id": report.ScheduleID,
+		"format":      report.Format,
+		"size":        len(content),
+	})
 
 	c.Header("Content-Disposition", "attachment; filename="+fileName)
-	c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
-	c.Header("Content-Length", string(len(report.Content)))
-	c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", report.Content)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Length", strconv.Itoa(len(content)))
+	c.Data(http.StatusOK, contentType, content)
+}
+
+// CompareReports compares a report with another report of the same schedule, which serves as the baseline.
+// Rows are aligned on the comma-separated key columns of ?keys=, and ?format=xlsx returns a workbook
+// with the differences highlighted instead of JSON.
+func CompareReports(c *gin.Context) {
+
+	var report, baseline models.Report
+	if err := database.DB.First(&report, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	if err := database.DB.First(&baseline, c.Param("otherId")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	if !authorize(c, utils.ReportResource(report), utils.AccessView) ||
+		!authorize(c, utils.ReportResource(baseline), utils.AccessView) {
+		return
+	}
+	if report.ScheduleID == 0 || report.ScheduleID != baseline.ScheduleID {
+		c.Error(errors.NewBadRequestError("Only reports of the same schedule can be compared", nil))
+		return
+	}
+	for _, r := range []models.Report{report, baseline} {
+		if r.Status != utils.RunSuccess && r.Status != utils.RunPartial {
+			c.Error(errors.NewBadRequestError(fmt.Sprintf("Report %d has no content to compare", r.ID), nil))
+			return
+		}
+	}
+
+	var keys []string
+	for _, key := range strings.Split(c.Query("keys"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	comparison, err := utils.CompareReports(report, baseline, keys)
+	if err != nil {
+		if err == utils.ErrCompareUnsupported {
+			c.Error(errors.NewBadRequestError("Reports cannot be compared", err))
+			return
+		}
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":     "compare_reports",
+			"reportID":   report.ID,
+			"baselineID": baseline.ID,
+			"error":      err.Error(),
+		}).Error("Failed to compare reports")
+		c.Error(errors.WrapError(err, "Could not compare reports"))
+		return
+	}
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, comparison)
+	case utils.FormatXLSX:
+		content, err := utils.RenderComparisonXLSX(comparison)
+		if err != nil {
+			c.Error(errors.WrapError(err, "Could not render comparison"))
+			return
+		}
+		contentType, _ := utils.ReportFileType(utils.FormatXLSX)
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s_compare_%d_%d.xlsx", report.Name, report.ID, baseline.ID))
+		c.Header("Content-Length", strconv.Itoa(len(content)))
+		c.Data(http.StatusOK, contentType, content)
+	default:
+		c.Error(errors.NewBadRequestError("format must be json or xlsx", nil))
+	}
+}
+
+// validateTimezone checks that timezone is empty (server time) or a known IANA name
+func validateTimezone(timezone string) *errors.CustomError {
+	if timezone == "" {
+		return nil
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return errors.NewBadRequestError("Invalid timezone", err)
+	}
+	return nil
+}
+
+// validateEmailTemplates checks the subject and body templates of a schedule
+func validateEmailTemplates(subject, body string) *errors.CustomError {
+	if err := utils.ValidateEmailTemplate(subject); err != nil {
+		return errors.NewBadRequestError("Invalid email subject template", err)
+	}
+	if err := utils.ValidateEmailTemplate(body); err != nil {
+		return errors.NewBadRequestError("Invalid email body template", err)
+	}
+	return nil
+}
+
+// checkWebhookAccess ensures every webhook destination exists and is visible to the current user
+func checkWebhookAccess(c *gin.Context, ids []uint) *errors.CustomError {
+	for _, id := range ids {
+		var dest models.WebhookDestination
+		if err := database.DB.First(&dest, id).Error; err != nil {
+			return errors.NewBadRequestError(fmt.Sprintf("Webhook %d not found", id), nil)
+		}
+		if !subject(c).Can(utils.WebhookResource(dest), utils.AccessView) {
+			return errors.ErrForbidden
+		}
+	}
+	return nil
+}
+
+// checkScheduleContent checks that the current user may run the queries and read the charts and
+// templates a schedule includes. They are checked again against the owner when the schedule runs.
+func checkScheduleContent(c *gin.Context, queryIDs, chartIDs, templateIDs []uint) bool {
+	for _, id := range queryIDs {
+		if !authorizeReferenced(c, utils.ResourceQuery, id, utils.AccessExecute) {
+			return false
+		}
+	}
+	for _, id := range chartIDs {
+		if !authorizeReferenced(c, utils.ResourceChart, id, utils.AccessView) {
+			return false
+		}
+	}
+	for _, id := range templateIDs {
+		if !authorizeReferenced(c, utils.ResourceTemplate, id, utils.AccessView) {
+			return false
+		}
+	}
+	return true
 }
 
 // calculateNextRun calculates the next run time based on report type
@@ -337,12 +695,30 @@ func calculateNextRun(reportType string) time.Time {
 	}
 }
 
-// calculateNextRunFromCron calculates the next run time based on cron pattern
-func calculateNextRunFromCron(cronPattern string) time.Time {
-	parser := cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow)
-	schedule, err := parser.Parse(cronPattern)
-	if err != nil {
-		return time.Now()
+// ListReportDeliveries lists the per-recipient delivery status of a report
+func ListReportDeliveries(c *gin.Context) {
+	id := c.Param("id")
+
+	var report models.Report
+	if err := database.DB.Select("id", "user_id", "organization_id", "schedule_id").First(&report, id).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+
+	if !authorize(c, utils.ReportResource(report), utils.AccessView) {
+		return
 	}
-	return schedule.Next(time.Now())
+
+	var deliveries []models.ReportDelivery
+	if err := database.DB.Where("report_id = ?", report.ID).Order("id").Find(&deliveries).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":   "list_report_deliveries",
+			"reportID": report.ID,
+			"error":    err.Error(),
+		}).Error("Failed to list report deliveries")
+		c.Error(errors.WrapError(err, "Could not fetch report deliveries"))
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveries)
 }
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestListReportDeliveriesAsOwner(t *testing.T) {
+	r := newTestRouter(t, func(api *gin.RouterGroup) {
+		api.GET("/reports/:id/deliveries", ListReportDeliveries)
+	})
+	owner, token := createTestUser(t, "owner", "user")
+	_, otherToken := createTestUser(t, "other", "user")
+
+	orgID := utils.DefaultOrganizationID()
+	schedule := models.ReportSchedule{UserID: owner.ID, OrganizationID: orgID, Name: "sales", Type: "daily"}
+	database.DB.Create(&schedule)
+	report := models.Report{UserID: owner.ID, OrganizationID: orgID, ScheduleID: schedule.ID, Name: "sales"}
+	database.DB.Create(&report)
+	database.DB.Create(&models.ReportDelivery{ReportID: report.ID, ScheduleID: schedule.ID, Channel: "email",
+		Recipient: "ops@example.com", Status: "sent"})
+	path := fmt.Sprintf("/api/reports/%d/deliveries", report.ID)
+
+	w := doRequest(r, http.MethodGet, path, token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("owner = %d %s", w.Code, w.Body.String())
+	}
+	var deliveries []models.ReportDelivery
+	if err := json.Unmarshal(w.Body.Bytes(), &deliveries); err != nil || len(deliveries) != 1 || deliveries[0].Recipient != "ops@example.com" {
+		t.Fatalf("deliveries = %s, %v", w.Body.String(), err)
+	}
+
+	if w := doRequest(r, http.MethodGet, path, otherToken, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("other user = %d %s", w.Code, w.Body.String())
+	}
+}
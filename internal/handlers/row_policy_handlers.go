@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/errors"
+	"gobi/pkg/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// GetUserAttributes lists the attributes row policies filter a user's rows on. Users can read their own.
+func GetUserAttributes(c *gin.Context) {
+	var user models.User
+	if err := database.DB.First(&user, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	if user.ID != c.GetUint("userID") && !requirePermission(c, utils.PermManageUsers) {
+		return
+	}
+	attrs, err := utils.UserAttributes(user.ID)
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not fetch user attributes"))
+		return
+	}
+	c.JSON(http.StatusOK, attrs)
+}
+
+// SetUserAttributes replaces the attributes of a user with those of the request, e.g.
+// {"region": ["emea", "apac"], "department": ["sales"]}
+func SetUserAttributes(c *gin.Context) {
+	if !requirePermission(c, utils.PermManageUsers) {
+		return
+	}
+	var user models.User
+	if err := database.DB.First(&user, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	var req map[string][]string
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("Attributes must map names to lists of values", err))
+		return
+	}
+	var attrs []models.UserAttribute
+	for name, values := range req {
+		if err := utils.ValidateAttributeName(name); err != nil {
+			c.Error(errors.NewBadRequestError(err.Error(), nil))
+			return
+		}
+		seen := map[string]bool{}
+		for _, value := range values {
+			if value == "" || len(value) > 191 {
+				c.Error(errors.NewBadRequestError(fmt.Sprintf("Values of attribute %s must have 1 to 191 characters", name), nil))
+				return
+			}
+			if !seen[value] {
+				seen[value] = true
+				attrs = append(attrs, models.UserAttribute{UserID: user.ID, Name: name, Value: value})
+			}
+		}
+	}
+
+	before, err := utils.UserAttributes(user.ID)
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not fetch user attributes"))
+		return
+	}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.UserAttribute{}).Error; err != nil {
+			return err
+		}
+		if len(attrs) == 0 {
+			return nil
+		}
+		return tx.Create(&attrs).Error
+	})
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not save user attributes"))
+		return
+	}
+	after, _ := utils.UserAttributes(user.ID)
+
+	event := auditEvent(c, "user.attributes", "user", user.ID)
+	event.Changes = utils.AuditChanges(attributeAuditFields(before), attributeAuditFields(after))
+	utils.RecordAudit(event, map[string]interface{}{"username": user.Username})
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":   "set_user_attributes",
+		"userID":   c.GetUint("userID"),
+		"targetID": user.ID,
+	}).Info("User attributes saved")
+
+	c.JSON(http.StatusOK, after)
+}
+
+// attributeAuditFields makes user attributes comparable by utils.AuditChanges
+func attributeAuditFields(attrs map[string][]string) map[string]interface{} {
+	fields := make(map[string]interface{}, len(attrs))
+	for name, values := range attrs {
+		fields[name] = values
+	}
+	return fields
+}
+
+// ListRowPolicies lists the row policies on a data source or query given as
+// ?resource_type=datasource&resource_id=1
+func ListRowPolicies(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Query("resource_id"), 10, 64)
+	if err != nil {
+		c.Error(errors.NewBadRequestError("resource_id is required", err))
+		return
+	}
+	res, ok := loadGrantedResource(c, c.Query("resource_type"), uint(id))
+	if !ok {
+		return
+	}
+
+	policies := []models.RowPolicy{}
+	if err := database.DB.Where("resource_type = ? AND resource_id = ?", res.Type, res.ID).Order("id").Find(&policies).Error; err != nil {
+		c.Error(errors.WrapError(err, "Could not fetch row policies"))
+		return
+	}
+	c.JSON(http.StatusOK, policies)
+}
+
+// CreateRowPolicy adds a row policy to a data source or query, which needs own access to it
+func CreateRowPolicy(c *gin.Context) {
+	var req struct {
+		ResourceType string `json:"resource_type" binding:"required"`
+		ResourceID   uint   `json:"resource_id" binding:"required"`
+		Column       string `json:"column" binding:"required"`
+		Attribute    string `json:"attribute" binding:"required"`
+		Description  string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("Invalid row policy request", err))
+		return
+	}
+	policy := models.RowPolicy{
+		ResourceType: req.ResourceType,
+		ResourceID:   req.ResourceID,
+		ColumnName:   req.Column,
+		Attribute:    req.Attribute,
+		Description:  req.Description,
+		CreatedBy:    c.GetUint("userID"),
+	}
+	if err := utils.ValidateRowPolicy(policy); err != nil {
+		c.Error(errors.NewBadRequestError(err.Error(), nil))
+		return
+	}
+	res, ok := loadGrantedResource(c, policy.ResourceType, policy.ResourceID)
+	if !ok {
+		return
+	}
+	if err := database.DB.Create(&policy).Error; err != nil {
+		c.Error(errors.WrapError(err, "Could not create row policy"))
+		return
+	}
+
+	event := auditEvent(c, "row_policy.create", res.Type, res.ID)
+	event.Changes = utils.AuditChanges(nil, rowPolicyAuditFields(policy))
+	utils.RecordAudit(event, map[string]interface{}{"policy_id": policy.ID})
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":       "create_row_policy",
+		"userID":       c.GetUint("userID"),
+		"resourceType": res.Type,
+		"resourceID":   res.ID,
+		"policyID":     policy.ID,
+	}).Info("Row policy created")
+
+	c.JSON(http.StatusCreated, policy)
+}
+
+// DeleteRowPolicy removes a row policy, which needs own access to its data source or query
+func DeleteRowPolicy(c *gin.Context) {
+	var policy models.RowPolicy
+	if err := database.DB.First(&policy, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return
+	}
+	if _, ok := loadGrantedResource(c, policy.ResourceType, policy.ResourceID); !ok {
+		return
+	}
+	if err := database.DB.Unscoped().Delete(&policy).Error; err != nil {
+		c.Error(errors.WrapError(err, "Could not delete row policy"))
+		return
+	}
+
+	event := auditEvent(c, "row_policy.delete", policy.ResourceType, policy.ResourceID)
+	event.Changes = utils.AuditChanges(rowPolicyAuditFields(policy), nil)
+	utils.RecordAudit(event, map[string]interface{}{"policy_id": policy.ID})
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":   "delete_row_policy",
+		"userID":   c.GetUint("userID"),
+		"policyID": policy.ID,
+	}).Info("Row policy deleted")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Row policy deleted successfully"})
+}
+
+// requireUnfilteredDataSource refuses SQL written for a data source by a user whose rows its row policies
+// filter, since the SQL could rename or fake the filtered columns
+func requireUnfilteredDataSource(c *gin.Context, dataSourceID uint) bool {
+	filtered, err := utils.DataSourceRowFiltered(subject(c), dataSourceID)
+	if err != nil {
+		c.Error(errors.WrapError(err, "Could not load row policies"))
+		return false
+	}
+	if filtered {
+		auditDenied(c, utils.ResourceDataSource, dataSourceID, map[string]interface{}{"reason": "row policies"})
+		c.Error(errors.NewError(http.StatusForbidden, "Row policies of this data source filter your rows, so you cannot write SQL for it", nil))
+		return false
+	}
+	return true
+}
+
+func rowPolicyAuditFields(policy models.RowPolicy) map[string]interface{} {
+	return map[string]interface{}{"column": policy.ColumnName, "attribute": policy.Attribute}
+}
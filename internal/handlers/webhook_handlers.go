@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/errors"
+	"gobi/pkg/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookRequest is the body of the create and update webhook endpoints
+type webhookRequest struct {
+	Name            string   `json:"name"`
+	URL             string   `json:"url"`
+	Secret          *string  `json:"secret"`
+	PayloadTemplate *string  `json:"payload_template"`
+	Events          []string `json:"events"`
+	Active          *bool    `json:"active"`
+}
+
+// apply validates the request and copies the fields that were set onto dest
+func (req webhookRequest) apply(dest *models.WebhookDestination) *errors.CustomError {
+	if req.Name != "" {
+		dest.Name = req.Name
+	}
+	if req.URL != "" {
+		if err := utils.ValidateWebhookURL(req.URL); err != nil {
+			return errors.NewBadRequestError("Invalid webhook URL: "+err.Error(), nil)
+		}
+		dest.URL = req.URL
+	}
+	if req.Secret != nil {
+		dest.Secret = ""
+		if *req.Secret != "" {
+			encrypted, err := utils.EncryptAES(*req.Secret)
+			if err != nil {
+				return errors.WrapError(err, "Could not encrypt webhook secret")
+			}
+			dest.Secret = encrypted
+		}
+	}
+	if req.PayloadTemplate != nil {
+		if err := utils.ValidateWebhookTemplate(*req.PayloadTemplate); err != nil {
+			return errors.NewBadRequestError("Invalid payload template", err)
+		}
+		dest.PayloadTemplate = *req.PayloadTemplate
+	}
+	if req.Events != nil {
+		for _, event := range req.Events {
+			if !containsString(utils.WebhookEvents, event) {
+				return errors.NewBadRequestError("Unknown webhook event: "+event, nil)
+			}
+		}
+		dest.Events = strings.Join(req.Events, ",")
+	}
+	if req.Active != nil {
+		dest.Active = *req.Active
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookResponse hides the secret, only telling whether one is set
+func webhookResponse(dest models.WebhookDestination) gin.H {
+	return gin.H{
+		"ID":              dest.ID,
+		"CreatedAt":       dest.CreatedAt,
+		"UpdatedAt":       dest.UpdatedAt,
+		"UserID":          dest.UserID,
+		"Name":            dest.Name,
+		"URL":             dest.URL,
+		"HasSecret":       dest.Secret != "",
+		"PayloadTemplate": dest.PayloadTemplate,
+		"Events":          dest.Events,
+		"Active":          dest.Active,
+	}
+}
+
+// loadWebhook loads the destination of the request, checking that the current user has level access
+func loadWebhook(c *gin.Context, level string) (*models.WebhookDestination, bool) {
+	var dest models.WebhookDestination
+	if err := database.DB.First(&dest, c.Param("id")).Error; err != nil {
+		c.Error(errors.ErrNotFound)
+		return nil, false
+	}
+	if !authorize(c, utils.WebhookResource(dest), level) {
+		return nil, false
+	}
+	return &dest, true
+}
+
+// CreateWebhook creates a new webhook destination
+func CreateWebhook(c *gin.Context) {
+	var req webhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("Invalid webhook data", err))
+		return
+	}
+	if req.Name == "" || req.URL == "" {
+		c.Error(errors.NewBadRequestError("Name and URL are required", nil))
+		return
+	}
+
+	if !requireCreate(c, utils.ResourceWebhook) {
+		return
+	}
+
+	userID := c.GetUint("userID")
+	dest := models.WebhookDestination{UserID: userID, OrganizationID: c.GetUint("orgID"), Active: true}
+	if err := req.apply(&dest); err != nil {
+		c.Error(err)
+		return
+	}
+
+	if err := database.DB.Create(&dest).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action": "create_webhook",
+			"userID": userID,
+			"error":  err.Error(),
+		}).Error("Failed to create webhook")
+		c.Error(errors.WrapError(err, "Could not create webhook"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":        "create_webhook",
+		"userID":        userID,
+		"destinationID": dest.ID,
+	}).Info("Webhook created successfully")
+
+	c.JSON(http.StatusCreated, webhookResponse(dest))
+}
+
+// ListWebhooks lists the webhook destinations of the user
+func ListWebhooks(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var destinations []models.WebhookDestination
+	query := database.DB.Model(&models.WebhookDestination{}).Scopes(subject(c).Visible(utils.ResourceWebhook, "id", false))
+
+	if err := query.Find(&destinations).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action": "list_webhooks",
+			"userID": userID,
+			"error":  err.Error(),
+		}).Error("Failed to list webhooks")
+		c.Error(errors.WrapError(err, "Could not fetch webhooks"))
+		return
+	}
+
+	result := make([]gin.H, 0, len(destinations))
+	for _, dest := range destinations {
+		result = append(result, webhookResponse(dest))
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// GetWebhook gets a specific webhook destination
+func GetWebhook(c *gin.Context) {
+	dest, ok := loadWebhook(c, utils.AccessView)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, webhookResponse(*dest))
+}
+
+// UpdateWebhook updates a webhook destination
+func UpdateWebhook(c *gin.Context) {
+	dest, ok := loadWebhook(c, utils.AccessEdit)
+	if !ok {
+		return
+	}
+
+	var req webhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.NewBadRequestError("Invalid webhook data", err))
+		return
+	}
+	if err := req.apply(dest); err != nil {
+		c.Error(err)
+		return
+	}
+
+	if err := database.DB.Save(dest).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":        "update_webhook",
+			"destinationID": dest.ID,
+			"error":         err.Error(),
+		}).Error("Failed to update webhook")
+		c.Error(errors.WrapError(err, "Could not update webhook"))
+		return
+	}
+
+	c.JSON(http.StatusOK, webhookResponse(*dest))
+}
+
+// DeleteWebhook deletes a webhook destination
+func DeleteWebhook(c *gin.Context) {
+	dest, ok := loadWebhook(c, utils.AccessOwn)
+	if !ok {
+		return
+	}
+
+	if err := database.DB.Delete(dest).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":        "delete_webhook",
+			"destinationID": dest.ID,
+			"error":         err.Error(),
+		}).Error("Failed to delete webhook")
+		c.Error(errors.WrapError(err, "Could not delete webhook"))
+		return
+	}
+
+	utils.Logger.WithFields(map[string]interface{}{
+		"action":        "delete_webhook",
+		"userID":        c.GetUint("userID"),
+		"destinationID": dest.ID,
+	}).Info("Webhook deleted successfully")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+// TestWebhook sends a test event to a destination and returns the recorded delivery
+func TestWebhook(c *gin.Context) {
+	dest, ok := loadWebhook(c, utils.AccessExecute)
+	if !ok {
+		return
+	}
+
+	payload := utils.WebhookPayload{
+		Event:     utils.EventWebhookTest,
+		Text:      "Test event from Gobi for webhook " + strconv.Quote(dest.Name),
+		Timestamp: time.Now(),
+	}
+	c.JSON(http.StatusOK, utils.SendWebhook(*dest, payload, 0))
+}
+
+// ListWebhookDeliveries lists the delivery log of a destination, newest first
+func ListWebhookDeliveries(c *gin.Context) {
+	dest, ok := loadWebhook(c, utils.AccessView)
+	if !ok {
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		c.Error(errors.NewBadRequestError("limit must be between 1 and 500", err))
+		return
+	}
+	query := database.DB.Where("destination_id = ?", dest.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if event := c.Query("event"); event != "" {
+		query = query.Where("event = ?", event)
+	}
+
+	var deliveries []models.WebhookDelivery
+	if err := query.Order("id DESC").Limit(limit).Find(&deliveries).Error; err != nil {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":        "list_webhook_deliveries",
+			"destinationID": dest.ID,
+			"error":         err.Error(),
+		}).Error("Failed to list webhook deliveries")
+		c.Error(errors.WrapError(err, "Could not fetch webhook deliveries"))
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
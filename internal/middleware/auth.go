@@ -3,7 +3,9 @@ package middleware
 import (
 	"gobi/config"
 	"gobi/pkg/errors"
+	"gobi/pkg/utils"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -12,6 +14,11 @@ import (
 
 func AuthMiddleware(cfg *config.Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+			authenticateAPIKey(c, apiKey)
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.Error(errors.NewError(http.StatusUnauthorized, "Authorization header is required", nil))
@@ -25,6 +32,10 @@ func AuthMiddleware(cfg *config.Config) gin.HandlerFunc {
 			c.Abort()
 			return
 		}
+		if strings.HasPrefix(parts[1], utils.APIKeyPrefix) {
+			authenticateAPIKey(c, parts[1])
+			return
+		}
 
 		token, err := jwt.Parse(parts[1], func(token *jwt.Token) (interface{}, error) {
 			return []byte(cfg.JWT.Secret), nil
@@ -79,8 +90,123 @@ func AuthMiddleware(cfg *config.Config) gin.HandlerFunc {
 			return
 		}
 
+		// Tokens without an ID cannot be revoked and are no longer accepted
+		tokenID, _ := claims["jti"].(string)
+		if tokenID == "" {
+			c.Error(errors.ErrTokenMissingClaims)
+			c.Abort()
+			return
+		}
+		revoked, err := utils.IsTokenRevoked(tokenID)
+		if err != nil {
+			c.Error(errors.WrapError(err, "Could not verify token"))
+			c.Abort()
+			return
+		}
+		if revoked {
+			c.Error(errors.ErrTokenRevoked)
+			c.Abort()
+			return
+		}
+		sessionID, _ := claims["sid"].(string)
+		expiresAt, _ := claims.GetExpirationTime()
+
 		c.Set("userID", uint(userIDFloat))
 		c.Set("role", roleStr)
+		c.Set("tokenID", tokenID)
+		c.Set("sessionID", sessionID)
+		if expiresAt != nil {
+			c.Set("tokenExpiresAt", expiresAt.Time)
+		}
+		if !setOrganization(c, uint(userIDFloat), roleStr) || !requireOrganizationMFA(c, uint(userIDFloat)) {
+			return
+		}
 		c.Next()
 	}
 }
+
+// requireOrganizationMFA refuses requests of users without two-factor authentication to an organization
+// requiring it. Routes under /api/auth stay open so that the user can enroll.
+func requireOrganizationMFA(c *gin.Context, userID uint) bool {
+	if strings.HasPrefix(c.FullPath(), "/api/auth/") || !utils.OrganizationRequiresMFA(c.GetUint("orgID")) ||
+		utils.MFAEnabled(userID) {
+		return true
+	}
+	c.Error(errors.NewError(http.StatusForbidden,
+		"Two-factor authentication is required by this organization, enroll at /api/auth/mfa/enroll", nil))
+	c.Abort()
+	return false
+}
+
+// setOrganization resolves the organization the request acts in, given by the X-Organization-ID header
+// or else the user's first organization, and stores it with the user's role there
+func setOrganization(c *gin.Context, userID uint, role string) bool {
+	var requested uint
+	if header := c.GetHeader("X-Organization-ID"); header != "" {
+		id, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			c.Error(errors.NewBadRequestError("Invalid X-Organization-ID header", err))
+			c.Abort()
+			return false
+		}
+		requested = uint(id)
+	}
+	orgID, orgRole, err := utils.ResolveOrganization(userID, role, requested)
+	if err != nil {
+		if err == utils.ErrNotOrganizationMember {
+			c.Error(errors.NewError(http.StatusForbidden, "Not a member of this organization", nil))
+		} else {
+			c.Error(errors.WrapError(err, "Could not resolve organization"))
+		}
+		c.Abort()
+		return false
+	}
+	c.Set("orgID", orgID)
+	c.Set("orgRole", orgRole)
+	return true
+}
+
+// authenticateAPIKey authenticates a request by API key, given as a Bearer token or in X-API-Key, and
+// checks that the key was granted the scope of the route
+func authenticateAPIKey(c *gin.Context, raw string) {
+	key, user, err := utils.AuthenticateAPIKey(raw, c.ClientIP())
+	if err != nil {
+		if err == utils.ErrAPIKeyInvalid {
+			c.Error(errors.NewError(http.StatusUnauthorized, "Invalid API key", nil))
+		} else {
+			c.Error(errors.WrapError(err, "Could not verify API key"))
+		}
+		c.Abort()
+		return
+	}
+
+	scope := utils.RouteScope(c.Request.Method, c.FullPath())
+	if scope == "" || !utils.APIKeyHasScope(key, scope) {
+		utils.Logger.WithFields(map[string]interface{}{
+			"action":   "api_key_auth",
+			"apiKeyID": key.ID,
+			"userID":   user.ID,
+			"path":     c.FullPath(),
+			"scope":    scope,
+		}).Warn("API key lacks scope for route")
+		message := "API key cannot be used for this endpoint"
+		if scope != "" {
+			message = "API key lacks scope " + scope
+		}
+		c.Error(errors.NewError(http.StatusForbidden, message, nil))
+		c.Abort()
+		return
+	}
+
+	c.Set("userID", user.ID)
+	c.Set("role", user.Role)
+	c.Set("apiKeyID", key.ID)
+	if !setOrganization(c, user.ID, user.Role) {
+		return
+	}
+	// Service accounts cannot enroll in two-factor authentication, their keys are only created by admins
+	if !user.IsServiceAccount && !requireOrganizationMFA(c, user.ID) {
+		return
+	}
+	c.Next()
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"errors"
 	"time"
 
 	"gorm.io/gorm"
@@ -11,83 +12,490 @@ type User struct {
 	Username  string `gorm:"type:varchar(64);uniqueIndex"`
 	Email     string `gorm:"type:varchar(128);uniqueIndex"`
 	Password  string
-	Role      string    // admin or user
+	Role      string    // built-in role (viewer, analyst, editor, admin or the legacy user) or a custom role
 	LastLogin time.Time `json:"last_login"`
+	// Service accounts are used by automation through API keys and cannot log in interactively
+	IsServiceAccount bool `json:"is_service_account"`
+	// Users provisioned by single sign-on have the provider and their subject there, and no usable password
+	AuthProvider string `gorm:"size:32" json:"auth_provider,omitempty"`
+	ExternalID   string `gorm:"index;size:255" json:"-"`
+	// Directory users removed from the directory are disabled by the sync and cannot sign in
+	Disabled bool `json:"disabled"`
 }
 
 type DataSource struct {
 	gorm.Model
-	UserID      uint
-	User        User
-	Name        string
-	Type        string // mysql, postgres, sqlite, etc.
-	Host        string
-	Port        int
-	Database    string
-	Username    string
-	Password    string
-	Description string
-	IsPublic    bool
+	UserID         uint
+	User           User
+	OrganizationID uint `gorm:"index"`
+	Name           string
+	Type           string // mysql, postgres, sqlite, etc.
+	Host           string
+	Port           int
+	Database       string
+	Username       string
+	Password       string
+	Description    string
+	IsPublic       bool
 }
 
 type Query struct {
 	gorm.Model
-	UserID       uint
-	User         User
-	DataSourceID uint
-	DataSource   DataSource
+	UserID         uint
+	User           User
+	OrganizationID uint `gorm:"index"`
+	DataSourceID   uint
+	DataSource     DataSource
+	Name           string
+	SQL            string
+	Description    string
+	IsPublic       bool
+	ExecCount      int64 // 新增：执行次数
+	Version        int   // current version number, 0 for queries created before versioning
+}
+
+// QueryVersion is an immutable snapshot of a query, recorded on every create, update and restore
+type QueryVersion struct {
+	gorm.Model
+	QueryID      uint `gorm:"uniqueIndex:idx_query_version"`
+	Version      int  `gorm:"uniqueIndex:idx_query_version"`
 	Name         string
 	SQL          string
 	Description  string
-	IsPublic     bool
-	ExecCount    int64 // 新增：执行次数
+	DataSourceID uint
+	AuthorID     uint
+	Note         string // e.g. "Restored from version 3"
 }
 
 type Chart struct {
 	gorm.Model
-	QueryID     uint
-	Query       Query
-	UserID      uint
-	User        User
+	QueryID        uint
+	Query          Query
+	UserID         uint
+	User           User
+	OrganizationID uint `gorm:"index"`
+	Name           string
+	Type           string // bar, line, pie, scatter, radar, heatmap, gauge, funnel, 3d-bar, 3d-scatter, 3d-surface, 3d-bubble
+	Config         string // JSON configuration
+	Data           string // JSON data
+	Description    string `json:"description"`
+	Version        int    // current version number, 0 for charts created before versioning
+}
+
+// ChartVersion is an immutable snapshot of a chart's visualization, recorded on every save and kept when
+// the chart is deleted
+type ChartVersion struct {
+	gorm.Model
+	ChartID     uint `gorm:"uniqueIndex:idx_chart_version"`
+	Version     int  `gorm:"uniqueIndex:idx_chart_version"`
 	Name        string
-	Type        string // bar, line, pie, scatter, radar, heatmap, gauge, funnel, 3d-bar, 3d-scatter, 3d-surface, 3d-bubble
-	Config      string // JSON configuration
-	Data        string // JSON data
-	Description string `json:"description"`
+	Type        string
+	QueryID     uint
+	Config      string
+	Description string
+	AuthorID    uint
+	Note        string // e.g. "Rolled back to version 2"
 }
 
 type ExcelTemplate struct {
 	gorm.Model
-	UserID      uint
-	User        User
-	Name        string
-	Template    []byte
-	Description string `json:"description"`
+	UserID         uint
+	User           User
+	OrganizationID uint `gorm:"index"`
+	Name           string
+	Template       []byte // legacy inline content, empty once the file lives in blob storage
+	StorageKey     string // blob storage reference of the template file
+	Description    string `json:"description"`
+	Placeholders   string `json:"placeholders"` // JSON array of placeholders found at upload time
 }
 
 type Report struct {
 	gorm.Model
-	UserID      uint
-	User        User
-	Name        string
-	Type        string    // daily, weekly, monthly
-	Content     []byte    // report content in PDF or Excel format
-	GeneratedAt time.Time // when the report was generated
-	Status      string    // pending, success, failed
-	Error       string    // error message if generation failed
+	UserID         uint
+	User           User
+	OrganizationID uint `gorm:"index"`
+	ScheduleID     uint // schedule that produced the report
+	Name           string
+	Type           string     // daily, weekly, monthly
+	Format         string     // xlsx, pdf, csv-zip, html
+	Timezone       string     // IANA timezone of the schedule, used for file name stamping
+	Content        []byte     // legacy inline content, empty once the file lives in blob storage
+	StorageKey     string     // blob storage reference of the report file
+	Params         string     // JSON object of the query parameter values the report was generated with
+	GeneratedAt    time.Time  // when the report was generated
+	Status         string     // pending, retrying, success, partial, failed
+	Error          string     // error message if generation failed or why the report is partial
+	Attempts       int        // runs made to generate the report, retries included
+	NextRetryAt    *time.Time `gorm:"index"` // when a failed or partial run is retried, nil when no retry is due
 }
 
 type ReportSchedule struct {
 	gorm.Model
-	UserID      uint
-	User        User
-	Name        string
-	Type        string    // daily, weekly, monthly
-	Queries     string    // JSON array of query IDs to include
-	Charts      string    // JSON array of chart IDs to include
-	Templates   string    // JSON array of template IDs to use
-	LastRun     time.Time // last time the report was generated
-	NextRun     time.Time // next scheduled run time
-	Active      bool      // whether the schedule is active
-	CronPattern string    // cron pattern for scheduling
+	UserID         uint
+	User           User
+	OrganizationID uint `gorm:"index"`
+	Name           string
+	Type           string     // daily, weekly, monthly
+	Queries        string     // JSON array of query IDs to include
+	Charts         string     // JSON array of chart IDs to include
+	Templates      string     // JSON array of template IDs to use
+	Params         string     // JSON object binding query parameters to values or relative date macros
+	Format         string     // output format: xlsx, pdf, csv-zip, html
+	Recipients     string     // JSON array of email addresses the report is sent to
+	EmailSubject   string     // text/template for the email subject, empty for the default
+	EmailBody      string     // text/template for the email body, empty for the default
+	DeliveryMode   string     // attach: send the file, link: send a download link
+	Webhooks       string     // JSON array of webhook destination IDs notified after each run
+	LastRun        time.Time  // last time the report was generated
+	NextRun        time.Time  // next scheduled run time
+	Active         bool       // whether the schedule is active
+	CronPattern    string     // cron pattern for scheduling
+	Timezone       string     // IANA timezone the cron pattern and report dates use, empty for server time
+	MisfirePolicy  string     // skip, run_once or catch_up for runs found late
+	MaxRetries     int        // automatic retries of a failed or partial run
+	RetryDelay     int        // seconds between retries
+	RetentionCount int        // keep only the latest N reports, 0 keeps all
+	RetentionDays  int        // delete reports older than N days, 0 keeps them forever
+	LockedBy       string     // scheduler instance currently generating the report
+	LockedUntil    *time.Time // lease expiry; an expired lease can be claimed by another instance
+}
+
+// Blob holds file content for the database storage backend
+type Blob struct {
+	gorm.Model
+	Path string `gorm:"uniqueIndex;size:512"`
+	Data []byte
+}
+
+// ReportDelivery records the delivery of a report, or of an alert notification, to a single recipient
+type ReportDelivery struct {
+	gorm.Model
+	ReportID   uint `gorm:"index"`
+	ScheduleID uint
+	AlertID    uint   `gorm:"index"` // set instead of ReportID for alert notifications
+	Channel    string // email
+	Recipient  string
+	Status     string // pending, sent, failed
+	Attempts   int
+	Error      string // last error if delivery failed
+	SentAt     *time.Time
+}
+
+// WebhookDestination is an outbound HTTP endpoint notified about report runs
+type WebhookDestination struct {
+	gorm.Model
+	UserID          uint
+	User            User `json:"-"`
+	OrganizationID  uint `gorm:"index"`
+	Name            string
+	URL             string
+	Secret          string `json:"-"` // AES encrypted HMAC secret, empty to send unsigned requests
+	PayloadTemplate string // text/template rendering the request body, empty for the default JSON payload
+	Events          string // comma separated events to send (report.success, report.failure), empty for all
+	Active          bool
+}
+
+// WebhookDelivery records one event sent to a webhook destination
+type WebhookDelivery struct {
+	gorm.Model
+	DestinationID uint `gorm:"index"`
+	ReportID      uint
+	AlertID       uint `gorm:"index"`
+	Event         string
+	Status        string // pending, sent, failed
+	Attempts      int
+	StatusCode    int    // HTTP status of the last attempt
+	Error         string // last error if delivery failed
+	DeliveredAt   *time.Time
+}
+
+// ReportRun is one attempt at generating a report
+type ReportRun struct {
+	gorm.Model
+	ScheduleID  uint   `gorm:"index"`
+	ReportID    uint   `gorm:"index"`
+	TriggeredBy string // schedule, manual or rerun
+	Attempt     int    // 1 for the first attempt, increased by automatic retries
+	Status      string // running, success, partial, failed
+	StartedAt   time.Time
+	FinishedAt  *time.Time
+	DurationMs  int64
+	Error       string
+	Steps       []ReportRunStep `gorm:"foreignKey:RunID"`
+}
+
+// ReportRunStep records a single query, chart, template or render step of a run
+type ReportRunStep struct {
+	gorm.Model
+	RunID        uint   `gorm:"index"`
+	Kind         string // query, chart, template, template_query, render
+	RefID        uint   // ID of the query, chart or template
+	QueryID      uint   // query executed by a query, chart or template query step
+	QueryVersion int    // version of that query at execution time
+	Name         string
+	Status       string // success, failed
+	Rows         int
+	DurationMs   int64
+	Error        string
+}
+
+// Alert runs a query on a cron pattern and notifies when its conditions start or stop matching
+type Alert struct {
+	gorm.Model
+	UserID          uint
+	User            User `json:"-"`
+	OrganizationID  uint `gorm:"index"`
+	QueryID         uint
+	Name            string
+	Description     string
+	CronPattern     string     // cron pattern for evaluations
+	Timezone        string     // IANA timezone of the cron pattern and date macros, empty for server time
+	Params          string     // JSON object binding query parameters to values or relative date macros
+	Conditions      string     // JSON array of conditions evaluated on the query result
+	Match           string     // any: fire when one condition matches, all: when every condition matches
+	Recipients      string     // JSON array of email addresses notified of state changes
+	Webhooks        string     // JSON array of webhook destination IDs notified of state changes
+	NotifyResolved  bool       // also notify when a firing alert resolves
+	RepeatInterval  int        // seconds after which a still firing alert is notified again, 0 notifies once
+	Active          bool       // whether the alert is evaluated
+	State           string     // ok or firing
+	StateChangedAt  *time.Time // when the alert last started firing or resolved
+	LastEvaluatedAt *time.Time
+	LastNotifiedAt  *time.Time
+	LastError       string     // error of the last evaluation, empty when it succeeded
+	NextRun         time.Time  // next scheduled evaluation
+	LockedBy        string     // scheduler instance currently evaluating the alert
+	LockedUntil     *time.Time // lease expiry; an expired lease can be claimed by another instance
+}
+
+// AlertEvaluation records one evaluation of an alert
+type AlertEvaluation struct {
+	gorm.Model
+	AlertID      uint   `gorm:"index"`
+	State        string // state after the evaluation: ok or firing, empty when the evaluation failed
+	Rows         int
+	QueryVersion int    // version of the alert's query that was executed
+	Results      string // JSON array with the metric and outcome of each condition
+	Params       string // JSON object of the resolved query parameters
+	Notified     string // event sent for this evaluation: alert.firing, alert.resolved or empty
+	TriggeredBy  string // schedule or manual
+	Error        string
+	DurationMs   int64
+	EvaluatedAt  time.Time
+}
+
+// OIDCState is a pending single sign-on login, kept from the redirect to the provider until its callback
+type OIDCState struct {
+	gorm.Model
+	State        string `gorm:"uniqueIndex;size:64"`
+	Nonce        string `gorm:"size:64"`
+	CodeVerifier string `gorm:"size:128"` // PKCE verifier, whose challenge was sent with the authorization request
+	ExpiresAt    time.Time
+}
+
+// UserMFA is the TOTP second factor of a user, enabled once the user confirmed a first code
+type UserMFA struct {
+	gorm.Model
+	UserID    uint   `gorm:"uniqueIndex"`
+	Secret    string `json:"-"` // base32 TOTP secret, encrypted like data source passwords
+	Enabled   bool
+	EnabledAt *time.Time
+	LastStep  int64 `json:"-"` // time step of the last accepted code; codes of this and earlier steps are refused
+}
+
+// MFARecoveryCode is a single use code replacing a TOTP code, stored as a SHA-256 hash
+type MFARecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"index"`
+	CodeHash string `gorm:"size:64"`
+	UsedAt   *time.Time
+}
+
+// MFAChallenge is a login that passed the password check and waits for the second factor
+type MFAChallenge struct {
+	gorm.Model
+	UserID    uint
+	TokenHash string `gorm:"uniqueIndex;size:64"`
+	Attempts  int
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// ErrAuditEventImmutable is returned when an audit event is changed or deleted
+var ErrAuditEventImmutable = errors.New("audit events cannot be changed or deleted")
+
+// AuditEvent records a security relevant action. The log is append-only and hash chained: every event
+// stores the hash of its predecessor and a hash over its own fields and that link, so that changing or
+// removing an event breaks the chain.
+type AuditEvent struct {
+	ID             uint      `gorm:"primarykey" json:"id"`
+	CreatedAt      time.Time `gorm:"index" json:"created_at"`
+	ActorID        uint      `gorm:"index" json:"actor_id"`       // user who acted, 0 for the system or an unknown user
+	ActorName      string    `gorm:"size:64" json:"actor_name"`   // username at the time, also of unknown users failing to log in
+	Action         string    `gorm:"index;size:64" json:"action"` // e.g. auth.login, user.update, query.execute
+	ResourceType   string    `gorm:"index:idx_audit_resource;size:32" json:"resource_type"`
+	ResourceID     uint      `gorm:"index:idx_audit_resource" json:"resource_id"`
+	OrganizationID uint      `gorm:"index" json:"organization_id"`
+	Outcome        string    `gorm:"size:16" json:"outcome"` // success, failure or denied
+	IP             string    `gorm:"size:64" json:"ip"`
+	UserAgent      string    `json:"user_agent"`
+	Changes        string    `json:"changes"` // JSON object of changed fields with their before and after values
+	Details        string    `json:"details"` // JSON object
+	// PrevHash is unique so that concurrent writers cannot fork the chain; it is NULL only for events
+	// written before the chain was introduced and not sealed yet
+	PrevHash *string `gorm:"uniqueIndex;size:64" json:"prev_hash"`
+	Hash     string  `gorm:"size:64" json:"hash"`
+}
+
+func (AuditEvent) BeforeUpdate(*gorm.DB) error { return ErrAuditEventImmutable }
+
+func (AuditEvent) BeforeDelete(*gorm.DB) error { return ErrAuditEventImmutable }
+
+// PasswordHistory keeps the bcrypt hashes of a user's recent passwords, which cannot be used again
+type PasswordHistory struct {
+	gorm.Model
+	UserID uint   `gorm:"index"`
+	Hash   string `json:"-"`
+}
+
+// LoginThrottle counts failed logins of a username or client IP. Once too many failed in a row, logins
+// are locked until LockedUntil, for longer after each lockout.
+type LoginThrottle struct {
+	gorm.Model
+	Target      string `gorm:"uniqueIndex;size:191"` // user:<username> or ip:<address>
+	Failures    int    // failed logins since the last lockout or success
+	Lockouts    int    // lockouts in a row, doubling the lock duration
+	LockedUntil *time.Time
+	LastFailure time.Time
+}
+
+// RefreshToken is a single use refresh token, stored as a SHA-256 hash. Every refresh replaces it with a
+// new token of the same session, together with a new access token whose ID is kept for revocation.
+type RefreshToken struct {
+	gorm.Model
+	UserID          uint   `gorm:"index"`
+	SessionID       string `gorm:"index;size:64"` // shared by all tokens issued from one login
+	TokenHash       string `gorm:"uniqueIndex;size:64"`
+	AccessTokenID   string `gorm:"size:64"` // jti of the access token issued with this refresh token
+	AccessExpiresAt time.Time
+	ExpiresAt       time.Time
+	UsedAt          *time.Time // set when the token was exchanged; presenting it again revokes the session
+	RevokedAt       *time.Time
+	UserAgent       string
+	IP              string
+}
+
+// RevokedToken lists access tokens that must be rejected before they expire
+type RevokedToken struct {
+	gorm.Model
+	TokenID   string `gorm:"uniqueIndex;size:64"` // jti claim
+	UserID    uint
+	Reason    string
+	ExpiresAt time.Time `gorm:"index"` // the entry can be purged once the token has expired
+}
+
+// APIKey authenticates automated API calls as its user, limited to its scopes. The secret is stored as
+// a SHA-256 hash; Prefix is the visible start of the key used to identify it.
+type APIKey struct {
+	gorm.Model
+	UserID     uint `gorm:"index"`
+	User       User `json:"-"`
+	Name       string
+	Prefix     string `gorm:"uniqueIndex;size:32"`
+	SecretHash string `json:"-" gorm:"size:64"`
+	Scopes     string // JSON array of scopes, see utils.APIKeyScopes
+	CreatedBy  uint   // user who created the key, an admin for service account keys
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	LastUsedIP string
+	RevokedAt  *time.Time
+}
+
+// Role is a custom role; built-in roles are defined in code
+type Role struct {
+	gorm.Model
+	Name        string `gorm:"uniqueIndex;size:64"`
+	Description string
+	Permissions string // JSON array of permissions such as query.execute or chart.*
+}
+
+// Group is a set of users that resources can be granted to
+type Group struct {
+	gorm.Model
+	Name        string `gorm:"uniqueIndex;size:64"`
+	Description string
+}
+
+// GroupMember adds a user to a group
+type GroupMember struct {
+	gorm.Model
+	GroupID uint `gorm:"uniqueIndex:idx_group_member"`
+	UserID  uint `gorm:"uniqueIndex:idx_group_member;index"`
+}
+
+// ResourceGrant gives a user or group an access level on a data source, query, chart, template or
+// schedule. Grants are deleted rather than soft deleted, so that one can be given again.
+type ResourceGrant struct {
+	gorm.Model
+	ResourceType string `gorm:"uniqueIndex:idx_resource_grant;size:32"`
+	ResourceID   uint   `gorm:"uniqueIndex:idx_resource_grant"`
+	SubjectType  string `gorm:"uniqueIndex:idx_resource_grant;size:16"` // user or group
+	SubjectID    uint   `gorm:"uniqueIndex:idx_resource_grant"`
+	Access       string // view, execute, edit or own
+	GrantedBy    uint
+}
+
+// Organization is a tenant. Every resource belongs to one organization and is only visible to its members.
+type Organization struct {
+	gorm.Model
+	Name        string `gorm:"uniqueIndex;size:128"`
+	Description string
+	RequireMFA  bool `json:"require_mfa"` // members must enable two-factor authentication to act in the organization
+}
+
+// OrganizationMember makes a user a member of an organization. Organization admins manage its members
+// and teams and have full access to its resources.
+type OrganizationMember struct {
+	gorm.Model
+	OrganizationID uint   `gorm:"uniqueIndex:idx_org_member"`
+	UserID         uint   `gorm:"uniqueIndex:idx_org_member;index"`
+	Role           string // admin or member
+}
+
+// Team is a set of members of an organization that resources can be granted to
+type Team struct {
+	gorm.Model
+	OrganizationID uint   `gorm:"uniqueIndex:idx_team_name"`
+	Name           string `gorm:"uniqueIndex:idx_team_name;size:128"`
+	Description    string
+}
+
+// TeamMember adds an organization member to a team. Maintainers manage the team's members.
+type TeamMember struct {
+	gorm.Model
+	TeamID uint   `gorm:"uniqueIndex:idx_team_member"`
+	UserID uint   `gorm:"uniqueIndex:idx_team_member;index"`
+	Role   string // maintainer or member
+}
+
+// UserAttribute is a value of a user attribute, such as a region or department, that row policies filter
+// rows on. A user may have several values of one attribute. Attributes are deleted rather than soft
+// deleted, so that a value can be given again.
+type UserAttribute struct {
+	gorm.Model
+	UserID uint   `gorm:"uniqueIndex:idx_user_attribute"`
+	Name   string `gorm:"uniqueIndex:idx_user_attribute;size:64"`
+	Value  string `gorm:"uniqueIndex:idx_user_attribute;size:191"`
+}
+
+// RowPolicy limits the rows of a data source or query to those whose ColumnName holds a value of the
+// executing user's Attribute. Policies on a data source apply to every query on it.
+type RowPolicy struct {
+	gorm.Model
+	ResourceType string `gorm:"index:idx_row_policy_resource;size:32" json:"resource_type"` // datasource or query
+	ResourceID   uint   `gorm:"index:idx_row_policy_resource" json:"resource_id"`
+	ColumnName   string `gorm:"size:64" json:"column"`
+	Attribute    string `gorm:"size:64" json:"attribute"`
+	Description  string `json:"description"`
+	CreatedBy    uint   `json:"created_by"`
 }
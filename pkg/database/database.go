@@ -38,6 +38,36 @@ func InitDB(cfg *config.Config) error {
 		&models.ExcelTemplate{},
 		&models.Report{},
 		&models.ReportSchedule{},
+		&models.ReportDelivery{},
+		&models.ReportRun{},
+		&models.ReportRunStep{},
+		&models.WebhookDestination{},
+		&models.WebhookDelivery{},
+		&models.Blob{},
+		&models.Alert{},
+		&models.QueryVersion{},
+		&models.ChartVersion{},
+		&models.AlertEvaluation{},
+		&models.RefreshToken{},
+		&models.RevokedToken{},
+		&models.APIKey{},
+		&models.Role{},
+		&models.Group{},
+		&models.GroupMember{},
+		&models.ResourceGrant{},
+		&models.Organization{},
+		&models.OrganizationMember{},
+		&models.Team{},
+		&models.TeamMember{},
+		&models.OIDCState{},
+		&models.UserMFA{},
+		&models.MFARecoveryCode{},
+		&models.MFAChallenge{},
+		&models.AuditEvent{},
+		&models.PasswordHistory{},
+		&models.LoginThrottle{},
+		&models.UserAttribute{},
+		&models.RowPolicy{},
 	)
 	if err != nil {
 		return err
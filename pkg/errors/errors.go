@@ -41,6 +41,7 @@ var (
 	ErrTokenExpired       = &CustomError{Code: http.StatusUnauthorized, Message: "Token expired"}
 	ErrTokenNotValidYet   = &CustomError{Code: http.StatusUnauthorized, Message: "Token not valid yet"}
 	ErrTokenMissingClaims = &CustomError{Code: http.StatusUnauthorized, Message: "Token missing required claims"}
+	ErrTokenRevoked       = &CustomError{Code: http.StatusUnauthorized, Message: "Token has been revoked"}
 	ErrUserExists         = &CustomError{Code: http.StatusConflict, Message: "User already exists"}
 	ErrInvalidCredentials = &CustomError{Code: http.StatusUnauthorized, Message: "Invalid credentials"}
 )
@@ -123,3 +124,4 @@ func NewConflictError(msg string, err error) *CustomError {
 }
 
 var As = errors.As
+var Is = errors.Is
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"errors"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DatabaseStore keeps content in the blobs table of the main database
+type DatabaseStore struct{}
+
+func (DatabaseStore) Put(key string, data []byte) error {
+	blob := models.Blob{Path: key, Data: data}
+	return database.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "path"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "updated_at", "deleted_at"}),
+	}).Create(&blob).Error
+}
+
+func (DatabaseStore) Get(key string) ([]byte, error) {
+	var blob models.Blob
+	if err := database.DB.Where("path = ?", key).First(&blob).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return blob.Data, nil
+}
+
+func (DatabaseStore) Delete(key string) error {
+	return database.DB.Unscoped().Where("path = ?", key).Delete(&models.Blob{}).Error
+}
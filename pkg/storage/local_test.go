@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	store := LocalStore{Dir: t.TempDir()}
+	if err := store.Put("reports/2026/10/sales.csv", []byte("id,region\n")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Get("reports/2026/10/sales.csv")
+	if err != nil || string(data) != "id,region\n" {
+		t.Fatalf("Get = %q, %v", data, err)
+	}
+	if err := store.Put("reports/2026/10/sales.csv", []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := store.Get("reports/2026/10/sales.csv"); string(data) != "replaced" {
+		t.Fatalf("Get after overwrite = %q", data)
+	}
+	entries, _ := os.ReadDir(filepath.Join(store.Dir, "reports", "2026", "10"))
+	if len(entries) != 1 {
+		t.Fatalf("temporary files left behind: %v", entries)
+	}
+
+	if err := store.Delete("reports/2026/10/sales.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("reports/2026/10/sales.csv"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete = %v", err)
+	}
+	if err := store.Delete("reports/2026/10/sales.csv"); err != nil {
+		t.Fatalf("Delete of a missing key = %v", err)
+	}
+}
+
+func TestLocalStoreRejectsEscapingKeys(t *testing.T) {
+	root := t.TempDir()
+	store := LocalStore{Dir: filepath.Join(root, "blobs")}
+	for _, key := range []string{"", ".", "..", "../escaped", "reports/../../escaped", "/tmp/escaped", "a/../../../escaped"} {
+		if err := store.Put(key, []byte("x")); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+		if _, err := store.Get(key); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) = %v", key, err)
+		}
+		if err := store.Delete(key); err == nil {
+			t.Errorf("Delete(%q) succeeded", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("a file was written outside the store: %v", err)
+	}
+
+	// Keys that only look like they climb stay inside the directory
+	if err := store.Put("reports/../sales..csv", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(store.Dir, "sales..csv")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveAndLoadReferences(t *testing.T) {
+	previous, previousName, previousStores := Default, defaultName, stores
+	t.Cleanup(func() { Default, defaultName, stores = previous, previousName, previousStores })
+	stores = map[string]Store{}
+	Default, defaultName = nil, ""
+
+	Register(BackendLocal, LocalStore{Dir: t.TempDir()})
+	ref, err := Save("templates/7.xlsx", []byte("xlsx"))
+	if err != nil || ref != "local:templates/7.xlsx" {
+		t.Fatalf("Save = %q, %v", ref, err)
+	}
+	if data, err := Load(ref); err != nil || string(data) != "xlsx" {
+		t.Fatalf("Load = %q, %v", data, err)
+	}
+	if err := Remove(ref); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(ref); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Load after Remove = %v", err)
+	}
+	if err := Remove(""); err != nil {
+		t.Fatalf("Remove of an empty reference = %v", err)
+	}
+	for _, ref := range []string{"templates/7.xlsx", "local:", "s3:templates/7.xlsx"} {
+		if _, err := Load(ref); err == nil {
+			t.Errorf("Load(%q) succeeded", ref)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an httptest stand-in for a path-style S3 bucket that checks the Signature Version 4 of
+// every request before serving it from memory
+type fakeS3 struct {
+	*httptest.Server
+	t         *testing.T
+	accessKey string
+	secretKey string
+	region    string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	s := &fakeS3{t: t, accessKey: "AKIDEXAMPLE", secretKey: "secret", region: "eu-west-1", objects: map[string][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if msg := s.verify(r, body); msg != "" {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "<Error><Code>SignatureDoesNotMatch</Code><Message>"+msg+"</Message></Error>")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		s.objects[key] = body
+	case http.MethodGet:
+		data, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verify recomputes the signature from the request as received and returns why it does not match
+func (s *fakeS3) verify(r *http.Request, body []byte) string {
+	payloadSum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payloadSum[:])
+	if r.Header.Get("X-Amz-Content-Sha256") != payloadHash {
+		return "payload hash"
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) != len("20060102T150405Z") {
+		return "date"
+	}
+	scope := amzDate[:8] + "/" + s.region + "/s3/aws4_request"
+	prefix := "AWS4-HMAC-SHA256 Credential=" + s.accessKey + "/" + scope + ", SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return "credential"
+	}
+
+	canonical := r.Method + "\n" + r.URL.EscapedPath() + "\n" + r.URL.RawQuery + "\n" +
+		"host:" + r.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n\n" +
+		"host;x-amz-content-sha256;x-amz-date\n" + payloadHash
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{amzDate[:8], s.region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if strings.TrimPrefix(auth, prefix) != hex.EncodeToString(key) {
+		return "signature"
+	}
+	return ""
+}
+
+func (s *fakeS3) store() *S3Store {
+	return &S3Store{
+		Endpoint:  s.URL,
+		Region:    s.region,
+		Bucket:    "reports",
+		AccessKey: s.accessKey,
+		SecretKey: s.secretKey,
+		Prefix:    "gobi/",
+		PathStyle: true,
+		Client:    s.Client(),
+	}
+}
+
+func TestS3StoreRoundTrip(t *testing.T) {
+	fake := newFakeS3(t)
+	store := fake.store()
+
+	key := "reports/2026-10/Umsatz März (final).csv"
+	if err := store.Put(key, []byte("id,region\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["/reports/gobi/"+key]; !ok {
+		t.Fatalf("object not stored under bucket and prefix: %v", fake.objects)
+	}
+	data, err := store.Get(key)
+	if err != nil || string(data) != "id,region\n" {
+		t.Fatalf("Get = %q, %v", data, err)
+	}
+	if err := store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete = %v", err)
+	}
+	if err := store.Delete(key); err != nil {
+		t.Fatalf("Delete of a missing key = %v", err)
+	}
+}
+
+func TestS3StoreReportsErrors(t *testing.T) {
+	fake := newFakeS3(t)
+	store := fake.store()
+	store.SecretKey = "wrong"
+
+	err := store.Put("reports/1.csv", []byte("x"))
+	if err == nil || !strings.Contains(err.Error(), "status 403") || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Fatalf("Put with a wrong secret = %v", err)
+	}
+	if _, err := store.Get("reports/1.csv"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get with a wrong secret = %v", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Fatalf("unsigned request was served: %v", fake.objects)
+	}
+}
+
+func TestS3ObjectURL(t *testing.T) {
+	virtualHost := &S3Store{Endpoint: "https://s3.eu-west-1.amazonaws.com/", Bucket: "reports", Prefix: "gobi/"}
+	u, err := virtualHost.objectURL("a b/c+d.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := u.String(), "https://reports.s3.eu-west-1.amazonaws.com/gobi/a%20b/c%2Bd.csv"; got != want {
+		t.Fatalf("virtual host URL = %s, want %s", got, want)
+	}
+
+	pathStyle := &S3Store{Endpoint: "http://minio:9000", Bucket: "reports", PathStyle: true}
+	if u, _ := pathStyle.objectURL("1.csv"); u.String() != "http://minio:9000/reports/1.csv" {
+		t.Fatalf("path style URL = %s", u)
+	}
+	if _, err := (&S3Store{Endpoint: "minio:9000"}).objectURL("1.csv"); err == nil {
+		t.Fatal("endpoint without scheme accepted")
+	}
+}
@@ -0,0 +1,123 @@
+// Package storage keeps report and template files in a pluggable blob store: the main database, a local
+// directory or an S3-compatible bucket.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"gobi/config"
+	"strings"
+)
+
+// Backend names, also used as the prefix of stored references
+const (
+	BackendDatabase = "database"
+	BackendLocal    = "local"
+	BackendS3       = "s3"
+)
+
+// ErrNotFound is returned when a key does not exist in a store
+var ErrNotFound = errors.New("blob not found")
+
+// Store is a flat key/value store for file content
+type Store interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error // deleting a missing key is not an error
+}
+
+var (
+	// Default receives new content; it is chosen by storage.backend
+	Default     Store
+	defaultName string
+	// stores holds every backend that could be configured, so that references written before a change
+	// of storage.backend stay readable
+	stores = map[string]Store{}
+)
+
+// Init sets up the configured backends and selects the default one
+func Init(cfg *config.Config) error {
+	stores = map[string]Store{BackendDatabase: DatabaseStore{}}
+	if cfg.Storage.LocalDir != "" {
+		stores[BackendLocal] = LocalStore{Dir: cfg.Storage.LocalDir}
+	}
+	if cfg.Storage.S3.Endpoint != "" && cfg.Storage.S3.Bucket != "" {
+		s3cfg := cfg.Storage.S3
+		stores[BackendS3] = &S3Store{
+			Endpoint:  s3cfg.Endpoint,
+			Region:    s3cfg.Region,
+			Bucket:    s3cfg.Bucket,
+			AccessKey: s3cfg.AccessKey,
+			SecretKey: s3cfg.SecretKey,
+			Prefix:    s3cfg.Prefix,
+			PathStyle: s3cfg.PathStyle,
+		}
+	}
+
+	backend := cfg.Storage.Backend
+	if backend == "" {
+		backend = BackendDatabase
+	}
+	store, ok := stores[backend]
+	if !ok {
+		return fmt.Errorf("storage backend %q is unknown or not configured", backend)
+	}
+	Default, defaultName = store, backend
+	return nil
+}
+
+// Register replaces the store used for a backend name, and makes it the default when it is the current one
+func Register(name string, store Store) {
+	stores[name] = store
+	if defaultName == name || Default == nil {
+		Default, defaultName = store, name
+	}
+}
+
+// Save writes data under key in the default store and returns the reference to keep on the record,
+// "<backend>:<key>"
+func Save(key string, data []byte) (string, error) {
+	if Default == nil {
+		Default, defaultName = DatabaseStore{}, BackendDatabase
+	}
+	if err := Default.Put(key, data); err != nil {
+		return "", fmt.Errorf("failed to store %s in %s storage: %w", key, defaultName, err)
+	}
+	return defaultName + ":" + key, nil
+}
+
+// Load reads the content a reference points to
+func Load(ref string) ([]byte, error) {
+	store, key, err := resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(key)
+}
+
+// Remove deletes the content a reference points to; an empty reference is ignored
+func Remove(ref string) error {
+	if ref == "" {
+		return nil
+	}
+	store, key, err := resolve(ref)
+	if err != nil {
+		return err
+	}
+	return store.Delete(key)
+}
+
+func resolve(ref string) (Store, string, error) {
+	name, key, ok := strings.Cut(ref, ":")
+	if !ok || key == "" {
+		return nil, "", fmt.Errorf("invalid storage reference %q", ref)
+	}
+	store, ok := stores[name]
+	if !ok {
+		if name != BackendDatabase {
+			return nil, "", fmt.Errorf("storage backend %q of %q is not configured", name, ref)
+		}
+		store = DatabaseStore{}
+	}
+	return store, key, nil
+}
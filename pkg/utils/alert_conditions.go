@@ -0,0 +1,379 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Alert condition types
+const (
+	ConditionThreshold = "threshold"  // compares a column of the result with a value
+	ConditionRowCount  = "row_count"  // compares the number of result rows with a value
+	ConditionPctChange = "pct_change" // compares the percentage change of a metric since the previous evaluation
+	ConditionZScore    = "zscore"     // flags a metric that deviates from its recent history by Value standard deviations
+)
+
+const (
+	defaultZScoreWindow    = 20
+	maxZScoreWindow        = 500
+	minZScoreHistory       = 5 // previous values needed before a z-score is computed
+	defaultZScoreThreshold = 3
+)
+
+var alertOperators = []string{">", ">=", "<", "<=", "==", "!="}
+
+// alertAggregates reduce a column to a single metric; threshold conditions also accept any and all,
+// which compare every row and match when one or every row does
+var alertAggregates = []string{"sum", "avg", "min", "max", "count", "first", "last"}
+
+// AlertCondition is one rule evaluated on the result of an alert's query
+type AlertCondition struct {
+	Type      string  `json:"type"`
+	Column    string  `json:"column,omitempty"`
+	Aggregate string  `json:"aggregate,omitempty"` // any, all, sum, avg, min, max, count, first, last
+	Operator  string  `json:"operator,omitempty"`  // >, >=, <, <=, ==, !=; for zscore > or < restricts to spikes or drops
+	Value     float64 `json:"value"`
+	Window    int     `json:"window,omitempty"` // zscore: number of previous evaluations forming the baseline
+}
+
+// AlertConditionResult is the outcome of a condition in one evaluation. Metric values are kept so that
+// later evaluations can compute changes and z-scores against them.
+type AlertConditionResult struct {
+	Condition string   `json:"condition"`
+	Key       string   `json:"key,omitempty"` // identifies the metric across evaluations, e.g. sum(amount)
+	Metric    *float64 `json:"metric,omitempty"`
+	Baseline  *float64 `json:"baseline,omitempty"` // previous value for pct_change, mean for zscore
+	Score     *float64 `json:"score,omitempty"`    // percentage change or z-score
+	Matched   bool     `json:"matched"`
+	Note      string   `json:"note,omitempty"`
+}
+
+// ParseAlertConditions decodes the JSON conditions of an alert
+func ParseAlertConditions(text string) ([]AlertCondition, error) {
+	var conditions []AlertCondition
+	if strings.TrimSpace(text) == "" || text == "null" {
+		return conditions, nil
+	}
+	if err := json.Unmarshal([]byte(text), &conditions); err != nil {
+		return nil, err
+	}
+	return conditions, nil
+}
+
+// ValidateAlertConditions checks that every condition is complete and uses known types, operators and aggregates
+func ValidateAlertConditions(conditions []AlertCondition) error {
+	if len(conditions) == 0 {
+		return fmt.Errorf("at least one condition is required")
+	}
+	for i, cond := range conditions {
+		if err := validateAlertCondition(cond); err != nil {
+			return fmt.Errorf("condition %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func validateAlertCondition(cond AlertCondition) error {
+	switch cond.Type {
+	case ConditionThreshold:
+		if cond.Column == "" {
+			return fmt.Errorf("threshold conditions need a column")
+		}
+		if cond.Aggregate != "" && cond.Aggregate != "any" && cond.Aggregate != "all" && !containsAlertWord(alertAggregates, cond.Aggregate) {
+			return fmt.Errorf("unknown aggregate %q", cond.Aggregate)
+		}
+	case ConditionRowCount:
+	case ConditionPctChange, ConditionZScore:
+		if cond.Aggregate != "" && !containsAlertWord(alertAggregates, cond.Aggregate) {
+			return fmt.Errorf("unknown aggregate %q", cond.Aggregate)
+		}
+		if cond.Aggregate != "" && cond.Column == "" {
+			return fmt.Errorf("aggregate %s needs a column", cond.Aggregate)
+		}
+	default:
+		return fmt.Errorf("unknown condition type %q", cond.Type)
+	}
+
+	if cond.Type == ConditionZScore {
+		if cond.Operator != "" && cond.Operator != ">" && cond.Operator != "<" {
+			return fmt.Errorf("zscore conditions only accept the operators > and <")
+		}
+		if cond.Value < 0 {
+			return fmt.Errorf("zscore threshold must not be negative")
+		}
+		if cond.Window != 0 && (cond.Window < minZScoreHistory || cond.Window > maxZScoreWindow) {
+			return fmt.Errorf("window must be between %d and %d", minZScoreHistory, maxZScoreWindow)
+		}
+		return nil
+	}
+	if !containsAlertWord(alertOperators, cond.Operator) {
+		return fmt.Errorf("unknown operator %q", cond.Operator)
+	}
+	return nil
+}
+
+func containsAlertWord(words []string, word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// describeCondition renders a condition as a short expression for results and notifications
+func describeCondition(cond AlertCondition) string {
+	value := formatAlertNumber(cond.Value)
+	switch cond.Type {
+	case ConditionThreshold:
+		aggregate := cond.Aggregate
+		if aggregate == "" {
+			aggregate = "any"
+		}
+		return fmt.Sprintf("%s(%s) %s %s", aggregate, cond.Column, cond.Operator, value)
+	case ConditionRowCount:
+		return fmt.Sprintf("row_count %s %s", cond.Operator, value)
+	case ConditionPctChange:
+		return fmt.Sprintf("pct_change(%s) %s %s%%", metricKey(cond), cond.Operator, value)
+	default:
+		threshold := cond.Value
+		if threshold == 0 {
+			threshold = defaultZScoreThreshold
+		}
+		op := map[string]string{"": "|z| >=", ">": "z >=", "<": "z <="}[cond.Operator]
+		if cond.Operator == "<" {
+			threshold = -threshold
+		}
+		return fmt.Sprintf("zscore(%s) %s %s", metricKey(cond), op, formatAlertNumber(threshold))
+	}
+}
+
+// metricKey names the metric of a change or anomaly condition: the aggregate of a column, sum by
+// default, or the row count when no column is given
+func metricKey(cond AlertCondition) string {
+	if cond.Column == "" {
+		return "count(*)"
+	}
+	aggregate := cond.Aggregate
+	if aggregate == "" {
+		aggregate = "sum"
+	}
+	return fmt.Sprintf("%s(%s)", aggregate, cond.Column)
+}
+
+// alertHistory holds the metric values of previous evaluations, newest first, keyed by metricKey
+type alertHistory map[string][]float64
+
+// evaluateCondition applies one condition to a query result
+func evaluateCondition(cond AlertCondition, columns []string, rows []map[string]interface{}, history alertHistory) (AlertConditionResult, error) {
+	res := AlertConditionResult{Condition: describeCondition(cond)}
+	if cond.Column != "" && !containsAlertWord(columns, cond.Column) {
+		return res, fmt.Errorf("column %q is not in the query result", cond.Column)
+	}
+
+	switch cond.Type {
+	case ConditionRowCount:
+		count := float64(len(rows))
+		res.Metric = &count
+		res.Matched = compareAlertValue(count, cond.Operator, cond.Value)
+
+	case ConditionThreshold:
+		if cond.Aggregate != "" && cond.Aggregate != "any" && cond.Aggregate != "all" {
+			metric, ok := aggregateColumn(cond.Aggregate, cond.Column, rows)
+			if !ok {
+				res.Note = "no numeric values"
+				return res, nil
+			}
+			res.Metric = &metric
+			res.Matched = compareAlertValue(metric, cond.Operator, cond.Value)
+			return res, nil
+		}
+		numeric, matched := 0, 0
+		for _, row := range rows {
+			v, ok := toFloat(row[cond.Column])
+			if !ok {
+				continue
+			}
+			numeric++
+			if compareAlertValue(v, cond.Operator, cond.Value) {
+				if matched == 0 {
+					res.Metric = &v
+				}
+				matched++
+			}
+		}
+		if cond.Aggregate == "all" {
+			res.Matched = numeric > 0 && matched == numeric
+		} else {
+			res.Matched = matched > 0
+		}
+		res.Note = fmt.Sprintf("%d of %d rows match", matched, numeric)
+
+	case ConditionPctChange:
+		res.Key = metricKey(cond)
+		metric, ok := conditionMetric(cond, rows)
+		if !ok {
+			res.Note = "no numeric values"
+			return res, nil
+		}
+		res.Metric = &metric
+		previous := history[res.Key]
+		if len(previous) == 0 {
+			res.Note = "no previous value"
+			return res, nil
+		}
+		prev := previous[0]
+		res.Baseline = &prev
+		if prev == 0 {
+			res.Note = "previous value is zero"
+			return res, nil
+		}
+		change := roundAlertNumber((metric - prev) / math.Abs(prev) * 100)
+		res.Score = &change
+		res.Matched = compareAlertValue(change, cond.Operator, cond.Value)
+
+	case ConditionZScore:
+		res.Key = metricKey(cond)
+		metric, ok := conditionMetric(cond, rows)
+		if !ok {
+			res.Note = "no numeric values"
+			return res, nil
+		}
+		res.Metric = &metric
+		window := cond.Window
+		if window == 0 {
+			window = defaultZScoreWindow
+		}
+		previous := history[res.Key]
+		if len(previous) > window {
+			previous = previous[:window]
+		}
+		if len(previous) < minZScoreHistory {
+			res.Note = fmt.Sprintf("%d of %d previous values needed", len(previous), minZScoreHistory)
+			return res, nil
+		}
+		mean, stddev := meanStddev(previous)
+		mean = roundAlertNumber(mean)
+		res.Baseline = &mean
+		threshold := cond.Value
+		if threshold == 0 {
+			threshold = defaultZScoreThreshold
+		}
+		if stddev == 0 {
+			// Any departure from a perfectly flat history is anomalous
+			res.Note = "previous values have no variance"
+			res.Matched = (metric > mean && cond.Operator != "<") || (metric < mean && cond.Operator != ">")
+			return res, nil
+		}
+		z := roundAlertNumber((metric - mean) / stddev)
+		res.Score = &z
+		switch cond.Operator {
+		case ">":
+			res.Matched = z >= threshold
+		case "<":
+			res.Matched = z <= -threshold
+		default:
+			res.Matched = math.Abs(z) >= threshold
+		}
+	}
+	return res, nil
+}
+
+// conditionMetric computes the metric of a change or anomaly condition
+func conditionMetric(cond AlertCondition, rows []map[string]interface{}) (float64, bool) {
+	if cond.Column == "" {
+		return float64(len(rows)), true
+	}
+	aggregate := cond.Aggregate
+	if aggregate == "" {
+		aggregate = "sum"
+	}
+	return aggregateColumn(aggregate, cond.Column, rows)
+}
+
+// aggregateColumn reduces the numeric values of a column; non-numeric values are ignored. Sum and count
+// of an empty column are 0, the other aggregates have no value.
+func aggregateColumn(aggregate, column string, rows []map[string]interface{}) (float64, bool) {
+	var values []float64
+	for _, row := range rows {
+		if v, ok := toFloat(row[column]); ok {
+			values = append(values, v)
+		}
+	}
+	switch aggregate {
+	case "count":
+		return float64(len(values)), true
+	case "sum":
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum, true
+	}
+	if len(values) == 0 {
+		return 0, false
+	}
+	switch aggregate {
+	case "avg":
+		mean, _ := meanStddev(values)
+		return mean, true
+	case "min":
+		lo := values[0]
+		for _, v := range values[1:] {
+			lo = math.Min(lo, v)
+		}
+		return lo, true
+	case "max":
+		hi := values[0]
+		for _, v := range values[1:] {
+			hi = math.Max(hi, v)
+		}
+		return hi, true
+	case "first":
+		return values[0], true
+	default:
+		return values[len(values)-1], true
+	}
+}
+
+func compareAlertValue(v float64, operator string, value float64) bool {
+	switch operator {
+	case ">":
+		return v > value
+	case ">=":
+		return v >= value
+	case "<":
+		return v < value
+	case "<=":
+		return v <= value
+	case "==":
+		return v == value
+	case "!=":
+		return v != value
+	}
+	return false
+}
+
+// meanStddev returns the mean and population standard deviation of values
+func meanStddev(values []float64) (float64, float64) {
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(values)))
+}
+
+func roundAlertNumber(v float64) float64 {
+	return math.Round(v*10000) / 10000
+}
+
+func formatAlertNumber(v float64) string {
+	return fmt.Sprintf("%g", roundAlertNumber(v))
+}
@@ -0,0 +1,443 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"strings"
+	"time"
+)
+
+// Alert states
+const (
+	AlertOK     = "ok"
+	AlertFiring = "firing"
+)
+
+// Alert match modes
+const (
+	MatchAny = "any" // fire when one condition matches
+	MatchAll = "all" // fire when every condition matches
+)
+
+// ErrAlertBusy is returned by EvaluateAlertNow while another evaluation of the alert holds its lease
+var ErrAlertBusy = errors.New("alert is already being evaluated")
+
+// checkAlerts claims due alerts while worker slots are free and evaluates them in the background,
+// sharing the workers and leasing of report schedules
+func checkAlerts() {
+	now := time.Now()
+	var alerts []models.Alert
+	if err := database.DB.Where("active = ? AND next_run <= ? AND (locked_until IS NULL OR locked_until < ?)", true, now, now).
+		Order("next_run").Find(&alerts).Error; err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action": "check_alerts",
+			"error":  err.Error(),
+		}).Error("Failed to fetch alerts")
+		return
+	}
+
+	for _, alert := range alerts {
+		select {
+		case workerSlots <- struct{}{}:
+		default:
+			Logger.WithFields(map[string]interface{}{
+				"action":  "check_alerts",
+				"workers": cap(workerSlots),
+			}).Info("All workers are busy, leaving remaining alerts for the next check")
+			return
+		}
+
+		claimed, err := claimAlert(&alert, now)
+		if err != nil || !claimed {
+			<-workerSlots
+			if err != nil {
+				Logger.WithFields(map[string]interface{}{
+					"action":  "check_alerts",
+					"alertID": alert.ID,
+					"error":   err.Error(),
+				}).Error("Failed to claim alert")
+			}
+			continue
+		}
+
+		workersDone.Add(1)
+		go func() {
+			defer workersDone.Done()
+			defer func() { <-workerSlots }()
+			runClaimedAlert(&alert)
+		}()
+	}
+}
+
+// claimAlert takes the lease of a due alert, see claimSchedule
+func claimAlert(alert *models.Alert, now time.Time) (bool, error) {
+	result := database.DB.Model(&models.Alert{}).
+		Where("id = ? AND active = ? AND next_run <= ? AND (locked_until IS NULL OR locked_until < ?)", alert.ID, true, now, now).
+		Updates(map[string]interface{}{"locked_by": schedulerID, "locked_until": now.Add(schedulerLease())})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	return true, database.DB.First(alert, alert.ID).Error
+}
+
+// runClaimedAlert evaluates an alert, sends its notifications and releases the lease with the next run
+// time. Missed evaluations are never caught up: an alert only cares about the current result.
+func runClaimedAlert(alert *models.Alert) {
+	stop := keepModelLease(&models.Alert{}, alert.ID)
+	defer stop()
+
+	eval, results := evaluateAlert(alert, TriggerSchedule)
+	notifyAlert(alert, eval, results)
+
+	// Pick up a cron pattern or timezone edited during the evaluation
+	var current models.Alert
+	if err := database.DB.Select("id", "cron_pattern", "timezone").First(&current, alert.ID).Error; err == nil {
+		alert.CronPattern = current.CronPattern
+		alert.Timezone = current.Timezone
+	}
+	nextRun := NextRunTime(alert.CronPattern, alert.Timezone, time.Now())
+	if err := releaseModelLease(&models.Alert{}, alert.ID, map[string]interface{}{"next_run": nextRun}); err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action":  "evaluate_alert",
+			"alertID": alert.ID,
+			"error":   err.Error(),
+		}).Error("Failed to update alert next run time")
+	}
+}
+
+// EvaluateAlertNow evaluates an alert immediately, leaving its next scheduled evaluation unchanged.
+// State changes are recorded before it returns; notifications are sent in the background.
+func EvaluateAlertNow(alert *models.Alert) (models.AlertEvaluation, error) {
+	now := time.Now()
+	result := database.DB.Model(&models.Alert{}).
+		Where("id = ? AND (locked_until IS NULL OR locked_until < ?)", alert.ID, now).
+		Updates(map[string]interface{}{"locked_by": schedulerID, "locked_until": now.Add(schedulerLease())})
+	if result.Error != nil {
+		return models.AlertEvaluation{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return models.AlertEvaluation{}, ErrAlertBusy
+	}
+
+	eval, results := evaluateAlert(alert, TriggerManual)
+	releaseModelLease(&models.Alert{}, alert.ID, nil)
+
+	if eval.Notified != "" {
+		snapshot := *alert
+		workersDone.Add(1)
+		go func() {
+			defer workersDone.Done()
+			notifyAlert(&snapshot, eval, results)
+		}()
+	}
+	return eval, nil
+}
+
+// evaluateAlert runs the alert's query, evaluates its conditions and records the evaluation together
+// with the resulting state. A failed evaluation is recorded but leaves the state unchanged, so that an
+// unreachable data source neither fires nor resolves an alert.
+func evaluateAlert(alert *models.Alert, trigger string) (models.AlertEvaluation, []AlertConditionResult) {
+	start := time.Now()
+	eval := models.AlertEvaluation{AlertID: alert.ID, TriggeredBy: trigger, EvaluatedAt: start}
+
+	results, err := runAlertConditions(alert, start, &eval)
+	if encoded, jsonErr := json.Marshal(results); jsonErr == nil {
+		eval.Results = string(encoded)
+	}
+	eval.DurationMs = time.Since(start).Milliseconds()
+
+	updates := map[string]interface{}{"last_evaluated_at": start}
+	if err != nil {
+		eval.Error = err.Error()
+		updates["last_error"] = eval.Error
+		Logger.WithFields(map[string]interface{}{
+			"action":  "evaluate_alert",
+			"alertID": alert.ID,
+			"error":   err.Error(),
+		}).Warn("Alert evaluation failed")
+	} else {
+		eval.State = AlertOK
+		if alertMatches(alert.Match, results) {
+			eval.State = AlertFiring
+		}
+		eval.Notified = alertTransition(alert, eval.State, start)
+		updates["last_error"] = ""
+		updates["state"] = eval.State
+		if eval.State != alert.State {
+			updates["state_changed_at"] = start
+			alert.StateChangedAt = &start
+		}
+		if eval.Notified != "" {
+			updates["last_notified_at"] = start
+			alert.LastNotifiedAt = &start
+		}
+		alert.State = eval.State
+	}
+	alert.LastEvaluatedAt = &start
+	alert.LastError = eval.Error
+
+	if err := database.DB.Create(&eval).Error; err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action":  "evaluate_alert",
+			"alertID": alert.ID,
+			"error":   err.Error(),
+		}).Error("Failed to save alert evaluation")
+	}
+	if err := database.DB.Model(&models.Alert{}).Where("id = ?", alert.ID).Updates(updates).Error; err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action":  "evaluate_alert",
+			"alertID": alert.ID,
+			"error":   err.Error(),
+		}).Error("Failed to update alert state")
+	}
+	return eval, results
+}
+
+// runAlertConditions executes the query of an alert as its owner and evaluates every condition,
+// recording the query version, parameters and row count in eval
+func runAlertConditions(alert *models.Alert, now time.Time, eval *models.AlertEvaluation) ([]AlertConditionResult, error) {
+	conditions, err := ParseAlertConditions(alert.Conditions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid conditions: %w", err)
+	}
+	var query models.Query
+	if err := database.DB.First(&query, alert.QueryID).Error; err != nil {
+		return nil, fmt.Errorf("query %d not found", alert.QueryID)
+	}
+	if !userCan(alert.UserID, QueryResource(query), AccessExecute) {
+		return nil, fmt.Errorf("access to query %d denied", alert.QueryID)
+	}
+	eval.QueryVersion = query.Version
+
+	bindings, err := ParseParamBindings(alert.Params)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameters: %w", err)
+	}
+	params, err := ResolveParamBindings(bindings, now.In(ScheduleLocation(alert.Timezone)))
+	if err != nil {
+		return nil, err
+	}
+	encodedParams, _ := json.Marshal(params)
+	eval.Params = string(encodedParams)
+
+	columns, rows, err := RunSavedQueryAsUser(alert.UserID, query, params)
+	if err != nil {
+		return nil, err
+	}
+	eval.Rows = len(rows)
+
+	history, err := loadAlertHistory(alert.ID, conditions)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]AlertConditionResult, 0, len(conditions))
+	for i, cond := range conditions {
+		res, err := evaluateCondition(cond, columns, rows, history)
+		if err != nil {
+			return results, fmt.Errorf("condition %d: %w", i+1, err)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// loadAlertHistory collects the metrics recorded by the latest successful evaluations, as many as the
+// largest z-score window needs
+func loadAlertHistory(alertID uint, conditions []AlertCondition) (alertHistory, error) {
+	limit := 0
+	for _, cond := range conditions {
+		switch cond.Type {
+		case ConditionPctChange:
+			limit = max(limit, 1)
+		case ConditionZScore:
+			window := cond.Window
+			if window == 0 {
+				window = defaultZScoreWindow
+			}
+			limit = max(limit, window)
+		}
+	}
+	history := alertHistory{}
+	if limit == 0 {
+		return history, nil
+	}
+
+	var evals []models.AlertEvaluation
+	if err := database.DB.Select("id", "results").Where("alert_id = ? AND error = ?", alertID, "").
+		Order("id DESC").Limit(limit).Find(&evals).Error; err != nil {
+		return nil, err
+	}
+	for _, eval := range evals {
+		var results []AlertConditionResult
+		if json.Unmarshal([]byte(eval.Results), &results) != nil {
+			continue
+		}
+		// Conditions may share a metric; count each evaluation once per metric
+		seen := map[string]bool{}
+		for _, res := range results {
+			if res.Key == "" || res.Metric == nil || seen[res.Key] {
+				continue
+			}
+			seen[res.Key] = true
+			history[res.Key] = append(history[res.Key], *res.Metric)
+		}
+	}
+	return history, nil
+}
+
+func alertMatches(match string, results []AlertConditionResult) bool {
+	if len(results) == 0 {
+		return false
+	}
+	for _, res := range results {
+		if match == MatchAll && !res.Matched {
+			return false
+		}
+		if match != MatchAll && res.Matched {
+			return true
+		}
+	}
+	return match == MatchAll
+}
+
+// alertTransition decides which event, if any, an evaluation notifies. Only a change of state is
+// notified, so a firing alert does not repeat itself on every evaluation unless a repeat interval is set.
+func alertTransition(alert *models.Alert, state string, now time.Time) string {
+	switch {
+	case state == AlertFiring && alert.State != AlertFiring:
+		return EventAlertFiring
+	case state == AlertFiring && alert.RepeatInterval > 0 &&
+		(alert.LastNotifiedAt == nil || now.Sub(*alert.LastNotifiedAt) >= time.Duration(alert.RepeatInterval)*time.Second):
+		return EventAlertFiring
+	case state == AlertOK && alert.State == AlertFiring && alert.NotifyResolved:
+		return EventAlertResolved
+	}
+	return ""
+}
+
+// notifyAlert sends the event of an evaluation to the alert's webhooks and email recipients
+func notifyAlert(alert *models.Alert, eval models.AlertEvaluation, results []AlertConditionResult) {
+	if eval.Notified == "" {
+		return
+	}
+	payload := alertWebhookPayload(alert, eval, results)
+	Logger.WithFields(map[string]interface{}{
+		"action":  "notify_alert",
+		"alertID": alert.ID,
+		"event":   eval.Notified,
+	}).Info(payload.Text)
+
+	var ids []uint
+	if alert.Webhooks != "" && json.Unmarshal([]byte(alert.Webhooks), &ids) == nil && len(ids) > 0 {
+		var destinations []models.WebhookDestination
+		if err := database.DB.Where("id IN ? AND active = ?", ids, true).Find(&destinations).Error; err != nil {
+			Logger.WithFields(map[string]interface{}{
+				"action":  "notify_alert",
+				"alertID": alert.ID,
+				"error":   err.Error(),
+			}).Error("Failed to load webhook destinations")
+		}
+		for _, dest := range destinations {
+			if webhookWants(dest, payload.Event) && userCan(alert.UserID, WebhookResource(dest), AccessView) {
+				SendWebhook(dest, payload, 0)
+			}
+		}
+	}
+
+	var recipients []string
+	if alert.Recipients == "" || json.Unmarshal([]byte(alert.Recipients), &recipients) != nil {
+		return
+	}
+	subject, body := alertEmail(alert, eval, results)
+	for _, recipient := range recipients {
+		delivery := models.ReportDelivery{
+			AlertID:   alert.ID,
+			Channel:   "email",
+			Recipient: recipient,
+			Status:    "pending",
+		}
+		database.DB.Create(&delivery)
+		sendReportMail(&delivery, subject, body, nil)
+		if err := database.DB.Save(&delivery).Error; err != nil {
+			Logger.WithFields(map[string]interface{}{
+				"action":    "notify_alert",
+				"alertID":   alert.ID,
+				"recipient": recipient,
+				"error":     err.Error(),
+			}).Error("Failed to save alert delivery")
+		}
+	}
+}
+
+func alertWebhookPayload(alert *models.Alert, eval models.AlertEvaluation, results []AlertConditionResult) WebhookPayload {
+	text := fmt.Sprintf("Alert %q resolved", alert.Name)
+	if eval.Notified == EventAlertFiring {
+		var matched []string
+		for _, res := range results {
+			if res.Matched {
+				matched = append(matched, res.Condition+describeResult(res))
+			}
+		}
+		text = fmt.Sprintf("Alert %q is firing: %s", alert.Name, strings.Join(matched, "; "))
+	}
+	return WebhookPayload{
+		Event:     eval.Notified,
+		Text:      text,
+		Timestamp: time.Now(),
+		Alert: &WebhookAlert{
+			ID:          alert.ID,
+			Name:        alert.Name,
+			State:       eval.State,
+			QueryID:     alert.QueryID,
+			Conditions:  results,
+			EvaluatedAt: eval.EvaluatedAt.In(ScheduleLocation(alert.Timezone)),
+		},
+	}
+}
+
+// describeResult renders the observed values of a condition, e.g. " (value 42, change -35.2%)"
+func describeResult(res AlertConditionResult) string {
+	var parts []string
+	if res.Metric != nil {
+		parts = append(parts, "value "+formatAlertNumber(*res.Metric))
+	}
+	if res.Baseline != nil {
+		parts = append(parts, "baseline "+formatAlertNumber(*res.Baseline))
+	}
+	if res.Score != nil {
+		if strings.HasPrefix(res.Condition, ConditionPctChange) {
+			parts = append(parts, fmt.Sprintf("change %+g%%", *res.Score))
+		} else {
+			parts = append(parts, fmt.Sprintf("z %+g", *res.Score))
+		}
+	}
+	if res.Note != "" {
+		parts = append(parts, res.Note)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
+
+func alertEmail(alert *models.Alert, eval models.AlertEvaluation, results []AlertConditionResult) (string, string) {
+	state := "FIRING"
+	if eval.Notified == EventAlertResolved {
+		state = "RESOLVED"
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Alert \"%s\" is %s.\n\n", alert.Name, strings.ToLower(state))
+	fmt.Fprintf(&sb, "Evaluated at %s, query returned %d rows.\n\n",
+		eval.EvaluatedAt.In(ScheduleLocation(alert.Timezone)).Format("2006-01-02 15:04:05 MST"), eval.Rows)
+	for _, res := range results {
+		mark := "ok"
+		if res.Matched {
+			mark = "MATCHED"
+		}
+		fmt.Fprintf(&sb, "- [%s] %s%s\n", mark, res.Condition, describeResult(res))
+	}
+	return fmt.Sprintf("[%s] %s", state, alert.Name), sb.String()
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APIKeyPrefix starts every API key, which tells them apart from JWTs in the Authorization header
+const APIKeyPrefix = "gobi_"
+
+var ErrAPIKeyInvalid = errors.New("API key is invalid, expired or revoked")
+
+// APIKeyScopes lists the scopes an API key can be granted. Routes of a resource need its read scope for
+// GET requests and its write scope otherwise; executing a query needs queries:execute.
+var APIKeyScopes = []string{
+	"queries:read", "queries:execute", "queries:write",
+	"datasources:read", "datasources:write",
+	"charts:read", "charts:write",
+	"templates:read", "templates:write",
+	"reports:read", "reports:write",
+	"alerts:read", "alerts:write",
+	"webhooks:read", "webhooks:write",
+	"dashboard:read",
+}
+
+// ValidateAPIKeyScopes checks that scopes is a non-empty list of known scopes
+func ValidateAPIKeyScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, s := range APIKeyScopes {
+			if s == scope {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+// RouteScope returns the scope an API key needs for a route, given its method and registered path such
+// as /api/queries/:id/execute. Routes outside the scoped resources, such as user, cache and API key
+// management, cannot be called with an API key and return an empty scope.
+func RouteScope(method, path string) string {
+	resource := strings.SplitN(strings.TrimPrefix(path, "/api/"), "/", 2)[0]
+	switch resource {
+	case "queries", "datasources", "charts", "templates", "reports", "alerts", "webhooks", "dashboard":
+	default:
+		return ""
+	}
+	if method == "GET" || method == "HEAD" {
+		return resource + ":read"
+	}
+	if resource == "queries" && strings.HasSuffix(path, "/execute") {
+		return "queries:execute"
+	}
+	if resource == "dashboard" {
+		return ""
+	}
+	return resource + ":write"
+}
+
+// APIKeyHasScope reports whether key was granted scope
+func APIKeyHasScope(key models.APIKey, scope string) bool {
+	var scopes []string
+	if err := json.Unmarshal([]byte(key.Scopes), &scopes); err != nil {
+		return false
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateAPIKey creates the secret of a new key and stores the key. The returned key is shown once;
+// only its visible prefix and a hash are stored.
+func GenerateAPIKey(tx *gorm.DB, key *models.APIKey) (string, error) {
+	id := make([]byte, 6)
+	secret := make([]byte, 32)
+	rand.Read(id)
+	rand.Read(secret)
+	key.Prefix = APIKeyPrefix + hex.EncodeToString(id)
+	raw := key.Prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	key.SecretHash = hashAPIKey(raw)
+	if err := tx.Create(key).Error; err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+func hashAPIKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuthenticateAPIKey looks up an API key and its owner and records its use
+func AuthenticateAPIKey(raw, ip string) (models.APIKey, models.User, error) {
+	var key models.APIKey
+	var user models.User
+	// The secret may contain underscores, the hex ID after APIKeyPrefix does not
+	if !strings.HasPrefix(raw, APIKeyPrefix) {
+		return key, user, ErrAPIKeyInvalid
+	}
+	i := strings.Index(raw[len(APIKeyPrefix):], "_")
+	if i <= 0 {
+		return key, user, ErrAPIKeyInvalid
+	}
+	if err := database.DB.Where("prefix = ?", raw[:len(APIKeyPrefix)+i]).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return key, user, ErrAPIKeyInvalid
+		}
+		return key, user, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.SecretHash), []byte(hashAPIKey(raw))) != 1 {
+		return key, user, ErrAPIKeyInvalid
+	}
+	now := time.Now()
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && now.After(*key.ExpiresAt)) {
+		return key, user, ErrAPIKeyInvalid
+	}
+	if err := database.DB.First(&user, key.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return key, user, ErrAPIKeyInvalid
+		}
+		return key, user, err
+	}
+	if user.Disabled {
+		return key, user, ErrAPIKeyInvalid
+	}
+
+	// Keys used in a loop would otherwise write on every request
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > time.Minute || key.LastUsedIP != ip {
+		key.LastUsedAt = &now
+		key.LastUsedIP = ip
+		if err := database.DB.Model(&models.APIKey{}).Where("id = ?", key.ID).
+			Updates(map[string]interface{}{"last_used_at": &now, "last_used_ip": ip}).Error; err != nil {
+			Logger.WithFields(map[string]interface{}{
+				"action":   "api_key_auth",
+				"apiKeyID": key.ID,
+				"error":    err.Error(),
+			}).Warn("Failed to record API key use")
+		}
+	}
+	return key, user, nil
+}
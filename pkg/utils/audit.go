@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"reflect"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Outcomes of audited actions
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied"
+)
+
+// auditAppendAttempts bounds the retries of an append that lost the race for the chain head to
+// another instance
+const auditAppendAttempts = 5
+
+// auditMu serializes appends of this instance, so that they do not race each other for the chain head
+var auditMu sync.Mutex
+
+// RecordAudit appends an event to the audit log. Failures are logged rather than returned, so that the
+// audited action itself is not undone.
+func RecordAudit(event models.AuditEvent, details map[string]interface{}) {
+	if details != nil {
+		if b, err := json.Marshal(details); err == nil {
+			event.Details = string(b)
+		}
+	}
+	if event.Outcome == "" {
+		event.Outcome = AuditSuccess
+	}
+	if event.ActorName == "" && event.ActorID != 0 {
+		var actor models.User
+		if database.DB.Unscoped().Select("username").Limit(1).Find(&actor, event.ActorID).Error == nil {
+			event.ActorName = actor.Username
+		}
+	}
+	// Stored timestamps keep milliseconds on every database, and the hash must match what is read back
+	event.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	var err error
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		if err = appendAuditEvent(database.DB, event); err == nil {
+			return
+		}
+	}
+	Logger.WithFields(map[string]interface{}{
+		"action":      "audit",
+		"auditAction": event.Action,
+		"actorID":     event.ActorID,
+		"error":       err.Error(),
+	}).Error("Could not write audit event")
+}
+
+// appendAuditEvent links an event to the current head of the chain and inserts it. The unique PrevHash
+// makes the insert fail when another writer appended to the same head first.
+func appendAuditEvent(db *gorm.DB, event models.AuditEvent) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var head models.AuditEvent
+		if err := tx.Where("prev_hash IS NOT NULL").Order("id DESC").Limit(1).Find(&head).Error; err != nil {
+			return err
+		}
+		prev := head.Hash
+		event.ID = 0
+		event.PrevHash = &prev
+		event.Hash = AuditEventHash(event, prev)
+		return tx.Create(&event).Error
+	})
+}
+
+// AuditEventHash returns the SHA-256 hash chaining an event to the hash of its predecessor
+func AuditEventHash(e models.AuditEvent, prevHash string) string {
+	payload, _ := json.Marshal([]interface{}{
+		prevHash, e.CreatedAt.UTC().Format(time.RFC3339Nano), e.ActorID, e.ActorName, e.Action, e.ResourceType,
+		e.ResourceID, e.OrganizationID, e.Outcome, e.IP, e.UserAgent, e.Changes, e.Details,
+	})
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// SQLHash identifies an executed SQL statement in the audit log without recording its text. It is taken
+// of the SQL as authored, before parameters are bound and row policies wrap it, so that every execution of
+// a query has the same hash whoever runs it.
+func SQLHash(sql string) string {
+	sum := sha256.Sum256([]byte(sql))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditChanges returns the fields whose value differs between before and after, as a JSON object of
+// {"field": {"before": ..., "after": ...}}, or "" when nothing changed
+func AuditChanges(before, after map[string]interface{}) string {
+	changes := make(map[string]map[string]interface{})
+	for field, old := range before {
+		if value, ok := after[field]; !ok || !reflect.DeepEqual(old, value) {
+			changes[field] = map[string]interface{}{"before": old, "after": value}
+		}
+	}
+	for field, value := range after {
+		if _, ok := before[field]; !ok {
+			changes[field] = map[string]interface{}{"before": nil, "after": value}
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(changes)
+	return string(b)
+}
+
+// SealAuditLog chains the events written before the audit log was hash chained, in the order they
+// were written. It runs at startup, before new events are appended.
+func SealAuditLog() error {
+	var unsealed int64
+	if err := database.DB.Model(&models.AuditEvent{}).Where("prev_hash IS NULL").Count(&unsealed).Error; err != nil {
+		return err
+	}
+	if unsealed == 0 {
+		return nil
+	}
+	// Skip the hooks refusing updates, this is the one time events get their hashes
+	db := database.DB.Session(&gorm.Session{SkipHooks: true})
+	prev := ""
+	var events []models.AuditEvent
+	err := db.Order("id").FindInBatches(&events, 500, func(tx *gorm.DB, batch int) error {
+		for _, e := range events {
+			if e.PrevHash == nil {
+				link := prev
+				e.Hash = AuditEventHash(e, link)
+				if err := db.Model(&models.AuditEvent{}).Where("id = ?", e.ID).
+					Updates(map[string]interface{}{"prev_hash": link, "hash": e.Hash}).Error; err != nil {
+					return err
+				}
+			}
+			prev = e.Hash
+		}
+		return nil
+	}).Error
+	if err == nil {
+		Logger.WithFields(map[string]interface{}{
+			"action": "audit_seal",
+			"events": unsealed,
+		}).Info("Audit events chained")
+	}
+	return err
+}
+
+// AuditVerification is the result of checking the hash chain of the audit log
+type AuditVerification struct {
+	Events   int64  `json:"events"`
+	Valid    bool   `json:"valid"`
+	BrokenAt uint   `json:"broken_at,omitempty"` // first event whose link or hash does not match
+	Reason   string `json:"reason,omitempty"`
+	// HeadHash is the hash of the last event. Keeping it outside of Gobi also reveals removed trailing events.
+	HeadHash string `json:"head_hash"`
+}
+
+// VerifyAuditLog recomputes the hash chain of the audit log, stopping at the first broken event
+func VerifyAuditLog() (AuditVerification, error) {
+	var result AuditVerification
+	prev := ""
+	var events []models.AuditEvent
+	err := database.DB.Order("id").FindInBatches(&events, 500, func(tx *gorm.DB, batch int) error {
+		for _, e := range events {
+			result.Events++
+			switch {
+			case e.PrevHash == nil:
+				result.Reason = "event is not chained"
+			case *e.PrevHash != prev:
+				result.Reason = "event does not link to its predecessor, an event before it was removed or changed"
+			case AuditEventHash(e, prev) != e.Hash:
+				result.Reason = "event content does not match its hash"
+			}
+			if result.Reason != "" {
+				result.BrokenAt = e.ID
+				return errAuditChainBroken
+			}
+			prev = e.Hash
+		}
+		return nil
+	}).Error
+	if err == errAuditChainBroken {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	result.Valid = true
+	result.HeadHash = prev
+	return result, nil
+}
+
+var errAuditChainBroken = errors.New("audit chain broken")
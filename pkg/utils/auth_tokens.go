@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"gobi/config"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, the session has been revoked")
+)
+
+// TokenPair is the response of a login or refresh
+type TokenPair struct {
+	AccessToken      string    `json:"access_token"`
+	TokenType        string    `json:"token_type"`
+	ExpiresIn        int       `json:"expires_in"` // seconds until the access token expires
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+func accessTokenLifetime() time.Duration {
+	if m := config.AppConfig.JWT.AccessTokenMinutes; m > 0 {
+		return time.Duration(m) * time.Minute
+	}
+	return 15 * time.Minute
+}
+
+func refreshTokenLifetime() time.Duration {
+	if h := config.AppConfig.JWT.ExpirationHours; h > 0 {
+		return time.Duration(h) * time.Hour
+	}
+	return 7 * 24 * time.Hour
+}
+
+// newTokenID returns a random URL safe identifier with the given number of random bytes
+func newTokenID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashRefreshToken is the form a refresh token is stored and looked up in
+func hashRefreshToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueTokenPair starts a new session for user and returns its first access and refresh token
+func IssueTokenPair(user models.User, userAgent, ip string) (TokenPair, error) {
+	return issueTokenPair(database.DB, user, newTokenID(16), userAgent, ip)
+}
+
+func issueTokenPair(tx *gorm.DB, user models.User, sessionID, userAgent, ip string) (TokenPair, error) {
+	now := time.Now()
+	accessID := newTokenID(16)
+	accessExpires := now.Add(accessTokenLifetime())
+	access := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": user.ID,
+		"role":    user.Role,
+		"jti":     accessID,
+		"sid":     sessionID,
+		"iat":     now.Unix(),
+		"exp":     accessExpires.Unix(),
+	})
+	signed, err := access.SignedString([]byte(config.AppConfig.JWT.Secret))
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	raw := newTokenID(32)
+	refresh := models.RefreshToken{
+		UserID:          user.ID,
+		SessionID:       sessionID,
+		TokenHash:       hashRefreshToken(raw),
+		AccessTokenID:   accessID,
+		AccessExpiresAt: accessExpires,
+		ExpiresAt:       now.Add(refreshTokenLifetime()),
+		UserAgent:       userAgent,
+		IP:              ip,
+	}
+	if err := tx.Create(&refresh).Error; err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:      signed,
+		TokenType:        "Bearer",
+		ExpiresIn:        int(accessExpires.Sub(now).Seconds()),
+		RefreshToken:     raw,
+		RefreshExpiresAt: refresh.ExpiresAt,
+	}, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new token pair of the same session. Each refresh
+// token can be used once: presenting a used token again means it was stolen or replayed, so the whole
+// session is revoked and ErrRefreshTokenReused returned.
+func RotateRefreshToken(raw, userAgent, ip string) (TokenPair, error) {
+	var token models.RefreshToken
+	if err := database.DB.Where("token_hash = ?", hashRefreshToken(raw)).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return TokenPair{}, ErrRefreshTokenInvalid
+		}
+		return TokenPair{}, err
+	}
+	if token.RevokedAt != nil || time.Now().After(token.ExpiresAt) {
+		return TokenPair{}, ErrRefreshTokenInvalid
+	}
+	if token.UsedAt != nil {
+		return TokenPair{}, revokeReusedSession(token)
+	}
+
+	var pair TokenPair
+	reused := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// Only one of concurrent requests with the same token may use it
+		now := time.Now()
+		res := tx.Model(&models.RefreshToken{}).
+			Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", token.ID).
+			Update("used_at", &now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			reused = true
+			return nil
+		}
+
+		// The role is read again so that the new access token carries the current one
+		var user models.User
+		if err := tx.First(&user, token.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRefreshTokenInvalid
+			}
+			return err
+		}
+		var err error
+		pair, err = issueTokenPair(tx, user, token.SessionID, userAgent, ip)
+		return err
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if reused {
+		return TokenPair{}, revokeReusedSession(token)
+	}
+	return pair, nil
+}
+
+func revokeReusedSession(token models.RefreshToken) error {
+	Logger.WithFields(map[string]interface{}{
+		"action":    "refresh_token",
+		"userID":    token.UserID,
+		"sessionID": token.SessionID,
+	}).Warn("Refresh token reused, revoking session")
+	if err := RevokeSession(token.SessionID, "refresh token reused"); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// RevokeSession revokes the refresh tokens of a session and the access tokens issued with them
+func RevokeSession(sessionID, reason string) error {
+	return revokeRefreshTokens("session_id", sessionID, reason)
+}
+
+// RevokeUserTokens signs a user out everywhere by revoking all of their refresh and access tokens. It
+// is called when a user is deleted, their password is reset or their role changes.
+func RevokeUserTokens(userID uint, reason string) error {
+	return revokeRefreshTokens("user_id", userID, reason)
+}
+
+// revokeRefreshTokens revokes the refresh tokens whose column equals value, together with the access
+// tokens issued with them that have not expired yet
+func revokeRefreshTokens(column string, value interface{}, reason string) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		var tokens []models.RefreshToken
+		if err := tx.Where(column+" = ?", value).Where("access_expires_at > ? OR (revoked_at IS NULL AND expires_at > ?)", now, now).
+			Find(&tokens).Error; err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			if token.AccessExpiresAt.After(now) {
+				if err := revokeAccessToken(tx, token.AccessTokenID, token.UserID, token.AccessExpiresAt, reason); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Model(&models.RefreshToken{}).Where(column+" = ?", value).Where("revoked_at IS NULL").
+			Update("revoked_at", &now).Error
+	})
+}
+
+// RevokeAccessToken adds an access token to the revocation list until it expires
+func RevokeAccessToken(tokenID string, userID uint, expiresAt time.Time, reason string) error {
+	return revokeAccessToken(database.DB, tokenID, userID, expiresAt, reason)
+}
+
+func revokeAccessToken(tx *gorm.DB, tokenID string, userID uint, expiresAt time.Time, reason string) error {
+	if tokenID == "" {
+		return nil
+	}
+	revoked := models.RevokedToken{TokenID: tokenID, UserID: userID, Reason: reason, ExpiresAt: expiresAt}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&revoked).Error
+}
+
+// IsTokenRevoked reports whether the access token with the given jti has been revoked
+func IsTokenRevoked(tokenID string) (bool, error) {
+	var count int64
+	if err := database.DB.Model(&models.RevokedToken{}).Where("token_id = ?", tokenID).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// purgeExpiredTokens deletes refresh tokens and revocation entries that can no longer be presented
+func purgeExpiredTokens() {
+	now := time.Now()
+	res := database.DB.Unscoped().Where("expires_at < ?", now).Delete(&models.RevokedToken{})
+	if res.Error != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action": "purge_tokens",
+			"error":  res.Error.Error(),
+		}).Error("Failed to purge revoked tokens")
+		return
+	}
+	revoked := res.RowsAffected
+	res = database.DB.Unscoped().Where("expires_at < ? AND access_expires_at < ?", now, now).Delete(&models.RefreshToken{})
+	if res.Error != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action": "purge_tokens",
+			"error":  res.Error.Error(),
+		}).Error("Failed to purge refresh tokens")
+		return
+	}
+	if revoked > 0 || res.RowsAffected > 0 {
+		Logger.WithFields(map[string]interface{}{
+			"action":        "purge_tokens",
+			"revokedTokens": revoked,
+			"refreshTokens": res.RowsAffected,
+		}).Info("Expired tokens purged")
+	}
+}
@@ -40,6 +40,20 @@ func DeleteQueryCache(key string) {
 
 // ExecuteSQL connects to the given data source and executes the SQL, returning the result as []map[string]interface{} or error
 func ExecuteSQL(ds models.DataSource, sqlStr string) ([]map[string]interface{}, error) {
+	_, results, err := ExecuteSQLWithColumns(ds, sqlStr)
+	return results, err
+}
+
+// ExecuteSQLWithColumns works like ExecuteSQL but also returns the column names in the order reported by the driver,
+// which callers writing tabular output need since map iteration order is random. args are passed to the driver
+// for the placeholders in sqlStr.
+func ExecuteSQLWithColumns(ds models.DataSource, sqlStr string, args ...interface{}) ([]string, []map[string]interface{}, error) {
+	return ExecuteSQLWithLimit(ds, 0, sqlStr, args...)
+}
+
+// ExecuteSQLWithLimit works like ExecuteSQLWithColumns but stops reading once maxRows rows were read, so that
+// callers showing a sample do not fetch the whole result; maxRows <= 0 reads every row
+func ExecuteSQLWithLimit(ds models.DataSource, maxRows int, sqlStr string, args ...interface{}) ([]string, []map[string]interface{}, error) {
 	var dsn, driver string
 	switch ds.Type {
 	case "mysql":
@@ -52,34 +66,34 @@ func ExecuteSQL(ds models.DataSource, sqlStr string) ([]map[string]interface{},
 		driver = "sqlite3"
 		dsn = ds.Database
 	default:
-		return nil, fmt.Errorf("unsupported data source type: %s", ds.Type)
+		return nil, nil, fmt.Errorf("unsupported data source type: %s", ds.Type)
 	}
 	db, err := sql.Open(driver, dsn)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer db.Close()
 
-	rows, err := db.Query(sqlStr)
+	rows, err := db.Query(sqlStr, args...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer rows.Close()
 
 	cols, err := rows.Columns()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	results := []map[string]interface{}{}
-	for rows.Next() {
+	for (maxRows <= 0 || len(results) < maxRows) && rows.Next() {
 		columns := make([]interface{}, len(cols))
 		scanArgs := make([]interface{}, len(cols))
 		for i := range columns {
 			scanArgs[i] = &columns[i]
 		}
 		if err := rows.Scan(scanArgs...); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		rowMap := make(map[string]interface{})
 		for i, col := range cols {
@@ -93,7 +107,7 @@ func ExecuteSQL(ds models.DataSource, sqlStr string) ([]map[string]interface{},
 		}
 		results = append(results, rowMap)
 	}
-	return results, nil
+	return cols, results, nil
 }
 
 // EncryptAES 加密明文，返回 base64 字符串
@@ -0,0 +1,390 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"sort"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	chartImageWidth  = 640
+	chartImageHeight = 400
+	chartImageMargin = 40
+)
+
+// chartPalette follows the default colors used by the frontend charts
+var chartPalette = []color.RGBA{
+	{0x18, 0x90, 0xff, 0xff},
+	{0x2f, 0xc2, 0x5b, 0xff},
+	{0xfa, 0xcc, 0x14, 0xff},
+	{0xf5, 0x22, 0x2d, 0xff},
+	{0x13, 0xc2, 0xc2, 0xff},
+	{0x72, 0x2e, 0xd1, 0xff},
+}
+
+// renderChartImage draws a static PNG of a chart. It is embedded in workbooks for chart types Excel has
+// no native equivalent for, and used for every chart in PDF and HTML reports.
+// 3D charts are rendered as a flat projection of x/y with z mapped to color.
+func renderChartImage(chartType string, opts chartOptions, columns []string, results []map[string]interface{}) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, chartImageWidth, chartImageHeight))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	drawLabel(img, chartImageMargin, 24, opts.Title, color.Black)
+
+	xCol := columnIndex(columns, opts.XField, 0)
+	yCol := columnIndex(columns, opts.YField, -1)
+	if yCol < 0 {
+		if cols := valueColumns(columns, results, opts, xCol); len(cols) > 0 {
+			yCol = cols[0]
+		} else {
+			yCol = xCol
+		}
+	}
+	zCol := columnIndex(columns, opts.ZField, -1)
+	if zCol < 0 && len(columns) > 2 {
+		zCol = 2
+	}
+
+	switch chartType {
+	case "heatmap", "3d-surface":
+		if zCol < 0 {
+			return nil, fmt.Errorf("chart type %s needs three columns", chartType)
+		}
+		drawHeatmap(img, results, columns[xCol], columns[yCol], columns[zCol])
+	case "gauge":
+		drawGauge(img, results, columns[yCol], opts.Max)
+	case "funnel":
+		drawFunnel(img, results, columns[xCol], columns[yCol])
+	case "line":
+		drawLine(img, results, columns[xCol], columns[yCol])
+	case "pie":
+		drawPie(img, results, columns[xCol], columns[yCol])
+	case "scatter":
+		drawProjection(img, results, columns[xCol], columns[yCol], "", "")
+	case "3d-scatter", "3d-bubble", "3d-bar":
+		zName := ""
+		if zCol >= 0 {
+			zName = columns[zCol]
+		}
+		drawProjection(img, results, columns[xCol], columns[yCol], zName, opts.SizeField)
+	default:
+		drawBars(img, results, columns[xCol], columns[yCol])
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drawHeatmap lays the distinct x and y values out as a grid and shades each cell by its z value
+func drawHeatmap(img *image.RGBA, results []map[string]interface{}, xName, yName, zName string) {
+	xs, ys := distinctLabels(results, xName), distinctLabels(results, yName)
+	minZ, maxZ := valueRange(results, zName)
+	plot := plotArea()
+	cellW := plot.Dx() / max(len(xs), 1)
+	cellH := plot.Dy() / max(len(ys), 1)
+
+	for _, row := range results {
+		xi := indexOf(xs, fmt.Sprint(row[xName]))
+		yi := indexOf(ys, fmt.Sprint(row[yName]))
+		z, _ := toFloat(row[zName])
+		cell := image.Rect(plot.Min.X+xi*cellW, plot.Min.Y+yi*cellH, plot.Min.X+(xi+1)*cellW-1, plot.Min.Y+(yi+1)*cellH-1)
+		draw.Draw(img, cell, &image.Uniform{heatColor(normalize(z, minZ, maxZ))}, image.Point{}, draw.Src)
+	}
+	for i, x := range xs {
+		drawLabel(img, plot.Min.X+i*cellW+2, plot.Max.Y+14, x, color.Black)
+	}
+	for i, y := range ys {
+		drawLabel(img, 4, plot.Min.Y+i*cellH+cellH/2, y, color.Black)
+	}
+}
+
+// drawGauge draws a half-ring filled proportionally to the first value against max (100 by default)
+func drawGauge(img *image.RGBA, results []map[string]interface{}, valueName string, maxValue float64) {
+	if maxValue <= 0 {
+		maxValue = 100
+	}
+	value, _ := toFloat(results[0][valueName])
+	ratio := math.Max(0, math.Min(1, value/maxValue))
+
+	cx, cy := chartImageWidth/2, chartImageHeight-chartImageMargin*2
+	outer, inner := 150.0, 110.0
+	for y := cy - int(outer); y <= cy; y++ {
+		for x := cx - int(outer); x <= cx+int(outer); x++ {
+			dx, dy := float64(x-cx), float64(cy-y)
+			r := math.Hypot(dx, dy)
+			if r < inner || r > outer {
+				continue
+			}
+			// angle runs from 0 on the left to 1 on the right
+			angle := 1 - math.Atan2(dy, dx)/math.Pi
+			c := color.RGBA{0xe8, 0xe8, 0xe8, 0xff}
+			if angle <= ratio {
+				c = chartPalette[0]
+			}
+			img.Set(x, y, c)
+		}
+	}
+	drawLabel(img, cx-20, cy-20, fmt.Sprintf("%.1f", value), color.Black)
+	drawLabel(img, cx-int(outer), cy+16, "0", color.Black)
+	drawLabel(img, cx+int(outer)-24, cy+16, fmt.Sprintf("%g", maxValue), color.Black)
+}
+
+// drawFunnel draws centered horizontal bars sorted from the largest stage to the smallest
+func drawFunnel(img *image.RGBA, results []map[string]interface{}, labelName, valueName string) {
+	type stage struct {
+		label string
+		value float64
+	}
+	stages := make([]stage, 0, len(results))
+	for _, row := range results {
+		v, _ := toFloat(row[valueName])
+		stages = append(stages, stage{fmt.Sprint(row[labelName]), v})
+	}
+	sort.SliceStable(stages, func(i, j int) bool { return stages[i].value > stages[j].value })
+	if len(stages) == 0 || stages[0].value <= 0 {
+		return
+	}
+
+	plot := plotArea()
+	barH := plot.Dy() / len(stages)
+	center := plot.Min.X + plot.Dx()/2
+	for i, s := range stages {
+		w := int(float64(plot.Dx()) * s.value / stages[0].value)
+		top := plot.Min.Y + i*barH
+		bar := image.Rect(center-w/2, top+2, center+w/2, top+barH-2)
+		draw.Draw(img, bar, &image.Uniform{chartPalette[i%len(chartPalette)]}, image.Point{}, draw.Src)
+		drawLabel(img, center-w/2+4, top+barH/2+4, fmt.Sprintf("%s: %g", s.label, s.value), color.White)
+	}
+}
+
+// drawProjection plots x against y, coloring points by z and sizing them by the optional size field
+func drawProjection(img *image.RGBA, results []map[string]interface{}, xName, yName, zName, sizeName string) {
+	plot := plotArea()
+	drawAxes(img, plot)
+	minX, maxX := axisRange(results, xName)
+	minY, maxY := valueRange(results, yName)
+	minZ, maxZ := valueRange(results, zName)
+	minS, maxS := valueRange(results, sizeName)
+
+	for i, row := range results {
+		x, ok := toFloat(row[xName])
+		if !ok {
+			x = float64(i)
+		}
+		y, _ := toFloat(row[yName])
+		c := chartPalette[0]
+		if zName != "" {
+			z, _ := toFloat(row[zName])
+			c = heatColor(normalize(z, minZ, maxZ))
+		}
+		radius := 4
+		if sizeName != "" {
+			s, _ := toFloat(row[sizeName])
+			radius = 3 + int(normalize(s, minS, maxS)*12)
+		}
+		px := plot.Min.X + int(normalize(x, minX, maxX)*float64(plot.Dx()))
+		py := plot.Max.Y - int(normalize(y, minY, maxY)*float64(plot.Dy()))
+		fillCircle(img, px, py, radius, c)
+	}
+}
+
+// drawLine connects the values in row order, labelling each point with its category
+func drawLine(img *image.RGBA, results []map[string]interface{}, labelName, valueName string) {
+	plot := plotArea()
+	drawAxes(img, plot)
+	minV, maxV := valueRange(results, valueName)
+	minV = math.Min(minV, 0)
+	if len(results) == 0 {
+		return
+	}
+	step := float64(plot.Dx()) / float64(max(len(results)-1, 1))
+	prevX, prevY := -1, -1
+	for i, row := range results {
+		v, _ := toFloat(row[valueName])
+		x := plot.Min.X + int(float64(i)*step)
+		y := plot.Max.Y - int(normalize(v, minV, maxV)*float64(plot.Dy()))
+		if prevX >= 0 {
+			drawSegment(img, prevX, prevY, x, y, chartPalette[0])
+		}
+		fillCircle(img, x, y, 3, chartPalette[0])
+		drawLabel(img, x-8, plot.Max.Y+14, fmt.Sprint(row[labelName]), color.Black)
+		prevX, prevY = x, y
+	}
+}
+
+// drawPie draws one slice per row with a legend on the right
+func drawPie(img *image.RGBA, results []map[string]interface{}, labelName, valueName string) {
+	total := 0.0
+	values := make([]float64, len(results))
+	for i, row := range results {
+		v, _ := toFloat(row[valueName])
+		values[i] = math.Max(v, 0)
+		total += values[i]
+	}
+	if total == 0 {
+		return
+	}
+
+	cx, cy, r := chartImageWidth/3, chartImageHeight/2+10, 140
+	// starts record the cumulative fraction at which every slice begins
+	starts := make([]float64, len(values)+1)
+	for i, v := range values {
+		starts[i+1] = starts[i] + v/total
+	}
+	for y := -r; y <= r; y++ {
+		for x := -r; x <= r; x++ {
+			if x*x+y*y > r*r {
+				continue
+			}
+			// fraction of a full turn, clockwise from 12 o'clock
+			angle := math.Atan2(float64(x), float64(-y)) / (2 * math.Pi)
+			if angle < 0 {
+				angle++
+			}
+			slice := sort.SearchFloat64s(starts[1:], angle)
+			img.Set(cx+x, cy+y, chartPalette[min(slice, len(values)-1)%len(chartPalette)])
+		}
+	}
+	for i, row := range results {
+		top := chartImageMargin + 10 + i*18
+		draw.Draw(img, image.Rect(cx+r+30, top, cx+r+42, top+12), &image.Uniform{chartPalette[i%len(chartPalette)]}, image.Point{}, draw.Src)
+		drawLabel(img, cx+r+48, top+11, fmt.Sprintf("%v (%.1f%%)", row[labelName], values[i]/total*100), color.Black)
+	}
+}
+
+// drawBars is the fallback renderer for chart types without a dedicated drawing
+func drawBars(img *image.RGBA, results []map[string]interface{}, labelName, valueName string) {
+	plot := plotArea()
+	drawAxes(img, plot)
+	_, maxV := valueRange(results, valueName)
+	if maxV <= 0 || len(results) == 0 {
+		return
+	}
+	slot := plot.Dx() / len(results)
+	for i, row := range results {
+		v, _ := toFloat(row[valueName])
+		h := int(float64(plot.Dy()) * math.Max(v, 0) / maxV)
+		left := plot.Min.X + i*slot
+		bar := image.Rect(left+slot/6, plot.Max.Y-h, left+slot-slot/6, plot.Max.Y)
+		draw.Draw(img, bar, &image.Uniform{chartPalette[0]}, image.Point{}, draw.Src)
+		drawLabel(img, left+slot/6, plot.Max.Y+14, fmt.Sprint(row[labelName]), color.Black)
+	}
+}
+
+func plotArea() image.Rectangle {
+	return image.Rect(chartImageMargin*2, chartImageMargin, chartImageWidth-chartImageMargin, chartImageHeight-chartImageMargin)
+}
+
+func drawAxes(img *image.RGBA, plot image.Rectangle) {
+	axis := &image.Uniform{color.RGBA{0x99, 0x99, 0x99, 0xff}}
+	draw.Draw(img, image.Rect(plot.Min.X, plot.Max.Y, plot.Max.X, plot.Max.Y+1), axis, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(plot.Min.X-1, plot.Min.Y, plot.Min.X, plot.Max.Y), axis, image.Point{}, draw.Src)
+}
+
+func drawLabel(img *image.RGBA, x, y int, text string, c color.Color) {
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(text)
+}
+
+// drawSegment draws a straight line between two points
+func drawSegment(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	steps := max(abs(x1-x0), abs(y1-y0), 1)
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		x := x0 + int(math.Round(t*float64(x1-x0)))
+		y := y0 + int(math.Round(t*float64(y1-y0)))
+		img.Set(x, y, c)
+		img.Set(x, y+1, c)
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func fillCircle(img *image.RGBA, cx, cy, r int, c color.Color) {
+	for y := -r; y <= r; y++ {
+		for x := -r; x <= r; x++ {
+			if x*x+y*y <= r*r {
+				img.Set(cx+x, cy+y, c)
+			}
+		}
+	}
+}
+
+// heatColor interpolates from blue (0) to red (1)
+func heatColor(t float64) color.RGBA {
+	return color.RGBA{uint8(49 + t*(215-49)), uint8(54 + t*(48-54)), uint8(149 + t*(39-149)), 0xff}
+}
+
+func normalize(v, lo, hi float64) float64 {
+	if hi <= lo {
+		return 0.5
+	}
+	return (v - lo) / (hi - lo)
+}
+
+// valueRange returns the min and max numeric value of a column
+func valueRange(results []map[string]interface{}, name string) (float64, float64) {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, row := range results {
+		if v, ok := toFloat(row[name]); ok {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+	}
+	if math.IsInf(lo, 1) {
+		return 0, 0
+	}
+	return lo, hi
+}
+
+// axisRange is valueRange for an axis that falls back to row positions when the column is not numeric
+func axisRange(results []map[string]interface{}, name string) (float64, float64) {
+	if len(results) > 0 {
+		if _, ok := toFloat(results[0][name]); !ok {
+			return 0, float64(len(results) - 1)
+		}
+	}
+	return valueRange(results, name)
+}
+
+func distinctLabels(results []map[string]interface{}, name string) []string {
+	var labels []string
+	seen := map[string]bool{}
+	for _, row := range results {
+		label := fmt.Sprint(row[name])
+		if !seen[label] {
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+func indexOf(values []string, v string) int {
+	for i, s := range values {
+		if s == v {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"gobi/internal/models"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// RecordChartVersion snapshots the current state of a chart as its next version, see RecordQueryVersion
+func RecordChartVersion(tx *gorm.DB, chart *models.Chart, authorID uint, note string) (models.ChartVersion, error) {
+	var latest int
+	if err := tx.Model(&models.ChartVersion{}).Where("chart_id = ?", chart.ID).
+		Select("COALESCE(MAX(version), 0)").Scan(&latest).Error; err != nil {
+		return models.ChartVersion{}, err
+	}
+	version := models.ChartVersion{
+		ChartID:     chart.ID,
+		Version:     latest + 1,
+		Name:        chart.Name,
+		Type:        chart.Type,
+		QueryID:     chart.QueryID,
+		Config:      chart.Config,
+		Description: chart.Description,
+		AuthorID:    authorID,
+		Note:        note,
+	}
+	if err := tx.Create(&version).Error; err != nil {
+		return models.ChartVersion{}, err
+	}
+	chart.Version = version.Version
+	if err := tx.Unscoped().Model(&models.Chart{}).Where("id = ?", chart.ID).Update("version", version.Version).Error; err != nil {
+		return models.ChartVersion{}, err
+	}
+	return version, nil
+}
+
+// EnsureChartBaseline records the state of a chart created before versioning as its first version
+func EnsureChartBaseline(tx *gorm.DB, chart *models.Chart) error {
+	if chart.Version != 0 {
+		return nil
+	}
+	_, err := RecordChartVersion(tx, chart, chart.UserID, "Version before history was recorded")
+	return err
+}
+
+// ConfigChange is a changed value of a chart's JSON config, addressed by a dotted path such as
+// series.0.color. Old is absent for added and New for removed values.
+type ConfigChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// ChartVersionDiff describes the changes from one version of a chart to another
+type ChartVersionDiff struct {
+	ChartID uint                 `json:"chart_id"`
+	From    int                  `json:"from"`
+	To      int                  `json:"to"`
+	Fields  []VersionFieldChange `json:"fields"`
+	Config  []ConfigChange       `json:"config"`
+}
+
+// DiffChartVersions compares two versions of the same chart. Configs that are valid JSON are compared
+// value by value; otherwise a changed config is reported as a whole in Fields.
+func DiffChartVersions(from, to models.ChartVersion) ChartVersionDiff {
+	diff := ChartVersionDiff{ChartID: from.ChartID, From: from.Version, To: to.Version,
+		Fields: []VersionFieldChange{}, Config: []ConfigChange{}}
+	if from.Name != to.Name {
+		diff.Fields = append(diff.Fields, VersionFieldChange{Field: "name", Old: from.Name, New: to.Name})
+	}
+	if from.Type != to.Type {
+		diff.Fields = append(diff.Fields, VersionFieldChange{Field: "type", Old: from.Type, New: to.Type})
+	}
+	if from.QueryID != to.QueryID {
+		diff.Fields = append(diff.Fields, VersionFieldChange{Field: "query_id", Old: from.QueryID, New: to.QueryID})
+	}
+	if from.Description != to.Description {
+		diff.Fields = append(diff.Fields, VersionFieldChange{Field: "description", Old: from.Description, New: to.Description})
+	}
+	if from.Config == to.Config {
+		return diff
+	}
+
+	oldConfig, oldOK := parseChartConfig(from.Config)
+	newConfig, newOK := parseChartConfig(to.Config)
+	if !oldOK || !newOK {
+		diff.Fields = append(diff.Fields, VersionFieldChange{Field: "config", Old: from.Config, New: to.Config})
+		return diff
+	}
+	diffJSON("", oldConfig, newConfig, &diff.Config)
+	return diff
+}
+
+// parseChartConfig decodes a config, treating an empty config as an empty object
+func parseChartConfig(text string) (interface{}, bool) {
+	if strings.TrimSpace(text) == "" {
+		return map[string]interface{}{}, true
+	}
+	var v interface{}
+	return v, json.Unmarshal([]byte(text), &v) == nil
+}
+
+// diffJSON appends the differences between two decoded JSON values, descending into objects and arrays
+func diffJSON(path string, old, new interface{}, changes *[]ConfigChange) {
+	switch o := old.(type) {
+	case map[string]interface{}:
+		n, ok := new.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(o)+len(n))
+		for k := range o {
+			keys = append(keys, k)
+		}
+		for k := range n {
+			if _, seen := o[k]; !seen {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ov, inOld := o[k]
+			nv, inNew := n[k]
+			switch {
+			case !inOld:
+				*changes = append(*changes, ConfigChange{Path: joinConfigPath(path, k), New: nv})
+			case !inNew:
+				*changes = append(*changes, ConfigChange{Path: joinConfigPath(path, k), Old: ov})
+			default:
+				diffJSON(joinConfigPath(path, k), ov, nv, changes)
+			}
+		}
+		return
+	case []interface{}:
+		n, ok := new.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(o) || i < len(n); i++ {
+			p := joinConfigPath(path, fmt.Sprint(i))
+			switch {
+			case i >= len(o):
+				*changes = append(*changes, ConfigChange{Path: p, New: n[i]})
+			case i >= len(n):
+				*changes = append(*changes, ConfigChange{Path: p, Old: o[i]})
+			default:
+				diffJSON(p, o[i], n[i], changes)
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(old, new) {
+		*changes = append(*changes, ConfigChange{Path: path, Old: old, New: new})
+	}
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"gobi/config"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+
+	"gorm.io/gorm"
+)
+
+var ErrExternalAccountExists = errors.New("a local account with this username or email already exists")
+
+// ExternalIdentity is a user vouched for by an identity provider or directory
+type ExternalIdentity struct {
+	Provider string // AuthProviderOIDC or AuthProviderLDAP
+	Subject  string // stable ID of the user at the provider
+	Username string
+	Email    string
+	Groups   []string
+}
+
+// mappedRole returns the role of the first role mapping matching one of the groups, or the default role
+func mappedRole(mapping config.GroupMapping, groups []string) string {
+	for _, m := range mapping.RoleMappings {
+		if containsString(groups, m.Group) {
+			if RoleExists(m.Role) {
+				return m.Role
+			}
+			Logger.WithFields(map[string]interface{}{
+				"action": "group_role_mapping",
+				"group":  m.Group,
+				"role":   m.Role,
+			}).Warn("Role mapping names an unknown role")
+		}
+	}
+	if mapping.DefaultRole != "" && RoleExists(mapping.DefaultRole) {
+		return mapping.DefaultRole
+	}
+	return "viewer"
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ProvisionExternalUser returns the user of an identity, creating it on first login. The role and the
+// memberships of mapped teams follow the user's groups on every login, and a disabled user is enabled
+// again. Existing local accounts are never taken over, since the provider's username or email is no
+// proof of owning them.
+func ProvisionExternalUser(identity ExternalIdentity, mapping config.GroupMapping) (models.User, error) {
+	var user models.User
+	role := mappedRole(mapping, identity.Groups)
+	roleChanged := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("auth_provider = ? AND external_id = ?", identity.Provider, identity.Subject).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if user, err = createExternalUser(tx, identity, role); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else if user.Role != role || user.Disabled {
+			roleChanged = user.Role != role
+			user.Role = role
+			user.Disabled = false
+			if err := tx.Model(&user).Updates(map[string]interface{}{"role": role, "disabled": false}).Error; err != nil {
+				return err
+			}
+		}
+		return syncMappedTeams(tx, user.ID, mapping, identity.Groups)
+	})
+	if err != nil {
+		return user, err
+	}
+	if roleChanged {
+		// Sessions from before carry the old role
+		if err := RevokeUserTokens(user.ID, "role changed by "+identity.Provider); err != nil {
+			return user, err
+		}
+	}
+	QueryCache.Flush()
+	return user, nil
+}
+
+func createExternalUser(tx *gorm.DB, identity ExternalIdentity, role string) (models.User, error) {
+	username := identity.Username
+	if username == "" {
+		username = identity.Email
+	}
+	if username == "" {
+		username = identity.Subject
+	}
+	email := identity.Email
+	if email == "" {
+		// Email is unique, so users without one get a placeholder that cannot clash
+		sum := sha256.Sum256([]byte(identity.Provider + ":" + identity.Subject))
+		email = fmt.Sprintf("%x@%s.invalid", sum[:8], identity.Provider)
+	}
+	var count int64
+	tx.Model(&models.User{}).Where("username = ? OR email = ?", username, email).Count(&count)
+	if count > 0 {
+		return models.User{}, ErrExternalAccountExists
+	}
+
+	user := models.User{
+		Username:     username,
+		Email:        email,
+		Role:         role,
+		AuthProvider: identity.Provider,
+		ExternalID:   identity.Subject,
+	}
+	if err := tx.Create(&user).Error; err != nil {
+		return user, err
+	}
+	if orgID := DefaultOrganizationID(); orgID != 0 {
+		orgRole := OrgRoleMember
+		if NewSubject(user.ID, role).IsSuperuser() {
+			orgRole = OrgRoleAdmin
+		}
+		if err := AddOrganizationMember(tx, orgID, user.ID, orgRole); err != nil {
+			return user, err
+		}
+	}
+	Logger.WithFields(map[string]interface{}{
+		"action":   "provision_user",
+		"provider": identity.Provider,
+		"userID":   user.ID,
+		"username": user.Username,
+		"role":     role,
+	}).Info("User provisioned on first login")
+	return user, nil
+}
+
+// syncMappedTeams adds the user to the teams mapped from its groups, joining their organization if
+// needed, and removes it from mapped teams of groups it left. Teams without a mapping are left alone.
+func syncMappedTeams(tx *gorm.DB, userID uint, mapping config.GroupMapping, groups []string) error {
+	for _, m := range mapping.TeamMappings {
+		var org models.Organization
+		if err := tx.Where("name = ?", m.Organization).First(&org).Error; err != nil {
+			Logger.WithFields(map[string]interface{}{
+				"action":       "group_team_mapping",
+				"group":        m.Group,
+				"organization": m.Organization,
+			}).Warn("Team mapping names an unknown organization")
+			continue
+		}
+		member := containsString(groups, m.Group)
+		team := models.Team{OrganizationID: org.ID, Name: m.Team}
+		if err := tx.Where(&team).Limit(1).Find(&team).Error; err != nil {
+			return err
+		}
+		if team.ID == 0 {
+			if !member {
+				continue
+			}
+			if err := tx.Create(&team).Error; err != nil {
+				return err
+			}
+		}
+
+		if !member {
+			if err := tx.Unscoped().Where("team_id = ? AND user_id = ?", team.ID, userID).
+				Delete(&models.TeamMember{}).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if OrgMemberRole(org.ID, userID) == "" {
+			if err := AddOrganizationMember(tx, org.ID, userID, OrgRoleMember); err != nil {
+				return err
+			}
+		}
+		teamMember := models.TeamMember{TeamID: team.ID, UserID: userID}
+		if err := tx.Where(&teamMember).Limit(1).Find(&teamMember).Error; err != nil {
+			return err
+		}
+		if teamMember.ID == 0 {
+			teamMember.Role = TeamRoleMember
+			if err := tx.Create(&teamMember).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package utils
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"gobi/config"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// AuthProviderLDAP marks users provisioned from an LDAP directory or Active Directory
+const AuthProviderLDAP = "ldap"
+
+var (
+	ErrLDAPInvalidCredentials = errors.New("invalid directory credentials")
+	ErrLDAPUserNotFound       = errors.New("user not found in directory")
+)
+
+func ldapAttribute(value, fallback string) string {
+	if value != "" {
+		return value
+	}
+	return fallback
+}
+
+// ldapConn is the part of a directory connection used for sign-in and sync
+type ldapConn interface {
+	Bind(username, password string) error
+	UnauthenticatedBind(username string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// ldapDial opens a connection to the configured directory, upgraded with StartTLS when configured. It is
+// a variable so that tests can stand in for a directory.
+var ldapDial = func() (ldapConn, error) {
+	cfg := config.AppConfig.LDAP
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if host := ldapHost(cfg.URL); host != "" {
+		tlsConfig.ServerName = host
+	}
+	conn, err := ldap.DialURL(cfg.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(10 * time.Second)
+	if cfg.StartTLS && strings.HasPrefix(cfg.URL, "ldap://") {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// ldapConnect opens a connection to the directory and binds as the service account
+func ldapConnect() (ldapConn, error) {
+	cfg := config.AppConfig.LDAP
+	conn, err := ldapDial()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BindDN != "" {
+		err = conn.Bind(cfg.BindDN, cfg.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("service bind: %w", err)
+	}
+	return conn, nil
+}
+
+func ldapHost(rawURL string) string {
+	host := rawURL
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexAny(host, ":/"); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// ldapSearchUser finds the entry of a username, which must be unique below the base DN
+func ldapSearchUser(conn ldapConn, username string) (*ldap.Entry, error) {
+	cfg := config.AppConfig.LDAP
+	usernameAttr := ldapAttribute(cfg.UsernameAttribute, "uid")
+	filter := ldapAttribute(cfg.UserFilter, "("+usernameAttr+"=%s)")
+	req := ldap.NewSearchRequest(cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf(filter, ldap.EscapeFilter(username)),
+		[]string{usernameAttr, ldapAttribute(cfg.EmailAttribute, "mail"), ldapAttribute(cfg.GroupAttribute, "memberOf")},
+		nil)
+	res, err := conn.Search(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+	if res == nil || len(res.Entries) == 0 {
+		return nil, ErrLDAPUserNotFound
+	}
+	if len(res.Entries) > 1 {
+		return nil, fmt.Errorf("username %q matches several directory entries", username)
+	}
+	return res.Entries[0], nil
+}
+
+// ldapIdentity reads the identity of a directory entry. Groups are listed both by DN and by their
+// first RDN value, usually the CN, so that mappings can name either.
+func ldapIdentity(entry *ldap.Entry, username string) ExternalIdentity {
+	cfg := config.AppConfig.LDAP
+	if v := entry.GetAttributeValue(ldapAttribute(cfg.UsernameAttribute, "uid")); v != "" {
+		username = v
+	}
+	identity := ExternalIdentity{
+		Provider: AuthProviderLDAP,
+		Subject:  strings.ToLower(username),
+		Username: username,
+		Email:    entry.GetAttributeValue(ldapAttribute(cfg.EmailAttribute, "mail")),
+	}
+	for _, group := range entry.GetAttributeValues(ldapAttribute(cfg.GroupAttribute, "memberOf")) {
+		identity.Groups = append(identity.Groups, group)
+		if dn, err := ldap.ParseDN(group); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			identity.Groups = append(identity.Groups, dn.RDNs[0].Attributes[0].Value)
+		}
+	}
+	return identity
+}
+
+// AuthenticateLDAP checks a username and password against the directory: the user's entry is searched
+// with the service account, then bound to with the password
+func AuthenticateLDAP(username, password string) (ExternalIdentity, error) {
+	// An empty password would be an unauthenticated bind, which most directories accept
+	if username == "" || password == "" {
+		return ExternalIdentity{}, ErrLDAPInvalidCredentials
+	}
+	conn, err := ldapConnect()
+	if err != nil {
+		return ExternalIdentity{}, err
+	}
+	defer conn.Close()
+
+	entry, err := ldapSearchUser(conn, username)
+	if errors.Is(err, ErrLDAPUserNotFound) {
+		return ExternalIdentity{}, ErrLDAPInvalidCredentials
+	}
+	if err != nil {
+		return ExternalIdentity{}, err
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return ExternalIdentity{}, ErrLDAPInvalidCredentials
+		}
+		return ExternalIdentity{}, err
+	}
+	return ldapIdentity(entry, username), nil
+}
+
+// syncLDAPUsers refreshes the role and mapped teams of every directory user from its current groups, and
+// disables users that can no longer be found, which includes accounts the user filter excludes
+func syncLDAPUsers() {
+	var users []models.User
+	if err := database.DB.Where("auth_provider = ?", AuthProviderLDAP).Find(&users).Error; err != nil || len(users) == 0 {
+		return
+	}
+	conn, err := ldapConnect()
+	if err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action": "ldap_sync",
+			"error":  err.Error(),
+		}).Error("Could not connect to directory")
+		return
+	}
+	defer conn.Close()
+
+	var synced, disabled int
+	for _, user := range users {
+		entry, err := ldapSearchUser(conn, user.ExternalID)
+		if errors.Is(err, ErrLDAPUserNotFound) {
+			if !user.Disabled {
+				if err := DisableUser(user.ID, "removed from directory"); err == nil {
+					disabled++
+				}
+			}
+			continue
+		}
+		if err != nil {
+			Logger.WithFields(map[string]interface{}{
+				"action": "ldap_sync",
+				"userID": user.ID,
+				"error":  err.Error(),
+			}).Error("Directory search failed")
+			continue
+		}
+		if _, err := ProvisionExternalUser(ldapIdentity(entry, user.ExternalID), config.AppConfig.LDAP.GroupMapping); err != nil {
+			Logger.WithFields(map[string]interface{}{
+				"action": "ldap_sync",
+				"userID": user.ID,
+				"error":  err.Error(),
+			}).Error("Could not sync directory user")
+			continue
+		}
+		synced++
+	}
+	Logger.WithFields(map[string]interface{}{
+		"action":   "ldap_sync",
+		"synced":   synced,
+		"disabled": disabled,
+	}).Info("Directory sync finished")
+}
+
+// DisableUser stops a user from signing in and revokes its sessions
+func DisableUser(userID uint, reason string) error {
+	if err := database.DB.Model(&models.User{}).Where("id = ?", userID).Update("disabled", true).Error; err != nil {
+		return err
+	}
+	if err := RevokeUserTokens(userID, reason); err != nil {
+		return err
+	}
+	Logger.WithFields(map[string]interface{}{
+		"action": "disable_user",
+		"userID": userID,
+		"reason": reason,
+	}).Warn("User disabled")
+	return nil
+}
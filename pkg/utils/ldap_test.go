@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"gobi/config"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeDirectory stands in for a directory server. An entry matches a search when the filter holds an
+// equality assertion on its username attribute, which is enough for the filters built by ldapSearchUser.
+type fakeDirectory struct {
+	passwords map[string]string // bind DN to password
+	entries   []*ldap.Entry
+
+	binds    []string
+	searches []*ldap.SearchRequest
+	closed   int
+}
+
+func (d *fakeDirectory) Bind(username, password string) error {
+	d.binds = append(d.binds, username)
+	if want, ok := d.passwords[username]; !ok || want != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+func (d *fakeDirectory) UnauthenticatedBind(username string) error {
+	d.binds = append(d.binds, "anonymous")
+	return nil
+}
+
+func (d *fakeDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	d.searches = append(d.searches, req)
+	attr := ldapAttribute(config.AppConfig.LDAP.UsernameAttribute, "uid")
+	res := &ldap.SearchResult{}
+	for _, entry := range d.entries {
+		if strings.Contains(req.Filter, "("+attr+"="+ldap.EscapeFilter(entry.GetAttributeValue(attr))+")") {
+			res.Entries = append(res.Entries, entry)
+		}
+	}
+	return res, nil
+}
+
+func (d *fakeDirectory) Close() error {
+	d.closed++
+	return nil
+}
+
+// useFakeDirectory configures LDAP against a directory holding alice and bob below dc=example,dc=com
+func useFakeDirectory(t *testing.T) *fakeDirectory {
+	dir := &fakeDirectory{
+		passwords: map[string]string{
+			"cn=gobi,ou=services,dc=example,dc=com": "service-secret",
+			"uid=alice,ou=people,dc=example,dc=com": "alice-secret",
+			"uid=bob,ou=people,dc=example,dc=com":   "bob-secret",
+		},
+		entries: []*ldap.Entry{
+			ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+				"uid":      {"alice"},
+				"mail":     {"alice@example.com"},
+				"memberOf": {"cn=analysts,ou=groups,dc=example,dc=com", "cn=finance,ou=groups,dc=example,dc=com"},
+			}),
+			ldap.NewEntry("uid=bob,ou=people,dc=example,dc=com", map[string][]string{
+				"uid": {"bob"},
+			}),
+		},
+	}
+	previousDial, previousConfig := ldapDial, config.AppConfig.LDAP
+	ldapDial = func() (ldapConn, error) { return dir, nil }
+	config.AppConfig.LDAP.BaseDN = "ou=people,dc=example,dc=com"
+	config.AppConfig.LDAP.BindDN = "cn=gobi,ou=services,dc=example,dc=com"
+	config.AppConfig.LDAP.BindPassword = "service-secret"
+	t.Cleanup(func() {
+		ldapDial = previousDial
+		config.AppConfig.LDAP = previousConfig
+	})
+	return dir
+}
+
+func TestAuthenticateLDAP(t *testing.T) {
+	dir := useFakeDirectory(t)
+
+	identity, err := AuthenticateLDAP("alice", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Provider != AuthProviderLDAP || identity.Subject != "alice" || identity.Email != "alice@example.com" {
+		t.Fatalf("identity = %+v", identity)
+	}
+	wantGroups := []string{"cn=analysts,ou=groups,dc=example,dc=com", "analysts", "cn=finance,ou=groups,dc=example,dc=com", "finance"}
+	if fmt.Sprint(identity.Groups) != fmt.Sprint(wantGroups) {
+		t.Fatalf("groups = %v, want %v", identity.Groups, wantGroups)
+	}
+	if fmt.Sprint(dir.binds) != "[cn=gobi,ou=services,dc=example,dc=com uid=alice,ou=people,dc=example,dc=com]" {
+		t.Fatalf("binds = %v", dir.binds)
+	}
+	search := dir.searches[0]
+	if search.BaseDN != "ou=people,dc=example,dc=com" || search.Filter != "(uid=alice)" || search.Scope != ldap.ScopeWholeSubtree {
+		t.Fatalf("search = %+v", search)
+	}
+	if dir.closed != 1 {
+		t.Fatalf("connection closed %d times", dir.closed)
+	}
+}
+
+func TestAuthenticateLDAPRejects(t *testing.T) {
+	for name, creds := range map[string][2]string{
+		"wrong password": {"alice", "bob-secret"},
+		"unknown user":   {"mallory", "alice-secret"},
+		"empty password": {"alice", ""},
+		"empty username": {"", "alice-secret"},
+	} {
+		dir := useFakeDirectory(t)
+		if _, err := AuthenticateLDAP(creds[0], creds[1]); !errors.Is(err, ErrLDAPInvalidCredentials) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+		if creds[1] == "" && len(dir.binds) != 0 {
+			t.Errorf("%s: directory was contacted", name)
+		}
+	}
+}
+
+func TestAuthenticateLDAPEscapesFilter(t *testing.T) {
+	dir := useFakeDirectory(t)
+
+	if _, err := AuthenticateLDAP("*)(uid=*", "alice-secret"); !errors.Is(err, ErrLDAPInvalidCredentials) {
+		t.Fatalf("err = %v", err)
+	}
+	if filter := dir.searches[0].Filter; filter != `(uid=\2a\29\28uid=\2a)` {
+		t.Fatalf("filter = %s", filter)
+	}
+}
+
+func TestAuthenticateLDAPCustomFilter(t *testing.T) {
+	dir := useFakeDirectory(t)
+	config.AppConfig.LDAP.UsernameAttribute = "sAMAccountName"
+	config.AppConfig.LDAP.UserFilter = "(&(objectClass=user)(sAMAccountName=%s))"
+	dir.entries = append(dir.entries, ldap.NewEntry("cn=Carol,ou=people,dc=example,dc=com", map[string][]string{
+		"sAMAccountName": {"Carol"},
+	}))
+	dir.passwords["cn=Carol,ou=people,dc=example,dc=com"] = "carol-secret"
+
+	identity, err := AuthenticateLDAP("Carol", "carol-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "Carol" || identity.Subject != "carol" {
+		t.Fatalf("identity = %+v", identity)
+	}
+	if filter := dir.searches[0].Filter; filter != "(&(objectClass=user)(sAMAccountName=Carol))" {
+		t.Fatalf("filter = %s", filter)
+	}
+}
+
+func TestAuthenticateLDAPAmbiguousUser(t *testing.T) {
+	dir := useFakeDirectory(t)
+	dir.entries = append(dir.entries, ldap.NewEntry("uid=alice,ou=contractors,dc=example,dc=com", map[string][]string{
+		"uid": {"alice"},
+	}))
+
+	if _, err := AuthenticateLDAP("alice", "alice-secret"); err == nil || errors.Is(err, ErrLDAPInvalidCredentials) {
+		t.Fatalf("err = %v", err)
+	}
+	if len(dir.binds) != 1 {
+		t.Fatalf("bound as a user of an ambiguous name: %v", dir.binds)
+	}
+}
+
+func TestAuthenticateLDAPServiceBindFails(t *testing.T) {
+	dir := useFakeDirectory(t)
+	config.AppConfig.LDAP.BindPassword = "rotated"
+
+	_, err := AuthenticateLDAP("alice", "alice-secret")
+	if err == nil || errors.Is(err, ErrLDAPInvalidCredentials) || !strings.Contains(err.Error(), "service bind") {
+		t.Fatalf("err = %v", err)
+	}
+	if len(dir.searches) != 0 || dir.closed != 1 {
+		t.Fatalf("searches = %d, closed = %d", len(dir.searches), dir.closed)
+	}
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"gobi/config"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	LoginThrottleUser = "user"
+	LoginThrottleIP   = "ip"
+)
+
+// LoginThrottleKey returns the key counting failed logins of a username or client IP. Usernames are
+// compared case-insensitively, as directories do.
+func LoginThrottleKey(kind, value string) string {
+	if kind == LoginThrottleUser {
+		value = strings.ToLower(value)
+	}
+	return kind + ":" + value
+}
+
+// LoginLockedUntil returns when the lock of a username or client IP ends, or the zero time when neither
+// is locked
+func LoginLockedUntil(username, ip string) time.Time {
+	var throttles []models.LoginThrottle
+	database.DB.Where("target IN ? AND locked_until > ?",
+		[]string{LoginThrottleKey(LoginThrottleUser, username), LoginThrottleKey(LoginThrottleIP, ip)}, time.Now()).
+		Find(&throttles)
+	var until time.Time
+	for _, t := range throttles {
+		if t.LockedUntil.After(until) {
+			until = *t.LockedUntil
+		}
+	}
+	return until
+}
+
+// RecordLoginFailure counts a failed login of a username from a client IP. A username is locked after
+// Lockout.MaxAttempts failures in a row, a client IP after Lockout.IPMaxAttempts failures within
+// Lockout.IPWindowMinutes.
+func RecordLoginFailure(username, ip string) {
+	cfg := config.AppConfig.Lockout
+	recordThrottleFailure(LoginThrottleKey(LoginThrottleUser, username), cfg.MaxAttempts, 0)
+	recordThrottleFailure(LoginThrottleKey(LoginThrottleIP, ip), cfg.IPMaxAttempts,
+		time.Duration(cfg.IPWindowMinutes)*time.Minute)
+}
+
+// recordThrottleFailure counts a failure of a key and locks it once it reached maxAttempts, counting
+// only failures within window unless it is 0. Each lockout in a row doubles the lock duration.
+func recordThrottleFailure(key string, maxAttempts int, window time.Duration) {
+	if maxAttempts <= 0 {
+		return
+	}
+	cfg := config.AppConfig.Lockout
+	maxLock := time.Duration(cfg.MaxLockMinutes) * time.Minute
+	now := time.Now()
+
+	// The failure is counted in a single UPDATE, so that parallel attempts cannot overwrite each other's
+	// count. MySQL assigns columns left to right, so last_failure has to come last.
+	err := database.DB.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.LoginThrottle{Target: key, LastFailure: now}).Error
+	if err == nil {
+		failures, lockouts := "failures + 1", "lockouts"
+		var args []interface{}
+		if window > 0 {
+			failures = "CASE WHEN last_failure < ? THEN 1 ELSE failures + 1 END"
+			args = append(args, now.Add(-window))
+		}
+		// A quiet period as long as the longest lock starts the progression over
+		if maxLock > 0 {
+			lockouts = "CASE WHEN last_failure < ? THEN 0 ELSE lockouts END"
+			args = append(args, now.Add(-maxLock))
+		}
+		err = database.DB.Exec("UPDATE login_throttles SET failures = "+failures+", lockouts = "+lockouts+
+			", last_failure = ?, updated_at = ? WHERE target = ?", append(args, now, now, key)...).Error
+	}
+	var t models.LoginThrottle
+	if err == nil {
+		err = database.DB.Where("target = ?", key).First(&t).Error
+	}
+	if err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action": "login_lockout",
+			"key":    key,
+			"error":  err.Error(),
+		}).Error("Could not record failed login")
+		return
+	}
+	if t.Failures < maxAttempts {
+		return
+	}
+
+	lock := time.Duration(cfg.LockMinutes) * time.Minute << min(t.Lockouts, 16)
+	if maxLock > 0 && lock > maxLock {
+		lock = maxLock
+	}
+	until := now.Add(lock)
+	// Only one of several parallel failures reaching the limit locks the key
+	res := database.DB.Model(&models.LoginThrottle{}).
+		Where("id = ? AND failures >= ? AND lockouts = ?", t.ID, maxAttempts, t.Lockouts).
+		Updates(map[string]interface{}{"locked_until": until, "failures": 0, "lockouts": gorm.Expr("lockouts + 1")})
+	if res.Error != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action": "login_lockout",
+			"key":    key,
+			"error":  res.Error.Error(),
+		}).Error("Could not lock login")
+		return
+	}
+	if res.RowsAffected > 0 {
+		Logger.WithFields(map[string]interface{}{
+			"action":      "login_lockout",
+			"key":         key,
+			"lockouts":    t.Lockouts + 1,
+			"lockedUntil": until,
+		}).Warn("Login locked after repeated failures")
+	}
+}
+
+// RecordLoginSuccess resets the failed logins of a username. Failures of the client IP are kept, so
+// that signing in to one account does not allow guessing others.
+func RecordLoginSuccess(username string) {
+	database.DB.Unscoped().Where("target = ?", LoginThrottleKey(LoginThrottleUser, username)).
+		Delete(&models.LoginThrottle{})
+}
+
+// UnlockLogin removes the lock and failed logins of a username or client IP
+func UnlockLogin(key string) error {
+	return database.DB.Unscoped().Where("target = ?", key).Delete(&models.LoginThrottle{}).Error
+}
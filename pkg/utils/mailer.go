@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"gobi/config"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MailTransport sends an RFC 5322 message. It is a variable so that another transport, such as a
+// local SMTP stand-in, can be plugged in.
+type MailTransport interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// Mailer is the transport used for report emails
+var Mailer MailTransport = SMTPTransport{}
+
+// SMTPTransport delivers mail through the server configured under smtp in config.yaml
+type SMTPTransport struct{}
+
+// Send opens a connection per message, upgrading to TLS when configured or offered by the server
+func (SMTPTransport) Send(from string, to []string, msg []byte) error {
+	cfg := config.AppConfig.SMTP
+	if cfg.Host == "" {
+		return fmt.Errorf("SMTP host is not configured")
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = 587
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: cfg.Host}
+
+	var client *smtp.Client
+	if cfg.TLS {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		if client, err = smtp.NewClient(conn, cfg.Host); err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+		if err != nil {
+			return err
+		}
+		if client, err = smtp.NewClient(conn, cfg.Host); err != nil {
+			conn.Close()
+			return err
+		}
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				client.Close()
+				return err
+			}
+		}
+	}
+	defer client.Close()
+
+	if cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// mailAttachment is a file attached to an email
+type mailAttachment struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+// buildMail assembles a UTF-8 text message, as multipart/mixed when there is an attachment
+func buildMail(from, to, subject, body string, attachment *mailAttachment) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@gobi>\r\n", randomToken())
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if attachment == nil {
+		if err := writeTextPart(&buf, body); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	boundary := "gobi-" + randomToken()
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	if err := writeTextPart(&buf, body); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: %s\r\n", attachment.ContentType)
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	fmt.Fprintf(&buf, "Content-Disposition: %s\r\n\r\n", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+	encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+// writeTextPart writes the headers and quoted-printable body of a plain text part
+func writeTextPart(buf *bytes.Buffer, body string) error {
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+		return err
+	}
+	if err := qp.Close(); err != nil {
+		return err
+	}
+	buf.WriteString("\r\n")
+	return nil
+}
+
+func randomToken() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
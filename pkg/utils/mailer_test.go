@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"gobi/config"
+	"gobi/internal/models"
+)
+
+// fakeTransport fails its first failures sends and records the message of the last successful one
+type fakeTransport struct {
+	failures int
+	calls    int
+	from     string
+	to       []string
+	msg      []byte
+}
+
+func (f *fakeTransport) Send(from string, to []string, msg []byte) error {
+	f.calls++
+	if f.calls <= f.failures {
+		return errors.New("connection refused")
+	}
+	f.from, f.to, f.msg = from, to, msg
+	return nil
+}
+
+func useFakeTransport(t *testing.T, transport MailTransport) {
+	previous, smtp := Mailer, config.AppConfig.SMTP
+	Mailer = transport
+	config.AppConfig.SMTP.From = "reports@example.com"
+	config.AppConfig.SMTP.RetryInterval = 1
+	t.Cleanup(func() {
+		Mailer = previous
+		config.AppConfig.SMTP = smtp
+	})
+}
+
+func TestBuildMailAttachment(t *testing.T) {
+	content := []byte(strings.Repeat("id,region\n1,emea\n", 20))
+	msg, err := buildMail("reports@example.com", "ops@example.com", "Umsatz – März", "Hello,\nsee attached.",
+		&mailAttachment{Name: "sales.csv", ContentType: "text/csv", Content: content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := mail.ReadMessage(strings.NewReader(string(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil || subject != "Umsatz – März" {
+		t.Fatalf("subject = %q, %v", subject, err)
+	}
+	if parsed.Header.Get("To") != "ops@example.com" {
+		t.Fatalf("To = %q", parsed.Header.Get("To"))
+	}
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q, %v", mediaType, err)
+	}
+
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	text, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(quotedprintable.NewReader(text))
+	if strings.TrimRight(string(body), "\r\n") != "Hello,\r\nsee attached." {
+		t.Fatalf("body = %q", body)
+	}
+	file, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.FileName() != "sales.csv" || file.Header.Get("Content-Type") != "text/csv" {
+		t.Fatalf("attachment = %q %q", file.FileName(), file.Header.Get("Content-Type"))
+	}
+	encoded, _ := io.ReadAll(file)
+	for _, line := range strings.Split(strings.TrimSpace(string(encoded)), "\r\n") {
+		if len(line) > 76 {
+			t.Fatalf("base64 line of %d characters", len(line))
+		}
+	}
+	decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, strings.NewReader(string(encoded))))
+	if err != nil || string(decoded) != string(content) {
+		t.Fatalf("attachment content = %q, %v", decoded, err)
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Fatalf("expected two parts, got %v", err)
+	}
+}
+
+func TestBuildMailPlain(t *testing.T) {
+	msg, err := buildMail("reports@example.com", "ops@example.com", "Daily", "Download: https://gobi.example.com/api/reports/1/download", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := mail.ReadMessage(strings.NewReader(string(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(parsed.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("Content-Type = %q", parsed.Header.Get("Content-Type"))
+	}
+	body, _ := io.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if !strings.Contains(string(body), "https://gobi.example.com/api/reports/1/download") {
+		t.Fatalf("body = %q", body)
+	}
+}
+
+func TestSendReportMailRetries(t *testing.T) {
+	transport := &fakeTransport{failures: 1}
+	useFakeTransport(t, transport)
+	config.AppConfig.SMTP.MaxAttempts = 3
+
+	delivery := models.ReportDelivery{Recipient: "ops@example.com"}
+	sendReportMail(&delivery, "Daily", "Hello", nil)
+	if delivery.Status != "sent" || delivery.Attempts != 2 || delivery.SentAt == nil || delivery.Error != "" {
+		t.Fatalf("delivery = %+v", delivery)
+	}
+	if transport.from != "reports@example.com" || len(transport.to) != 1 || transport.to[0] != "ops@example.com" {
+		t.Fatalf("sent from %q to %v", transport.from, transport.to)
+	}
+	if !strings.Contains(string(transport.msg), "Subject: Daily") {
+		t.Fatalf("message = %q", transport.msg)
+	}
+}
+
+func TestSendReportMailGivesUp(t *testing.T) {
+	transport := &fakeTransport{failures: 10}
+	useFakeTransport(t, transport)
+	config.AppConfig.SMTP.MaxAttempts = 2
+
+	delivery := models.ReportDelivery{Recipient: "ops@example.com"}
+	sendReportMail(&delivery, "Daily", "Hello", nil)
+	if delivery.Status != "failed" || delivery.Attempts != 2 || transport.calls != 2 || delivery.Error != "connection refused" {
+		t.Fatalf("delivery = %+v, calls = %d", delivery, transport.calls)
+	}
+}
+
+func TestValidateEmailTemplate(t *testing.T) {
+	for text, valid := range map[string]bool{
+		"":                                   true,
+		"{{.Name}} - {{.Date}}":              true,
+		"{{if .Link}}{{.Link}}{{end}}":       true,
+		"{{.Recipient}}":                     false,
+		"{{.Name":                            false,
+		"Report {{.ReportID}} {{.FileName}}": true,
+	} {
+		if err := ValidateEmailTemplate(text); (err == nil) != valid {
+			t.Errorf("ValidateEmailTemplate(%q) = %v", text, err)
+		}
+	}
+}
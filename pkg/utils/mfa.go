@@ -0,0 +1,327 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+)
+
+// TOTP parameters (RFC 6238), the defaults of common authenticator apps
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of time steps a code may be off, allowing for clock drift
+	totpSkew = 1
+)
+
+const (
+	// MFAIssuer is shown as the account's issuer in authenticator apps
+	MFAIssuer             = "Gobi"
+	MFAChallengeLifetime  = 5 * time.Minute
+	mfaChallengeAttempts  = 5
+	mfaRecoveryCodeCount  = 10
+	mfaRecoveryCodeLength = 10
+)
+
+var (
+	ErrMFAAlreadyEnabled   = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnrolled      = errors.New("two-factor authentication is not enrolled")
+	ErrMFAInvalidCode      = errors.New("invalid two-factor code")
+	ErrMFAChallengeInvalid = errors.New("two-factor challenge is invalid or expired")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the code of a secret for a time step
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the time step a code is valid for, allowing for totpSkew, or 0
+func matchTOTP(secret, code string, now time.Time) int64 {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+// MFAProvisioningURI returns the otpauth:// URI authenticator apps read from a QR code
+func MFAProvisioningURI(username, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", MFAIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(MFAIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// MFAQRCode renders a provisioning URI as a PNG data URL
+func MFAQRCode(uri string) (string, error) {
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png), nil
+}
+
+// MFAEnabled reports whether a user has confirmed two-factor authentication
+func MFAEnabled(userID uint) bool {
+	var count int64
+	database.DB.Model(&models.UserMFA{}).Where("user_id = ? AND enabled = ?", userID, true).Count(&count)
+	return count > 0
+}
+
+// BeginMFAEnrollment creates a new TOTP secret for a user, replacing an unconfirmed one. The second
+// factor only takes effect once ConfirmMFAEnrollment accepted a code of it.
+func BeginMFAEnrollment(userID uint) (string, error) {
+	var mfa models.UserMFA
+	if err := database.DB.Where("user_id = ?", userID).Limit(1).Find(&mfa).Error; err != nil {
+		return "", err
+	}
+	if mfa.Enabled {
+		return "", ErrMFAAlreadyEnabled
+	}
+	key := make([]byte, 20)
+	rand.Read(key)
+	secret := totpEncoding.EncodeToString(key)
+	encrypted, err := EncryptAES(secret)
+	if err != nil {
+		return "", err
+	}
+	mfa.UserID = userID
+	mfa.Secret = encrypted
+	mfa.LastStep = 0
+	return secret, database.DB.Save(&mfa).Error
+}
+
+// ConfirmMFAEnrollment enables the enrolled secret once the user proved to have it, and returns new
+// recovery codes
+func ConfirmMFAEnrollment(userID uint, code string) ([]string, error) {
+	var codes []string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var mfa models.UserMFA
+		if err := tx.Where("user_id = ?", userID).First(&mfa).Error; err != nil {
+			return ErrMFANotEnrolled
+		}
+		if mfa.Enabled {
+			return ErrMFAAlreadyEnabled
+		}
+		secret, err := DecryptAES(mfa.Secret)
+		if err != nil {
+			return err
+		}
+		step := matchTOTP(secret, code, time.Now())
+		if step == 0 {
+			return ErrMFAInvalidCode
+		}
+		now := time.Now()
+		if err := tx.Model(&mfa).Updates(map[string]interface{}{"enabled": true, "enabled_at": &now, "last_step": step}).Error; err != nil {
+			return err
+		}
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a user with enabled two-factor authentication
+func RegenerateRecoveryCodes(userID uint) ([]string, error) {
+	var codes []string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, mfaRecoveryCodeCount)
+	for i := 0; i < mfaRecoveryCodeCount; i++ {
+		b := make([]byte, mfaRecoveryCodeLength*5/8)
+		rand.Read(b)
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))
+		code := raw[:mfaRecoveryCodeLength/2] + "-" + raw[mfaRecoveryCodeLength/2:]
+		if err := tx.Create(&models.MFARecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(code)}).Error; err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	return hashRefreshToken(strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", "")))
+}
+
+// RecoveryCodesRemaining returns the number of unused recovery codes of a user
+func RecoveryCodesRemaining(userID uint) int64 {
+	var count int64
+	database.DB.Model(&models.MFARecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count)
+	return count
+}
+
+// VerifyMFACode checks a TOTP code or an unused recovery code of a user. Each TOTP code and recovery
+// code is accepted once.
+func VerifyMFACode(userID uint, code string) error {
+	code = strings.TrimSpace(code)
+	var mfa models.UserMFA
+	if err := database.DB.Where("user_id = ? AND enabled = ?", userID, true).First(&mfa).Error; err != nil {
+		return ErrMFANotEnrolled
+	}
+	if len(code) == totpDigits {
+		secret, err := DecryptAES(mfa.Secret)
+		if err != nil {
+			return err
+		}
+		step := matchTOTP(secret, code, time.Now())
+		if step == 0 {
+			return ErrMFAInvalidCode
+		}
+		// The conditional update refuses a code seen before, also when two requests race
+		res := database.DB.Model(&models.UserMFA{}).Where("id = ? AND last_step < ?", mfa.ID, step).Update("last_step", step)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrMFAInvalidCode
+		}
+		return nil
+	}
+
+	now := time.Now()
+	res := database.DB.Model(&models.MFARecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(code)).
+		Update("used_at", &now)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrMFAInvalidCode
+	}
+	Logger.WithFields(map[string]interface{}{
+		"action":    "mfa_recovery_code",
+		"userID":    userID,
+		"remaining": RecoveryCodesRemaining(userID),
+	}).Warn("Recovery code used")
+	return nil
+}
+
+// DisableMFA removes the second factor and recovery codes of a user
+func DisableMFA(userID uint) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&models.UserMFA{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", userID).Delete(&models.MFAChallenge{}).Error
+	})
+}
+
+// CreateMFAChallenge starts the second step of a login whose password was accepted, and returns the
+// token the client presents with the code
+func CreateMFAChallenge(userID uint) (string, error) {
+	database.DB.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.MFAChallenge{})
+	token := newTokenID(32)
+	challenge := models.MFAChallenge{
+		UserID:    userID,
+		TokenHash: hashRefreshToken(token),
+		ExpiresAt: time.Now().Add(MFAChallengeLifetime),
+	}
+	return token, database.DB.Create(&challenge).Error
+}
+
+// MFAChallengeUser returns the user of an open challenge, without checking a code
+func MFAChallengeUser(token string) (models.User, error) {
+	var user models.User
+	var challenge models.MFAChallenge
+	err := database.DB.Where("token_hash = ? AND used_at IS NULL AND expires_at > ? AND attempts < ?",
+		hashRefreshToken(token), time.Now(), mfaChallengeAttempts).First(&challenge).Error
+	if err != nil {
+		return user, ErrMFAChallengeInvalid
+	}
+	if err := database.DB.First(&user, challenge.UserID).Error; err != nil {
+		return user, ErrMFAChallengeInvalid
+	}
+	return user, nil
+}
+
+// CompleteMFAChallenge checks the code of a challenge and returns its user. A challenge is used up by
+// its first correct code or after mfaChallengeAttempts wrong ones.
+func CompleteMFAChallenge(token, code string) (models.User, error) {
+	var user models.User
+	var challenge models.MFAChallenge
+	err := database.DB.Where("token_hash = ? AND used_at IS NULL AND expires_at > ? AND attempts < ?",
+		hashRefreshToken(token), time.Now(), mfaChallengeAttempts).First(&challenge).Error
+	if err != nil {
+		return user, ErrMFAChallengeInvalid
+	}
+	// Count the attempt before checking the code, so that parallel guesses cannot exceed the limit
+	res := database.DB.Model(&models.MFAChallenge{}).Where("id = ? AND attempts < ?", challenge.ID, mfaChallengeAttempts).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if res.Error != nil {
+		return user, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return user, ErrMFAChallengeInvalid
+	}
+
+	if err := VerifyMFACode(challenge.UserID, code); err != nil {
+		return user, err
+	}
+	now := time.Now()
+	res = database.DB.Model(&models.MFAChallenge{}).Where("id = ? AND used_at IS NULL", challenge.ID).Update("used_at", &now)
+	if res.Error != nil {
+		return user, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return user, ErrMFAChallengeInvalid
+	}
+	if err := database.DB.First(&user, challenge.UserID).Error; err != nil {
+		return user, ErrMFAChallengeInvalid
+	}
+	return user, nil
+}
+
+// OrganizationRequiresMFA reports whether an organization requires its members to use two-factor
+// authentication
+func OrganizationRequiresMFA(orgID uint) bool {
+	var count int64
+	database.DB.Model(&models.Organization{}).Where("id = ? AND require_mfa = ?", orgID, true).Count(&count)
+	return count > 0
+}
@@ -0,0 +1,296 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gobi/config"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// AuthProviderOIDC marks users provisioned by OIDC single sign-on
+const AuthProviderOIDC = "oidc"
+
+// OIDCStateLifetime is how long a login started at the provider can be completed
+const OIDCStateLifetime = 10 * time.Minute
+
+var (
+	ErrOIDCStateInvalid   = errors.New("login state is invalid or expired")
+	ErrOIDCTokenRejected  = errors.New("identity provider returned an invalid ID token")
+	ErrOIDCProviderFailed = errors.New("identity provider request failed")
+)
+
+// oidcProvider holds the endpoints and signing keys of the configured identity provider
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	configIssuer string
+	keys         map[string]interface{}
+	keysFetched  time.Time
+}
+
+var (
+	oidcMu     sync.Mutex
+	oidcCached *oidcProvider
+	oidcClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// getOIDCProvider reads the discovery document of the configured issuer, once per issuer
+func getOIDCProvider() (*oidcProvider, error) {
+	issuer := strings.TrimSuffix(config.AppConfig.OIDC.Issuer, "/")
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcCached != nil && oidcCached.configIssuer == issuer {
+		return oidcCached, nil
+	}
+
+	var provider oidcProvider
+	if err := oidcGetJSON(issuer+"/.well-known/openid-configuration", &provider); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("%w: discovery document is for issuer %q", ErrOIDCProviderFailed, provider.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: discovery document lacks endpoints", ErrOIDCProviderFailed)
+	}
+	provider.configIssuer = issuer
+	oidcCached = &provider
+	return oidcCached, nil
+}
+
+func oidcGetJSON(url string, v interface{}) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrOIDCProviderFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: GET %s returned %s", ErrOIDCProviderFailed, url, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrOIDCProviderFailed, err)
+	}
+	return nil
+}
+
+// signingKey returns the provider key with the given ID, reloading the key set when the ID is unknown
+// so that key rotation at the provider is picked up
+func (p *oidcProvider) signingKey(kid string) (interface{}, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < time.Minute && p.keys != nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := oidcGetJSON(p.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	p.keys = keys
+	p.keysFetched = time.Now()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// OIDCAuthURL starts a login: it stores a new state with its nonce and PKCE verifier and returns the
+// authorization URL of the provider to redirect the browser to, with the state the browser must bring
+// back to the callback
+func OIDCAuthURL() (string, string, error) {
+	provider, err := getOIDCProvider()
+	if err != nil {
+		return "", "", err
+	}
+	database.DB.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.OIDCState{})
+
+	state := models.OIDCState{
+		State:        newTokenID(24),
+		Nonce:        newTokenID(24),
+		CodeVerifier: newTokenID(48),
+		ExpiresAt:    time.Now().Add(OIDCStateLifetime),
+	}
+	if err := database.DB.Create(&state).Error; err != nil {
+		return "", "", err
+	}
+	challenge := sha256.Sum256([]byte(state.CodeVerifier))
+
+	cfg := config.AppConfig.OIDC
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", cfg.ClientID)
+	params.Set("redirect_uri", cfg.RedirectURL)
+	params.Set("scope", strings.Join(append([]string{"openid"}, cfg.Scopes...), " "))
+	params.Set("state", state.State)
+	params.Set("nonce", state.Nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return provider.AuthorizationEndpoint + sep + params.Encode(), state.State, nil
+}
+
+// CompleteOIDCLogin finishes a login at the callback: it consumes the state, exchanges the code for
+// tokens with the PKCE verifier and returns the identity of the verified ID token
+func CompleteOIDCLogin(stateValue, code string) (ExternalIdentity, error) {
+	var state models.OIDCState
+	if err := database.DB.Where("state = ? AND expires_at > ?", stateValue, time.Now()).First(&state).Error; err != nil {
+		return ExternalIdentity{}, ErrOIDCStateInvalid
+	}
+	// Deleting the state makes it single use, even when two callbacks race
+	if res := database.DB.Unscoped().Delete(&state); res.Error != nil || res.RowsAffected == 0 {
+		return ExternalIdentity{}, ErrOIDCStateInvalid
+	}
+
+	provider, err := getOIDCProvider()
+	if err != nil {
+		return ExternalIdentity{}, err
+	}
+	cfg := config.AppConfig.OIDC
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", cfg.RedirectURL)
+	form.Set("client_id", cfg.ClientID)
+	form.Set("code_verifier", state.CodeVerifier)
+	if cfg.ClientSecret != "" {
+		form.Set("client_secret", cfg.ClientSecret)
+	}
+	resp, err := oidcClient.PostForm(provider.TokenEndpoint, form)
+	if err != nil {
+		return ExternalIdentity{}, fmt.Errorf("%w: %v", ErrOIDCProviderFailed, err)
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return ExternalIdentity{}, fmt.Errorf("%w: token response: %v", ErrOIDCProviderFailed, err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return ExternalIdentity{}, fmt.Errorf("%w: token request returned %s %s %s", ErrOIDCProviderFailed,
+			resp.Status, tokens.Error, tokens.ErrorDescription)
+	}
+	return verifyIDToken(provider, tokens.IDToken, state.Nonce)
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token
+func verifyIDToken(provider *oidcProvider, raw, nonce string) (ExternalIdentity, error) {
+	cfg := config.AppConfig.OIDC
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return provider.signingKey(kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(provider.Issuer),
+		jwt.WithAudience(cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return ExternalIdentity{}, fmt.Errorf("%w: %v", ErrOIDCTokenRejected, err)
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return ExternalIdentity{}, fmt.Errorf("%w: nonce mismatch", ErrOIDCTokenRejected)
+	}
+
+	identity := ExternalIdentity{Provider: AuthProviderOIDC}
+	identity.Subject, _ = claims["sub"].(string)
+	if identity.Subject == "" {
+		return ExternalIdentity{}, fmt.Errorf("%w: missing sub", ErrOIDCTokenRejected)
+	}
+	usernameClaim := cfg.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "preferred_username"
+	}
+	identity.Username, _ = claims[usernameClaim].(string)
+	identity.Email, _ = claims["email"].(string)
+
+	groupsClaim := cfg.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	switch groups := claims[groupsClaim].(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, s)
+			}
+		}
+	case string:
+		identity.Groups = strings.Fields(strings.ReplaceAll(groups, ",", " "))
+	}
+	return identity, nil
+}
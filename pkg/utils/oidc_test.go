@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gobi/config"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// useTestDatabase points database.DB at a fresh sqlite database holding the given models
+func useTestDatabase(t *testing.T, tables ...interface{}) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "gobi.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(tables...); err != nil {
+		t.Fatal(err)
+	}
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
+}
+
+// mockIssuer is an httptest identity provider serving discovery, a JWKS with one RSA key and a token
+// endpoint that checks the PKCE verifier of the authorization request
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	kid string
+
+	mu            sync.Mutex
+	jwksRequests  int
+	codeChallenge string
+	nonce         string
+	claims        jwt.MapClaims // added to, or overriding, the claims of issued ID tokens
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockIssuer{key: key, kid: "k1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+			"jwks_uri":               issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		issuer.jwksRequests++
+		issuer.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": issuer.kid,
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "auth-code" || r.PostForm.Get("client_id") != "gobi" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != issuer.codeChallenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": issuer.idToken(t, issuer.key, issuer.kid, nil)})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+
+	previous := config.AppConfig.OIDC
+	config.AppConfig.OIDC.Issuer = issuer.URL
+	config.AppConfig.OIDC.ClientID = "gobi"
+	config.AppConfig.OIDC.RedirectURL = "https://gobi.example.com/api/auth/oidc/callback"
+	config.AppConfig.OIDC.Scopes = []string{"email", "groups"}
+	oidcCached = nil
+	t.Cleanup(func() {
+		config.AppConfig.OIDC = previous
+		oidcCached = nil
+	})
+	return issuer
+}
+
+// idToken signs an ID token for alice with the nonce of the last authorization request, applying the
+// issuer's claim overrides and then extra
+func (m *mockIssuer) idToken(t *testing.T, key *rsa.PrivateKey, kid string, extra jwt.MapClaims) string {
+	claims := jwt.MapClaims{
+		"iss":                m.URL,
+		"aud":                "gobi",
+		"sub":                "00u1",
+		"preferred_username": "alice",
+		"email":              "alice@example.com",
+		"groups":             []string{"analysts", "finance"},
+		"nonce":              m.nonce,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// authorize starts a login and records what the browser would carry to the provider
+func (m *mockIssuer) authorize(t *testing.T) string {
+	authURL, state, err := OIDCAuthURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("client_id") != "gobi" || q.Get("response_type") != "code" ||
+		q.Get("scope") != "openid email groups" || q.Get("code_challenge_method") != "S256" || q.Get("state") != state ||
+		q.Get("redirect_uri") != "https://gobi.example.com/api/auth/oidc/callback" {
+		t.Fatalf("authorization URL = %s", authURL)
+	}
+	m.codeChallenge, m.nonce = q.Get("code_challenge"), q.Get("nonce")
+	return state
+}
+
+func TestOIDCLogin(t *testing.T) {
+	useTestDatabase(t, &models.OIDCState{})
+	issuer := newMockIssuer(t)
+
+	state := issuer.authorize(t)
+	identity, err := CompleteOIDCLogin(state, "auth-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Provider != AuthProviderOIDC || identity.Subject != "00u1" || identity.Username != "alice" ||
+		identity.Email != "alice@example.com" || len(identity.Groups) != 2 || identity.Groups[1] != "finance" {
+		t.Fatalf("identity = %+v", identity)
+	}
+
+	// A state is single use
+	if _, err := CompleteOIDCLogin(state, "auth-code"); !errors.Is(err, ErrOIDCStateInvalid) {
+		t.Fatalf("replayed state = %v", err)
+	}
+	if _, err := CompleteOIDCLogin("forged", "auth-code"); !errors.Is(err, ErrOIDCStateInvalid) {
+		t.Fatalf("unknown state = %v", err)
+	}
+}
+
+func TestOIDCLoginRejectsWrongCode(t *testing.T) {
+	useTestDatabase(t, &models.OIDCState{})
+	issuer := newMockIssuer(t)
+
+	state := issuer.authorize(t)
+	if _, err := CompleteOIDCLogin(state, "stolen-code"); !errors.Is(err, ErrOIDCProviderFailed) {
+		t.Fatalf("wrong code = %v", err)
+	}
+}
+
+func TestOIDCLoginExpiredState(t *testing.T) {
+	useTestDatabase(t, &models.OIDCState{})
+	issuer := newMockIssuer(t)
+
+	state := issuer.authorize(t)
+	database.DB.Model(&models.OIDCState{}).Where("state = ?", state).Update("expires_at", time.Now().Add(-time.Second))
+	if _, err := CompleteOIDCLogin(state, "auth-code"); !errors.Is(err, ErrOIDCStateInvalid) {
+		t.Fatalf("expired state = %v", err)
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.nonce = "n-1"
+	provider, err := getOIDCProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := verifyIDToken(provider, issuer.idToken(t, issuer.key, issuer.kid, nil), "n-1"); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	for name, raw := range map[string]string{
+		"foreign key":     issuer.idToken(t, otherKey, issuer.kid, nil),
+		"unknown kid":     issuer.idToken(t, issuer.key, "k2", nil),
+		"wrong issuer":    issuer.idToken(t, issuer.key, issuer.kid, jwt.MapClaims{"iss": "https://evil.example.com"}),
+		"wrong audience":  issuer.idToken(t, issuer.key, issuer.kid, jwt.MapClaims{"aud": "other-client"}),
+		"expired":         issuer.idToken(t, issuer.key, issuer.kid, jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}),
+		"no expiry":       issuer.idToken(t, issuer.key, issuer.kid, jwt.MapClaims{"exp": nil}),
+		"wrong nonce":     issuer.idToken(t, issuer.key, issuer.kid, jwt.MapClaims{"nonce": "n-2"}),
+		"missing subject": issuer.idToken(t, issuer.key, issuer.kid, jwt.MapClaims{"sub": ""}),
+		"hmac":            hmacIDToken(t, issuer),
+	} {
+		if _, err := verifyIDToken(provider, raw, "n-1"); !errors.Is(err, ErrOIDCTokenRejected) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+
+	// Unknown key IDs reload the key set at most once a minute
+	if issuer.jwksRequests != 1 {
+		t.Fatalf("JWKS fetched %d times", issuer.jwksRequests)
+	}
+}
+
+// hmacIDToken signs a token with HS256 keyed by the issuer's public modulus, which must not pass for
+// an RSA signature
+func hmacIDToken(t *testing.T, issuer *mockIssuer) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": issuer.URL, "aud": "gobi", "sub": "00u1", "nonce": "n-1", "exp": time.Now().Add(time.Minute).Unix(),
+	})
+	token.Header["kid"] = issuer.kid
+	signed, err := token.SignedString(issuer.key.N.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerifyIDTokenGroupsClaim(t *testing.T) {
+	issuer := newMockIssuer(t)
+	config.AppConfig.OIDC.GroupsClaim = "roles"
+	config.AppConfig.OIDC.UsernameClaim = "email"
+	issuer.claims = jwt.MapClaims{"roles": "admins, analysts"}
+	provider, err := getOIDCProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := verifyIDToken(provider, issuer.idToken(t, issuer.key, issuer.kid, nil), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "alice@example.com" || len(identity.Groups) != 2 || identity.Groups[0] != "admins" || identity.Groups[1] != "analysts" {
+		t.Fatalf("identity = %+v", identity)
+	}
+}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"errors"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+
+	"gorm.io/gorm"
+)
+
+// Roles of organization and team members
+const (
+	OrgRoleAdmin       = "admin"
+	OrgRoleMember      = "member"
+	TeamRoleMaintainer = "maintainer"
+	TeamRoleMember     = "member"
+)
+
+// DefaultOrganizationName is the organization existing users and resources are moved to on upgrade
+const DefaultOrganizationName = "Default"
+
+var ErrNotOrganizationMember = errors.New("user is not a member of the organization")
+
+// orgScopedTables hold resources that belong to an organization
+var orgScopedTables = []interface{}{
+	&models.DataSource{}, &models.Query{}, &models.Chart{}, &models.ExcelTemplate{}, &models.ReportSchedule{},
+	&models.Report{}, &models.Alert{}, &models.WebhookDestination{},
+}
+
+// EnsureDefaultOrganization creates the default organization when there is none yet, makes every user a
+// member of it, and moves resources created before organizations existed into the first organization
+func EnsureDefaultOrganization() error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var org models.Organization
+		err := tx.Order("id").First(&org).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			org = models.Organization{Name: DefaultOrganizationName}
+			if err := tx.Create(&org).Error; err != nil {
+				return err
+			}
+			var users []models.User
+			if err := tx.Find(&users).Error; err != nil {
+				return err
+			}
+			for _, user := range users {
+				role := OrgRoleMember
+				if NewSubject(user.ID, user.Role).IsSuperuser() {
+					role = OrgRoleAdmin
+				}
+				member := models.OrganizationMember{OrganizationID: org.ID, UserID: user.ID, Role: role}
+				if err := tx.Create(&member).Error; err != nil {
+					return err
+				}
+			}
+			Logger.WithFields(map[string]interface{}{
+				"action":         "ensure_default_organization",
+				"organizationID": org.ID,
+				"members":        len(users),
+			}).Info("Default organization created")
+		} else if err != nil {
+			return err
+		}
+
+		for _, table := range orgScopedTables {
+			if err := tx.Unscoped().Model(table).Where("organization_id = 0 OR organization_id IS NULL").
+				Update("organization_id", org.ID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DefaultOrganizationID returns the oldest organization, where users are added when none is specified
+func DefaultOrganizationID() uint {
+	var org models.Organization
+	if err := database.DB.Select("id").Order("id").First(&org).Error; err != nil {
+		return 0
+	}
+	return org.ID
+}
+
+// OrgMemberRole returns the role of a user in an organization, or "" if the user is not a member
+func OrgMemberRole(orgID, userID uint) string {
+	var member models.OrganizationMember
+	if err := database.DB.Where("organization_id = ? AND user_id = ?", orgID, userID).First(&member).Error; err != nil {
+		return ""
+	}
+	return member.Role
+}
+
+// AddOrganizationMember makes a user a member of an organization, changing the role of an existing member
+func AddOrganizationMember(tx *gorm.DB, orgID, userID uint, role string) error {
+	member := models.OrganizationMember{OrganizationID: orgID, UserID: userID}
+	if err := tx.Where(&member).Limit(1).Find(&member).Error; err != nil {
+		return err
+	}
+	member.Role = role
+	return tx.Save(&member).Error
+}
+
+// ResolveOrganization returns the organization a request acts in and the user's role there. requested is
+// the organization asked for, 0 for the user's first organization. Superusers may act in any organization.
+// A user without organizations gets 0 and can only see resources once added to one.
+func ResolveOrganization(userID uint, role string, requested uint) (uint, string, error) {
+	superuser := NewSubject(userID, role).IsSuperuser()
+	if requested != 0 {
+		if memberRole := OrgMemberRole(requested, userID); memberRole != "" {
+			return requested, memberRole, nil
+		}
+		if superuser {
+			var count int64
+			database.DB.Model(&models.Organization{}).Where("id = ?", requested).Count(&count)
+			if count > 0 {
+				return requested, OrgRoleAdmin, nil
+			}
+		}
+		return 0, "", ErrNotOrganizationMember
+	}
+
+	var member models.OrganizationMember
+	err := database.DB.Where("user_id = ?", userID).Order("organization_id").First(&member).Error
+	if err == nil {
+		return member.OrganizationID, member.Role, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, "", err
+	}
+	if superuser {
+		if orgID := DefaultOrganizationID(); orgID != 0 {
+			return orgID, OrgRoleAdmin, nil
+		}
+	}
+	return 0, "", nil
+}
+
+// OrganizationHasResources reports whether any resource still belongs to an organization
+func OrganizationHasResources(orgID uint) (bool, error) {
+	for _, table := range orgScopedTables {
+		var count int64
+		if err := database.DB.Model(table).Where("organization_id = ?", orgID).Count(&count).Error; err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CountOrganizationAdmins returns the number of admins of an organization
+func CountOrganizationAdmins(tx *gorm.DB, orgID uint) int64 {
+	var count int64
+	tx.Model(&models.OrganizationMember{}).Where("organization_id = ? AND role = ?", orgID, OrgRoleAdmin).Count(&count)
+	return count
+}
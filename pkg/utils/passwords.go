@@ -0,0 +1,146 @@
+package utils
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"gobi/config"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//go:embed breached_passwords.txt
+var breachedPasswordList string
+
+// breachedPasswords holds the bundled list of common breached passwords, in lower case
+var breachedPasswords = func() map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, line := range strings.Split(breachedPasswordList, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			set[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	return set
+}()
+
+var ErrPasswordReused = errors.New("Password was used recently, choose a different one")
+
+// PasswordPolicyError lists the rules of the password policy a password breaks
+type PasswordPolicyError struct {
+	Violations []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "Password " + strings.Join(e.Violations, ", ")
+}
+
+// ValidatePassword checks a password against the configured password policy
+func ValidatePassword(password, username string) error {
+	policy := config.AppConfig.PasswordPolicy
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	var violations []string
+	if n := len([]rune(password)); n < policy.MinLength {
+		violations = append(violations, fmt.Sprintf("must have at least %d characters", policy.MinLength))
+	}
+	if policy.RequireUpper && !upper {
+		violations = append(violations, "must contain an uppercase letter")
+	}
+	if policy.RequireLower && !lower {
+		violations = append(violations, "must contain a lowercase letter")
+	}
+	if policy.RequireDigit && !digit {
+		violations = append(violations, "must contain a digit")
+	}
+	if policy.RequireSymbol && !symbol {
+		violations = append(violations, "must contain a symbol")
+	}
+	if username != "" && strings.EqualFold(password, username) {
+		violations = append(violations, "must differ from the username")
+	}
+	if policy.CheckBreached {
+		if _, found := breachedPasswords[strings.ToLower(password)]; found {
+			violations = append(violations, "is too common and appears in breached password lists")
+		}
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// HashPassword checks a new password of a user against the password policy and the user's recent
+// passwords, and returns its bcrypt hash. Users not created yet have no ID and no recent passwords.
+func HashPassword(user models.User, password string) (string, error) {
+	if err := ValidatePassword(password, user.Username); err != nil {
+		return "", err
+	}
+	if size := config.AppConfig.PasswordPolicy.HistorySize; size > 0 && user.ID != 0 {
+		hashes := []string{user.Password}
+		var history []models.PasswordHistory
+		if err := database.DB.Where("user_id = ?", user.ID).Order("id DESC").Limit(size).Find(&history).Error; err != nil {
+			return "", err
+		}
+		for _, h := range history {
+			hashes = append(hashes, h.Hash)
+		}
+		for _, hash := range hashes {
+			if hash != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+				return "", ErrPasswordReused
+			}
+		}
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// RecordPasswordHistory remembers a user's new password hash, keeping as many as the policy refuses
+// to reuse
+func RecordPasswordHistory(userID uint, hash string) {
+	size := config.AppConfig.PasswordPolicy.HistorySize
+	if size <= 0 {
+		return
+	}
+	if err := database.DB.Create(&models.PasswordHistory{UserID: userID, Hash: hash}).Error; err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action": "password_history",
+			"userID": userID,
+			"error":  err.Error(),
+		}).Error("Could not record password history")
+		return
+	}
+	// The ids to keep are read first, since MySQL does not allow LIMIT in an IN subquery
+	var keep []uint
+	err := database.DB.Model(&models.PasswordHistory{}).Where("user_id = ?", userID).
+		Order("id DESC").Limit(size).Pluck("id", &keep).Error
+	if err == nil {
+		err = database.DB.Unscoped().Where("user_id = ? AND id NOT IN ?", userID, keep).Delete(&models.PasswordHistory{}).Error
+	}
+	if err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action": "password_history",
+			"userID": userID,
+			"error":  err.Error(),
+		}).Error("Could not prune password history")
+	}
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queryParamPattern matches {{name}} parameters in saved query SQL. Parameters are bound as driver
+// arguments, so they must not be quoted: WHERE day = {{date}}
+var queryParamPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// ParamBinding binds a query parameter of a schedule to a fixed value or to a relative date macro that
+// is evaluated when the report runs
+type ParamBinding struct {
+	Value  string `json:"value,omitempty"`
+	Macro  string `json:"macro,omitempty"`  // e.g. yesterday, start_of_week, last_month_end, now-7d
+	Format string `json:"format,omitempty"` // Go time layout of a macro value
+}
+
+// QueryParamNames returns the distinct parameters used in sqlStr, in order of appearance
+func QueryParamNames(sqlStr string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, m := range queryParamPattern.FindAllStringSubmatch(sqlStr, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// BindQueryParams replaces the {{name}} parameters of sqlStr with placeholders of the data source
+// driver and returns the matching arguments
+func BindQueryParams(dsType, sqlStr string, params map[string]string) (string, []interface{}, error) {
+	var args []interface{}
+	var missing []string
+	bound := queryParamPattern.ReplaceAllStringFunc(sqlStr, func(m string) string {
+		name := queryParamPattern.FindStringSubmatch(m)[1]
+		value, ok := params[name]
+		if !ok {
+			missing = append(missing, name)
+			return m
+		}
+		args = append(args, value)
+		return placeholder(dsType, len(args))
+	})
+	if len(missing) > 0 {
+		return "", nil, fmt.Errorf("query parameter %s has no value", strings.Join(missing, ", "))
+	}
+	return bound, args, nil
+}
+
+// placeholder returns the driver placeholder of the nth argument of a statement
+func placeholder(dsType string, n int) string {
+	if dsType == "postgres" {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// ParseParamBindings decodes the JSON parameter bindings of a schedule
+func ParseParamBindings(text string) (map[string]ParamBinding, error) {
+	bindings := map[string]ParamBinding{}
+	if strings.TrimSpace(text) == "" || text == "null" {
+		return bindings, nil
+	}
+	if err := json.Unmarshal([]byte(text), &bindings); err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+// ValidateParamBindings checks parameter names and that every binding has exactly one valid value or macro
+func ValidateParamBindings(bindings map[string]ParamBinding) error {
+	for name, binding := range bindings {
+		if !queryParamPattern.MatchString("{{" + name + "}}") {
+			return fmt.Errorf("invalid parameter name %q", name)
+		}
+		if (binding.Value == "") == (binding.Macro == "") {
+			return fmt.Errorf("parameter %s needs either a value or a macro", name)
+		}
+		if binding.Macro != "" {
+			if _, _, err := evalDateMacro(binding.Macro, time.Now()); err != nil {
+				return fmt.Errorf("parameter %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ResolveParamBindings evaluates the bindings at now, which should be on the schedule's wall clock
+func ResolveParamBindings(bindings map[string]ParamBinding, now time.Time) (map[string]string, error) {
+	values := make(map[string]string, len(bindings))
+	names := make([]string, 0, len(bindings))
+	for name := range bindings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		binding := bindings[name]
+		if binding.Macro == "" {
+			values[name] = binding.Value
+			continue
+		}
+		t, layout, err := evalDateMacro(binding.Macro, now)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %s: %w", name, err)
+		}
+		if binding.Format != "" {
+			layout = binding.Format
+		}
+		values[name] = t.Format(layout)
+	}
+	return values, nil
+}
+
+// dateMacroPattern is a base macro followed by optional offsets such as -7d or +1m
+var dateMacroPattern = regexp.MustCompile(`^([a-z_]+)((?:[+-]\d+[hdwmy])*)$`)
+var dateOffsetPattern = regexp.MustCompile(`([+-]\d+)([hdwmy])`)
+
+// evalDateMacro evaluates a relative date macro and returns it with its default layout: dates for the
+// day based macros and date and time for now
+//
+//	now, today, yesterday, tomorrow
+//	start_of_week, end_of_week, last_week_start, last_week_end (weeks start on Monday)
+//	start_of_month, end_of_month, last_month_start, last_month_end
+//	start_of_year, end_of_year, last_year_start, last_year_end
+//
+// Any macro can be shifted by offsets in hours, days, weeks, months or years: now-7d, today+1w, start_of_month-1y
+func evalDateMacro(macro string, now time.Time) (time.Time, string, error) {
+	m := dateMacroPattern.FindStringSubmatch(strings.ToLower(strings.ReplaceAll(macro, " ", "")))
+	if m == nil {
+		return time.Time{}, "", fmt.Errorf("invalid date macro %q", macro)
+	}
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	weekStart := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	yearStart := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, now.Location())
+
+	layout := "2006-01-02"
+	var t time.Time
+	switch m[1] {
+	case "now":
+		t, layout = now, "2006-01-02 15:04:05"
+	case "today":
+		t = day
+	case "yesterday":
+		t = day.AddDate(0, 0, -1)
+	case "tomorrow":
+		t = day.AddDate(0, 0, 1)
+	case "start_of_week":
+		t = weekStart
+	case "end_of_week":
+		t = weekStart.AddDate(0, 0, 6)
+	case "last_week_start":
+		t = weekStart.AddDate(0, 0, -7)
+	case "last_week_end":
+		t = weekStart.AddDate(0, 0, -1)
+	case "start_of_month":
+		t = monthStart
+	case "end_of_month":
+		t = monthStart.AddDate(0, 1, -1)
+	case "last_month_start":
+		t = monthStart.AddDate(0, -1, 0)
+	case "last_month_end":
+		t = monthStart.AddDate(0, 0, -1)
+	case "start_of_year":
+		t = yearStart
+	case "end_of_year":
+		t = yearStart.AddDate(1, 0, -1)
+	case "last_year_start":
+		t = yearStart.AddDate(-1, 0, 0)
+	case "last_year_end":
+		t = yearStart.AddDate(0, 0, -1)
+	default:
+		return time.Time{}, "", fmt.Errorf("unknown date macro %q", m[1])
+	}
+
+	for _, offset := range dateOffsetPattern.FindAllStringSubmatch(m[2], -1) {
+		n, err := strconv.Atoi(offset[1])
+		if err != nil {
+			return time.Time{}, "", fmt.Errorf("invalid offset in date macro %q", macro)
+		}
+		switch offset[2] {
+		case "h":
+			t = t.Add(time.Duration(n) * time.Hour)
+		case "d":
+			t = t.AddDate(0, 0, n)
+		case "w":
+			t = t.AddDate(0, 0, 7*n)
+		case "m":
+			t = addMonthsClamped(t, n)
+		case "y":
+			t = addMonthsClamped(t, 12*n)
+		}
+	}
+	return t, layout, nil
+}
+
+// addMonthsClamped adds months without overflowing into the next month, so that Mar 31 - 1m is Feb 28/29
+func addMonthsClamped(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month(), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	target := first.AddDate(0, months, 0)
+	lastDay := target.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return target.AddDate(0, 0, day-1)
+}
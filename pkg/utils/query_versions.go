@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"fmt"
+	"gobi/internal/models"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// RecordQueryVersion snapshots the current state of a query as its next version and stores the new
+// version number on the query. It must run in the same transaction as the query update, so that the
+// unique (query_id, version) index rejects a concurrent update instead of losing it.
+func RecordQueryVersion(tx *gorm.DB, query *models.Query, authorID uint, note string) (models.QueryVersion, error) {
+	var latest int
+	if err := tx.Model(&models.QueryVersion{}).Where("query_id = ?", query.ID).
+		Select("COALESCE(MAX(version), 0)").Scan(&latest).Error; err != nil {
+		return models.QueryVersion{}, err
+	}
+	version := models.QueryVersion{
+		QueryID:      query.ID,
+		Version:      latest + 1,
+		Name:         query.Name,
+		SQL:          query.SQL,
+		Description:  query.Description,
+		DataSourceID: query.DataSourceID,
+		AuthorID:     authorID,
+		Note:         note,
+	}
+	if err := tx.Create(&version).Error; err != nil {
+		return models.QueryVersion{}, err
+	}
+	query.Version = version.Version
+	if err := tx.Model(&models.Query{}).Where("id = ?", query.ID).Update("version", version.Version).Error; err != nil {
+		return models.QueryVersion{}, err
+	}
+	return version, nil
+}
+
+// EnsureQueryBaseline records the state of a query created before versioning as its first version,
+// so that the first update can still be diffed and undone
+func EnsureQueryBaseline(tx *gorm.DB, query *models.Query) error {
+	if query.Version != 0 {
+		return nil
+	}
+	_, err := RecordQueryVersion(tx, query, query.UserID, "Version before history was recorded")
+	return err
+}
+
+// VersionFieldChange is a changed scalar field between two versions of a query or chart
+type VersionFieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// SQLDiffLine is one line of a line-based SQL diff: op is " " for unchanged, "-" for removed and "+"
+// for added lines
+type SQLDiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// QueryVersionDiff describes the changes from one version of a query to another
+type QueryVersionDiff struct {
+	QueryID uint                 `json:"query_id"`
+	From    int                  `json:"from"`
+	To      int                  `json:"to"`
+	Fields  []VersionFieldChange `json:"fields"`
+	SQL     []SQLDiffLine        `json:"sql"`
+	Unified string               `json:"unified"` // unified diff of the SQL, empty when it did not change
+}
+
+// DiffQueryVersions compares the fields and SQL of two versions of the same query
+func DiffQueryVersions(from, to models.QueryVersion) QueryVersionDiff {
+	diff := QueryVersionDiff{QueryID: from.QueryID, From: from.Version, To: to.Version, Fields: []VersionFieldChange{}}
+	if from.Name != to.Name {
+		diff.Fields = append(diff.Fields, VersionFieldChange{Field: "name", Old: from.Name, New: to.Name})
+	}
+	if from.Description != to.Description {
+		diff.Fields = append(diff.Fields, VersionFieldChange{Field: "description", Old: from.Description, New: to.Description})
+	}
+	if from.DataSourceID != to.DataSourceID {
+		diff.Fields = append(diff.Fields, VersionFieldChange{Field: "data_source_id", Old: from.DataSourceID, New: to.DataSourceID})
+	}
+	diff.SQL = diffLines(splitSQLLines(from.SQL), splitSQLLines(to.SQL))
+	if from.SQL != to.SQL {
+		diff.Unified = unifiedDiff(diff.SQL, fmt.Sprintf("version %d", from.Version), fmt.Sprintf("version %d", to.Version), 3)
+	}
+	return diff
+}
+
+func splitSQLLines(sql string) []string {
+	sql = strings.ReplaceAll(sql, "\r\n", "\n")
+	if sql == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(sql, "\n"), "\n")
+}
+
+// diffLines computes a minimal line diff from the longest common subsequence of a and b
+func diffLines(a, b []string) []SQLDiffLine {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	lines := []SQLDiffLine{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, SQLDiffLine{Op: " ", Text: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, SQLDiffLine{Op: "-", Text: a[i]})
+			i++
+		default:
+			lines = append(lines, SQLDiffLine{Op: "+", Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, SQLDiffLine{Op: "-", Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, SQLDiffLine{Op: "+", Text: b[j]})
+	}
+	return lines
+}
+
+// unifiedDiff renders a line diff in unified format with the given number of context lines
+func unifiedDiff(lines []SQLDiffLine, fromName, toName string, context int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+
+	// Line numbers of each diff line in the old and new SQL
+	oldNo := make([]int, len(lines)+1)
+	newNo := make([]int, len(lines)+1)
+	for k, line := range lines {
+		oldNo[k+1], newNo[k+1] = oldNo[k], newNo[k]
+		if line.Op != "+" {
+			oldNo[k+1]++
+		}
+		if line.Op != "-" {
+			newNo[k+1]++
+		}
+	}
+
+	for k := 0; k < len(lines); {
+		if lines[k].Op == " " {
+			k++
+			continue
+		}
+		// Grow the hunk while changes are separated by at most 2*context unchanged lines
+		start := max(k-context, 0)
+		end := k
+		for end < len(lines) {
+			if lines[end].Op != " " {
+				end++
+				continue
+			}
+			next := end
+			for next < len(lines) && lines[next].Op == " " {
+				next++
+			}
+			if next == len(lines) || next-end > 2*context {
+				end = min(end+context, len(lines))
+				break
+			}
+			end = next
+		}
+
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(oldNo[start], oldNo[end]), hunkRange(newNo[start], newNo[end]))
+		for _, line := range lines[start:end] {
+			sb.WriteString(line.Op + line.Text + "\n")
+		}
+		k = end
+	}
+	return sb.String()
+}
+
+// hunkRange formats the start,count range of a hunk from the line counts before and after it
+func hunkRange(before, after int) string {
+	count := after - before
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
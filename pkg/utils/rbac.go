@@ -0,0 +1,370 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Access levels on a resource, each one including the levels before it: view < execute < edit < own.
+// own allows deleting the resource, changing its visibility and managing its grants.
+const (
+	AccessView    = "view"
+	AccessExecute = "execute"
+	AccessEdit    = "edit"
+	AccessOwn     = "own"
+)
+
+var accessRank = map[string]int{AccessView: 1, AccessExecute: 2, AccessEdit: 3, AccessOwn: 4}
+
+// Resource types checked by the policy engine
+const (
+	ResourceDataSource = "datasource"
+	ResourceQuery      = "query"
+	ResourceChart      = "chart"
+	ResourceTemplate   = "template"
+	ResourceSchedule   = "schedule"
+	ResourceAlert      = "alert"
+	ResourceWebhook    = "webhook"
+)
+
+// GrantableResources are the resource types that can be shared with users, groups and teams. Alerts
+// and webhooks are only accessible to their owner and admins.
+var GrantableResources = []string{ResourceDataSource, ResourceQuery, ResourceChart, ResourceTemplate, ResourceSchedule}
+
+// Subjects a resource can be granted to
+const (
+	GrantSubjectUser  = "user"
+	GrantSubjectGroup = "group"
+	GrantSubjectTeam  = "team"
+)
+
+// publicAccess is the level every member of the organization gets on a resource marked public
+var publicAccess = map[string]string{ResourceDataSource: AccessExecute, ResourceQuery: AccessExecute}
+
+// Permissions not tied to a resource. A role holding PermAll is a superuser that passes every check.
+const (
+	PermAll         = "*"
+	PermManageUsers = "users.manage" // users, groups and service accounts
+	PermManageRoles = "roles.manage"
+	PermManageOrgs  = "orgs.manage" // create and delete organizations, manage any organization
+	PermClearCache  = "cache.clear"
+	PermReadAudit   = "audit.read" // the audit log of every organization
+	PermBypassRLS   = "rls.bypass" // every row, regardless of row policies
+)
+
+// BuiltinRoles maps the built-in roles to their permissions. Resource permissions have the form
+// <type>.<action>, where action is an access level or create, and <type>.* grants every action.
+// "user" is the role of accounts created before roles existed and keeps its former rights.
+var BuiltinRoles = map[string][]string{
+	"viewer": {"datasource.view", "query.view", "query.execute", "chart.view", "template.view", "template.execute",
+		"schedule.view"},
+	"analyst": {"datasource.view", "datasource.execute", "query.*", "chart.*", "template.view", "template.execute",
+		"schedule.view", "schedule.execute", "alert.*"},
+	"editor": editorPermissions,
+	"user":   editorPermissions,
+	"admin":  {PermAll},
+}
+
+var editorPermissions = []string{"datasource.*", "query.*", "chart.*", "template.*", "schedule.*", "alert.*", "webhook.*"}
+
+// resourceTypes are the types resource permissions can name
+var resourceTypes = map[string]bool{
+	ResourceDataSource: true, ResourceQuery: true, ResourceChart: true, ResourceTemplate: true,
+	ResourceSchedule: true, ResourceAlert: true, ResourceWebhook: true,
+}
+
+// ValidatePermissions checks that every permission is known, so that typos do not silently grant nothing
+func ValidatePermissions(perms []string) error {
+	for _, perm := range perms {
+		switch perm {
+		case PermAll, PermManageUsers, PermManageRoles, PermManageOrgs, PermClearCache, PermReadAudit, PermBypassRLS:
+			continue
+		}
+		resource, action, ok := strings.Cut(perm, ".")
+		if !ok || !resourceTypes[resource] || (action != "*" && action != "create" && accessRank[action] == 0) {
+			return fmt.Errorf("unknown permission %q", perm)
+		}
+	}
+	return nil
+}
+
+// RoleExists reports whether role is a built-in or custom role
+func RoleExists(role string) bool {
+	if _, ok := BuiltinRoles[role]; ok {
+		return true
+	}
+	var count int64
+	database.DB.Model(&models.Role{}).Where("name = ?", role).Count(&count)
+	return count > 0
+}
+
+// RolePermissions returns the permissions of a built-in or custom role; unknown roles have none
+func RolePermissions(role string) []string {
+	if perms, ok := BuiltinRoles[role]; ok {
+		return perms
+	}
+	var custom models.Role
+	if err := database.DB.Where("name = ?", role).First(&custom).Error; err != nil {
+		return nil
+	}
+	var perms []string
+	_ = json.Unmarshal([]byte(custom.Permissions), &perms)
+	return perms
+}
+
+// Subject is the user an action is authorized for, acting in an organization
+type Subject struct {
+	UserID  uint
+	Role    string
+	OrgID   uint   // organization the subject acts in, 0 for none
+	OrgRole string // role of the subject in OrgID
+	perms   []string
+}
+
+// NewSubject returns the subject for a user with the given role, outside any organization
+func NewSubject(userID uint, role string) Subject {
+	return Subject{UserID: userID, Role: role, perms: RolePermissions(role)}
+}
+
+// InOrganization returns the subject acting in an organization where it has orgRole
+func (s Subject) InOrganization(orgID uint, orgRole string) Subject {
+	s.OrgID, s.OrgRole = orgID, orgRole
+	return s
+}
+
+// SubjectForUser loads the current role of a user and its membership of an organization, for checks
+// made outside a request
+func SubjectForUser(userID, orgID uint) (Subject, error) {
+	var user models.User
+	if err := database.DB.Select("id", "role").First(&user, userID).Error; err != nil {
+		return Subject{}, err
+	}
+	s := NewSubject(user.ID, user.Role)
+	if orgRole := OrgMemberRole(orgID, userID); orgRole != "" {
+		s = s.InOrganization(orgID, orgRole)
+	}
+	return s, nil
+}
+
+// IsOrgAdmin reports whether the subject administers the organization it acts in
+func (s Subject) IsOrgAdmin() bool {
+	return s.OrgID != 0 && (s.OrgRole == OrgRoleAdmin || s.IsSuperuser())
+}
+
+// HasPermission reports whether the subject's role grants perm. Organization admins hold every
+// resource permission in their organization.
+func (s Subject) HasPermission(perm string) bool {
+	resource, _, _ := strings.Cut(perm, ".")
+	if s.OrgID != 0 && s.OrgRole == OrgRoleAdmin && resourceTypes[resource] {
+		return true
+	}
+	for _, p := range s.perms {
+		if p == PermAll || p == perm || p == resource+".*" {
+			return true
+		}
+	}
+	return false
+}
+
+// UngrantablePermission returns the first of perms that the subject's role does not hold, or "" when it
+// holds them all. Permissions can only be given to others, through a role or a role assignment, by a
+// subject holding them; organization admin rights do not count, since roles apply in every organization.
+func (s Subject) UngrantablePermission(perms []string) string {
+	s.OrgID, s.OrgRole = 0, ""
+	for _, perm := range perms {
+		if !s.HasPermission(perm) {
+			return perm
+		}
+	}
+	return ""
+}
+
+// IsSuperuser reports whether the subject passes every check
+func (s Subject) IsSuperuser() bool {
+	return s.HasPermission(PermAll)
+}
+
+// CanCreate reports whether the subject may create resources of a type in its organization
+func (s Subject) CanCreate(resourceType string) bool {
+	return s.OrgID != 0 && s.HasPermission(resourceType+".create")
+}
+
+// Resource is a resource an action is authorized on
+type Resource struct {
+	Type    string
+	ID      uint
+	OwnerID uint
+	OrgID   uint
+	Public  bool
+}
+
+func DataSourceResource(ds models.DataSource) Resource {
+	return Resource{Type: ResourceDataSource, ID: ds.ID, OwnerID: ds.UserID, OrgID: ds.OrganizationID, Public: ds.IsPublic}
+}
+
+func QueryResource(q models.Query) Resource {
+	return Resource{Type: ResourceQuery, ID: q.ID, OwnerID: q.UserID, OrgID: q.OrganizationID, Public: q.IsPublic}
+}
+
+func ChartResource(chart models.Chart) Resource {
+	return Resource{Type: ResourceChart, ID: chart.ID, OwnerID: chart.UserID, OrgID: chart.OrganizationID}
+}
+
+func TemplateResource(tpl models.ExcelTemplate) Resource {
+	return Resource{Type: ResourceTemplate, ID: tpl.ID, OwnerID: tpl.UserID, OrgID: tpl.OrganizationID}
+}
+
+func ScheduleResource(schedule models.ReportSchedule) Resource {
+	return Resource{Type: ResourceSchedule, ID: schedule.ID, OwnerID: schedule.UserID, OrgID: schedule.OrganizationID}
+}
+
+// ReportResource authorizes a report through its schedule, so grants on a schedule cover its reports
+func ReportResource(report models.Report) Resource {
+	return Resource{Type: ResourceSchedule, ID: report.ScheduleID, OwnerID: report.UserID, OrgID: report.OrganizationID}
+}
+
+func AlertResource(alert models.Alert) Resource {
+	return Resource{Type: ResourceAlert, ID: alert.ID, OwnerID: alert.UserID, OrgID: alert.OrganizationID}
+}
+
+func WebhookResource(dest models.WebhookDestination) Resource {
+	return Resource{Type: ResourceWebhook, ID: dest.ID, OwnerID: dest.UserID, OrgID: dest.OrganizationID}
+}
+
+// AccessLevel returns the highest level the subject has on a resource through superuser or organization
+// admin rights, ownership, grants to the subject, its groups or teams, or the resource being public. It
+// ignores the role's permissions, see Can. Resources of other organizations get no access.
+func (s Subject) AccessLevel(res Resource) string {
+	if s.IsSuperuser() {
+		return AccessOwn
+	}
+	if s.OrgID == 0 || res.OrgID != s.OrgID {
+		return ""
+	}
+	if s.IsOrgAdmin() || (res.OwnerID != 0 && res.OwnerID == s.UserID) {
+		return AccessOwn
+	}
+	level := ""
+	if res.Public {
+		level = publicAccess[res.Type]
+	}
+	if res.ID == 0 {
+		return level
+	}
+	var grants []models.ResourceGrant
+	database.DB.Where("resource_type = ? AND resource_id = ?", res.Type, res.ID).
+		Where(s.grantedTo()).
+		Find(&grants)
+	for _, g := range grants {
+		if accessRank[g.Access] > accessRank[level] {
+			level = g.Access
+		}
+	}
+	return level
+}
+
+// Can reports whether the subject may act on a resource at the given level: its role must hold the
+// permission for the level and it must have at least that level on the resource
+func (s Subject) Can(res Resource, level string) bool {
+	if s.IsSuperuser() {
+		return true
+	}
+	if !s.HasPermission(res.Type + "." + level) {
+		return false
+	}
+	return accessRank[s.AccessLevel(res)] >= accessRank[level]
+}
+
+// grantedTo returns the condition matching grants to the subject, its groups and its teams
+func (s Subject) grantedTo() *gorm.DB {
+	groupIDs := database.DB.Model(&models.GroupMember{}).Select("group_id").Where("user_id = ?", s.UserID)
+	teamIDs := database.DB.Model(&models.TeamMember{}).Select("team_id").Where("user_id = ?", s.UserID)
+	return database.DB.Where("subject_type = ? AND subject_id = ?", GrantSubjectUser, s.UserID).
+		Or("subject_type = ? AND subject_id IN (?)", GrantSubjectGroup, groupIDs).
+		Or("subject_type = ? AND subject_id IN (?)", GrantSubjectTeam, teamIDs)
+}
+
+// Visible returns a scope restricting a list of resources of a type to those of the subject's
+// organization it can view: all of them for admins, otherwise owned, public when the table has an
+// is_public column, or granted. idColumn is the column holding the resource ID, such as schedule_id
+// when listing reports.
+func (s Subject) Visible(resourceType, idColumn string, public bool) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		db = db.Where("organization_id = ?", s.OrgID)
+		if s.IsOrgAdmin() {
+			return db
+		}
+		if s.OrgID == 0 || !s.HasPermission(resourceType+".view") {
+			return db.Where("1 = 0")
+		}
+		granted := database.DB.Model(&models.ResourceGrant{}).Select("resource_id").
+			Where("resource_type = ?", resourceType).
+			Where(s.grantedTo())
+		if public {
+			return db.Where("(user_id = ? OR is_public = ? OR "+idColumn+" IN (?))", s.UserID, true, granted)
+		}
+		return db.Where("(user_id = ? OR "+idColumn+" IN (?))", s.UserID, granted)
+	}
+}
+
+// userCan authorizes a user outside a request, such as the owner of a schedule or alert while it runs,
+// in the organization of the resource
+func userCan(userID uint, res Resource, level string) bool {
+	subject, err := SubjectForUser(userID, res.OrgID)
+	if err != nil {
+		return false
+	}
+	return subject.Can(res, level)
+}
+
+// LoadResource loads a grantable resource by type and ID
+func LoadResource(resourceType string, id uint) (Resource, error) {
+	var err error
+	var res Resource
+	switch resourceType {
+	case ResourceDataSource:
+		var ds models.DataSource
+		err = database.DB.First(&ds, id).Error
+		res = DataSourceResource(ds)
+	case ResourceQuery:
+		var q models.Query
+		err = database.DB.First(&q, id).Error
+		res = QueryResource(q)
+	case ResourceChart:
+		var chart models.Chart
+		err = database.DB.First(&chart, id).Error
+		res = ChartResource(chart)
+	case ResourceTemplate:
+		var tpl models.ExcelTemplate
+		err = database.DB.First(&tpl, id).Error
+		res = TemplateResource(tpl)
+	case ResourceSchedule:
+		var schedule models.ReportSchedule
+		err = database.DB.First(&schedule, id).Error
+		res = ScheduleResource(schedule)
+	default:
+		return res, fmt.Errorf("resource type %q cannot be shared", resourceType)
+	}
+	return res, err
+}
+
+// ValidAccessLevel reports whether level is one of the access levels
+func ValidAccessLevel(level string) bool {
+	return accessRank[level] > 0
+}
+
+// RoleNames returns the built-in role names in a stable order
+func RoleNames() []string {
+	names := make([]string, 0, len(BuiltinRoles))
+	for name := range BuiltinRoles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
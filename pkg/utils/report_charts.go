@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"gobi/internal/models"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// chartOptions is the subset of the frontend chart config that matters when exporting a chart
+type chartOptions struct {
+	XField     string  `json:"xField"`
+	YField     string  `json:"yField"`
+	ZField     string  `json:"zField"`
+	SizeField  string  `json:"sizeField"`
+	ColorField string  `json:"colorField"`
+	Title      string  `json:"title"`
+	Max        float64 `json:"max"`
+}
+
+// nativeChartTypes maps Gobi chart types to the excelize chart types that represent them natively
+var nativeChartTypes = map[string]excelize.ChartType{
+	"bar":     excelize.Col,
+	"line":    excelize.Line,
+	"pie":     excelize.Pie,
+	"scatter": excelize.Scatter,
+	"radar":   excelize.Radar,
+}
+
+// addChartSheet writes the chart data to a new sheet and places either a native Excel chart
+// or, for types Excel cannot draw, a rendered PNG next to the table
+func addChartSheet(f *excelize.File, sheetName string, chart models.Chart, columns []string, results []map[string]interface{}) error {
+	if _, err := f.NewSheet(sheetName); err != nil {
+		return err
+	}
+	writeResultTable(f, sheetName, columns, results)
+	if len(columns) == 0 || len(results) == 0 {
+		return nil
+	}
+
+	opts := parseChartOptions(chart)
+	anchor, _ := excelize.CoordinatesToCellName(len(columns)+2, 1)
+
+	if chartType, ok := nativeChartTypes[chart.Type]; ok {
+		return f.AddChart(sheetName, anchor, buildNativeChart(sheetName, chartType, opts, columns, results))
+	}
+
+	img, err := renderChartImage(chart.Type, opts, columns, results)
+	if err != nil {
+		return err
+	}
+	return f.AddPictureFromBytes(sheetName, anchor, &excelize.Picture{
+		Extension: ".png",
+		File:      img,
+		Format:    &excelize.GraphicOptions{AltText: opts.Title},
+	})
+}
+
+// parseChartOptions reads the chart config, filling in defaults the exporter relies on
+func parseChartOptions(chart models.Chart) chartOptions {
+	var opts chartOptions
+	if chart.Config != "" {
+		_ = json.Unmarshal([]byte(chart.Config), &opts)
+	}
+	if opts.Title == "" {
+		opts.Title = chart.Name
+	}
+	return opts
+}
+
+// buildNativeChart maps the x field to categories and every value column to a series
+func buildNativeChart(sheetName string, chartType excelize.ChartType, opts chartOptions, columns []string, results []map[string]interface{}) *excelize.Chart {
+	xCol := columnIndex(columns, opts.XField, 0)
+	valueCols := valueColumns(columns, results, opts, xCol)
+	if chartType == excelize.Pie && len(valueCols) > 1 {
+		valueCols = valueCols[:1]
+	}
+
+	lastRow := len(results) + 1
+	categories := columnRange(sheetName, xCol, 2, lastRow)
+	series := make([]excelize.ChartSeries, 0, len(valueCols))
+	for _, col := range valueCols {
+		series = append(series, excelize.ChartSeries{
+			Name:       columnRange(sheetName, col, 1, 1),
+			Categories: categories,
+			Values:     columnRange(sheetName, col, 2, lastRow),
+		})
+	}
+
+	return &excelize.Chart{
+		Type:      chartType,
+		Series:    series,
+		Title:     []excelize.RichTextRun{{Text: opts.Title}},
+		Legend:    excelize.ChartLegend{Position: "bottom"},
+		Dimension: excelize.ChartDimension{Width: 640, Height: 400},
+	}
+}
+
+// valueColumns returns the columns plotted as series: the configured y field, or every numeric column other than x
+func valueColumns(columns []string, results []map[string]interface{}, opts chartOptions, xCol int) []int {
+	if idx := columnIndex(columns, opts.YField, -1); idx >= 0 {
+		return []int{idx}
+	}
+	var cols []int
+	for i, name := range columns {
+		if i == xCol {
+			continue
+		}
+		if _, ok := toFloat(results[0][name]); ok {
+			cols = append(cols, i)
+		}
+	}
+	if len(cols) == 0 && len(columns) > 1 {
+		cols = append(cols, (xCol+1)%len(columns))
+	}
+	return cols
+}
+
+// columnIndex finds name in columns, returning fallback when it is empty or missing
+func columnIndex(columns []string, name string, fallback int) int {
+	if name != "" {
+		for i, col := range columns {
+			if col == name {
+				return i
+			}
+		}
+	}
+	return fallback
+}
+
+// columnRange builds an absolute reference such as 'Sales'!$B$2:$B$10 for a zero-based column
+func columnRange(sheetName string, col, fromRow, toRow int) string {
+	name, _ := excelize.ColumnNumberToName(col + 1)
+	sheet := "'" + strings.ReplaceAll(sheetName, "'", "''") + "'"
+	if fromRow == toRow {
+		return fmt.Sprintf("%s!$%s$%d", sheet, name, fromRow)
+	}
+	return fmt.Sprintf("%s!$%s$%d:$%s$%d", sheet, name, fromRow, name, toRow)
+}
+
+// toFloat converts the loosely typed values returned by ExecuteSQL into a float
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case uint:
+		return float64(t), true
+	case uint32:
+		return float64(t), true
+	case uint64:
+		return float64(t), true
+	case float32:
+		return float64(t), true
+	case float64:
+		return t, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(t)), 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
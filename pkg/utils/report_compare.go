@@ -0,0 +1,473 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"gobi/internal/models"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// ErrCompareUnsupported is returned for report formats whose tables cannot be read back
+var ErrCompareUnsupported = errors.New("only xlsx and csv-zip reports can be compared")
+
+// Row statuses of a report comparison
+const (
+	DiffAdded    = "added"
+	DiffRemoved  = "removed"
+	DiffChanged  = "changed"
+	DiffCompared = "compared"
+)
+
+// ReportComparison is the result of comparing a report with a baseline report, sheet by sheet
+type ReportComparison struct {
+	ReportID   uint        `json:"report_id"`
+	BaselineID uint        `json:"baseline_id"`
+	Sheets     []SheetDiff `json:"sheets"`
+	Summary    DiffSummary `json:"summary"`
+}
+
+// DiffSummary counts rows by status
+type DiffSummary struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Changed   int `json:"changed"`
+	Unchanged int `json:"unchanged"`
+}
+
+// SheetDiff compares one sheet; Status is added or removed for sheets found in only one report
+type SheetDiff struct {
+	Name       string      `json:"name"`
+	Status     string      `json:"status"`
+	KeyColumns []string    `json:"key_columns,omitempty"`
+	Columns    []string    `json:"columns"`
+	Added      []DiffRow   `json:"added"`
+	Removed    []DiffRow   `json:"removed"`
+	Changed    []DiffRow   `json:"changed"`
+	Summary    DiffSummary `json:"summary"`
+}
+
+// DiffRow is an added, removed or changed row. Values hold the current row, or the baseline row for
+// removed rows; Changes describes every changed cell.
+type DiffRow struct {
+	Key     map[string]string     `json:"key"`
+	Values  map[string]string     `json:"values"`
+	Changes map[string]CellChange `json:"changes,omitempty"`
+}
+
+// CellChange is a changed cell, with the difference for numeric values
+type CellChange struct {
+	Old     string   `json:"old"`
+	New     string   `json:"new"`
+	Delta   *float64 `json:"delta,omitempty"`
+	Percent *float64 `json:"percent,omitempty"` // change relative to the old value, absent when it is 0
+}
+
+// CompareReports compares a report with a baseline report of the same schedule, aligning rows on keys
+func CompareReports(report, baseline models.Report, keys []string) (ReportComparison, error) {
+	cmp := ReportComparison{ReportID: report.ID, BaselineID: baseline.ID}
+	current, err := storedReportTables(report)
+	if err != nil {
+		return cmp, err
+	}
+	base, err := storedReportTables(baseline)
+	if err != nil {
+		return cmp, err
+	}
+	cmp.Sheets = compareReportTables(current, base, keys)
+	for _, diff := range cmp.Sheets {
+		cmp.Summary.Added += diff.Summary.Added
+		cmp.Summary.Removed += diff.Summary.Removed
+		cmp.Summary.Changed += diff.Summary.Changed
+		cmp.Summary.Unchanged += diff.Summary.Unchanged
+	}
+	return cmp, nil
+}
+
+func storedReportTables(report models.Report) ([]reportSection, error) {
+	format := NormalizeReportFormat(report.Format)
+	if format != FormatXLSX && format != FormatCSVZip {
+		return nil, ErrCompareUnsupported
+	}
+	content, err := LoadReportContent(report)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := reportTables(format, content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report %d: %w", report.ID, err)
+	}
+	return tables, nil
+}
+
+// reportTables reads the tables of a generated report: every sheet of an xlsx report, or every CSV file
+// of a csv-zip report
+func reportTables(format string, content []byte) ([]reportSection, error) {
+	switch NormalizeReportFormat(format) {
+	case FormatXLSX:
+		f, err := excelize.OpenReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return workbookSections(f)
+	case FormatCSVZip:
+		return csvZipSections(content)
+	default:
+		return nil, ErrCompareUnsupported
+	}
+}
+
+// csvFilePrefix is the ordering prefix renderCSVZip puts in front of each file name
+var csvFilePrefix = regexp.MustCompile(`^\d+_`)
+
+func csvZipSections(content []byte) ([]reportSection, error) {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+	var sections []reportSection
+	for _, file := range zr.File {
+		if path.Ext(file.Name) != ".csv" {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		cr := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+		cr.FieldsPerRecord = -1
+		records, err := cr.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file.Name, err)
+		}
+		if len(records) == 0 {
+			continue
+		}
+		section := reportSection{
+			Title:   csvFilePrefix.ReplaceAllString(strings.TrimSuffix(file.Name, ".csv"), ""),
+			Columns: records[0],
+		}
+		for _, record := range records[1:] {
+			result := make(map[string]interface{}, len(record))
+			for i, value := range record {
+				if i < len(section.Columns) {
+					result[section.Columns[i]] = value
+				}
+			}
+			section.Results = append(section.Results, result)
+		}
+		sections = append(sections, section)
+	}
+	return sections, nil
+}
+
+// compareReportTables compares the tables of a report with those of a baseline report. Sheets are matched
+// by name and rows are aligned on keys, or on the first column of sheets that lack any of the keys.
+func compareReportTables(current, baseline []reportSection, keys []string) []SheetDiff {
+	baseByName := map[string]reportSection{}
+	for _, section := range baseline {
+		baseByName[section.Title] = section
+	}
+
+	var diffs []SheetDiff
+	seen := map[string]bool{}
+	for _, section := range current {
+		seen[section.Title] = true
+		base, ok := baseByName[section.Title]
+		if !ok {
+			diffs = append(diffs, wholeSheetDiff(section, DiffAdded))
+			continue
+		}
+		diffs = append(diffs, compareSection(section, base, keys))
+	}
+	for _, section := range baseline {
+		if !seen[section.Title] {
+			diffs = append(diffs, wholeSheetDiff(section, DiffRemoved))
+		}
+	}
+	return diffs
+}
+
+// newSheetDiff starts a diff with empty rather than null row lists in JSON
+func newSheetDiff(name, status string, columns []string) SheetDiff {
+	return SheetDiff{Name: name, Status: status, Columns: columns, Added: []DiffRow{}, Removed: []DiffRow{}, Changed: []DiffRow{}}
+}
+
+func wholeSheetDiff(section reportSection, status string) SheetDiff {
+	diff := newSheetDiff(section.Title, status, section.Columns)
+	for _, result := range section.Results {
+		row := DiffRow{Values: rowValues(section.Columns, result)}
+		if status == DiffAdded {
+			diff.Added = append(diff.Added, row)
+		} else {
+			diff.Removed = append(diff.Removed, row)
+		}
+	}
+	diff.Summary.Added, diff.Summary.Removed = len(diff.Added), len(diff.Removed)
+	return diff
+}
+
+func compareSection(current, base reportSection, keys []string) SheetDiff {
+	keyColumns := sectionKeys(current, base, keys)
+	columns := append([]string{}, current.Columns...)
+	for _, col := range base.Columns {
+		if !containsColumn(columns, col) {
+			columns = append(columns, col)
+		}
+	}
+	diff := newSheetDiff(current.Title, DiffCompared, columns)
+	diff.KeyColumns = keyColumns
+
+	baseRows := keyedRows(base, keyColumns)
+	matched := map[string]bool{}
+	currentRows := keyedRows(current, keyColumns)
+	for _, key := range orderedKeys(current, keyColumns) {
+		values := currentRows[key]
+		old, ok := baseRows[key]
+		if !ok {
+			diff.Added = append(diff.Added, DiffRow{Key: pick(values, keyColumns), Values: values})
+			continue
+		}
+		matched[key] = true
+		changes := map[string]CellChange{}
+		for _, col := range columns {
+			if containsColumn(keyColumns, col) || old[col] == values[col] {
+				continue
+			}
+			changes[col] = cellChange(old[col], values[col])
+		}
+		if len(changes) == 0 {
+			diff.Summary.Unchanged++
+			continue
+		}
+		diff.Changed = append(diff.Changed, DiffRow{Key: pick(values, keyColumns), Values: values, Changes: changes})
+	}
+	for _, key := range orderedKeys(base, keyColumns) {
+		if !matched[key] {
+			values := baseRows[key]
+			diff.Removed = append(diff.Removed, DiffRow{Key: pick(values, keyColumns), Values: values})
+		}
+	}
+	diff.Summary.Added, diff.Summary.Removed, diff.Summary.Changed = len(diff.Added), len(diff.Removed), len(diff.Changed)
+	return diff
+}
+
+// sectionKeys returns keys when both tables have all of them, otherwise their first common column
+func sectionKeys(current, base reportSection, keys []string) []string {
+	if len(keys) > 0 {
+		ok := true
+		for _, key := range keys {
+			if !containsColumn(current.Columns, key) || !containsColumn(base.Columns, key) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return keys
+		}
+	}
+	for _, col := range current.Columns {
+		if containsColumn(base.Columns, col) {
+			return []string{col}
+		}
+	}
+	return nil
+}
+
+// keyedRows indexes rows by their key values. Repeated keys get an occurrence suffix so that duplicate
+// rows are aligned in order instead of overwriting each other.
+func keyedRows(section reportSection, keyColumns []string) map[string]map[string]string {
+	rows := map[string]map[string]string{}
+	for i, key := range orderedKeys(section, keyColumns) {
+		rows[key] = rowValues(section.Columns, section.Results[i])
+	}
+	return rows
+}
+
+func orderedKeys(section reportSection, keyColumns []string) []string {
+	keys := make([]string, 0, len(section.Results))
+	count := map[string]int{}
+	for i, result := range section.Results {
+		parts := make([]string, len(keyColumns))
+		for j, col := range keyColumns {
+			parts[j] = formatCell(result[col])
+		}
+		key := strings.Join(parts, "\x00")
+		if len(keyColumns) == 0 {
+			key = strconv.Itoa(i)
+		}
+		if count[key]++; count[key] > 1 {
+			key += "\x00#" + strconv.Itoa(count[key])
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func rowValues(columns []string, result map[string]interface{}) map[string]string {
+	values := make(map[string]string, len(columns))
+	for _, col := range columns {
+		values[col] = formatCell(result[col])
+	}
+	return values
+}
+
+func pick(values map[string]string, columns []string) map[string]string {
+	picked := make(map[string]string, len(columns))
+	for _, col := range columns {
+		picked[col] = values[col]
+	}
+	return picked
+}
+
+func containsColumn(columns []string, name string) bool {
+	for _, col := range columns {
+		if col == name {
+			return true
+		}
+	}
+	return false
+}
+
+// cellChange describes a changed cell, computing the delta and percentage when both values are numeric
+func cellChange(old, new string) CellChange {
+	change := CellChange{Old: old, New: new}
+	oldNum, err1 := strconv.ParseFloat(strings.TrimSpace(old), 64)
+	newNum, err2 := strconv.ParseFloat(strings.TrimSpace(new), 64)
+	if err1 != nil || err2 != nil {
+		return change
+	}
+	delta := roundDiff(newNum - oldNum)
+	change.Delta = &delta
+	if oldNum != 0 {
+		pct := roundDiff((newNum - oldNum) / math.Abs(oldNum) * 100)
+		change.Percent = &pct
+	}
+	return change
+}
+
+// roundDiff drops floating point noise such as 0.30000000000000004
+func roundDiff(v float64) float64 {
+	return math.Round(v*1e6) / 1e6
+}
+
+// RenderComparisonXLSX writes a comparison as a workbook: a summary sheet followed by one sheet per
+// compared sheet listing its added (green), removed (red) and changed rows, with changed cells highlighted
+// in yellow and the old value, delta and percentage in a cell comment
+func RenderComparisonXLSX(cmp ReportComparison) ([]byte, error) {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	bold, _ := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	fill := func(color string) int {
+		style, _ := f.NewStyle(&excelize.Style{Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{color}}})
+		return style
+	}
+	styles := map[string]int{DiffAdded: fill("C6EFCE"), DiffRemoved: fill("FFC7CE"), DiffChanged: fill("FFEB9C")}
+
+	summary := "Summary"
+	f.SetSheetName("Sheet1", summary)
+	f.SetSheetRow(summary, "A1", &[]interface{}{"Sheet", "Status", "Added", "Removed", "Changed", "Unchanged"})
+	f.SetRowStyle(summary, 1, 1, bold)
+	for i, diff := range cmp.Sheets {
+		f.SetSheetRow(summary, fmt.Sprintf("A%d", i+2), &[]interface{}{
+			diff.Name, diff.Status, diff.Summary.Added, diff.Summary.Removed, diff.Summary.Changed, diff.Summary.Unchanged,
+		})
+	}
+	f.SetColWidth(summary, "A", "A", 30)
+
+	for _, diff := range cmp.Sheets {
+		sheet := uniqueSheetName(f, diff.Name, "Sheet")
+		f.NewSheet(sheet)
+		header := append([]interface{}{"Change"}, stringsToCells(diff.Columns)...)
+		f.SetSheetRow(sheet, "A1", &header)
+		f.SetRowStyle(sheet, 1, 1, bold)
+
+		row := 2
+		write := func(status string, r DiffRow) {
+			values := []interface{}{status}
+			for _, col := range diff.Columns {
+				values = append(values, diffCellValue(r.Values[col]))
+			}
+			f.SetSheetRow(sheet, fmt.Sprintf("A%d", row), &values)
+			if status != DiffChanged {
+				f.SetRowStyle(sheet, row, row, styles[status])
+			}
+			cols := make([]string, 0, len(r.Changes))
+			for col := range r.Changes {
+				cols = append(cols, col)
+			}
+			sort.Strings(cols)
+			for _, col := range cols {
+				idx := 0
+				for i, c := range diff.Columns {
+					if c == col {
+						idx = i + 2
+					}
+				}
+				cell, _ := excelize.CoordinatesToCellName(idx, row)
+				f.SetCellStyle(sheet, cell, cell, styles[DiffChanged])
+				f.AddComment(sheet, excelize.Comment{Cell: cell, Author: "Gobi", Text: changeNote(r.Changes[col])})
+			}
+			row++
+		}
+		for _, r := range diff.Changed {
+			write(DiffChanged, r)
+		}
+		for _, r := range diff.Added {
+			write(DiffAdded, r)
+		}
+		for _, r := range diff.Removed {
+			write(DiffRemoved, r)
+		}
+	}
+
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func stringsToCells(values []string) []interface{} {
+	cells := make([]interface{}, len(values))
+	for i, v := range values {
+		cells[i] = v
+	}
+	return cells
+}
+
+// diffCellValue writes numbers as numbers so that the highlighted workbook can still be summed
+func diffCellValue(value string) interface{} {
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		return n
+	}
+	return value
+}
+
+func changeNote(change CellChange) string {
+	note := "was " + change.Old
+	if change.Delta != nil {
+		note += fmt.Sprintf("\nΔ %+g", *change.Delta)
+	}
+	if change.Percent != nil {
+		note += fmt.Sprintf(" (%+.2f%%)", *change.Percent)
+	}
+	return note
+}
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"gobi/config"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Report delivery modes
+const (
+	DeliveryAttach = "attach"
+	DeliveryLink   = "link"
+)
+
+const (
+	defaultEmailSubject = "{{.Name}} - {{.Date}}"
+	defaultEmailBody    = `Hello,
+
+The report "{{.Name}}" was generated at {{.GeneratedAt}}.
+{{if .Link}}
+Download: {{.Link}}
+{{- else}}
+The report is attached as {{.FileName}}.
+{{- end}}
+`
+)
+
+// emailData is the data available to the subject and body templates of a schedule
+type emailData struct {
+	ReportID    uint
+	Name        string
+	Type        string
+	Format      string
+	FileName    string
+	Date        string
+	GeneratedAt string
+	Link        string // download link, only set in link mode
+}
+
+// ValidateEmailTemplate checks that a subject or body template parses and only uses known fields
+func ValidateEmailTemplate(text string) error {
+	if text == "" {
+		return nil
+	}
+	_, err := renderEmailTemplate(text, "", emailData{})
+	return err
+}
+
+func renderEmailTemplate(text, fallback string, data emailData) (string, error) {
+	if strings.TrimSpace(text) == "" {
+		text = fallback
+	}
+	tpl, err := template.New("email").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	if err := tpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// ReportFileName returns the download file name of a report, stamped with its period in the schedule's timezone
+func ReportFileName(report models.Report) string {
+	generatedAt := report.GeneratedAt.In(ScheduleLocation(report.Timezone))
+	fileName := report.Name
+	if report.Type == "daily" {
+		fileName += "_" + generatedAt.Format("2006-01-02")
+	} else if report.Type == "weekly" {
+		fileName += "_week_" + generatedAt.Format("2006-01-02")
+	} else if report.Type == "monthly" {
+		fileName += "_" + generatedAt.Format("2006-01")
+	}
+	_, ext := ReportFileType(report.Format)
+	return fileName + ext
+}
+
+// ReportDownloadURL returns the API link of a report, absolute when server.public_url is configured
+func ReportDownloadURL(reportID uint) string {
+	return fmt.Sprintf("%s/api/reports/%d/download", strings.TrimRight(config.AppConfig.Server.PublicURL, "/"), reportID)
+}
+
+// deliverReport emails a generated report to every recipient of its schedule, recording one delivery per recipient
+func deliverReport(schedule *models.ReportSchedule, report *models.Report, content []byte) {
+	var recipients []string
+	if schedule.Recipients == "" || json.Unmarshal([]byte(schedule.Recipients), &recipients) != nil || len(recipients) == 0 {
+		return
+	}
+
+	generatedAt := report.GeneratedAt.In(ScheduleLocation(report.Timezone))
+	data := emailData{
+		ReportID:    report.ID,
+		Name:        report.Name,
+		Type:        report.Type,
+		Format:      NormalizeReportFormat(report.Format),
+		FileName:    ReportFileName(*report),
+		Date:        generatedAt.Format("2006-01-02"),
+		GeneratedAt: generatedAt.Format("2006-01-02 15:04:05 MST"),
+	}
+	var attachment *mailAttachment
+	if schedule.DeliveryMode == DeliveryLink {
+		data.Link = ReportDownloadURL(report.ID)
+	} else {
+		contentType, _ := ReportFileType(report.Format)
+		attachment = &mailAttachment{Name: data.FileName, ContentType: contentType, Content: content}
+	}
+
+	subject, err := renderEmailTemplate(schedule.EmailSubject, defaultEmailSubject, data)
+	var body string
+	if err == nil {
+		body, err = renderEmailTemplate(schedule.EmailBody, defaultEmailBody, data)
+	}
+
+	for _, recipient := range recipients {
+		delivery := models.ReportDelivery{
+			ReportID:   report.ID,
+			ScheduleID: schedule.ID,
+			Channel:    "email",
+			Recipient:  recipient,
+			Status:     "pending",
+		}
+		database.DB.Create(&delivery)
+
+		if err != nil {
+			delivery.Status = "failed"
+			delivery.Error = fmt.Sprintf("failed to render email template: %v", err)
+		} else {
+			sendReportMail(&delivery, subject, body, attachment)
+		}
+
+		if err := database.DB.Save(&delivery).Error; err != nil {
+			Logger.WithFields(map[string]interface{}{
+				"action":    "deliver_report",
+				"reportID":  report.ID,
+				"recipient": recipient,
+				"error":     err.Error(),
+			}).Error("Failed to save report delivery")
+		}
+	}
+}
+
+// sendReportMail sends one message with retries, updating the delivery with the outcome
+func sendReportMail(delivery *models.ReportDelivery, subject, body string, attachment *mailAttachment) {
+	cfg := config.AppConfig.SMTP
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	wait := time.Duration(cfg.RetryInterval) * time.Second
+	if wait <= 0 {
+		wait = 30 * time.Second
+	}
+
+	msg, err := buildMail(cfg.From, delivery.Recipient, subject, body, attachment)
+	if err != nil {
+		delivery.Status = "failed"
+		delivery.Error = err.Error()
+		return
+	}
+
+	for delivery.Attempts < maxAttempts {
+		if delivery.Attempts > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		delivery.Attempts++
+		if err = Mailer.Send(cfg.From, []string{delivery.Recipient}, msg); err == nil {
+			now := time.Now()
+			delivery.Status = "sent"
+			delivery.Error = ""
+			delivery.SentAt = &now
+			return
+		}
+		Logger.WithFields(map[string]interface{}{
+			"action":    "deliver_report",
+			"reportID":  delivery.ReportID,
+			"recipient": delivery.Recipient,
+			"attempt":   delivery.Attempts,
+			"error":     err.Error(),
+		}).Warn("Failed to send report email")
+	}
+	delivery.Status = "failed"
+	delivery.Error = err.Error()
+}
@@ -1,161 +1,442 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"gobi/internal/models"
 	"gobi/pkg/database"
+	"strings"
 	"time"
 
-	"github.com/robfig/cron/v3"
 	"github.com/xuri/excelize/v2"
 )
 
-var reportCron *cron.Cron
-
-// InitReportGenerator initializes the report generator cron jobs
-func InitReportGenerator() {
-	reportCron = cron.New()
-	reportCron.Start()
-
-	// Schedule report generation check every minute
-	reportCron.AddFunc("* * * * *", checkAndGenerateReports)
-}
-
-// StopReportGenerator stops the report generator cron jobs
-func StopReportGenerator() {
-	if reportCron != nil {
-		reportCron.Stop()
+// newScheduleReport creates the pending report record that the runs of a schedule fill in
+func newScheduleReport(schedule *models.ReportSchedule) (*models.Report, error) {
+	report := models.Report{
+		UserID:         schedule.UserID,
+		OrganizationID: schedule.OrganizationID,
+		ScheduleID:     schedule.ID,
+		Name:           schedule.Name,
+		Type:           schedule.Type,
+		Format:         NormalizeReportFormat(schedule.Format),
+		Timezone:       schedule.Timezone,
+		Status:         "pending",
+		GeneratedAt:    time.Now(),
+	}
+	if err := database.DB.Create(&report).Error; err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action":     "generate_report",
+			"scheduleID": schedule.ID,
+			"error":      err.Error(),
+		}).Error("Failed to create report record")
+		return nil, err
 	}
+	return &report, nil
 }
 
-// checkAndGenerateReports checks for reports that need to be generated
-func checkAndGenerateReports() {
-	now := time.Now()
-	var schedules []models.ReportSchedule
+// generateReport makes one attempt at filling report from the schedule. A failed or partial attempt with
+// retries left is not delivered: the report waits for its retry at NextRetryAt, which the scheduler picks
+// up, so that no worker slot or schedule lease is held in between. The final result is delivered.
+func generateReport(schedule *models.ReportSchedule, report *models.Report, trigger string) {
+	loc := ScheduleLocation(schedule.Timezone)
+	report.Timezone = schedule.Timezone
+	params, paramErr := reportParams(schedule, report, time.Now().In(loc))
 
-	// Find all active schedules that are due
-	if err := database.DB.Where("active = ? AND next_run <= ?", true, now).Find(&schedules).Error; err != nil {
-		Logger.WithFields(map[string]interface{}{
-			"action": "check_reports",
-			"error":  err.Error(),
-		}).Error("Failed to fetch report schedules")
-		return
+	report.Attempts++
+	report.GeneratedAt = time.Now()
+	report.NextRetryAt = nil
+	run := startReportRun(schedule, report, trigger, report.Attempts)
+	rec := &runRecorder{}
+	// Template dates and document timestamps use the schedule's wall clock
+	var content []byte
+	err := paramErr
+	if err == nil {
+		content, err = buildReport(schedule, report.GeneratedAt.In(loc), params, rec)
 	}
-
-	for _, schedule := range schedules {
-		go generateReport(&schedule)
+	report.Status, report.Error = rec.outcome(err)
+	if report.Status == RunFailed {
+		content = nil
 	}
-}
+	finishReportRun(run, rec, report.Status, report.Error)
 
-// generateReport generates a report based on the schedule
-func generateReport(schedule *models.ReportSchedule) {
-	// Create a new report record
-	report := models.Report{
-		UserID:      schedule.UserID,
-		Name:        schedule.Name,
-		Type:        schedule.Type,
-		Status:      "pending",
-		GeneratedAt: time.Now(),
+	if report.Status != RunSuccess && report.Attempts <= schedule.MaxRetries {
+		delay := time.Duration(schedule.RetryDelay) * time.Second
+		if delay <= 0 {
+			delay = time.Minute
+		}
+		retryAt := time.Now().Add(delay)
+		Logger.WithFields(map[string]interface{}{
+			"action":     "generate_report",
+			"scheduleID": schedule.ID,
+			"reportID":   report.ID,
+			"attempt":    report.Attempts,
+			"status":     report.Status,
+			"error":      report.Error,
+			"retryAt":    retryAt,
+		}).Warn("Report run did not succeed, retrying later")
+		report.Status = ReportRetrying
+		report.NextRetryAt = &retryAt
+		content = nil
+	} else if err := StoreReportContent(report, content); err != nil {
+		report.Status, report.Error = RunFailed, err.Error()
+		content = nil
 	}
 
-	if err := database.DB.Create(&report).Error; err != nil {
+	// Update report status
+	if err := database.DB.Save(report).Error; err != nil {
 		Logger.WithFields(map[string]interface{}{
 			"action":     "generate_report",
 			"scheduleID": schedule.ID,
+			"reportID":   report.ID,
 			"error":      err.Error(),
-		}).Error("Failed to create report record")
+		}).Error("Failed to update report status")
+	}
+	if report.Status == ReportRetrying {
 		return
 	}
 
-	// Create Excel file
-	f := excelize.NewFile()
-	defer f.Close()
+	if report.Status != RunFailed {
+		deliverReport(schedule, report, content)
+	}
+	notifyReportWebhooks(schedule, report)
+}
+
+// reportParams resolves the parameter bindings of a schedule and records the values on the report. A rerun
+// reuses the values recorded by the original run, so that it covers the same period.
+func reportParams(schedule *models.ReportSchedule, report *models.Report, now time.Time) (map[string]string, error) {
+	params := map[string]string{}
+	if report.Params != "" && json.Unmarshal([]byte(report.Params), &params) == nil {
+		return params, nil
+	}
+	bindings, err := ParseParamBindings(schedule.Params)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule parameters: %w", err)
+	}
+	if params, err = ResolveParamBindings(bindings, now); err != nil {
+		return nil, err
+	}
+	if len(params) > 0 {
+		encoded, _ := json.Marshal(params)
+		report.Params = string(encoded)
+	}
+	return params, nil
+}
+
+// buildReport collects the query and chart sections of a schedule and renders them in its output format
+func buildReport(schedule *models.ReportSchedule, now time.Time, params map[string]string, rec *runRecorder) ([]byte, error) {
+	sections := collectSections(schedule, params, rec)
+	format := NormalizeReportFormat(schedule.Format)
+	if format == FormatXLSX {
+		return renderXLSX(schedule, now, params, sections, rec)
+	}
+
+	// Other formats render the filled template sheets as plain tables ahead of the query and chart sections
+	f, fromTemplate, err := openReportWorkbook(schedule, now, params, rec)
+	if err != nil {
+		return nil, err
+	}
+	if fromTemplate {
+		templateSections, err := workbookSections(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read filled template: %w", err)
+		}
+		sections = append(templateSections, sections...)
+	}
+	f.Close()
+
+	doc := reportDocument{Title: schedule.Name, Type: schedule.Type, GeneratedAt: now, Sections: sections}
+	var content []byte
+	err = rec.record(StepRender, 0, format, func() (int, error) {
+		switch format {
+		case FormatPDF:
+			content, err = renderPDF(doc)
+		case FormatCSVZip:
+			content, err = renderCSVZip(doc)
+		case FormatHTML:
+			content, err = renderHTML(doc)
+		default:
+			err = fmt.Errorf("unsupported report format: %s", format)
+		}
+		return 0, err
+	})
+	return content, err
+}
+
+// collectSections runs the schedule's queries and charts, recording a step for each. Failed queries and
+// charts are left out of the report, which the run outcome then marks as partial.
+func collectSections(schedule *models.ReportSchedule, params map[string]string, rec *runRecorder) []reportSection {
+	var sections []reportSection
 
 	// Process queries
 	var queryIDs []uint
 	if err := json.Unmarshal([]byte(schedule.Queries), &queryIDs); err == nil {
 		for i, queryID := range queryIDs {
-			var query models.Query
-			if err := database.DB.First(&query, queryID).Error; err != nil {
-				continue
-			}
+			name := fmt.Sprintf("Query_%d", i+1)
+			var section reportSection
+			err := rec.record(StepQuery, queryID, name, func() (int, error) {
+				var query models.Query
+				if err := database.DB.First(&query, queryID).Error; err != nil {
+					return 0, fmt.Errorf("query %d not found", queryID)
+				}
+				section.Title = sectionTitle(query.Name, name)
+				rec.rename(section.Title)
+				rec.useQuery(query)
+				if !userCan(schedule.UserID, QueryResource(query), AccessExecute) {
+					return 0, fmt.Errorf("access to query %d denied", queryID)
+				}
 
-			// Execute query
-			var ds models.DataSource
-			if err := database.DB.First(&ds, query.DataSourceID).Error; err != nil {
-				continue
+				columns, results, err := RunSavedQueryAsUser(schedule.UserID, query, params)
+				section.Columns, section.Results = columns, results
+				return len(results), err
+			})
+			if err == nil {
+				sections = append(sections, section)
 			}
+		}
+	}
 
-			results, err := ExecuteSQL(ds, query.SQL)
-			if err != nil {
-				continue
+	// Process charts
+	var chartIDs []uint
+	if err := json.Unmarshal([]byte(schedule.Charts), &chartIDs); err == nil {
+		for i, chartID := range chartIDs {
+			name := fmt.Sprintf("Chart_%d", i+1)
+			var section reportSection
+			err := rec.record(StepChart, chartID, name, func() (int, error) {
+				var chart models.Chart
+				if err := database.DB.Preload("Query").First(&chart, chartID).Error; err != nil {
+					return 0, fmt.Errorf("chart %d not found", chartID)
+				}
+				section.Title = sectionTitle(chart.Name, name)
+				section.Chart = &chart
+				rec.rename(section.Title)
+				rec.useQuery(chart.Query)
+				if !userCan(schedule.UserID, ChartResource(chart), AccessView) {
+					return 0, fmt.Errorf("access to chart %d denied", chartID)
+				}
+
+				columns, results, err := RunSavedQueryAsUser(schedule.UserID, chart.Query, params)
+				section.Columns, section.Results = columns, results
+				return len(results), err
+			})
+			if err == nil {
+				sections = append(sections, section)
 			}
+		}
+	}
+	return sections
+}
 
-			// Create sheet for query results
-			sheetName := fmt.Sprintf("Query_%d", i+1)
+// renderXLSX writes each section to its own sheet of the schedule's (template) workbook
+func renderXLSX(schedule *models.ReportSchedule, now time.Time, params map[string]string, sections []reportSection, rec *runRecorder) ([]byte, error) {
+	f, fromTemplate, err := openReportWorkbook(schedule, now, params, rec)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	for _, section := range sections {
+		sheetName := uniqueSheetName(f, section.Title, section.Title)
+		if section.Chart == nil {
 			f.NewSheet(sheetName)
+			writeResultTable(f, sheetName, section.Columns, section.Results)
+			continue
+		}
+		if err := addChartSheet(f, sheetName, *section.Chart, section.Columns, section.Results); err != nil {
+			Logger.WithFields(map[string]interface{}{
+				"action":     "generate_report",
+				"scheduleID": schedule.ID,
+				"chartID":    section.Chart.ID,
+				"error":      err.Error(),
+			}).Warn("Failed to render chart, keeping data only")
+		}
+	}
 
-			// Write headers
-			if len(results) > 0 {
-				col := 1
-				for key := range results[0] {
-					cell, _ := excelize.CoordinatesToCellName(col, 1)
-					f.SetCellValue(sheetName, cell, key)
-					col++
-				}
-			}
+	// Drop the default sheet of a blank workbook once real content has been written
+	if !fromTemplate && f.SheetCount > 1 {
+		f.DeleteSheet("Sheet1")
+	}
 
-			// Write data
-			for row, result := range results {
-				col := 1
-				for _, value := range result {
-					cell, _ := excelize.CoordinatesToCellName(col, row+2)
-					f.SetCellValue(sheetName, cell, value)
-					col++
-				}
-			}
+	var content []byte
+	err = rec.record(StepRender, 0, FormatXLSX, func() (int, error) {
+		buf, err := f.WriteToBuffer()
+		if err != nil {
+			return 0, fmt.Errorf("failed to generate Excel file: %w", err)
 		}
+		content = buf.Bytes()
+		return 0, nil
+	})
+	return content, err
+}
+
+// openReportWorkbook returns the workbook a report is built on: the schedule's first template filled
+// with live data, or a blank workbook when the schedule has no template. Additional templates are
+// ignored because excelize cannot copy sheets between workbooks.
+func openReportWorkbook(schedule *models.ReportSchedule, now time.Time, params map[string]string, rec *runRecorder) (*excelize.File, bool, error) {
+	var templateIDs []uint
+	if err := json.Unmarshal([]byte(schedule.Templates), &templateIDs); err != nil || len(templateIDs) == 0 {
+		return excelize.NewFile(), false, nil
 	}
+	if len(templateIDs) > 1 {
+		Logger.WithFields(map[string]interface{}{
+			"action":      "generate_report",
+			"scheduleID":  schedule.ID,
+			"templateIDs": templateIDs,
+		}).Warn("Schedule has several templates, only the first one is used")
+	}
+
+	var f *excelize.File
+	err := rec.record(StepTemplate, templateIDs[0], fmt.Sprintf("Template_%d", templateIDs[0]), func() (int, error) {
+		var tpl models.ExcelTemplate
+		if err := database.DB.First(&tpl, templateIDs[0]).Error; err != nil {
+			return 0, fmt.Errorf("template %d not found: %w", templateIDs[0], err)
+		}
+		rec.rename(tpl.Name)
+		if !userCan(schedule.UserID, TemplateResource(tpl), AccessView) {
+			return 0, fmt.Errorf("access to template %d denied", tpl.ID)
+		}
 
-	// Save the report
-	content, err := f.WriteToBuffer()
+		content, err := LoadTemplateContent(tpl)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read template %d: %w", tpl.ID, err)
+		}
+		f, err = excelize.OpenReader(bytes.NewReader(content))
+		if err != nil {
+			return 0, fmt.Errorf("template %d is not a valid workbook: %w", tpl.ID, err)
+		}
+		data := templateData{
+			Now:    now,
+			Params: defaultTemplateParams(schedule.Name, schedule.Type, now),
+			Query:  scheduleQueryRunner(schedule, params, rec),
+		}
+		// Resolved schedule parameters are available to {{param:...}} placeholders as well
+		for name, value := range params {
+			data.Params[name] = value
+		}
+		if err := fillTemplate(f, data); err != nil {
+			f.Close()
+			return 0, fmt.Errorf("failed to fill template %d: %w", tpl.ID, err)
+		}
+		return 0, nil
+	})
 	if err != nil {
-		report.Status = "failed"
-		report.Error = "Failed to generate Excel file: " + err.Error()
-	} else {
-		report.Status = "success"
-		report.Content = content.Bytes()
+		return nil, false, err
 	}
+	return f, true, nil
+}
 
-	// Update report status
-	if err := database.DB.Save(&report).Error; err != nil {
-		Logger.WithFields(map[string]interface{}{
-			"action":     "generate_report",
-			"scheduleID": schedule.ID,
-			"reportID":   report.ID,
-			"error":      err.Error(),
-		}).Error("Failed to update report status")
+// scheduleQueryRunner resolves {{query:ID}} anchors, only allowing queries the schedule owner can access
+func scheduleQueryRunner(schedule *models.ReportSchedule, params map[string]string, rec *runRecorder) func(uint) ([]string, []map[string]interface{}, error) {
+	return func(queryID uint) ([]string, []map[string]interface{}, error) {
+		var columns []string
+		var results []map[string]interface{}
+		err := rec.record(StepTemplateQuery, queryID, fmt.Sprintf("Query_%d", queryID), func() (int, error) {
+			var query models.Query
+			if err := database.DB.First(&query, queryID).Error; err != nil {
+				return 0, fmt.Errorf("query %d not found", queryID)
+			}
+			rec.rename(query.Name)
+			rec.useQuery(query)
+			if !userCan(schedule.UserID, QueryResource(query), AccessExecute) {
+				return 0, fmt.Errorf("access to query %d denied", queryID)
+			}
+			var err error
+			columns, results, err = RunSavedQueryAsUser(schedule.UserID, query, params)
+			return len(results), err
+		})
+		return columns, results, err
 	}
+}
 
-	// Update schedule next run time using cron pattern
-	schedule.LastRun = time.Now()
-	schedule.NextRun = calculateNextRunFromCron(schedule.CronPattern)
-	if err := database.DB.Save(&schedule).Error; err != nil {
-		Logger.WithFields(map[string]interface{}{
-			"action":     "generate_report",
-			"scheduleID": schedule.ID,
-			"error":      err.Error(),
-		}).Error("Failed to update schedule next run time")
+// RunSavedQuery executes a saved query against its data source for viewer, decrypting the stored password first
+func RunSavedQuery(query models.Query, viewer Subject) ([]string, []map[string]interface{}, error) {
+	return RunSavedQueryWithParams(query, nil, viewer)
+}
+
+// RunSavedQueryAsUser executes a saved query for a user outside a request, such as the owner of a schedule
+// or alert while it runs, in the organization of the query
+func RunSavedQueryAsUser(userID uint, query models.Query, params map[string]string) ([]string, []map[string]interface{}, error) {
+	viewer, err := SubjectForUser(userID, query.OrganizationID)
+	if err != nil {
+		return nil, nil, err
 	}
+	return RunSavedQueryWithParams(query, params, viewer)
+}
+
+// RunSavedQueryWithParams executes a saved query for viewer, binding its {{name}} parameters to params and
+// keeping the rows that the row policies of the query and its data source let viewer see
+func RunSavedQueryWithParams(query models.Query, params map[string]string, viewer Subject) ([]string, []map[string]interface{}, error) {
+	return RunSavedQueryWithLimit(query, params, viewer, 0)
 }
 
-// calculateNextRunFromCron calculates the next run time based on cron pattern
-func calculateNextRunFromCron(cronPattern string) time.Time {
-	parser := cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow)
-	schedule, err := parser.Parse(cronPattern)
+// RunSavedQueryWithLimit works like RunSavedQueryWithParams but reads at most maxRows rows of the result,
+// every row when maxRows <= 0
+func RunSavedQueryWithLimit(query models.Query, params map[string]string, viewer Subject, maxRows int) ([]string, []map[string]interface{}, error) {
+	var ds models.DataSource
+	if err := database.DB.First(&ds, query.DataSourceID).Error; err != nil {
+		return nil, nil, err
+	}
+	if ds.Password != "" {
+		pwd, err := DecryptAES(ds.Password)
+		if err != nil {
+			return nil, nil, err
+		}
+		ds.Password = pwd
+	}
+	sqlStr, args, err := BindQueryParams(ds.Type, query.SQL, params)
 	if err != nil {
-		return time.Now()
+		return nil, nil, err
+	}
+	filters, err := RowFilters(viewer, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	sqlStr, args = WrapRowFilters(ds.Type, sqlStr, args, filters)
+	columns, results, err := ExecuteSQLWithLimit(ds, maxRows, sqlStr, args...)
+	return columns, results, RowFilterError(err, filters)
+}
+
+// writeResultTable writes a header row followed by the result rows, starting at A1
+func writeResultTable(f *excelize.File, sheetName string, columns []string, results []map[string]interface{}) {
+	for col, name := range columns {
+		cell, _ := excelize.CoordinatesToCellName(col+1, 1)
+		f.SetCellValue(sheetName, cell, name)
+	}
+	for row, result := range results {
+		for col, name := range columns {
+			cell, _ := excelize.CoordinatesToCellName(col+1, row+2)
+			f.SetCellValue(sheetName, cell, result[name])
+		}
+	}
+}
+
+// uniqueSheetName turns name into a valid sheet name that does not clash with existing sheets
+func uniqueSheetName(f *excelize.File, name, fallback string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, strings.Trim(strings.TrimSpace(name), "'"))
+	if name == "" {
+		name = fallback
+	}
+	if len([]rune(name)) > 31 {
+		name = string([]rune(name)[:31])
+	}
+
+	candidate := name
+	for n := 2; ; n++ {
+		if idx, _ := f.GetSheetIndex(candidate); idx == -1 {
+			return candidate
+		}
+		suffix := fmt.Sprintf(" (%d)", n)
+		base := []rune(name)
+		if len(base)+len(suffix) > 31 {
+			base = base[:31-len(suffix)]
+		}
+		candidate = string(base) + suffix
 	}
-	return schedule.Next(time.Now())
 }
@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"gobi/config"
+
+	"github.com/go-pdf/fpdf"
+)
+
+const (
+	pdfMargin     = 15.0
+	pdfRowHeight  = 6.0
+	pdfFontSize   = 9.0
+	pdfWideTable  = 6 // tables with more columns are printed in landscape
+	pdfFontFamily = "report"
+)
+
+// pdfA4 is used for AddPageFormat, which takes the size in portrait orientation
+var pdfA4 = fpdf.SizeType{Wd: 210, Ht: 297}
+
+// pdfWriter wraps fpdf with the font and text translation chosen for the report
+type pdfWriter struct {
+	*fpdf.Fpdf
+	family string
+	tr     func(string) string
+}
+
+// renderPDF renders a cover page followed by one paginated table per section, with chart images
+// above the tables and page numbers in the footer
+func renderPDF(doc reportDocument) ([]byte, error) {
+	pdf := newPDFWriter()
+	pdf.AliasNbPages("{nb}")
+	pdf.SetMargins(pdfMargin, pdfMargin, pdfMargin)
+	// Page breaks are handled by writeTable so the header row can be repeated
+	pdf.SetAutoPageBreak(false, pdfMargin)
+	pdf.SetFooterFunc(func() {
+		if pdf.PageNo() == 1 {
+			return
+		}
+		pdf.SetY(-pdfMargin + 3)
+		pdf.SetFont(pdf.family, "", 8)
+		pdf.SetTextColor(120, 120, 120)
+		pdf.CellFormat(0, 5, fmt.Sprintf("%s    %d / {nb}", pdf.tr(doc.Title), pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+
+	pdf.writeCover(doc)
+	for i, section := range doc.Sections {
+		pdf.writeSection(i, section)
+	}
+
+	if err := pdf.Error(); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newPDFWriter uses the configured UTF-8 font when there is one; the built-in Helvetica only covers cp1252
+func newPDFWriter() *pdfWriter {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	if fontPath := config.AppConfig.Report.PDFFont; fontPath != "" {
+		pdf.AddUTF8Font(pdfFontFamily, "", fontPath)
+		pdf.AddUTF8Font(pdfFontFamily, "B", fontPath)
+		return &pdfWriter{Fpdf: pdf, family: pdfFontFamily, tr: func(s string) string { return s }}
+	}
+	return &pdfWriter{Fpdf: pdf, family: "Helvetica", tr: pdf.UnicodeTranslatorFromDescriptor("")}
+}
+
+func (pdf *pdfWriter) writeCover(doc reportDocument) {
+	pdf.AddPage()
+	pdf.SetY(80)
+	pdf.SetFont(pdf.family, "B", 24)
+	pdf.SetTextColor(0x1f, 0x4e, 0x79)
+	pdf.MultiCell(0, 12, pdf.tr(doc.Title), "", "C", false)
+	pdf.Ln(4)
+	pdf.SetFont(pdf.family, "", 12)
+	pdf.SetTextColor(100, 100, 100)
+	pdf.CellFormat(0, 8, pdf.tr(fmt.Sprintf("%s  |  %s", doc.Type, doc.GeneratedAt.Format("2006-01-02 15:04:05"))), "", 1, "C", false, 0, "")
+
+	if len(doc.Sections) == 0 {
+		return
+	}
+	pdf.Ln(16)
+	pdf.SetFont(pdf.family, "B", 12)
+	pdf.SetTextColor(0, 0, 0)
+	pdf.CellFormat(0, 8, pdf.tr("Contents"), "", 1, "L", false, 0, "")
+	pdf.SetFont(pdf.family, "", 11)
+	for i, section := range doc.Sections {
+		pdf.CellFormat(0, 7, pdf.tr(fmt.Sprintf("%d. %s (%d rows)", i+1, section.Title, len(section.Results))), "", 1, "L", false, 0, "")
+	}
+}
+
+func (pdf *pdfWriter) writeSection(index int, section reportSection) {
+	orientation := "P"
+	if len(section.Columns) > pdfWideTable {
+		orientation = "L"
+	}
+	pdf.AddPageFormat(orientation, pdfA4)
+	pdf.SetFont(pdf.family, "B", 14)
+	pdf.SetTextColor(0, 0, 0)
+	pdf.MultiCell(0, 8, pdf.tr(section.Title), "", "L", false)
+	pdf.Ln(2)
+
+	if img := section.image(); img != nil {
+		pageW, _ := pdf.GetPageSize()
+		w := pageW - 2*pdfMargin
+		h := w * chartImageHeight / chartImageWidth
+		name := fmt.Sprintf("chart-%d", index)
+		opts := fpdf.ImageOptions{ImageType: "PNG"}
+		pdf.RegisterImageOptionsReader(name, opts, bytes.NewReader(img))
+		pdf.ImageOptions(name, pdfMargin, pdf.GetY(), w, h, true, opts, 0, "")
+		pdf.Ln(4)
+	}
+
+	pdf.writeTable(orientation, section)
+}
+
+// writeTable prints the section rows, starting a new page and repeating the header when a page is full
+func (pdf *pdfWriter) writeTable(orientation string, section reportSection) {
+	if len(section.Columns) == 0 {
+		return
+	}
+	pageW, pageH := pdf.GetPageSize()
+	colW := (pageW - 2*pdfMargin) / float64(len(section.Columns))
+	bottom := pageH - pdfMargin - 6
+
+	header := func() {
+		pdf.SetFont(pdf.family, "B", pdfFontSize)
+		pdf.SetFillColor(0x44, 0x72, 0xc4)
+		pdf.SetTextColor(255, 255, 255)
+		for _, col := range section.Columns {
+			pdf.CellFormat(colW, pdfRowHeight+1, pdf.fit(col, colW), "1", 0, "C", true, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont(pdf.family, "", pdfFontSize)
+		pdf.SetTextColor(0, 0, 0)
+	}
+
+	if pdf.GetY()+2*pdfRowHeight > bottom {
+		pdf.AddPageFormat(orientation, pdfA4)
+	}
+	header()
+	for i, result := range section.Results {
+		if pdf.GetY()+pdfRowHeight > bottom {
+			pdf.AddPageFormat(orientation, pdfA4)
+			header()
+		}
+		fill := i%2 == 1
+		pdf.SetFillColor(0xf5, 0xf7, 0xfa)
+		for _, col := range section.Columns {
+			value := result[col]
+			align := "L"
+			if _, ok := toFloat(value); ok {
+				align = "R"
+			}
+			pdf.CellFormat(colW, pdfRowHeight, pdf.fit(formatCell(value), colW), "1", 0, align, fill, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+}
+
+// fit translates s and truncates it with an ellipsis so that it fits into a cell of width w.
+// Truncation works on the untranslated runes because the cp1252 translation is not valid UTF-8.
+func (pdf *pdfWriter) fit(s string, w float64) string {
+	limit := w - 2
+	if out := pdf.tr(s); pdf.GetStringWidth(out) <= limit {
+		return out
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && pdf.GetStringWidth(pdf.tr(string(runes)+"...")) > limit {
+		runes = runes[:len(runes)-1]
+	}
+	return pdf.tr(string(runes) + "...")
+}
@@ -0,0 +1,281 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"gobi/internal/models"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Report output formats
+const (
+	FormatXLSX   = "xlsx"
+	FormatPDF    = "pdf"
+	FormatCSVZip = "csv-zip"
+	FormatHTML   = "html"
+)
+
+// reportFileTypes maps each output format to the content type and file extension it is served with
+var reportFileTypes = map[string][2]string{
+	FormatXLSX:   {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", ".xlsx"},
+	FormatPDF:    {"application/pdf", ".pdf"},
+	FormatCSVZip: {"application/zip", ".zip"},
+	FormatHTML:   {"text/html; charset=utf-8", ".html"},
+}
+
+// NormalizeReportFormat returns format, defaulting to xlsx for schedules and reports created before formats existed
+func NormalizeReportFormat(format string) string {
+	if _, ok := reportFileTypes[format]; ok {
+		return format
+	}
+	return FormatXLSX
+}
+
+// ReportFileType returns the content type and file extension for a report format
+func ReportFileType(format string) (string, string) {
+	t := reportFileTypes[NormalizeReportFormat(format)]
+	return t[0], t[1]
+}
+
+// reportDocument is the format independent content of a generated report
+type reportDocument struct {
+	Title       string
+	Type        string
+	GeneratedAt time.Time
+	Sections    []reportSection
+}
+
+// reportSection is one table of a report, optionally drawn as a chart
+type reportSection struct {
+	Title   string
+	Columns []string
+	Results []map[string]interface{}
+	Chart   *models.Chart
+}
+
+// image renders the section's chart as PNG, returning nil for plain tables or empty results
+func (s reportSection) image() []byte {
+	if s.Chart == nil || len(s.Columns) == 0 || len(s.Results) == 0 {
+		return nil
+	}
+	img, err := renderChartImage(s.Chart.Type, parseChartOptions(*s.Chart), s.Columns, s.Results)
+	if err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action":  "render_chart_image",
+			"chartID": s.Chart.ID,
+			"error":   err.Error(),
+		}).Warn("Failed to render chart image")
+		return nil
+	}
+	return img
+}
+
+// sectionTitle returns name, or fallback when the name is blank
+func sectionTitle(name, fallback string) string {
+	if strings.TrimSpace(name) == "" {
+		return fallback
+	}
+	return name
+}
+
+// formatCell renders a result value for text based formats
+func formatCell(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+			return t.Format("2006-01-02")
+		}
+		return t.Format("2006-01-02 15:04:05")
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// workbookSections turns every sheet of a filled template into a section, using the first row as header
+func workbookSections(f *excelize.File) ([]reportSection, error) {
+	var sections []reportSection
+	for _, sheet := range f.GetSheetList() {
+		rows, err := f.GetRows(sheet)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		width := 0
+		for _, row := range rows {
+			width = max(width, len(row))
+		}
+
+		columns := make([]string, width)
+		seen := map[string]int{}
+		for i := range columns {
+			name := ""
+			if i < len(rows[0]) {
+				name = strings.TrimSpace(rows[0][i])
+			}
+			if name == "" {
+				name, _ = excelize.ColumnNumberToName(i + 1)
+			}
+			if seen[name]++; seen[name] > 1 {
+				name = fmt.Sprintf("%s (%d)", name, seen[name])
+			}
+			columns[i] = name
+		}
+
+		results := make([]map[string]interface{}, 0, len(rows)-1)
+		for _, row := range rows[1:] {
+			result := make(map[string]interface{}, width)
+			for i, value := range row {
+				result[columns[i]] = value
+			}
+			results = append(results, result)
+		}
+		sections = append(sections, reportSection{Title: sheet, Columns: columns, Results: results})
+	}
+	return sections, nil
+}
+
+// renderCSVZip writes one UTF-8 CSV per section, plus a PNG for chart sections, into a zip archive
+func renderCSVZip(doc reportDocument) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i, section := range doc.Sections {
+		base := fmt.Sprintf("%02d_%s", i+1, safeFileName(section.Title))
+		w, err := zw.Create(base + ".csv")
+		if err != nil {
+			return nil, err
+		}
+		// BOM so that Excel detects UTF-8 when opening the CSV directly
+		if _, err := w.Write([]byte("\xef\xbb\xbf")); err != nil {
+			return nil, err
+		}
+		cw := csv.NewWriter(w)
+		if err := cw.Write(section.Columns); err != nil {
+			return nil, err
+		}
+		for _, result := range section.Results {
+			record := make([]string, len(section.Columns))
+			for j, col := range section.Columns {
+				record[j] = formatCell(result[col])
+			}
+			if err := cw.Write(record); err != nil {
+				return nil, err
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return nil, err
+		}
+
+		if img := section.image(); img != nil {
+			w, err := zw.Create(base + ".png")
+			if err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(img); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// safeFileName replaces characters that are not allowed in file names inside archives
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`<>:"/\|?*`, r) || r < 0x20 {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+var reportHTMLTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", "PingFang SC", "Microsoft YaHei", sans-serif; margin: 32px; color: #222; }
+h1 { margin-bottom: 4px; }
+.meta { color: #666; margin-bottom: 24px; }
+nav li { margin: 2px 0; }
+section { margin-top: 40px; }
+table { border-collapse: collapse; font-size: 13px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+th { background: #4472c4; color: #fff; }
+tr:nth-child(even) td { background: #f5f7fa; }
+img { display: block; margin: 12px 0; max-width: 100%; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<div class="meta">{{.Type}} · {{.GeneratedAt}}</div>
+<nav><ol>{{range $i, $s := .Sections}}<li><a href="#section-{{$i}}">{{$s.Title}}</a></li>{{end}}</ol></nav>
+{{range $i, $s := .Sections}}
+<section id="section-{{$i}}">
+<h2>{{$s.Title}}</h2>
+{{if $s.Image}}<img src="{{$s.Image}}" alt="{{$s.Title}}">{{end}}
+<table>
+<thead><tr>{{range $s.Columns}}<th>{{.}}</th>{{end}}</tr></thead>
+<tbody>{{range $s.Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>{{end}}</tbody>
+</table>
+</section>
+{{end}}
+</body>
+</html>
+`))
+
+// renderHTML renders a standalone HTML page with chart images embedded as data URIs
+func renderHTML(doc reportDocument) ([]byte, error) {
+	type htmlSection struct {
+		Title   string
+		Columns []string
+		Rows    [][]string
+		Image   template.URL
+	}
+	data := struct {
+		Title       string
+		Type        string
+		GeneratedAt string
+		Sections    []htmlSection
+	}{
+		Title:       doc.Title,
+		Type:        doc.Type,
+		GeneratedAt: doc.GeneratedAt.Format("2006-01-02 15:04:05"),
+	}
+	for _, section := range doc.Sections {
+		hs := htmlSection{Title: section.Title, Columns: section.Columns}
+		for _, result := range section.Results {
+			row := make([]string, len(section.Columns))
+			for i, col := range section.Columns {
+				row[i] = formatCell(result[col])
+			}
+			hs.Rows = append(hs.Rows, row)
+		}
+		if img := section.image(); img != nil {
+			// The data URI is generated here, so it is safe to mark as a trusted URL
+			hs.Image = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(img))
+		}
+		data.Sections = append(data.Sections, hs)
+	}
+
+	var buf bytes.Buffer
+	if err := reportHTMLTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
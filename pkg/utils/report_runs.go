@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"time"
+)
+
+// Report run statuses; a finished report carries the status of its last run
+const (
+	RunRunning = "running"
+	RunSuccess = "success"
+	RunPartial = "partial"
+	RunFailed  = "failed"
+)
+
+// ReportRetrying is the status of a report whose failed or partial run waits for its automatic retry
+const ReportRetrying = "retrying"
+
+// Report run triggers
+const (
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+	TriggerRerun    = "rerun"
+	TriggerRetry    = "retry"
+)
+
+// Report run step kinds
+const (
+	StepQuery         = "query"
+	StepChart         = "chart"
+	StepTemplate      = "template"
+	StepTemplateQuery = "template_query"
+	StepRender        = "render"
+)
+
+// runRecorder collects the steps of a report run
+type runRecorder struct {
+	steps []models.ReportRunStep
+	open  []int // indexes of the steps currently running, innermost last
+}
+
+// record runs fn as a step, timing it and storing its row count and error
+func (r *runRecorder) record(kind string, refID uint, name string, fn func() (int, error)) error {
+	r.steps = append(r.steps, models.ReportRunStep{Kind: kind, RefID: refID, Name: name})
+	idx := len(r.steps) - 1
+	r.open = append(r.open, idx)
+	start := time.Now()
+	rows, err := fn()
+	r.open = r.open[:len(r.open)-1]
+
+	step := &r.steps[idx]
+	step.DurationMs = time.Since(start).Milliseconds()
+	step.Rows = rows
+	step.Status = RunSuccess
+	if err != nil {
+		step.Status = RunFailed
+		step.Error = err.Error()
+	}
+	return err
+}
+
+// rename replaces the placeholder name of the innermost running step once the real name is known
+func (r *runRecorder) rename(name string) {
+	if name != "" && len(r.open) > 0 {
+		r.steps[r.open[len(r.open)-1]].Name = name
+	}
+}
+
+// useQuery records which version of a query the innermost running step executes
+func (r *runRecorder) useQuery(query models.Query) {
+	if len(r.open) > 0 {
+		step := &r.steps[r.open[len(r.open)-1]]
+		step.QueryID = query.ID
+		step.QueryVersion = query.Version
+	}
+}
+
+// outcome derives the run status: failed when the report could not be built or every query and chart
+// failed, partial when only some of them failed
+func (r *runRecorder) outcome(err error) (string, string) {
+	if err != nil {
+		return RunFailed, err.Error()
+	}
+	failed, total := 0, 0
+	for _, step := range r.steps {
+		if step.Kind != StepQuery && step.Kind != StepChart {
+			continue
+		}
+		total++
+		if step.Status == RunFailed {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return RunSuccess, ""
+	case failed == total:
+		return RunFailed, fmt.Sprintf("all %d queries and charts failed", total)
+	default:
+		return RunPartial, fmt.Sprintf("%d of %d queries and charts failed", failed, total)
+	}
+}
+
+func startReportRun(schedule *models.ReportSchedule, report *models.Report, trigger string, attempt int) *models.ReportRun {
+	run := &models.ReportRun{
+		ScheduleID:  schedule.ID,
+		ReportID:    report.ID,
+		TriggeredBy: trigger,
+		Attempt:     attempt,
+		Status:      RunRunning,
+		StartedAt:   time.Now(),
+	}
+	if err := database.DB.Create(run).Error; err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action":     "generate_report",
+			"scheduleID": schedule.ID,
+			"reportID":   report.ID,
+			"error":      err.Error(),
+		}).Error("Failed to create report run")
+	}
+	return run
+}
+
+func finishReportRun(run *models.ReportRun, rec *runRecorder, status, errMsg string) {
+	now := time.Now()
+	run.Status = status
+	run.Error = errMsg
+	run.FinishedAt = &now
+	run.DurationMs = now.Sub(run.StartedAt).Milliseconds()
+	for i := range rec.steps {
+		rec.steps[i].RunID = run.ID
+	}
+	run.Steps = rec.steps
+
+	if err := database.DB.Save(run).Error; err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action":   "generate_report",
+			"reportID": run.ReportID,
+			"runID":    run.ID,
+			"error":    err.Error(),
+		}).Error("Failed to save report run")
+	}
+}
@@ -0,0 +1,367 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gobi/config"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Misfire policies decide what happens to a run that is found more than scheduler.misfire_grace late,
+// for example after downtime
+const (
+	MisfireSkip    = "skip"     // drop the missed runs and wait for the next one
+	MisfireRunOnce = "run_once" // run once now, however many runs were missed
+	MisfireCatchUp = "catch_up" // run once for every missed occurrence
+)
+
+var (
+	reportCron *cron.Cron
+	// schedulerID identifies this process as the owner of the schedules it claims
+	schedulerID string
+	// workerSlots bounds the number of reports generated concurrently by this process
+	workerSlots chan struct{}
+	workersDone sync.WaitGroup
+)
+
+// InitReportGenerator initializes the report generator cron jobs
+func InitReportGenerator() {
+	schedulerID = newSchedulerID()
+	workerSlots = make(chan struct{}, schedulerWorkers())
+
+	reportCron = cron.New()
+	reportCron.Start()
+
+	// Schedule report generation check every minute, followed by the retries of failed runs
+	reportCron.AddFunc("* * * * *", func() {
+		checkAndGenerateReports()
+		checkReportRetries()
+	})
+	// Evaluate due alerts every minute
+	reportCron.AddFunc("* * * * *", checkAlerts)
+	// Delete reports past the retention of their schedules every hour
+	reportCron.AddFunc("@hourly", sweepReports)
+	// Drop expired refresh tokens and revocation entries every hour
+	reportCron.AddFunc("@hourly", purgeExpiredTokens)
+	// Sync directory users with LDAP
+	if cfg := config.AppConfig.LDAP; cfg.Enabled && cfg.SyncInterval > 0 {
+		reportCron.AddFunc(fmt.Sprintf("@every %dm", cfg.SyncInterval), syncLDAPUsers)
+	}
+}
+
+// StopReportGenerator stops the report generator cron jobs and waits for running reports to finish
+func StopReportGenerator() {
+	if reportCron != nil {
+		<-reportCron.Stop().Done()
+		workersDone.Wait()
+	}
+}
+
+func newSchedulerID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+func schedulerWorkers() int {
+	if n := config.AppConfig.Scheduler.Workers; n > 0 {
+		return n
+	}
+	return 4
+}
+
+func schedulerLease() time.Duration {
+	if s := config.AppConfig.Scheduler.LeaseSeconds; s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+func schedulerMisfireGrace() time.Duration {
+	if s := config.AppConfig.Scheduler.MisfireGrace; s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// checkAndGenerateReports claims due schedules while worker slots are free and generates them in the
+// background. Schedules left unclaimed stay due and are picked up by the next check or another replica.
+func checkAndGenerateReports() {
+	now := time.Now()
+	var schedules []models.ReportSchedule
+
+	// Find all active schedules that are due and not leased by a live scheduler
+	if err := database.DB.Where("active = ? AND next_run <= ? AND (locked_until IS NULL OR locked_until < ?)", true, now, now).
+		Order("next_run").Find(&schedules).Error; err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action": "check_reports",
+			"error":  err.Error(),
+		}).Error("Failed to fetch report schedules")
+		return
+	}
+
+	for _, schedule := range schedules {
+		select {
+		case workerSlots <- struct{}{}:
+		default:
+			Logger.WithFields(map[string]interface{}{
+				"action":  "check_reports",
+				"workers": cap(workerSlots),
+			}).Info("All report workers are busy, leaving remaining schedules for the next check")
+			return
+		}
+
+		claimed, err := claimSchedule(&schedule, now)
+		if err != nil || !claimed {
+			<-workerSlots
+			if err != nil {
+				Logger.WithFields(map[string]interface{}{
+					"action":     "check_reports",
+					"scheduleID": schedule.ID,
+					"error":      err.Error(),
+				}).Error("Failed to claim report schedule")
+			}
+			continue
+		}
+
+		workersDone.Add(1)
+		go func() {
+			defer workersDone.Done()
+			defer func() { <-workerSlots }()
+			runClaimedSchedule(&schedule)
+		}()
+	}
+}
+
+// claimSchedule takes the lease of a due schedule with a single conditional UPDATE, which is atomic on
+// SQLite, MySQL and Postgres alike, and reloads the schedule when the lease was won
+func claimSchedule(schedule *models.ReportSchedule, now time.Time) (bool, error) {
+	leaseUntil := now.Add(schedulerLease())
+	result := database.DB.Model(&models.ReportSchedule{}).
+		Where("id = ? AND active = ? AND next_run <= ? AND (locked_until IS NULL OR locked_until < ?)", schedule.ID, true, now, now).
+		Updates(map[string]interface{}{"locked_by": schedulerID, "locked_until": leaseUntil})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	return true, database.DB.First(schedule, schedule.ID).Error
+}
+
+// ErrScheduleBusy is returned by RunScheduleNow while another run of the schedule holds its lease
+var ErrScheduleBusy = errors.New("report schedule is already running")
+
+// RunScheduleNow claims a schedule regardless of its next run time and generates it in the background,
+// leaving the next scheduled run unchanged. Passing a report reruns it in place instead of creating a new
+// one. The returned report is a snapshot taken before generation starts.
+func RunScheduleNow(schedule *models.ReportSchedule, report *models.Report) (models.Report, error) {
+	leased, err := leaseSchedule(schedule.ID, time.Now())
+	if err != nil {
+		return models.Report{}, err
+	}
+	if !leased {
+		return models.Report{}, ErrScheduleBusy
+	}
+
+	trigger := TriggerRerun
+	if report == nil {
+		trigger = TriggerManual
+		created, err := newScheduleReport(schedule)
+		if err != nil {
+			releaseLease(schedule.ID, nil)
+			return models.Report{}, err
+		}
+		report = created
+	} else {
+		// A rerun starts over with its own retries, replacing a retry still due
+		report.Status = "pending"
+		report.Attempts = 0
+		report.NextRetryAt = nil
+		database.DB.Model(report).Updates(map[string]interface{}{"status": report.Status, "attempts": 0, "next_retry_at": nil})
+	}
+	snapshot := *report
+
+	workersDone.Add(1)
+	go func() {
+		defer workersDone.Done()
+		stop := keepLease(schedule.ID)
+		defer stop()
+		if workerSlots != nil {
+			workerSlots <- struct{}{}
+			defer func() { <-workerSlots }()
+		}
+		generateReport(schedule, report, trigger)
+		releaseLease(schedule.ID, map[string]interface{}{"last_run": time.Now()})
+	}()
+	return snapshot, nil
+}
+
+// leaseSchedule takes the lease of a schedule regardless of its next run time, reporting false while
+// another run holds it
+func leaseSchedule(scheduleID uint, now time.Time) (bool, error) {
+	result := database.DB.Model(&models.ReportSchedule{}).
+		Where("id = ? AND (locked_until IS NULL OR locked_until < ?)", scheduleID, now).
+		Updates(map[string]interface{}{"locked_by": schedulerID, "locked_until": now.Add(schedulerLease())})
+	return result.RowsAffected > 0, result.Error
+}
+
+// checkReportRetries starts the retries of failed and partial reports that are due, while worker slots
+// are free. A retry takes the lease of its schedule like any run, and waits for the next check while the
+// schedule is running.
+func checkReportRetries() {
+	now := time.Now()
+	var reports []models.Report
+	if err := database.DB.Omit("content").Where("next_retry_at <= ?", now).Order("next_retry_at").Find(&reports).Error; err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action": "check_report_retries",
+			"error":  err.Error(),
+		}).Error("Failed to fetch report retries")
+		return
+	}
+
+	for _, report := range reports {
+		var schedule models.ReportSchedule
+		if err := database.DB.First(&schedule, report.ScheduleID).Error; err != nil {
+			// The schedule was deleted while the retry waited; the last attempt stands
+			database.DB.Model(&report).Updates(map[string]interface{}{"status": RunFailed, "next_retry_at": nil})
+			continue
+		}
+
+		select {
+		case workerSlots <- struct{}{}:
+		default:
+			return
+		}
+		leased, err := leaseSchedule(schedule.ID, now)
+		if err == nil && leased {
+			// Clearing the retry time claims the retry, should another scheduler have started it already
+			result := database.DB.Model(&models.Report{}).Where("id = ? AND next_retry_at = ?", report.ID, report.NextRetryAt).
+				Update("next_retry_at", nil)
+			if err = result.Error; err == nil && result.RowsAffected == 0 {
+				releaseLease(schedule.ID, nil)
+				leased = false
+			}
+		}
+		if err != nil || !leased {
+			<-workerSlots
+			if err != nil {
+				Logger.WithFields(map[string]interface{}{
+					"action":   "check_report_retries",
+					"reportID": report.ID,
+					"error":    err.Error(),
+				}).Error("Failed to claim report retry")
+			}
+			continue
+		}
+
+		workersDone.Add(1)
+		go func() {
+			defer workersDone.Done()
+			defer func() { <-workerSlots }()
+			stop := keepLease(schedule.ID)
+			defer stop()
+			generateReport(&schedule, &report, TriggerRetry)
+			releaseLease(schedule.ID, map[string]interface{}{"last_run": time.Now()})
+		}()
+	}
+}
+
+// releaseLease clears the lease held by this instance, applying any extra column updates with it
+func releaseLease(scheduleID uint, updates map[string]interface{}) error {
+	return releaseModelLease(&models.ReportSchedule{}, scheduleID, updates)
+}
+
+// keepLease extends the lease of a schedule until the returned function is called, so that long
+// running reports are not claimed a second time
+func keepLease(scheduleID uint) func() {
+	return keepModelLease(&models.ReportSchedule{}, scheduleID)
+}
+
+// releaseModelLease clears the lease of any leased record, such as a schedule or an alert
+func releaseModelLease(model interface{}, id uint, updates map[string]interface{}) error {
+	if updates == nil {
+		updates = map[string]interface{}{}
+	}
+	updates["locked_by"] = ""
+	updates["locked_until"] = nil
+	return database.DB.Model(model).
+		Where("id = ? AND locked_by = ?", id, schedulerID).
+		Updates(updates).Error
+}
+
+// keepModelLease heartbeats the lease of any leased record until the returned function is called
+func keepModelLease(model interface{}, id uint) func() {
+	lease := schedulerLease()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				database.DB.Model(model).
+					Where("id = ? AND locked_by = ?", id, schedulerID).
+					Update("locked_until", time.Now().Add(lease))
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// runClaimedSchedule applies the misfire policy, generates the report and releases the lease together
+// with the new run times
+func runClaimedSchedule(schedule *models.ReportSchedule) {
+	stop := keepLease(schedule.ID)
+	defer stop()
+
+	dueAt := schedule.NextRun
+	late := time.Since(dueAt) > schedulerMisfireGrace()
+	policy := schedule.MisfirePolicy
+	if policy == "" {
+		policy = MisfireRunOnce
+	}
+
+	updates := map[string]interface{}{}
+	if late && policy == MisfireSkip {
+		Logger.WithFields(map[string]interface{}{
+			"action":     "generate_report",
+			"scheduleID": schedule.ID,
+			"dueAt":      dueAt,
+		}).Warn("Skipping misfired report run")
+	} else {
+		if report, err := newScheduleReport(schedule); err == nil {
+			generateReport(schedule, report, TriggerSchedule)
+		}
+		updates["last_run"] = time.Now()
+	}
+
+	// Pick up a cron pattern or timezone edited while the report was running
+	var current models.ReportSchedule
+	if err := database.DB.Select("id", "cron_pattern", "timezone").First(&current, schedule.ID).Error; err == nil {
+		schedule.CronPattern = current.CronPattern
+		schedule.Timezone = current.Timezone
+	}
+	if late && policy == MisfireCatchUp {
+		// Advance one occurrence at a time; further missed occurrences stay due
+		updates["next_run"] = NextRunTime(schedule.CronPattern, schedule.Timezone, dueAt)
+	} else {
+		updates["next_run"] = NextRunTime(schedule.CronPattern, schedule.Timezone, time.Now())
+	}
+
+	if err := releaseLease(schedule.ID, updates); err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action":     "generate_report",
+			"scheduleID": schedule.ID,
+			"error":      err.Error(),
+		}).Error("Failed to update schedule next run time")
+	}
+}
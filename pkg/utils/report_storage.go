@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"gobi/pkg/storage"
+	"path"
+	"time"
+)
+
+// StoreReportContent moves report content into blob storage, replacing the previous file of the report.
+// Passing nil content removes the stored file.
+func StoreReportContent(report *models.Report, content []byte) error {
+	old := report.StorageKey
+	report.Content = nil
+	report.StorageKey = ""
+	if content != nil {
+		_, ext := ReportFileType(report.Format)
+		ref, err := storage.Save(fmt.Sprintf("reports/%d/%d%s", report.ScheduleID, report.ID, ext), content)
+		if err != nil {
+			return err
+		}
+		report.StorageKey = ref
+	}
+	if old != "" && old != report.StorageKey {
+		RemoveStoredContent(old)
+	}
+	return nil
+}
+
+// LoadReportContent returns the file of a report, reading inline content of reports stored before blob
+// storage was introduced
+func LoadReportContent(report models.Report) ([]byte, error) {
+	if report.StorageKey == "" {
+		return report.Content, nil
+	}
+	return storage.Load(report.StorageKey)
+}
+
+// StoreTemplateContent writes an uploaded template file to blob storage under a new key and returns the
+// reference it replaced, to be removed once the template record has been saved
+func StoreTemplateContent(tpl *models.ExcelTemplate, content []byte) (string, error) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	ref, err := storage.Save(path.Join("templates", hex.EncodeToString(b)+".xlsx"), content)
+	if err != nil {
+		return "", err
+	}
+	old := tpl.StorageKey
+	tpl.Template = nil
+	tpl.StorageKey = ref
+	return old, nil
+}
+
+// LoadTemplateContent returns the file of a template, reading inline content of legacy templates
+func LoadTemplateContent(tpl models.ExcelTemplate) ([]byte, error) {
+	if tpl.StorageKey == "" {
+		return tpl.Template, nil
+	}
+	return storage.Load(tpl.StorageKey)
+}
+
+// RemoveStoredContent deletes a stored file that is no longer referenced, logging failures instead of
+// returning them since the owning record has already been updated
+func RemoveStoredContent(ref string) {
+	if err := storage.Remove(ref); err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action": "remove_stored_content",
+			"ref":    ref,
+			"error":  err.Error(),
+		}).Warn("Failed to remove stored content")
+	}
+}
+
+// sweepReports enforces the retention rules of every schedule, deleting reports beyond the newest
+// RetentionCount or older than RetentionDays together with their files. Pending reports are never
+// deleted; reports soft deleted by users keep their place in the count until they are swept with the rest.
+func sweepReports() {
+	var schedules []models.ReportSchedule
+	if err := database.DB.Unscoped().Where("retention_count > 0 OR retention_days > 0").Find(&schedules).Error; err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action": "sweep_reports",
+			"error":  err.Error(),
+		}).Error("Failed to fetch report schedules")
+		return
+	}
+	for _, schedule := range schedules {
+		deleted, err := sweepScheduleReports(schedule, time.Now())
+		if err != nil {
+			Logger.WithFields(map[string]interface{}{
+				"action":     "sweep_reports",
+				"scheduleID": schedule.ID,
+				"error":      err.Error(),
+			}).Error("Failed to apply report retention")
+			continue
+		}
+		if deleted > 0 {
+			Logger.WithFields(map[string]interface{}{
+				"action":     "sweep_reports",
+				"scheduleID": schedule.ID,
+				"deleted":    deleted,
+			}).Info("Deleted reports past their retention")
+		}
+	}
+}
+
+func sweepScheduleReports(schedule models.ReportSchedule, now time.Time) (int, error) {
+	var reports []models.Report
+	if err := database.DB.Unscoped().Select("id", "generated_at", "storage_key").
+		Where("schedule_id = ? AND status NOT IN ?", schedule.ID, []string{"pending", ReportRetrying}).
+		Order("generated_at DESC, id DESC").Find(&reports).Error; err != nil {
+		return 0, err
+	}
+
+	var cutoff time.Time
+	if schedule.RetentionDays > 0 {
+		cutoff = now.AddDate(0, 0, -schedule.RetentionDays)
+	}
+	deleted, kept := 0, 0
+	for _, report := range reports {
+		expired := (!cutoff.IsZero() && report.GeneratedAt.Before(cutoff)) ||
+			(schedule.RetentionCount > 0 && kept >= schedule.RetentionCount)
+		if !expired {
+			kept++
+			continue
+		}
+		if err := storage.Remove(report.StorageKey); err != nil {
+			return deleted, fmt.Errorf("failed to remove content of report %d: %w", report.ID, err)
+		}
+		if err := database.DB.Unscoped().Delete(&models.Report{}, report.ID).Error; err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
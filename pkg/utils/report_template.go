@@ -0,0 +1,464 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// placeholderPattern matches the template placeholders:
+//
+//	{{query:12}}          table anchor, query results are written starting at this cell
+//	{{param:date}}        scalar replaced by a report parameter
+//	{{now}}               generation time, optionally {{now:2006-01-02}} with a Go layout
+var placeholderPattern = regexp.MustCompile(`\{\{\s*(query|param|now)(?::([^}]+?))?\s*\}\}`)
+
+// chartRefPattern and cellRefPattern locate the data references inside chart XML parts;
+// Excel writes them as <c:f> while excelize uses a default namespace and writes <f>
+var (
+	chartRefPattern = regexp.MustCompile(`<(c:)?f>([^<]*)</(?:c:)?f>`)
+	cellRefPattern  = regexp.MustCompile(`^(.+)!\$?([A-Z]{1,3})\$?(\d+)(?::\$?([A-Z]{1,3})\$?(\d+))?$`)
+)
+
+// formulaRangePattern matches range references inside formulas, optionally qualified with a sheet name
+var formulaRangePattern = regexp.MustCompile(`(?:('(?:[^']|'')+'|[\p{L}\p{N}_.]+)!)?(\$?[A-Z]{1,3}\$?)(\d+):(\$?[A-Z]{1,3}\$?)(\d+)`)
+
+// TemplatePlaceholder is a placeholder found in a template cell
+type TemplatePlaceholder struct {
+	Sheet string `json:"sheet"`
+	Cell  string `json:"cell"`
+	Kind  string `json:"kind"` // query, param or now
+	Arg   string `json:"arg,omitempty"`
+}
+
+// templateData supplies the values used to fill a template
+type templateData struct {
+	Now    time.Time
+	Params map[string]string
+	// Query returns the columns and rows for a {{query:ID}} anchor
+	Query func(queryID uint) ([]string, []map[string]interface{}, error)
+}
+
+// findPlaceholders scans every sheet of the workbook for placeholders
+func findPlaceholders(f *excelize.File) ([]TemplatePlaceholder, error) {
+	var placeholders []TemplatePlaceholder
+	for _, sheet := range f.GetSheetList() {
+		rows, err := f.GetRows(sheet, excelize.Options{RawCellValue: true})
+		if err != nil {
+			return nil, err
+		}
+		for r, row := range rows {
+			for c, value := range row {
+				if !strings.Contains(value, "{{") {
+					continue
+				}
+				cell, _ := excelize.CoordinatesToCellName(c+1, r+1)
+				for _, m := range placeholderPattern.FindAllStringSubmatch(value, -1) {
+					placeholders = append(placeholders, TemplatePlaceholder{Sheet: sheet, Cell: cell, Kind: m[1], Arg: strings.TrimSpace(m[2])})
+				}
+			}
+		}
+	}
+	return placeholders, nil
+}
+
+// InspectTemplate checks that content is a readable workbook with well-formed placeholders and returns
+// its sheet names together with the placeholders it declares
+func InspectTemplate(content []byte) ([]string, []TemplatePlaceholder, error) {
+	f, err := excelize.OpenReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	placeholders, err := findPlaceholders(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range placeholders {
+		switch p.Kind {
+		case "query":
+			if _, err := strconv.ParseUint(p.Arg, 10, 64); err != nil {
+				return nil, nil, fmt.Errorf("invalid query placeholder in %s!%s: %q", p.Sheet, p.Cell, p.Arg)
+			}
+		case "param":
+			if p.Arg == "" {
+				return nil, nil, fmt.Errorf("param placeholder in %s!%s has no name", p.Sheet, p.Cell)
+			}
+		}
+	}
+	return f.GetSheetList(), placeholders, nil
+}
+
+// PreviewTemplate fills a template in memory and returns the resulting workbook without storing a report.
+// Missing built-in params (date, time, datetime) are derived from now.
+func PreviewTemplate(content []byte, now time.Time, params map[string]string, query func(uint) ([]string, []map[string]interface{}, error)) ([]byte, error) {
+	f, err := excelize.OpenReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	merged := defaultTemplateParams("", "preview", now)
+	for k, v := range params {
+		merged[k] = v
+	}
+	if err := fillTemplate(f, templateData{Now: now, Params: merged, Query: query}); err != nil {
+		return nil, err
+	}
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// defaultTemplateParams returns the built-in values available to {{param:...}} placeholders
+func defaultTemplateParams(name, reportType string, now time.Time) map[string]string {
+	return map[string]string{
+		"date":     now.Format("2006-01-02"),
+		"time":     now.Format("15:04:05"),
+		"datetime": now.Format("2006-01-02 15:04:05"),
+		"name":     name,
+		"type":     reportType,
+	}
+}
+
+// fillTemplate replaces scalar placeholders in place and expands every query anchor into a table,
+// inserting rows so that content below the anchor is pushed down rather than overwritten
+func fillTemplate(f *excelize.File, data templateData) error {
+	placeholders, err := findPlaceholders(f)
+	if err != nil {
+		return err
+	}
+
+	anchors := map[string][]TemplatePlaceholder{}
+	scalarCells := map[[2]string]bool{}
+	for _, p := range placeholders {
+		if p.Kind == "query" {
+			anchors[p.Sheet] = append(anchors[p.Sheet], p)
+			continue
+		}
+		scalarCells[[2]string{p.Sheet, p.Cell}] = true
+	}
+
+	// Scalars are filled first so they move along with their rows once tables are expanded
+	for key := range scalarCells {
+		value, err := f.GetCellValue(key[0], key[1], excelize.Options{RawCellValue: true})
+		if err != nil {
+			return err
+		}
+		if err := f.SetCellValue(key[0], key[1], expandScalars(value, data)); err != nil {
+			return err
+		}
+	}
+
+	for sheet, list := range anchors {
+		if err := fillAnchors(f, sheet, list, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandScalars substitutes {{param:x}} and {{now}} placeholders inside a cell value
+func expandScalars(value string, data templateData) string {
+	return placeholderPattern.ReplaceAllStringFunc(value, func(m string) string {
+		parts := placeholderPattern.FindStringSubmatch(m)
+		switch parts[1] {
+		case "param":
+			return data.Params[strings.TrimSpace(parts[2])]
+		case "now":
+			layout := strings.TrimSpace(parts[2])
+			if layout == "" {
+				layout = "2006-01-02 15:04:05"
+			}
+			return data.Now.Format(layout)
+		default:
+			return m
+		}
+	})
+}
+
+// fillAnchors writes query results for every anchor on a sheet. Anchor rows are processed bottom-up
+// so inserting rows for one anchor never moves an anchor that has not been filled yet.
+func fillAnchors(f *excelize.File, sheet string, list []TemplatePlaceholder, data templateData) error {
+	type block struct {
+		col     int
+		columns []string
+		results []map[string]interface{}
+	}
+	byRow := map[int][]TemplatePlaceholder{}
+	for _, p := range list {
+		_, row, err := excelize.CellNameToCoordinates(p.Cell)
+		if err != nil {
+			return err
+		}
+		byRow[row] = append(byRow[row], p)
+	}
+	rowNums := make([]int, 0, len(byRow))
+	for row := range byRow {
+		rowNums = append(rowNums, row)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(rowNums)))
+
+	for _, row := range rowNums {
+		var blocks []block
+		filled := 0
+		for _, p := range byRow[row] {
+			queryID, err := strconv.ParseUint(p.Arg, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid query placeholder in %s!%s: %q", sheet, p.Cell, p.Arg)
+			}
+			columns, results, err := data.Query(uint(queryID))
+			if err != nil {
+				return fmt.Errorf("query %d for %s!%s: %w", queryID, sheet, p.Cell, err)
+			}
+			col, _, _ := excelize.CellNameToCoordinates(p.Cell)
+			blocks = append(blocks, block{col: col, columns: columns, results: results})
+			filled = max(filled, len(results))
+		}
+
+		if filled > 1 {
+			if err := f.InsertRows(sheet, row+1, filled-1); err != nil {
+				return err
+			}
+			for _, b := range blocks {
+				if err := copyRowStyle(f, sheet, row, b.col, b.col+max(len(b.columns), 1)-1, filled-1); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, b := range blocks {
+			anchor, _ := excelize.CoordinatesToCellName(b.col, row)
+			if len(b.results) == 0 {
+				if err := f.SetCellValue(sheet, anchor, ""); err != nil {
+					return err
+				}
+				continue
+			}
+			for i, result := range b.results {
+				for j, name := range b.columns {
+					cell, _ := excelize.CoordinatesToCellName(b.col+j, row+i)
+					if err := f.SetCellValue(sheet, cell, result[name]); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		lastRow := row + max(filled, 1) - 1
+		if err := extendTables(f, sheet, row, lastRow); err != nil {
+			return err
+		}
+		if err := stretchFormulaRefs(f, sheet, row, lastRow); err != nil {
+			return err
+		}
+		adjustChartRefs(f, sheet, row, lastRow)
+	}
+	return nil
+}
+
+// copyRowStyle applies the style of each anchor-row cell to the n rows inserted below it
+func copyRowStyle(f *excelize.File, sheet string, row, fromCol, toCol, n int) error {
+	for col := fromCol; col <= toCol; col++ {
+		src, _ := excelize.CoordinatesToCellName(col, row)
+		styleID, err := f.GetCellStyle(sheet, src)
+		if err != nil {
+			return err
+		}
+		if styleID == 0 {
+			continue
+		}
+		top, _ := excelize.CoordinatesToCellName(col, row+1)
+		bottom, _ := excelize.CoordinatesToCellName(col, row+n)
+		if err := f.SetCellStyle(sheet, top, bottom, styleID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extendTables grows any Excel table that contains the anchor row so it covers every filled row
+func extendTables(f *excelize.File, sheet string, anchorRow, lastRow int) error {
+	tables, err := f.GetTables(sheet)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		cells := strings.Split(table.Range, ":")
+		if len(cells) != 2 {
+			continue
+		}
+		x1, y1, err1 := excelize.CellNameToCoordinates(cells[0])
+		x2, y2, err2 := excelize.CellNameToCoordinates(cells[1])
+		if err1 != nil || err2 != nil || anchorRow < y1 || anchorRow > y2 || y2 >= lastRow {
+			continue
+		}
+		from, _ := excelize.CoordinatesToCellName(x1, y1)
+		to, _ := excelize.CoordinatesToCellName(x2, lastRow)
+		if err := f.DeleteTable(table.Name); err != nil {
+			return err
+		}
+		if err := f.AddTable(sheet, &excelize.Table{
+			Range:             from + ":" + to,
+			Name:              table.Name,
+			StyleName:         table.StyleName,
+			ShowColumnStripes: table.ShowColumnStripes,
+			ShowFirstColumn:   table.ShowFirstColumn,
+			ShowHeaderRow:     table.ShowHeaderRow,
+			ShowLastColumn:    table.ShowLastColumn,
+			ShowRowStripes:    table.ShowRowStripes,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adjustChartRefs rewrites chart series references after an anchor on sheet was expanded to lastRow.
+// Ranges starting at the anchor (or at the header row just above it) are stretched to the filled data,
+// and references below the anchor are shifted by the number of inserted rows, since excelize does not
+// update chart parts when rows are inserted.
+func adjustChartRefs(f *excelize.File, sheet string, anchorRow, lastRow int) {
+	inserted := lastRow - anchorRow
+	f.Pkg.Range(func(key, value interface{}) bool {
+		path, ok := key.(string)
+		if !ok || !strings.HasPrefix(path, "xl/charts/chart") || !strings.HasSuffix(path, ".xml") {
+			return true
+		}
+		content, ok := value.([]byte)
+		if !ok {
+			return true
+		}
+		updated := chartRefPattern.ReplaceAllFunc(content, func(m []byte) []byte {
+			parts := chartRefPattern.FindSubmatch(m)
+			tag := string(parts[1]) + "f"
+			if adjusted, ok := adjustCellRef(string(parts[2]), sheet, anchorRow, lastRow, inserted); ok {
+				return []byte("<" + tag + ">" + adjusted + "</" + tag + ">")
+			}
+			return m
+		})
+		f.Pkg.Store(path, updated)
+		return true
+	})
+}
+
+// adjustCellRef applies the adjustChartRefs rules to a single reference such as 'Sales'!$C$5:$C$5
+func adjustCellRef(ref, sheet string, anchorRow, lastRow, inserted int) (string, bool) {
+	parts := cellRefPattern.FindStringSubmatch(ref)
+	if parts == nil {
+		return "", false
+	}
+	if unquoteSheetName(html.UnescapeString(parts[1])) != sheet {
+		return "", false
+	}
+
+	startCol, endCol := parts[2], parts[4]
+	startRow, _ := strconv.Atoi(parts[3])
+	if endCol == "" {
+		if startRow <= anchorRow {
+			return "", false
+		}
+		return fmt.Sprintf("%s!$%s$%d", parts[1], startCol, startRow+inserted), true
+	}
+
+	endRow, _ := strconv.Atoi(parts[5])
+	switch {
+	case startRow > anchorRow:
+		startRow, endRow = startRow+inserted, endRow+inserted
+	case startRow >= anchorRow-1 && endRow >= anchorRow:
+		endRow = lastRow
+	case endRow > anchorRow:
+		endRow += inserted
+	default:
+		return "", false
+	}
+	return fmt.Sprintf("%s!$%s$%d:$%s$%d", parts[1], startCol, startRow, endCol, endRow), true
+}
+
+// stretchFormulaRefs extends formula ranges that cover exactly the anchor row (optionally with the header
+// row above it), such as SUM(C5:C5), to the filled rows. Ranges ending below the anchor are already
+// adjusted by excelize when the rows are inserted.
+func stretchFormulaRefs(f *excelize.File, sheet string, anchorRow, lastRow int) error {
+	if lastRow == anchorRow {
+		return nil
+	}
+	for _, name := range f.GetSheetList() {
+		maxCol, maxRow, err := sheetBounds(f, name)
+		if err != nil {
+			return err
+		}
+		for r := 1; r <= maxRow; r++ {
+			if name == sheet && r >= anchorRow && r <= lastRow {
+				continue
+			}
+			for c := 1; c <= maxCol; c++ {
+				cell, _ := excelize.CoordinatesToCellName(c, r)
+				formula, err := f.GetCellFormula(name, cell)
+				if err != nil || formula == "" {
+					continue
+				}
+				updated := formulaRangePattern.ReplaceAllStringFunc(formula, func(m string) string {
+					parts := formulaRangePattern.FindStringSubmatch(m)
+					if parts[1] == "" && name != sheet || parts[1] != "" && unquoteSheetName(parts[1]) != sheet {
+						return m
+					}
+					startRow, _ := strconv.Atoi(parts[3])
+					endRow, _ := strconv.Atoi(parts[5])
+					if endRow != anchorRow || startRow < anchorRow-1 {
+						return m
+					}
+					prefix := ""
+					if parts[1] != "" {
+						prefix = parts[1] + "!"
+					}
+					return fmt.Sprintf("%s%s%d:%s%d", prefix, parts[2], startRow, parts[4], lastRow)
+				})
+				if updated != formula {
+					if err := f.SetCellFormula(name, cell, updated); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sheetBounds returns the last used column and row of a sheet, combining the stored dimension with
+// the rows that actually hold values
+func sheetBounds(f *excelize.File, sheet string) (int, int, error) {
+	maxCol, maxRow := 0, 0
+	if dim, err := f.GetSheetDimension(sheet); err == nil && dim != "" {
+		cells := strings.Split(dim, ":")
+		if col, row, err := excelize.CellNameToCoordinates(cells[len(cells)-1]); err == nil {
+			maxCol, maxRow = col, row
+		}
+	}
+	rows, err := f.GetRows(sheet, excelize.Options{RawCellValue: true})
+	if err != nil {
+		return 0, 0, err
+	}
+	maxRow = max(maxRow, len(rows))
+	for _, row := range rows {
+		maxCol = max(maxCol, len(row))
+	}
+	return maxCol, maxRow, nil
+}
+
+// unquoteSheetName strips the quotes Excel puts around sheet names containing spaces or punctuation
+func unquoteSheetName(name string) string {
+	if len(name) >= 2 && strings.HasPrefix(name, "'") && strings.HasSuffix(name, "'") {
+		return strings.ReplaceAll(name[1:len(name)-1], "''", "'")
+	}
+	return name
+}
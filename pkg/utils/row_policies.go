@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"regexp"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// Built-in user attributes, which row policies can filter on without stored values
+const (
+	AttributeUserID   = "user_id"
+	AttributeUsername = "username"
+	AttributeOrg      = "org" // ID of the organization the query runs in
+)
+
+// AttributeAll is an attribute value that exempts the user from the policies on that attribute
+const AttributeAll = "*"
+
+var builtinAttributes = map[string]bool{AttributeUserID: true, AttributeUsername: true, AttributeOrg: true}
+
+var (
+	attributeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+	columnNamePattern    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+)
+
+// ValidateAttributeName checks the name of a stored user attribute; built-in attributes cannot be stored
+func ValidateAttributeName(name string) error {
+	if !attributeNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid attribute name %q, use lower case letters, digits and _", name)
+	}
+	if builtinAttributes[name] {
+		return fmt.Errorf("attribute %q is built in", name)
+	}
+	return nil
+}
+
+// ValidateRowPolicy checks the column and attribute of a row policy. The column is put in the SQL, so only
+// plain identifiers are accepted.
+func ValidateRowPolicy(policy models.RowPolicy) error {
+	if policy.ResourceType != ResourceDataSource && policy.ResourceType != ResourceQuery {
+		return fmt.Errorf("row policies apply to a %s or a %s", ResourceDataSource, ResourceQuery)
+	}
+	if !columnNamePattern.MatchString(policy.ColumnName) {
+		return fmt.Errorf("invalid column name %q", policy.ColumnName)
+	}
+	if !builtinAttributes[policy.Attribute] && !attributeNamePattern.MatchString(policy.Attribute) {
+		return fmt.Errorf("invalid attribute name %q", policy.Attribute)
+	}
+	return nil
+}
+
+// UserAttributes returns the stored attributes of a user with their values
+func UserAttributes(userID uint) (map[string][]string, error) {
+	var stored []models.UserAttribute
+	if err := database.DB.Where("user_id = ?", userID).Order("name, value").Find(&stored).Error; err != nil {
+		return nil, err
+	}
+	attrs := make(map[string][]string)
+	for _, a := range stored {
+		attrs[a.Name] = append(attrs[a.Name], a.Value)
+	}
+	return attrs, nil
+}
+
+var (
+	// ErrRowPolicyEditor is returned for a query whose SQL the viewer can edit, while row policies of its data
+	// source filter the viewer's rows: the SQL could rename or fake the filtered columns
+	ErrRowPolicyEditor = errors.New("row policies of the data source filter your rows, so queries you can edit on it cannot run for you")
+	// ErrRowPolicyColumns is returned when filtered SQL fails because its result has duplicate column names
+	ErrRowPolicyColumns = errors.New("row policies apply to this query, which needs a distinct name for every result column")
+)
+
+// RowFilter is the predicate of a row policy: Column must hold one of Values
+type RowFilter struct {
+	PolicyID     uint
+	ResourceType string // type of the resource the policy is on, a data source or a query
+	Column       string
+	Values       []interface{}
+}
+
+// RowFilters returns the filters of the row policies on a query and its data source for the user running
+// it. Users without a value of a policy's attribute get a filter matching no rows, subjects with
+// rls.bypass get no filters. Data source policies only hold for SQL the viewer cannot change, so queries
+// the viewer can edit are refused with ErrRowPolicyEditor while such a policy filters their rows.
+func RowFilters(viewer Subject, query models.Query) ([]RowFilter, error) {
+	filters, err := rowPolicyFilters(viewer, database.DB.Where(
+		"(resource_type = ? AND resource_id = ?) OR (resource_type = ? AND resource_id = ?)",
+		ResourceQuery, query.ID, ResourceDataSource, query.DataSourceID))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range filters {
+		if f.ResourceType == ResourceDataSource && viewer.Can(QueryResource(query), AccessEdit) {
+			return nil, ErrRowPolicyEditor
+		}
+	}
+	return filters, nil
+}
+
+// DataSourceRowFiltered reports whether row policies of a data source filter the rows of viewer. Such
+// users cannot write SQL for the data source.
+func DataSourceRowFiltered(viewer Subject, dataSourceID uint) (bool, error) {
+	filters, err := rowPolicyFilters(viewer, database.DB.Where("resource_type = ? AND resource_id = ?",
+		ResourceDataSource, dataSourceID))
+	return len(filters) > 0, err
+}
+
+// rowPolicyFilters returns the filters of the policies matched by scope for viewer
+func rowPolicyFilters(viewer Subject, scope *gorm.DB) ([]RowFilter, error) {
+	if viewer.HasPermission(PermBypassRLS) {
+		return nil, nil
+	}
+	var policies []models.RowPolicy
+	if err := scope.Order("id").Find(&policies).Error; err != nil || len(policies) == 0 {
+		return nil, err
+	}
+
+	stored, err := UserAttributes(viewer.UserID)
+	if err != nil {
+		return nil, err
+	}
+	filters := make([]RowFilter, 0, len(policies))
+	for _, policy := range policies {
+		var values []interface{}
+		switch policy.Attribute {
+		case AttributeUserID:
+			values = []interface{}{viewer.UserID}
+		case AttributeOrg:
+			if viewer.OrgID != 0 {
+				values = []interface{}{viewer.OrgID}
+			}
+		case AttributeUsername:
+			var user models.User
+			if err := database.DB.Select("username").First(&user, viewer.UserID).Error; err == nil {
+				values = []interface{}{user.Username}
+			}
+		default:
+			exempt := false
+			for _, value := range stored[policy.Attribute] {
+				exempt = exempt || value == AttributeAll
+				values = append(values, value)
+			}
+			if exempt {
+				continue
+			}
+		}
+		filters = append(filters, RowFilter{PolicyID: policy.ID, ResourceType: policy.ResourceType, Column: policy.ColumnName, Values: values})
+	}
+	return filters, nil
+}
+
+// WrapRowFilters wraps SQL already bound for the data source type in a subquery keeping only the rows
+// that pass every filter. The filter values are appended to args.
+func WrapRowFilters(dsType, sqlStr string, args []interface{}, filters []RowFilter) (string, []interface{}) {
+	if len(filters) == 0 {
+		return sqlStr, args
+	}
+	conds := make([]string, 0, len(filters))
+	for _, f := range filters {
+		if len(f.Values) == 0 {
+			conds = append(conds, "1 = 0")
+			continue
+		}
+		marks := make([]string, len(f.Values))
+		for i, value := range f.Values {
+			args = append(args, value)
+			marks[i] = placeholder(dsType, len(args))
+		}
+		conds = append(conds, fmt.Sprintf("rls.%s IN (%s)", quoteIdentifier(dsType, f.Column), strings.Join(marks, ", ")))
+	}
+	// The saved SQL goes on its own lines, so that a trailing line comment cannot swallow the wrapper
+	inner := strings.TrimRight(strings.TrimSpace(sqlStr), "; \t\r\n")
+	return fmt.Sprintf("SELECT * FROM (\n%s\n) rls WHERE %s", inner, strings.Join(conds, " AND ")), args
+}
+
+// RowFilterError explains errors of SQL wrapped by WrapRowFilters that come from the wrapping: MySQL
+// refuses a derived table with duplicate column names, and Postgres a filtered column that is ambiguous
+func RowFilterError(err error, filters []RowFilter) error {
+	if err == nil || len(filters) == 0 {
+		return err
+	}
+	var mysqlErr *mysql.MySQLError
+	var pqErr *pq.Error
+	if (errors.As(err, &mysqlErr) && mysqlErr.Number == 1060) || (errors.As(err, &pqErr) && pqErr.Code == "42702") {
+		return fmt.Errorf("%w: %v", ErrRowPolicyColumns, err)
+	}
+	return err
+}
+
+// quoteIdentifier quotes a validated column name for the data source type
+func quoteIdentifier(dsType, name string) string {
+	if dsType == "mysql" {
+		return "`" + name + "`"
+	}
+	return `"` + name + `"`
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"strings"
+	"time"
+	// Embed the IANA database so schedule timezones resolve in minimal container images
+	_ "time/tzdata"
+
+	"github.com/robfig/cron/v3"
+)
+
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow)
+
+// ValidateCronPattern checks a five field cron pattern
+func ValidateCronPattern(cronPattern string) error {
+	_, err := cronParser.Parse(cronPattern)
+	return err
+}
+
+// ScheduleLocation returns the location of an IANA timezone name, falling back to server local time for
+// empty or unknown names
+func ScheduleLocation(timezone string) *time.Location {
+	if timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// NextRunTime returns the first occurrence of cronPattern after from, evaluated in timezone
+func NextRunTime(cronPattern, timezone string, from time.Time) time.Time {
+	return nextCronTime(cronPattern, from, ScheduleLocation(timezone))
+}
+
+// nextCronTime evaluates cronPattern on the wall clock of loc, or returns from for invalid patterns.
+// Around DST transitions it follows the usual cron convention for patterns with fixed hours: a run whose
+// time is skipped when clocks go forward fires at the transition instead, and a run whose time occurs
+// twice when clocks go back fires only the first time. Patterns with a wildcard or step hour keep
+// running on every matching instant.
+func nextCronTime(cronPattern string, from time.Time, loc *time.Location) time.Time {
+	schedule, err := cronParser.Parse(cronPattern)
+	if err != nil {
+		return from
+	}
+	fixedHour := false
+	if fields := strings.Fields(cronPattern); len(fields) == 5 {
+		fixedHour = !strings.ContainsAny(fields[1], "*/")
+	}
+
+	from = from.In(loc)
+	for {
+		next := schedule.Next(from)
+		if !fixedHour || next.IsZero() {
+			return next
+		}
+		// Clocks going forward between from and next may have skipped a run
+		for t := from; ; {
+			_, end := t.ZoneBounds()
+			if end.IsZero() || !end.Before(next) {
+				break
+			}
+			if end.After(from) && skippedByGap(schedule, end) {
+				return end
+			}
+			t = end
+		}
+		if !repeatedByFallBack(next) {
+			return next
+		}
+		from = next
+	}
+}
+
+// skippedByGap reports whether the wall-clock times skipped at a forward transition contain a match
+func skippedByGap(schedule cron.Schedule, transition time.Time) bool {
+	_, before := transition.Add(-time.Second).Zone()
+	_, after := transition.Zone()
+	if after <= before {
+		return false
+	}
+	gapStart := wallClockUTC(transition.In(time.FixedZone("", before)))
+	gapEnd := wallClockUTC(transition.In(time.FixedZone("", after)))
+	return schedule.Next(gapStart.Add(-time.Second)).Before(gapEnd)
+}
+
+// repeatedByFallBack reports whether t is the second occurrence of its wall-clock time after clocks went back
+func repeatedByFallBack(t time.Time) bool {
+	start, _ := t.ZoneBounds()
+	if start.IsZero() {
+		return false
+	}
+	_, before := start.Add(-time.Second).Zone()
+	_, after := start.Zone()
+	return before > after && t.Sub(start) < time.Duration(before-after)*time.Second
+}
+
+// wallClockUTC returns the wall-clock reading of t as a UTC time, which has no transitions
+func wallClockUTC(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
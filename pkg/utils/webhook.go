@@ -0,0 +1,408 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gobi/config"
+	"gobi/internal/models"
+	"gobi/pkg/database"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// Webhook events
+const (
+	EventReportSuccess = "report.success"
+	EventReportFailure = "report.failure"
+	EventAlertFiring   = "alert.firing"
+	EventAlertResolved = "alert.resolved"
+	EventWebhookTest   = "webhook.test" // sent by the test endpoint regardless of the destination's events
+)
+
+// WebhookEvents lists the events a destination can subscribe to
+var WebhookEvents = []string{EventReportSuccess, EventReportFailure, EventAlertFiring, EventAlertResolved}
+
+// ErrWebhookAddressBlocked is returned for webhook URLs reaching a private, loopback or link-local address
+var ErrWebhookAddressBlocked = errors.New("webhook URL must not point to a private, loopback or link-local address")
+
+// blockedWebhookNetworks are non-public ranges not covered by the net.IP predicates checked by
+// webhookAddressAllowed
+var blockedWebhookNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),     // "this network"
+	mustParseCIDR("100.64.0.0/10"), // carrier-grade NAT
+	mustParseCIDR("192.0.0.0/24"),  // IETF protocol assignments
+	mustParseCIDR("198.18.0.0/15"), // benchmarking
+}
+
+// webhookAllowPrivate lets tests post to receivers on the loopback interface
+var webhookAllowPrivate = false
+
+// WebhookClient sends webhook requests; the timeout is applied per request from config. Connections
+// are checked after name resolution, so that neither the URL, nor a redirect, nor a DNS answer changed
+// since the URL was saved can reach internal addresses. Proxy settings of the environment are not used,
+// since they would hide the destination from that check.
+var WebhookClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: webhookDialControl,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return ValidateWebhookURL(req.URL.String())
+	},
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// webhookAddressAllowed reports whether a webhook request may connect to ip
+func webhookAddressAllowed(ip net.IP) bool {
+	if webhookAllowPrivate {
+		return true
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range blockedWebhookNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialControl refuses connections to addresses webhooks may not reach; it runs for the resolved
+// address right before each connection is made
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !webhookAddressAllowed(ip) {
+		return ErrWebhookAddressBlocked
+	}
+	return nil
+}
+
+// ValidateWebhookURL checks that a webhook URL is an absolute http or https URL whose host resolves
+// only to addresses webhooks may reach
+func ValidateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("webhook URL must be an absolute http or https URL")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("could not resolve webhook host %s: %w", u.Hostname(), err)
+	}
+	for _, addr := range addrs {
+		if !webhookAddressAllowed(addr.IP) {
+			return ErrWebhookAddressBlocked
+		}
+	}
+	return nil
+}
+
+// WebhookReport describes the report an event is about
+type WebhookReport struct {
+	ID          uint      `json:"id"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Format      string    `json:"format"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	GeneratedAt time.Time `json:"generated_at"`
+	DownloadURL string    `json:"download_url,omitempty"`
+}
+
+// WebhookSchedule describes the schedule that produced a report
+type WebhookSchedule struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// WebhookPayload is the default request body and the data available to payload templates
+type WebhookPayload struct {
+	Event     string           `json:"event"`
+	Text      string           `json:"text"` // one line summary, understood by chat incoming webhooks
+	Timestamp time.Time        `json:"timestamp"`
+	Report    *WebhookReport   `json:"report,omitempty"`
+	Schedule  *WebhookSchedule `json:"schedule,omitempty"`
+	Alert     *WebhookAlert    `json:"alert,omitempty"`
+}
+
+// WebhookAlert describes the alert an alert.firing or alert.resolved event is about
+type WebhookAlert struct {
+	ID          uint                   `json:"id"`
+	Name        string                 `json:"name"`
+	State       string                 `json:"state"`
+	QueryID     uint                   `json:"query_id"`
+	Conditions  []AlertConditionResult `json:"conditions"`
+	EvaluatedAt time.Time              `json:"evaluated_at"`
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	// json encodes a value, so that strings can be embedded in JSON templates safely
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// ValidateWebhookTemplate checks that a payload template renders valid JSON for a sample event
+func ValidateWebhookTemplate(text string) error {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	sample := WebhookPayload{
+		Event:     EventReportSuccess,
+		Text:      "sample",
+		Timestamp: time.Now(),
+		Report:    &WebhookReport{ID: 1, Name: "sample", Status: "success", GeneratedAt: time.Now()},
+		Schedule:  &WebhookSchedule{ID: 1, Name: "sample"},
+	}
+	body, err := renderWebhookPayload(text, sample)
+	if err != nil {
+		return err
+	}
+	if !json.Valid(body) {
+		return fmt.Errorf("payload template does not render valid JSON")
+	}
+	return nil
+}
+
+func renderWebhookPayload(text string, payload WebhookPayload) ([]byte, error) {
+	if strings.TrimSpace(text) == "" {
+		return json.Marshal(payload)
+	}
+	tpl, err := template.New("payload").Funcs(webhookTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WebhookSignature returns the value of the X-Gobi-Signature header: an HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the destination secret
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookWants reports whether a destination subscribed to event
+func webhookWants(dest models.WebhookDestination, event string) bool {
+	if event == EventWebhookTest || strings.TrimSpace(dest.Events) == "" {
+		return true
+	}
+	for _, e := range strings.Split(dest.Events, ",") {
+		if strings.TrimSpace(e) == event {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyReportWebhooks posts the outcome of a report run to the schedule's webhook destinations
+func notifyReportWebhooks(schedule *models.ReportSchedule, report *models.Report) {
+	var ids []uint
+	if schedule.Webhooks == "" || json.Unmarshal([]byte(schedule.Webhooks), &ids) != nil || len(ids) == 0 {
+		return
+	}
+	var destinations []models.WebhookDestination
+	if err := database.DB.Where("id IN ? AND active = ?", ids, true).Find(&destinations).Error; err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action":     "notify_webhooks",
+			"scheduleID": schedule.ID,
+			"error":      err.Error(),
+		}).Error("Failed to load webhook destinations")
+		return
+	}
+
+	payload := reportWebhookPayload(schedule, report)
+	for _, dest := range destinations {
+		if !webhookWants(dest, payload.Event) || !userCan(schedule.UserID, WebhookResource(dest), AccessView) {
+			continue
+		}
+		SendWebhook(dest, payload, report.ID)
+	}
+}
+
+func reportWebhookPayload(schedule *models.ReportSchedule, report *models.Report) WebhookPayload {
+	payload := WebhookPayload{
+		Event:     EventReportSuccess,
+		Timestamp: time.Now(),
+		Report: &WebhookReport{
+			ID:          report.ID,
+			Name:        report.Name,
+			Type:        report.Type,
+			Format:      NormalizeReportFormat(report.Format),
+			Status:      report.Status,
+			Error:       report.Error,
+			GeneratedAt: report.GeneratedAt.In(ScheduleLocation(report.Timezone)),
+		},
+		Schedule: &WebhookSchedule{ID: schedule.ID, Name: schedule.Name},
+	}
+	switch report.Status {
+	case RunSuccess:
+		payload.Report.DownloadURL = ReportDownloadURL(report.ID)
+		payload.Text = fmt.Sprintf("Report %q generated: %s", report.Name, payload.Report.DownloadURL)
+	case RunPartial:
+		payload.Report.DownloadURL = ReportDownloadURL(report.ID)
+		payload.Text = fmt.Sprintf("Report %q generated with errors (%s): %s", report.Name, report.Error, payload.Report.DownloadURL)
+	default:
+		payload.Event = EventReportFailure
+		payload.Text = fmt.Sprintf("Report %q failed: %s", report.Name, report.Error)
+	}
+	return payload
+}
+
+// SendWebhook posts payload to a destination, retrying with exponential backoff on network errors,
+// 408, 429 and 5xx responses, and records the outcome as a WebhookDelivery
+func SendWebhook(dest models.WebhookDestination, payload WebhookPayload, reportID uint) models.WebhookDelivery {
+	delivery := models.WebhookDelivery{
+		DestinationID: dest.ID,
+		ReportID:      reportID,
+		Event:         payload.Event,
+		Status:        "pending",
+	}
+	if payload.Alert != nil {
+		delivery.AlertID = payload.Alert.ID
+	}
+	database.DB.Create(&delivery)
+
+	if err := postWebhook(dest, payload, &delivery); err != nil {
+		delivery.Status = "failed"
+		delivery.Error = err.Error()
+		Logger.WithFields(map[string]interface{}{
+			"action":        "send_webhook",
+			"destinationID": dest.ID,
+			"event":         payload.Event,
+			"attempts":      delivery.Attempts,
+			"error":         err.Error(),
+		}).Warn("Failed to deliver webhook")
+	} else {
+		now := time.Now()
+		delivery.Status = "sent"
+		delivery.Error = ""
+		delivery.DeliveredAt = &now
+	}
+
+	if err := database.DB.Save(&delivery).Error; err != nil {
+		Logger.WithFields(map[string]interface{}{
+			"action":        "send_webhook",
+			"destinationID": dest.ID,
+			"error":         err.Error(),
+		}).Error("Failed to save webhook delivery")
+	}
+	return delivery
+}
+
+func postWebhook(dest models.WebhookDestination, payload WebhookPayload, delivery *models.WebhookDelivery) error {
+	cfg := config.AppConfig.Webhook
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+	wait := time.Duration(cfg.RetryInterval) * time.Second
+	if wait <= 0 {
+		wait = 5 * time.Second
+	}
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	body, err := renderWebhookPayload(dest.PayloadTemplate, payload)
+	if err != nil {
+		return fmt.Errorf("failed to render payload: %w", err)
+	}
+	secret := ""
+	if dest.Secret != "" {
+		if secret, err = DecryptAES(dest.Secret); err != nil {
+			return fmt.Errorf("failed to decrypt secret: %w", err)
+		}
+	}
+
+	for {
+		delivery.Attempts++
+		retry, err := postWebhookOnce(dest.URL, secret, payload.Event, delivery, body, timeout)
+		if err == nil {
+			return nil
+		}
+		if !retry || delivery.Attempts >= maxAttempts {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// postWebhookOnce makes a single attempt and reports whether a failure is worth retrying
+func postWebhookOnce(url, secret, event string, delivery *models.WebhookDelivery, body []byte, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Gobi-Webhook/1.0")
+	req.Header.Set("X-Gobi-Event", event)
+	req.Header.Set("X-Gobi-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set("X-Gobi-Timestamp", timestamp)
+	if secret != "" {
+		req.Header.Set("X-Gobi-Signature", WebhookSignature(secret, timestamp, body))
+	}
+
+	resp, err := WebhookClient.Do(req)
+	if err != nil {
+		return !errors.Is(err, ErrWebhookAddressBlocked), err
+	}
+	// Only the status is kept; the body of the receiver's response is neither read nor stored
+	resp.Body.Close()
+	delivery.StatusCode = resp.StatusCode
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("unexpected status %d", resp.StatusCode)
+}
@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gobi/config"
+	"gobi/internal/models"
+)
+
+// webhookReceiver is an httptest stand-in for a webhook endpoint answering with the given statuses in
+// turn, the last one repeating
+type webhookReceiver struct {
+	*httptest.Server
+	calls    atomic.Int32
+	requests chan *http.Request
+	bodies   chan []byte
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	receiver := &webhookReceiver{requests: make(chan *http.Request, 10), bodies: make(chan []byte, 10)}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(receiver.calls.Add(1))
+		body, _ := io.ReadAll(r.Body)
+		receiver.requests <- r
+		receiver.bodies <- body
+		w.WriteHeader(statuses[min(n, len(statuses))-1])
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+// useWebhookConfig lets webhooks reach the loopback receivers of a test and shortens the retry interval
+func useWebhookConfig(t *testing.T, maxAttempts int) {
+	previous := config.AppConfig.Webhook
+	webhookAllowPrivate = true
+	config.AppConfig.Webhook.MaxAttempts = maxAttempts
+	config.AppConfig.Webhook.RetryInterval = 1
+	config.AppConfig.Webhook.Timeout = 5
+	t.Cleanup(func() {
+		webhookAllowPrivate = false
+		config.AppConfig.Webhook = previous
+	})
+}
+
+func TestPostWebhookSignsPayload(t *testing.T) {
+	useWebhookConfig(t, 3)
+	t.Setenv("DATA_SOURCE_SECRET", "0123456789abcdef0123456789abcdef")
+	secret, err := EncryptAES("whsec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := newWebhookReceiver(t, http.StatusNoContent)
+
+	dest := models.WebhookDestination{URL: receiver.URL, Secret: secret}
+	payload := WebhookPayload{Event: EventReportSuccess, Text: "Report \"sales\" generated", Timestamp: time.Now()}
+	delivery := models.WebhookDelivery{}
+	delivery.ID = 7
+	if err := postWebhook(dest, payload, &delivery); err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Attempts != 1 || delivery.StatusCode != http.StatusNoContent {
+		t.Fatalf("delivery = %+v", delivery)
+	}
+
+	req, body := <-receiver.requests, <-receiver.bodies
+	if req.Header.Get("X-Gobi-Event") != EventReportSuccess || req.Header.Get("X-Gobi-Delivery") != "7" ||
+		req.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("headers = %v", req.Header)
+	}
+	timestamp := req.Header.Get("X-Gobi-Timestamp")
+	if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+		t.Fatalf("X-Gobi-Timestamp = %q", timestamp)
+	}
+	if got, want := req.Header.Get("X-Gobi-Signature"), WebhookSignature("whsec", timestamp, body); got != want {
+		t.Fatalf("X-Gobi-Signature = %q, want %q", got, want)
+	}
+	if WebhookSignature("other", timestamp, body) == req.Header.Get("X-Gobi-Signature") {
+		t.Fatal("signature does not depend on the secret")
+	}
+}
+
+func TestPostWebhookUnsigned(t *testing.T) {
+	useWebhookConfig(t, 3)
+	receiver := newWebhookReceiver(t, http.StatusOK)
+
+	delivery := models.WebhookDelivery{}
+	if err := postWebhook(models.WebhookDestination{URL: receiver.URL}, WebhookPayload{Event: EventWebhookTest}, &delivery); err != nil {
+		t.Fatal(err)
+	}
+	if req := <-receiver.requests; req.Header.Get("X-Gobi-Signature") != "" {
+		t.Fatalf("X-Gobi-Signature = %q without a secret", req.Header.Get("X-Gobi-Signature"))
+	}
+}
+
+func TestPostWebhookRetries(t *testing.T) {
+	useWebhookConfig(t, 3)
+	receiver := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusOK)
+
+	delivery := models.WebhookDelivery{}
+	if err := postWebhook(models.WebhookDestination{URL: receiver.URL}, WebhookPayload{Event: EventAlertFiring}, &delivery); err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Attempts != 2 || receiver.calls.Load() != 2 || delivery.StatusCode != http.StatusOK {
+		t.Fatalf("delivery = %+v, calls = %d", delivery, receiver.calls.Load())
+	}
+}
+
+func TestPostWebhookGivesUp(t *testing.T) {
+	useWebhookConfig(t, 2)
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError)
+
+	delivery := models.WebhookDelivery{}
+	err := postWebhook(models.WebhookDestination{URL: receiver.URL}, WebhookPayload{Event: EventAlertFiring}, &delivery)
+	if err == nil || delivery.Attempts != 2 || receiver.calls.Load() != 2 || delivery.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("err = %v, delivery = %+v, calls = %d", err, delivery, receiver.calls.Load())
+	}
+}
+
+func TestPostWebhookClientErrorNotRetried(t *testing.T) {
+	useWebhookConfig(t, 3)
+	receiver := newWebhookReceiver(t, http.StatusBadRequest)
+
+	delivery := models.WebhookDelivery{}
+	err := postWebhook(models.WebhookDestination{URL: receiver.URL}, WebhookPayload{Event: EventAlertFiring}, &delivery)
+	if err == nil || delivery.Attempts != 1 || receiver.calls.Load() != 1 {
+		t.Fatalf("err = %v, delivery = %+v, calls = %d", err, delivery, receiver.calls.Load())
+	}
+}
+
+func TestPostWebhookBlocksLoopback(t *testing.T) {
+	useWebhookConfig(t, 3)
+	webhookAllowPrivate = false
+	receiver := newWebhookReceiver(t, http.StatusOK)
+
+	delivery := models.WebhookDelivery{}
+	err := postWebhook(models.WebhookDestination{URL: receiver.URL}, WebhookPayload{Event: EventAlertFiring}, &delivery)
+	if !errors.Is(err, ErrWebhookAddressBlocked) || delivery.Attempts != 1 || receiver.calls.Load() != 0 {
+		t.Fatalf("err = %v, delivery = %+v, calls = %d", err, delivery, receiver.calls.Load())
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	for rawURL, valid := range map[string]bool{
+		"https://93.184.216.34/hook":          true,
+		"http://127.0.0.1:8080/hook":          false,
+		"http://[::1]/hook":                   false,
+		"http://169.254.169.254/latest/meta":  false,
+		"http://10.1.2.3/hook":                false,
+		"http://192.168.0.10/hook":            false,
+		"http://0.0.0.0/hook":                 false,
+		"http://100.64.0.1/hook":              false,
+		"ftp://93.184.216.34/hook":            false,
+		"/relative/hook":                      false,
+		"http://[fe80::1%25eth0]/hook":        false,
+		"https://93.184.216.34:8443/hook?x=1": true,
+	} {
+		if err := ValidateWebhookURL(rawURL); (err == nil) != valid {
+			t.Errorf("ValidateWebhookURL(%q) = %v", rawURL, err)
+		}
+	}
+}
+
+func TestWebhookRedirectToMetadataBlocked(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://169.254.169.254/latest/meta-data/", nil)
+	if err := WebhookClient.CheckRedirect(req, []*http.Request{httptest.NewRequest(http.MethodPost, "https://93.184.216.34/", nil)}); !errors.Is(err, ErrWebhookAddressBlocked) {
+		t.Fatalf("CheckRedirect = %v", err)
+	}
+}
+
+func TestWebhookWants(t *testing.T) {
+	dest := models.WebhookDestination{Events: "report.failure, alert.firing"}
+	if !webhookWants(dest, EventAlertFiring) || !webhookWants(dest, EventReportFailure) || webhookWants(dest, EventReportSuccess) {
+		t.Fatal("subscribed events not matched")
+	}
+	if !webhookWants(dest, EventWebhookTest) || !webhookWants(models.WebhookDestination{}, EventAlertResolved) {
+		t.Fatal("test events and destinations without events should always match")
+	}
+}